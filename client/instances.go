@@ -219,8 +219,16 @@ func (c *Client) DestroyInstance(domain string) error {
 	return err
 }
 
+// FsckOptions is a struct holding the options of the check of a VFS.
+type FsckOptions struct {
+	Prune        bool
+	DryRun       bool
+	CheckContent bool
+	Workers      int
+}
+
 // FsckInstance returns the list of the inconsistencies in the VFS.
-func (c *Client) FsckInstance(domain string, prune, dryRun bool) ([]map[string]string, error) {
+func (c *Client) FsckInstance(domain string, opts *FsckOptions) ([]map[string]string, error) {
 	if !validDomain(domain) {
 		return nil, fmt.Errorf("Invalid domain: %s", domain)
 	}
@@ -228,8 +236,10 @@ func (c *Client) FsckInstance(domain string, prune, dryRun bool) ([]map[string]s
 		Method: "GET",
 		Path:   "/instances/" + url.PathEscape(domain) + "/fsck",
 		Queries: url.Values{
-			"Prune":  {strconv.FormatBool(prune)},
-			"DryRun": {strconv.FormatBool(dryRun)},
+			"Prune":        {strconv.FormatBool(opts.Prune)},
+			"DryRun":       {strconv.FormatBool(opts.DryRun)},
+			"CheckContent": {strconv.FormatBool(opts.CheckContent)},
+			"Workers":      {strconv.Itoa(opts.Workers)},
 		},
 	})
 	if err != nil {
@@ -242,6 +252,21 @@ func (c *Client) FsckInstance(domain string, prune, dryRun bool) ([]map[string]s
 	return list, nil
 }
 
+// SetFilesMaintenance enables or disables the maintenance mode of the files
+// of the instance, where they can be read but not modified.
+func (c *Client) SetFilesMaintenance(domain string, enabled bool) error {
+	if !validDomain(domain) {
+		return fmt.Errorf("Invalid domain: %s", domain)
+	}
+	_, err := c.Req(&request.Options{
+		Method:     "POST",
+		Path:       "/instances/" + url.PathEscape(domain) + "/files_maintenance",
+		Queries:    url.Values{"Enabled": {strconv.FormatBool(enabled)}},
+		NoResponse: true,
+	})
+	return err
+}
+
 // GetToken is used to generate a toke with the specified options.
 func (c *Client) GetToken(opts *TokenOptions) (string, error) {
 	q := url.Values{
@@ -35,6 +35,8 @@ var flagPassphrase string
 var flagForce bool
 var flagFsckDry bool
 var flagFsckPrune bool
+var flagFsckContent bool
+var flagFsckWorkers int
 var flagJSON bool
 var flagDirectory string
 var flagIncreaseQuota bool
@@ -313,6 +315,28 @@ specific domain.
 	},
 }
 
+var filesMaintenanceInstanceCmd = &cobra.Command{
+	Use:   "files-maintenance <domain> <true/false>",
+	Short: "Activate or deactivate the maintenance mode of the files",
+	Long: `
+cozy-stack instances files-maintenance allows to freeze the files of the
+instance of the given domain, for a backup or a migration: they can still be
+read, but not modified. It is only supported by the local filesystem storage.
+`,
+	Example: "$ cozy-stack instances files-maintenance cozy.tools:8080 true",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Usage()
+		}
+		enabled, err := strconv.ParseBool(args[1])
+		if err != nil {
+			return err
+		}
+		c := newAdminClient()
+		return c.SetFilesMaintenance(args[0], enabled)
+	},
+}
+
 var lsInstanceCmd = &cobra.Command{
 	Use:   "ls",
 	Short: "List instances",
@@ -494,7 +518,12 @@ in swift/localfs but not couchdb.
 		domain := args[0]
 
 		c := newAdminClient()
-		list, err := c.FsckInstance(domain, flagFsckPrune, flagFsckDry)
+		list, err := c.FsckInstance(domain, &client.FsckOptions{
+			Prune:        flagFsckPrune,
+			DryRun:       flagFsckDry,
+			CheckContent: flagFsckContent,
+			Workers:      flagFsckWorkers,
+		})
 		if err != nil {
 			return err
 		}
@@ -723,6 +752,7 @@ func init() {
 	instanceCmdGroup.AddCommand(lsInstanceCmd)
 	instanceCmdGroup.AddCommand(quotaInstanceCmd)
 	instanceCmdGroup.AddCommand(debugInstanceCmd)
+	instanceCmdGroup.AddCommand(filesMaintenanceInstanceCmd)
 	instanceCmdGroup.AddCommand(destroyInstanceCmd)
 	instanceCmdGroup.AddCommand(fsckInstanceCmd)
 	instanceCmdGroup.AddCommand(appTokenInstanceCmd)
@@ -765,6 +795,8 @@ func init() {
 	destroyInstanceCmd.Flags().BoolVar(&flagForce, "force", false, "Force the deletion without asking for confirmation")
 	fsckInstanceCmd.Flags().BoolVar(&flagFsckDry, "dry", false, "Don't modify the VFS, only show the inconsistencies")
 	fsckInstanceCmd.Flags().BoolVar(&flagFsckPrune, "prune", false, "Try to solve inconsistencies by modifying the file system")
+	fsckInstanceCmd.Flags().BoolVar(&flagFsckContent, "check-content", false, "Read the content of the files to check their md5sum (slow)")
+	fsckInstanceCmd.Flags().IntVar(&flagFsckWorkers, "workers", 1, "Number of files whose content is checked in parallel")
 	oauthClientInstanceCmd.Flags().BoolVar(&flagJSON, "json", false, "Output more informations in JSON format")
 	oauthTokenInstanceCmd.Flags().DurationVar(&flagExpire, "expire", 0, "Make the token expires in this amount of time")
 	appTokenInstanceCmd.Flags().DurationVar(&flagExpire, "expire", 0, "Make the token expires in this amount of time")
@@ -2,13 +2,19 @@ package apps
 
 import (
 	"compress/gzip"
+	// #nosec
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
 	"io"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/cozy/afero"
 	"github.com/cozy/cozy-stack/pkg/magic"
 	"github.com/cozy/cozy-stack/pkg/utils"
@@ -22,95 +28,416 @@ type Copier interface {
 	Copy(stat os.FileInfo, src io.Reader) error
 	Abort() error
 	Commit() error
+
+	// Recompress rewrites the stored files of an installed version of an
+	// application with the current compression policy.
+	Recompress(slug, version string) error
+
+	// SlugSize returns the storage footprint of all the stored versions of an
+	// application: the size of the stored (compressed) files, the size of
+	// their original content, and the number of versions.
+	SlugSize(slug string) (totalCompressed, totalOriginal int64, versionCount int, err error)
+}
+
+// SizedCopier is a Copier that can check, before copying an application,
+// that there is enough space to store it.
+type SizedCopier interface {
+	Copier
+	// StartWithSize is like Start, but it returns ErrInsufficientStorage,
+	// without creating any temporary object, if the given number of bytes
+	// can not be stored.
+	StartWithSize(slug, version string, size int64) (exists bool, err error)
+}
+
+// startCopier starts the copier, with a check of the available space if the
+// size of the application is known and the copier supports it.
+func startCopier(c Copier, slug, version string, size int64) (bool, error) {
+	if sc, ok := c.(SizedCopier); ok && size > 0 {
+		return sc.StartWithSize(slug, version, size)
+	}
+	return c.Start(slug, version)
+}
+
+// Codec is the compression algorithm used to store the files of an
+// application. Its value is the associated content-encoding.
+type Codec string
+
+const (
+	// CodecGzip is the gzip compression. It is used by default for all the
+	// files.
+	CodecGzip Codec = "gzip"
+	// CodecBrotli is the brotli compression. It is only used for text files,
+	// the other files are still stored with gzip.
+	CodecBrotli Codec = "br"
+	// CodecDictionary is the deflate compression with a preset dictionary
+	// shared by all the applications (see RegisterDictionary). It is only used
+	// for text files, and as the browsers do not know the dictionary, these
+	// files are always decompressed by the stack when they are served.
+	CodecDictionary Codec = "x-cozy-dict"
+)
+
+// storedCodecs are the codecs that can be used for the stored files, in the
+// order they are looked for.
+var storedCodecs = []Codec{CodecBrotli, CodecDictionary, CodecGzip}
+
+// isCompressed returns true if the codec is one used to store the files.
+func isCompressed(codec Codec) bool {
+	for _, c := range storedCodecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// CopierOptions contains the options that can be used to configure a Copier.
+type CopierOptions struct {
+	// Codec is the compression used to store the text files (javascript, css,
+	// html, ...). If empty, CodecGzip is used.
+	Codec Codec
+	// Naming is how the objects are named by the swift copier. If nil,
+	// NestedObjectNaming is used.
+	Naming ObjectNaming
+	// Dictionary is the identifier of the dictionary used with
+	// CodecDictionary. Without it, the files are compressed with gzip.
+	Dictionary string
+	// TmpTTL is the time after which the temporary objects of the swift
+	// copier are removed by swift, if the installation has not been
+	// committed. If zero, defaultTmpTTL is used, and if negative, the
+	// temporary objects do not expire.
+	TmpTTL time.Duration
+	// Journal records the commits and the aborts of the copier. If nil,
+	// nothing is recorded.
+	Journal Journal
+	// MaxSize is the maximal total size of the files of a version of an
+	// application, before compression. Copy returns ErrAppTooBig once it is
+	// exceeded. If zero, there is no limit.
+	MaxSize int64
+	// MaxSizes overrides MaxSize for some applications, by slug. A zero value
+	// removes the limit for the application.
+	MaxSizes map[string]int64
+	// SniffLen is the maximal number of bytes read at the beginning of a file
+	// without a known extension to detect its content-type. If zero,
+	// defaultSniffLen is used.
+	SniffLen int64
+	// Detector is called for the files whose content-type is not detected
+	// from their extension nor from their content, before FallbackContentType
+	// is used. If nil, there is no other detection.
+	Detector ContentTypeDetector
+	// FallbackContentType is the content-type of the files that are not
+	// detected. If empty, defaultFallbackContentType is used.
+	FallbackContentType string
+	// OnExists is what Start does when the version of the application is
+	// already stored. If empty, ExistsSkip is used.
+	OnExists ExistsPolicy
+	// VerifyStored makes Start read all the files of the version of the
+	// application already stored, to check them against the md5sums recorded
+	// when they were copied. A version that does not match is copied again,
+	// whatever OnExists, as if it was not stored.
+	VerifyStored bool
+}
+
+// ContentTypeDetector detects the content-type of a file of an application,
+// from its name and its content. It returns an empty string if the type is
+// not known, and a reader of the whole content, as it may read the beginning
+// of src.
+type ContentTypeDetector func(name string, src io.Reader) (string, io.Reader)
+
+// defaultFallbackContentType is the content-type of the files that are not
+// detected, if not configured.
+const defaultFallbackContentType = "application/octet-stream"
+
+// ExistsPolicy is what a Copier does when it starts to copy a version of an
+// application that is already stored.
+type ExistsPolicy string
+
+const (
+	// ExistsSkip keeps the stored version: Start returns true, and nothing is
+	// copied. It is the default.
+	ExistsSkip ExistsPolicy = "skip"
+	// ExistsOverwrite copies the application again, and replaces the stored
+	// version with the new files on commit.
+	ExistsOverwrite ExistsPolicy = "overwrite"
+	// ExistsError makes Start fail with ErrVersionExists.
+	ExistsError ExistsPolicy = "error"
+)
+
+// onExists returns if the copy must be skipped, for a version of an
+// application that is stored or not.
+func (o CopierOptions) onExists(exists bool) (bool, error) {
+	if !exists {
+		return false, nil
+	}
+	switch o.OnExists {
+	case ExistsOverwrite:
+		return false, nil
+	case ExistsError:
+		return false, ErrVersionExists
+	default:
+		return true, nil
+	}
+}
+
+// overwrites returns true if the copier replaces the versions that are
+// already stored.
+func overwrites(c Copier) bool {
+	var opts CopierOptions
+	switch c := c.(type) {
+	case *swiftCopier:
+		opts = c.opts
+	case *aferoCopier:
+		opts = c.opts
+	case *MemCopier:
+		opts = c.opts
+	}
+	return opts.OnExists == ExistsOverwrite
+}
+
+// defaultSniffLen is the number of bytes read to detect the content-type of
+// a file, when it is not configured.
+const defaultSniffLen = 512
+
+func (o CopierOptions) sniffLen() int64 {
+	if o.SniffLen <= 0 {
+		return defaultSniffLen
+	}
+	return o.SniffLen
+}
+
+func (o CopierOptions) maxSize(slug string) int64 {
+	if size, ok := o.MaxSizes[slug]; ok {
+		return size
+	}
+	return o.MaxSize
+}
+
+// budget checks that the file can be copied without exceeding the maximal
+// size of the version, given the files already copied, and wraps its content
+// to stop the copy with ErrAppTooBig if it is bigger than announced.
+func (o CopierOptions) budget(stat os.FileInfo, src io.Reader, stats *copierStats) (io.Reader, error) {
+	max := o.maxSize(stats.slug)
+	if max <= 0 {
+		return src, nil
+	}
+	remaining := max - stats.size
+	if stat.Size() > remaining {
+		return nil, ErrAppTooBig
+	}
+	return &budgetReader{r: src, remaining: remaining}, nil
+}
+
+// budgetReader is a reader that fails with ErrAppTooBig when more than the
+// remaining bytes allowed for a version of an application are read.
+type budgetReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, ErrAppTooBig
+	}
+	return n, err
+}
+
+// defaultTmpTTL is the expiration of the temporary objects of the swift
+// copier, when it is not configured.
+const defaultTmpTTL = 24 * time.Hour
+
+func (o CopierOptions) tmpTTL() time.Duration {
+	if o.TmpTTL == 0 {
+		return defaultTmpTTL
+	}
+	return o.TmpTTL
 }
 
 type swiftCopier struct {
 	c         *swift.Connection
+	opts      CopierOptions
+	naming    ObjectNaming
+	slug      string
+	version   string
 	appObj    string
 	tmpObj    string
 	container string
 	started   bool
+	overwrite bool
+	tmpMeta   map[string]swift.Metadata
+	stats     copierStats
 }
 
 type aferoCopier struct {
-	fs      afero.Fs
-	appDir  string
-	tmpDir  string
-	started bool
+	fs        afero.Fs
+	opts      CopierOptions
+	appDir    string
+	tmpDir    string
+	started   bool
+	overwrite bool
+	etags     map[string]string
+	meta      map[string]storedFileMetadata
+	stats     copierStats
+}
+
+// etagsFileName is the name of the file where the afero copier stores the
+// md5sum of the original content of each file of an application version.
+const etagsFileName = ".cozy-etags.json"
+
+// metadataFileName is the name of the file where the afero copier stores the
+// encoding and the original size of each file of an application version,
+// like the metadata of the objects written by the swift copier.
+const metadataFileName = ".cozy-metadata.json"
+
+// storedFileMetadata is the metadata recorded for each file by the afero
+// copier.
+type storedFileMetadata struct {
+	ContentEncoding       Codec `json:"content-encoding"`
+	OriginalContentLength int64 `json:"original-content-length"`
+}
+
+// isSidecarFile returns true for the files written by the afero copier next
+// to the files of an application.
+func isSidecarFile(name string) bool {
+	return name == etagsFileName || name == metadataFileName
+}
+
+// byteCounter is a writer that only counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
 }
 
 // NewSwiftCopier defines a Copier storing data into a swift container.
-func NewSwiftCopier(conn *swift.Connection, appsType AppType) Copier {
-	return &swiftCopier{
+func NewSwiftCopier(conn *swift.Connection, appsType AppType, opts *CopierOptions) Copier {
+	f := &swiftCopier{
 		c:         conn,
 		container: containerName(appsType),
 	}
+	if opts != nil {
+		f.opts = *opts
+	}
+	f.naming = f.opts.Naming
+	if f.naming == nil {
+		f.naming = NestedObjectNaming
+	}
+	return f
 }
 
 func (f *swiftCopier) Start(slug, version string) (bool, error) {
+	f.slug, f.version = slug, version
 	f.appObj = path.Join(slug, version)
 	_, _, err := f.c.Object(f.container, f.appObj)
-	if err == nil {
-		return true, nil
-	}
-	if err != swift.ObjectNotFound {
+	if err != nil && err != swift.ObjectNotFound {
 		return false, err
 	}
+	f.overwrite = err == nil
+	stored := f.overwrite
+	if stored && f.opts.VerifyStored {
+		if stored, err = f.verify(); err != nil {
+			return false, err
+		}
+	}
+	if skip, err := f.opts.onExists(stored); skip || err != nil {
+		return skip, err
+	}
 	if _, _, err = f.c.Container(f.container); err == swift.ContainerNotFound {
 		if err = f.c.ContainerCreate(f.container, nil); err != nil {
 			return false, err
 		}
 	}
 	f.tmpObj = "tmp-" + utils.RandomString(20) + "/"
+	f.tmpMeta = make(map[string]swift.Metadata)
+	f.stats.reset(slug, version)
 	f.started = true
-	return false, err
+	return false, nil
+}
+
+func (f *swiftCopier) StartWithSize(slug, version string, size int64) (bool, error) {
+	// The quota of the account is only known if it has been set by the
+	// administrator of the swift cluster.
+	account, h, err := f.c.Account()
+	if err != nil {
+		return false, err
+	}
+	quota, err := strconv.ParseInt(h.AccountMetadata()["quota-bytes"], 10, 64)
+	if err == nil && quota-account.BytesUsed < size {
+		return false, ErrInsufficientStorage
+	}
+	return f.Start(slug, version)
 }
 
 func (f *swiftCopier) Copy(stat os.FileInfo, src io.Reader) (err error) {
 	if !f.started {
 		panic("copier should call Start() before Copy()")
 	}
+	if src, err = f.opts.budget(stat, src, &f.stats); err != nil {
+		return err
+	}
+
+	var contentType string
+	contentType, src = f.opts.contentType(stat.Name(), src)
+	codec := f.opts.codecFor(contentType)
 
-	objName := path.Join(f.tmpObj, stat.Name())
+	// The objects are moved to their final name on commit, by removing the
+	// temporary prefix.
+	objName := f.tmpObj + f.naming.ObjectName(f.slug, f.version, stat.Name())
 	objMeta := swift.Metadata{
-		"content-encoding":        "gzip",
+		"content-encoding":        string(codec),
 		"original-content-length": strconv.FormatInt(stat.Size(), 10),
+		"original-path":           cleanFileName(stat.Name()),
 	}
-
-	contentType := magic.MIMETypeByExtension(path.Ext(stat.Name()))
-	if contentType == "" {
-		contentType, src = magic.MIMETypeFromReader(src)
-	}
-	if contentType == "" {
-		contentType = "application/octet-stream"
+	if mtime := stat.ModTime(); !mtime.IsZero() {
+		objMeta["original-mtime"] = mtime.UTC().Format(time.RFC3339)
 	}
 
 	file, err := f.c.ObjectCreate(f.container, objName, true, "",
-		contentType, objMeta.ObjectHeaders())
+		contentType, f.tmpHeaders(objMeta))
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if errc := file.Close(); errc != nil {
-			err = errc
-		}
-	}()
-
-	gw, err := gzip.NewWriterLevel(file, gzip.BestCompression)
+	h := md5.New() // #nosec
+	var size byteCounter
+	r := io.TeeReader(src, io.MultiWriter(h, &size))
+	err = copyCompressed(file, r, codec, f.opts.Dictionary)
+	if errc := file.Close(); err == nil {
+		err = errc
+	}
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if errc := gw.Close(); errc != nil && err == nil {
-			err = errc
-		}
-	}()
 
-	_, err = io.Copy(gw, src)
-	return err
+	// The md5sum of the original content is only known once it has been
+	// copied, and is added to the metadata of the object afterwards.
+	objMeta["original-md5"] = hex.EncodeToString(h.Sum(nil))
+	if err = f.c.ObjectUpdate(f.container, objName, f.tmpHeaders(objMeta)); err != nil {
+		return err
+	}
+	f.tmpMeta[objName] = objMeta
+	f.stats.add(int64(size))
+	return nil
+}
+
+// tmpHeaders returns the headers of a temporary object, with an expiration so
+// that swift removes it if the installation dies before its commit. The
+// expiration must be sent with each update, as a POST without it removes it.
+func (f *swiftCopier) tmpHeaders(objMeta swift.Metadata) swift.Headers {
+	h := objMeta.ObjectHeaders()
+	if ttl := f.opts.tmpTTL(); ttl > 0 {
+		h["X-Delete-After"] = strconv.FormatInt(int64(ttl/time.Second), 10)
+	}
+	return h
 }
 
 func (f *swiftCopier) Abort() error {
+	err := f.abort()
+	f.stats.record(f.opts.Journal, JournalAbort, err)
+	return err
+}
+
+func (f *swiftCopier) abort() error {
 	objectNames, err := f.c.ObjectNamesAll(f.container, &swift.ObjectsOpts{
 		Prefix: f.tmpObj,
 	})
@@ -121,57 +448,180 @@ func (f *swiftCopier) Abort() error {
 	return err
 }
 
+// Commit moves the objects to their final names, and removes their
+// expiration. If a move fails, the objects already moved are removed with the
+// temporary ones, so that the installation can be retried from a clean state.
 func (f *swiftCopier) Commit() error {
+	err := f.commit()
+	f.stats.record(f.opts.Journal, JournalCommit, err)
+	return err
+}
+
+func (f *swiftCopier) commit() error {
 	objectNames, err := f.c.ObjectNamesAll(f.container, &swift.ObjectsOpts{
 		Prefix: f.tmpObj,
 	})
 	if err != nil {
 		return err
 	}
+	var oldNames []string
+	if f.overwrite {
+		oldNames, err = f.c.ObjectNamesAll(f.container, &swift.ObjectsOpts{
+			Prefix: f.naming.Prefix(f.slug, f.version),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	moved := make([]string, 0, len(objectNames))
 	for _, srcObjectName := range objectNames {
-		dstObjectName := path.Join(f.appObj, strings.TrimPrefix(srcObjectName, f.tmpObj))
+		dstObjectName := strings.TrimPrefix(srcObjectName, f.tmpObj)
 		err = f.c.ObjectMove(f.container, srcObjectName, f.container, dstObjectName)
 		if err != nil {
-			return f.Abort()
+			f.abortCommit(moved) // #nosec
+			return err
+		}
+		moved = append(moved, dstObjectName)
+		if objMeta, ok := f.tmpMeta[srcObjectName]; ok && f.opts.tmpTTL() > 0 {
+			h := objMeta.ObjectHeaders()
+			h["X-Remove-Delete-At"] = "1"
+			if err = f.c.ObjectUpdate(f.container, dstObjectName, h); err != nil {
+				f.abortCommit(moved) // #nosec
+				return err
+			}
 		}
 	}
-	o, err := f.c.ObjectCreate(f.container, f.appObj, true, "", "", nil)
+	// The marker of the version has the list of its objects, for checking
+	// that none has been added or removed when the stored versions are
+	// verified.
+	sort.Strings(moved)
+	list, err := json.Marshal(moved)
 	if err != nil {
 		return err
 	}
-	return o.Close()
+	o, err := f.c.ObjectCreate(f.container, f.appObj, true, "", "application/json", nil)
+	if err != nil {
+		return err
+	}
+	if _, err = o.Write(list); err != nil {
+		o.Close() // #nosec
+		return err
+	}
+	if err = o.Close(); err != nil {
+		return err
+	}
+	return f.removeStaleObjects(oldNames, moved)
+}
+
+// removeStaleObjects removes the objects of an overwritten version that have
+// not been replaced by the new files.
+func (f *swiftCopier) removeStaleObjects(oldNames, moved []string) error {
+	replaced := make(map[string]struct{}, len(moved))
+	for _, name := range moved {
+		replaced[name] = struct{}{}
+	}
+	var stale []string
+	for _, name := range oldNames {
+		if _, ok := replaced[name]; !ok {
+			stale = append(stale, name)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	_, err := f.c.BulkDelete(f.container, stale)
+	return err
+}
+
+// abortCommit removes the objects already moved to their final names by an
+// interrupted commit, and the temporary objects. When a stored version is
+// overwritten, the objects moved have replaced the old ones, and they are
+// kept: the version can be fixed by installing it again.
+func (f *swiftCopier) abortCommit(moved []string) error {
+	if len(moved) > 0 && !f.overwrite {
+		if _, err := f.c.BulkDelete(f.container, moved); err != nil {
+			return err
+		}
+	}
+	return f.abort()
 }
 
 // NewAferoCopier defines a copier using an afero.Fs filesystem to store the
 // application data.
-func NewAferoCopier(fs afero.Fs) Copier {
-	return &aferoCopier{fs: fs}
+func NewAferoCopier(fs afero.Fs, opts *CopierOptions) Copier {
+	f := &aferoCopier{fs: fs}
+	if opts != nil {
+		f.opts = *opts
+	}
+	return f
 }
 
+// tmpDirPrefix is the prefix of the name of the temporary directory where the
+// files of an application version are copied before its commit.
+const tmpDirPrefix = "tmp"
+
+// overwrittenSuffix is added to the name of the directory of an application
+// version while it is replaced by a new one.
+const overwrittenSuffix = "~overwritten"
+
 func (f *aferoCopier) Start(slug, version string) (bool, error) {
 	f.appDir = path.Join("/", slug, version)
+	if err := f.recoverOverwrite(); err != nil {
+		return false, err
+	}
 	exists, err := afero.DirExists(f.fs, f.appDir)
-	if err != nil || exists {
-		return exists, err
+	if err != nil {
+		return false, err
+	}
+	f.overwrite = exists
+	if exists && f.opts.VerifyStored {
+		if exists, err = f.verify(); err != nil {
+			return false, err
+		}
+	}
+	if skip, err := f.opts.onExists(exists); skip || err != nil {
+		return skip, err
 	}
 	dir := path.Dir(f.appDir)
 	if err = f.fs.MkdirAll(dir, 0755); err != nil {
 		return false, err
 	}
-	f.tmpDir, err = afero.TempDir(f.fs, dir, "tmp")
+	f.tmpDir, err = afero.TempDir(f.fs, dir, tmpDirPrefix)
 	if err != nil {
 		return false, err
 	}
+	f.etags = make(map[string]string)
+	f.meta = make(map[string]storedFileMetadata)
+	f.stats.reset(slug, version)
 	f.started = true
 	return false, nil
 }
 
+func (f *aferoCopier) StartWithSize(slug, version string, size int64) (bool, error) {
+	// The available space can only be known for a filesystem on the disk.
+	if bp, ok := f.fs.(*afero.BasePathFs); ok {
+		if dir, err := bp.RealPath("/"); err == nil {
+			if available, ok := availableSpace(dir); ok && available < size {
+				return false, ErrInsufficientStorage
+			}
+		}
+	}
+	return f.Start(slug, version)
+}
+
 func (f *aferoCopier) Copy(stat os.FileInfo, src io.Reader) (err error) {
 	if !f.started {
 		panic("copier should call Start() before Copy()")
 	}
+	if src, err = f.opts.budget(stat, src, &f.stats); err != nil {
+		return err
+	}
+
+	var contentType string
+	contentType, src = f.opts.contentType(stat.Name(), src)
+	codec := f.opts.codecFor(contentType)
 
-	fullpath := path.Join(f.tmpDir, stat.Name()) + ".gz"
+	fullpath := path.Join(f.tmpDir, stat.Name()) + codecExtension(codec)
 	dir := path.Dir(fullpath)
 	if err = f.fs.MkdirAll(dir, 0755); err != nil {
 		return err
@@ -185,28 +635,207 @@ func (f *aferoCopier) Copy(stat os.FileInfo, src io.Reader) (err error) {
 		if errc := dst.Close(); errc != nil {
 			err = errc
 		}
+		// The mtime is set after the file is closed, as writing to it changes
+		// its mtime. It is not an error if the filesystem does not support it.
+		if mtime := stat.ModTime(); err == nil && !mtime.IsZero() {
+			f.fs.Chtimes(fullpath, mtime, mtime) // #nosec
+		}
 	}()
 
-	gw, err := gzip.NewWriterLevel(dst, gzip.BestCompression)
-	if err != nil {
+	h := md5.New() // #nosec
+	var size byteCounter
+	r := io.TeeReader(src, io.MultiWriter(h, &size))
+	if err = copyCompressed(dst, r, codec, f.opts.Dictionary); err != nil {
 		return err
 	}
-	defer func() {
-		if errc := gw.Close(); errc != nil && err == nil {
-			err = errc
-		}
-	}()
+	name := path.Join("/", stat.Name())
+	f.etags[name] = hex.EncodeToString(h.Sum(nil))
+	f.meta[name] = storedFileMetadata{
+		ContentEncoding:       codec,
+		OriginalContentLength: int64(size),
+	}
+	f.stats.add(int64(size))
+	return nil
+}
 
-	_, err = io.Copy(gw, src)
+func (f *aferoCopier) Commit() error {
+	err := f.commit()
+	f.stats.record(f.opts.Journal, JournalCommit, err)
 	return err
 }
 
-func (f *aferoCopier) Commit() error {
+func (f *aferoCopier) commit() error {
+	// The list of the files is written even if it is empty, as a version
+	// without it is not considered as intact when the stored versions are
+	// verified.
+	b, err := json.Marshal(f.etags)
+	if err != nil {
+		return err
+	}
+	name := path.Join(f.tmpDir, etagsFileName)
+	if err = afero.WriteFile(f.fs, name, b, 0644); err != nil {
+		return err
+	}
+	if len(f.meta) > 0 {
+		if err := writeMetadataFile(f.fs, f.tmpDir, f.meta); err != nil {
+			return err
+		}
+	}
+	if f.overwrite {
+		return f.swapAppDir()
+	}
 	return f.fs.Rename(f.tmpDir, f.appDir)
 }
 
+// swapAppDir replaces the directory of a stored version by the new one. The
+// old directory is renamed first, as a directory can't be renamed over a
+// non-empty one, and it is removed once the new one is in place. If the
+// process crashes between the two renames, the next Start puts the old
+// directory back.
+func (f *aferoCopier) swapAppDir() error {
+	old := f.appDir + overwrittenSuffix
+	if err := f.fs.Rename(f.appDir, old); err != nil {
+		return err
+	}
+	if err := f.fs.Rename(f.tmpDir, f.appDir); err != nil {
+		f.fs.Rename(old, f.appDir) // #nosec
+		return err
+	}
+	return f.fs.RemoveAll(old)
+}
+
+// recoverOverwrite finishes an overwrite interrupted by a crash: the old
+// directory is removed if the new one is in place, and put back otherwise.
+func (f *aferoCopier) recoverOverwrite() error {
+	old := f.appDir + overwrittenSuffix
+	exists, err := afero.DirExists(f.fs, old)
+	if err != nil || !exists {
+		return err
+	}
+	exists, err = afero.DirExists(f.fs, f.appDir)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return f.fs.RemoveAll(old)
+	}
+	return f.fs.Rename(old, f.appDir)
+}
+
+// writeMetadataFile writes the metadata of the files of an application
+// version in its directory.
+func writeMetadataFile(fs afero.Fs, dir string, meta map[string]storedFileMetadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, path.Join(dir, metadataFileName), b, 0644)
+}
+
+// readMetadataFile reads the metadata of the files of an application version.
+// It returns an empty map for the versions copied before it was recorded.
+func readMetadataFile(fs afero.Fs, name string) (map[string]storedFileMetadata, error) {
+	meta := make(map[string]storedFileMetadata)
+	b, err := afero.ReadFile(fs, name)
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
 func (f *aferoCopier) Abort() error {
-	return f.fs.RemoveAll(f.tmpDir)
+	err := f.fs.RemoveAll(f.tmpDir)
+	f.stats.record(f.opts.Journal, JournalAbort, err)
+	return err
+}
+
+// copyCompressed writes the content of src to w, compressed with the codec
+// (and the dictionary for CodecDictionary).
+func copyCompressed(w io.Writer, src io.Reader, codec Codec, dict string) error {
+	cw, err := newCompressWriter(w, codec, dict)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(cw, src)
+	if errc := cw.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+// contentType returns the content-type of a file, from its extension or by
+// sniffing its first bytes. The returned reader gives back the sniffed bytes
+// before the rest of the content.
+func (o CopierOptions) contentType(name string, src io.Reader) (string, io.Reader) {
+	contentType := magic.MIMETypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType, src = magic.MIMETypeFromReaderN(src, o.sniffLen())
+	}
+	if contentType == "" && o.Detector != nil {
+		contentType, src = o.Detector(name, src)
+	}
+	if contentType == "" {
+		contentType = o.fallbackContentType()
+	}
+	return contentType, src
+}
+
+func (o CopierOptions) fallbackContentType() string {
+	if o.FallbackContentType == "" {
+		return defaultFallbackContentType
+	}
+	return o.FallbackContentType
+}
+
+// codecFor returns the codec that should be used to store a file with the
+// given content-type.
+func (o CopierOptions) codecFor(contentType string) Codec {
+	if o.Codec == CodecBrotli && isTextContentType(contentType) {
+		return CodecBrotli
+	}
+	if o.Codec == CodecDictionary && o.Dictionary != "" && isTextContentType(contentType) {
+		return CodecDictionary
+	}
+	return CodecGzip
+}
+
+func isTextContentType(contentType string) bool {
+	if strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+	switch contentType {
+	case "application/javascript", "application/x-javascript",
+		"application/json", "application/manifest+json",
+		"application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+func codecExtension(codec Codec) string {
+	switch codec {
+	case CodecBrotli:
+		return ".br"
+	case CodecDictionary:
+		return ".dz"
+	}
+	return ".gz"
+}
+
+func newCompressWriter(w io.Writer, codec Codec, dict string) (io.WriteCloser, error) {
+	switch codec {
+	case CodecBrotli:
+		return brotli.NewWriterLevel(w, brotli.BestCompression), nil
+	case CodecDictionary:
+		return newDictionaryWriter(w, dict)
+	}
+	return gzip.NewWriterLevel(w, gzip.BestCompression)
 }
 
 type fileInfo struct {
@@ -0,0 +1,995 @@
+package apps
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/swift"
+	"github.com/ncw/swift/swifttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func copyFiles(t *testing.T, c Copier, files map[string]string) {
+	exists, err := c.Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	for name, content := range files {
+		stat := &fileInfo{
+			name: name,
+			size: int64(len(content)),
+			mode: 0644,
+			time: time.Now(),
+		}
+		err = c.Copy(stat, bytes.NewBufferString(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, c.Commit())
+}
+
+func TestAferoCopierBrotli(t *testing.T) {
+	osFS := afero.NewOsFs()
+	tmpDir, err := afero.TempDir(osFS, "", "cozy-copier-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer osFS.RemoveAll(tmpDir)
+
+	fs := afero.NewBasePathFs(osFS, tmpDir)
+	c := NewAferoCopier(fs, &CopierOptions{Codec: CodecBrotli})
+	copyFiles(t, c, map[string]string{
+		"index.js": "console.log('foo')",
+		"logo.png": "not really a png",
+	})
+
+	ok, err := afero.Exists(fs, "/my-app/1.0.0/index.js.br")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = afero.Exists(fs, "/my-app/1.0.0/logo.png.gz")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	s := NewAferoFileServer(fs, nil)
+	rc, err := s.Open("my-app", "1.0.0", "index.js")
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Equal(t, "console.log('foo')", string(b))
+		assert.NoError(t, rc.Close())
+	}
+	rc, err = s.Open("my-app", "1.0.0", "logo.png")
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Equal(t, "not really a png", string(b))
+		assert.NoError(t, rc.Close())
+	}
+
+	names, err := s.FilesList("my-app", "1.0.0")
+	assert.NoError(t, err)
+	sort.Strings(names)
+	assert.Equal(t, []string{"/index.js", "/logo.png"}, names)
+}
+
+func TestAferoCopierDictionary(t *testing.T) {
+	osFS := afero.NewOsFs()
+	tmpDir, err := afero.TempDir(osFS, "", "cozy-copier-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer osFS.RemoveAll(tmpDir)
+
+	dict := RegisterDictionary([]byte("function(){return this.props.children}console.log("))
+	assert.Len(t, dict, dictionaryIDLen)
+
+	fs := afero.NewBasePathFs(osFS, tmpDir)
+	c := NewAferoCopier(fs, &CopierOptions{Codec: CodecDictionary, Dictionary: dict})
+	copyFiles(t, c, map[string]string{
+		"index.js": "console.log('foo')",
+		"logo.png": "not really a png",
+	})
+
+	ok, err := afero.Exists(fs, "/my-app/1.0.0/index.js.dz")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = afero.Exists(fs, "/my-app/1.0.0/logo.png.gz")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	s := NewAferoFileServer(fs, nil)
+	rc, err := s.Open("my-app", "1.0.0", "index.js")
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Equal(t, "console.log('foo')", string(b))
+		assert.NoError(t, rc.Close())
+	}
+
+	// The browsers do not know the dictionary: the content is decompressed
+	req := httptest.NewRequest("GET", "/index.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br, x-cozy-dict")
+	res := httptest.NewRecorder()
+	assert.NoError(t, s.ServeFileContent(res, req, "my-app", "1.0.0", "index.js"))
+	assert.Empty(t, res.Header().Get("Content-Encoding"))
+	assert.Equal(t, "console.log('foo')", res.Body.String())
+
+	names, err := s.FilesList("my-app", "1.0.0")
+	assert.NoError(t, err)
+	sort.Strings(names)
+	assert.Equal(t, []string{"/index.js", "/logo.png"}, names)
+
+	// Without dictionary, the text files are compressed with gzip
+	assert.Equal(t, CodecGzip, CopierOptions{Codec: CodecDictionary}.codecFor("application/javascript"))
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	_, err := gw.Write(bytes.Repeat([]byte("a"), 1000))
+	assert.NoError(t, err)
+	assert.NoError(t, gw.Close())
+	compressed := buf.Bytes()
+
+	rc, err := newDecompressReadCloser(ioutil.NopCloser(bytes.NewReader(compressed)), CodecGzip, 1000)
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Len(t, b, 1000)
+	}
+
+	rc, err = newDecompressReadCloser(ioutil.NopCloser(bytes.NewReader(compressed)), CodecGzip, 100)
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.Equal(t, ErrDecompressionLimitExceeded, err)
+		assert.Len(t, b, 100)
+	}
+}
+
+func TestAferoCopierModTime(t *testing.T) {
+	osFS := afero.NewOsFs()
+	tmpDir, err := afero.TempDir(osFS, "", "cozy-copier-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer osFS.RemoveAll(tmpDir)
+
+	fs := afero.NewBasePathFs(osFS, tmpDir)
+	c := NewAferoCopier(fs, nil)
+	exists, err := c.Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	mtime := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	content := "console.log('foo')"
+	err = c.Copy(&fileInfo{
+		name: "index.js",
+		size: int64(len(content)),
+		mode: 0644,
+		time: mtime,
+	}, bytes.NewBufferString(content))
+	assert.NoError(t, err)
+	assert.NoError(t, c.Commit())
+
+	s := NewAferoFileServer(fs, nil)
+	modtime, err := s.ModTime("my-app", "1.0.0", "index.js")
+	assert.NoError(t, err)
+	assert.True(t, mtime.Equal(modtime))
+}
+
+func TestAferoOpenRange(t *testing.T) {
+	osFS := afero.NewOsFs()
+	tmpDir, err := afero.TempDir(osFS, "", "cozy-copier-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer osFS.RemoveAll(tmpDir)
+
+	fs := afero.NewBasePathFs(osFS, tmpDir)
+	copyFiles(t, NewAferoCopier(fs, nil), map[string]string{
+		"index.js": "console.log('foo')",
+	})
+	err = afero.WriteFile(fs, "/my-app/1.0.0/raw.txt", []byte("0123456789"), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	s := NewAferoFileServer(fs, nil)
+	ok, err := s.SupportsRanges("my-app", "1.0.0", "index.js")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = s.SupportsRanges("my-app", "1.0.0", "raw.txt")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	fr, err := s.OpenRange("my-app", "1.0.0", "index.js", 8, 3)
+	if assert.NoError(t, err) {
+		assert.False(t, fr.Efficient)
+		b, err := ioutil.ReadAll(fr)
+		assert.NoError(t, err)
+		assert.Equal(t, "log", string(b))
+		assert.NoError(t, fr.Close())
+	}
+
+	fr, err = s.OpenRange("my-app", "1.0.0", "raw.txt", 2, 5)
+	if assert.NoError(t, err) {
+		assert.True(t, fr.Efficient)
+		assert.Equal(t, int64(10), fr.Size)
+		b, err := ioutil.ReadAll(fr)
+		assert.NoError(t, err)
+		assert.Equal(t, "23456", string(b))
+		assert.NoError(t, fr.Close())
+	}
+
+	fr, err = s.OpenRange("my-app", "1.0.0", "raw.txt", 7, -1)
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(fr)
+		assert.NoError(t, err)
+		assert.Equal(t, "789", string(b))
+		assert.NoError(t, fr.Close())
+	}
+
+	_, err = s.OpenRange("my-app", "1.0.0", "raw.txt", 11, 1)
+	assert.Equal(t, ErrInvalidRange, err)
+	_, err = s.OpenRange("my-app", "1.0.0", "index.js", 100, 1)
+	assert.Equal(t, ErrInvalidRange, err)
+}
+
+func TestAferoETag(t *testing.T) {
+	osFS := afero.NewOsFs()
+	tmpDir, err := afero.TempDir(osFS, "", "cozy-copier-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer osFS.RemoveAll(tmpDir)
+
+	fs := afero.NewBasePathFs(osFS, tmpDir)
+	content := "console.log('foo')"
+	copyFiles(t, NewAferoCopier(fs, nil), map[string]string{
+		"index.js": content,
+	})
+
+	s := NewAferoFileServer(fs, nil)
+	sum := md5.Sum([]byte(content))
+	expected := fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:]))
+	etag, err := s.ETag("my-app", "1.0.0", "index.js")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, etag)
+	etag, err = s.ETag("my-app", "1.0.0", "unknown.js")
+	assert.NoError(t, err)
+	assert.Empty(t, etag)
+
+	names, err := s.FilesList("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/index.js"}, names)
+
+	req := httptest.NewRequest("GET", "/index.js", nil)
+	req.Header.Set("If-None-Match", expected)
+	w := httptest.NewRecorder()
+	assert.NoError(t, s.ServeFileContent(w, req, "my-app", "1.0.0", "index.js"))
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	req = httptest.NewRequest("GET", "/index.js", nil)
+	w = httptest.NewRecorder()
+	assert.NoError(t, s.ServeFileContent(w, req, "my-app", "1.0.0", "index.js"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, expected, w.Header().Get("Etag"))
+	assert.Equal(t, content, w.Body.String())
+
+	// The compressed content has its own ETag
+	encoded := fmt.Sprintf(`"%s-gzip"`, hex.EncodeToString(sum[:]))
+	req = httptest.NewRequest("GET", "/index.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", expected)
+	w = httptest.NewRecorder()
+	assert.NoError(t, s.ServeFileContent(w, req, "my-app", "1.0.0", "index.js"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, encoded, w.Header().Get("Etag"))
+
+	req = httptest.NewRequest("GET", "/index.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", encoded)
+	w = httptest.NewRecorder()
+	assert.NoError(t, s.ServeFileContent(w, req, "my-app", "1.0.0", "index.js"))
+	assert.Equal(t, http.StatusNotModified, w.Code)
+}
+
+func TestAferoSize(t *testing.T) {
+	osFS := afero.NewOsFs()
+	tmpDir, err := afero.TempDir(osFS, "", "cozy-copier-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer osFS.RemoveAll(tmpDir)
+
+	fs := afero.NewBasePathFs(osFS, tmpDir)
+	content := "console.log('foo')"
+	copyFiles(t, NewAferoCopier(fs, &CopierOptions{Codec: CodecGzip}), map[string]string{
+		"index.js": content,
+		"logo.png": "not really a png",
+	})
+
+	b, err := afero.ReadFile(fs, "/my-app/1.0.0/"+metadataFileName)
+	if assert.NoError(t, err) {
+		var meta map[string]storedFileMetadata
+		assert.NoError(t, json.Unmarshal(b, &meta))
+		assert.Equal(t, storedFileMetadata{
+			ContentEncoding:       CodecGzip,
+			OriginalContentLength: int64(len(content)),
+		}, meta["/index.js"])
+	}
+
+	s := NewAferoFileServer(fs, nil)
+	size, err := s.Size("my-app", "1.0.0", "index.js")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	rng, err := s.OpenRange("my-app", "1.0.0", "index.js", 8, 3)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(len(content)), rng.Size)
+		assert.NoError(t, rng.Close())
+	}
+	_, err = s.Size("my-app", "1.0.0", "unknown.js")
+	assert.Error(t, err)
+
+	names, err := s.FilesList("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.Len(t, names, 2)
+
+	// The encoding is updated by the recompression
+	c := NewAferoCopier(fs, &CopierOptions{Codec: CodecBrotli})
+	assert.NoError(t, c.Recompress("my-app", "1.0.0"))
+	b, err = afero.ReadFile(fs, "/my-app/1.0.0/"+metadataFileName)
+	if assert.NoError(t, err) {
+		var meta map[string]storedFileMetadata
+		assert.NoError(t, json.Unmarshal(b, &meta))
+		assert.Equal(t, CodecBrotli, meta["/index.js"].ContentEncoding)
+		assert.Equal(t, int64(len(content)), meta["/index.js"].OriginalContentLength)
+	}
+
+	// The versions copied before the metadata was recorded
+	assert.NoError(t, fs.Remove("/my-app/1.0.0/"+metadataFileName))
+	size, err = s.Size("my-app", "1.0.0", "index.js")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), size)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestAferoCorruptObject(t *testing.T) {
+	osFS := afero.NewOsFs()
+	tmpDir, err := afero.TempDir(osFS, "", "cozy-copier-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer osFS.RemoveAll(tmpDir)
+
+	fs := afero.NewBasePathFs(osFS, tmpDir)
+	content := strings.Repeat("console.log('foo');\n", 10)
+	copyFiles(t, NewAferoCopier(fs, &CopierOptions{Codec: CodecGzip}), map[string]string{
+		"index.js": content,
+	})
+	name := "/my-app/1.0.0/index.js" + codecExtension(CodecGzip)
+	stored, err := afero.ReadFile(fs, name)
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := NewAferoFileServer(fs, nil)
+
+	// Checksum mismatch
+	corrupt := append([]byte{}, stored...)
+	corrupt[len(corrupt)-8] ^= 0xff
+	assert.NoError(t, afero.WriteFile(fs, name, corrupt, 0644))
+	rc, err := s.Open("my-app", "1.0.0", "index.js")
+	if assert.NoError(t, err) {
+		_, err = ioutil.ReadAll(rc)
+		assert.True(t, IsCorruptStoredObject(err))
+		assert.Contains(t, err.Error(), "my-app/1.0.0/index.js")
+		assert.Equal(t, gzip.ErrChecksum, err.(*CorruptObjectError).Err)
+		assert.NoError(t, rc.Close())
+	}
+
+	// Truncated content
+	assert.NoError(t, afero.WriteFile(fs, name, stored[:len(stored)/2], 0644))
+	rng, err := s.OpenRange("my-app", "1.0.0", "index.js", 0, -1)
+	if assert.NoError(t, err) {
+		_, err = ioutil.ReadAll(rng)
+		assert.True(t, IsCorruptStoredObject(err))
+		assert.NoError(t, rng.Close())
+	}
+
+	// Bad header
+	assert.NoError(t, afero.WriteFile(fs, name, []byte("not gzip"), 0644))
+	_, err = s.Open("my-app", "1.0.0", "index.js")
+	assert.True(t, IsCorruptStoredObject(err))
+
+	// The errors of the storage are not a corruption
+	rc, err = newObjectReadCloser(ioutil.NopCloser(io.MultiReader(bytes.NewReader(stored[:20]), failingReader{})),
+		CodecGzip, -1, "my-app", "1.0.0", "index.js")
+	if assert.NoError(t, err) {
+		_, err = ioutil.ReadAll(rc)
+		assert.Error(t, err)
+		assert.False(t, IsCorruptStoredObject(err))
+	}
+}
+
+func TestAferoRecompress(t *testing.T) {
+	osFS := afero.NewOsFs()
+	tmpDir, err := afero.TempDir(osFS, "", "cozy-copier-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer osFS.RemoveAll(tmpDir)
+
+	fs := afero.NewBasePathFs(osFS, tmpDir)
+	copyFiles(t, NewAferoCopier(fs, nil), map[string]string{
+		"index.js": "console.log('foo')",
+		"logo.png": "not really a png",
+	})
+	// A leftover of an interrupted recompression
+	assert.NoError(t, afero.WriteFile(fs, "/my-app/1.0.0/index.js.br.recompress", []byte("partial"), 0644))
+	s := NewAferoFileServer(fs, nil)
+	etag, err := s.ETag("my-app", "1.0.0", "index.js")
+	assert.NoError(t, err)
+
+	c := NewAferoCopier(fs, &CopierOptions{Codec: CodecBrotli})
+	assert.Equal(t, ErrNotFound, c.Recompress("my-app", "2.0.0"))
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, c.Recompress("my-app", "1.0.0"))
+		for name, exists := range map[string]bool{
+			"/my-app/1.0.0/index.js.br":            true,
+			"/my-app/1.0.0/index.js.gz":            false,
+			"/my-app/1.0.0/index.js.br.recompress": false,
+			"/my-app/1.0.0/logo.png.gz":            true,
+		} {
+			ok, err := afero.Exists(fs, name)
+			assert.NoError(t, err)
+			assert.Equal(t, exists, ok, name)
+		}
+	}
+
+	rc, err := s.Open("my-app", "1.0.0", "index.js")
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Equal(t, "console.log('foo')", string(b))
+		assert.NoError(t, rc.Close())
+	}
+	recompressed, err := s.ETag("my-app", "1.0.0", "index.js")
+	assert.NoError(t, err)
+	assert.Equal(t, etag, recompressed)
+
+	// Back to gzip, resuming after a crash that has left a file stored with
+	// both codecs
+	buf := new(bytes.Buffer)
+	assert.NoError(t, copyCompressed(buf, bytes.NewBufferString("not really a png"), CodecBrotli, ""))
+	assert.NoError(t, afero.WriteFile(fs, "/my-app/1.0.0/logo.png.br", buf.Bytes(), 0644))
+	assert.NoError(t, NewAferoCopier(fs, nil).Recompress("my-app", "1.0.0"))
+	for name, exists := range map[string]bool{
+		"/my-app/1.0.0/index.js.br": false,
+		"/my-app/1.0.0/index.js.gz": true,
+		"/my-app/1.0.0/logo.png.br": false,
+		"/my-app/1.0.0/logo.png.gz": true,
+	} {
+		ok, err := afero.Exists(fs, name)
+		assert.NoError(t, err)
+		assert.Equal(t, exists, ok, name)
+	}
+	names, err := s.FilesList("my-app", "1.0.0")
+	assert.NoError(t, err)
+	sort.Strings(names)
+	assert.Equal(t, []string{"/index.js", "/logo.png"}, names)
+}
+
+type journalRecorder []*JournalEntry
+
+func (j *journalRecorder) Record(entry *JournalEntry) {
+	*j = append(*j, entry)
+}
+
+func TestAferoJournal(t *testing.T) {
+	osFS := afero.NewOsFs()
+	tmpDir, err := afero.TempDir(osFS, "", "cozy-copier-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer osFS.RemoveAll(tmpDir)
+
+	fs := afero.NewBasePathFs(osFS, tmpDir)
+	journal := &journalRecorder{}
+	c := NewAferoCopier(fs, &CopierOptions{Codec: CodecGzip, Journal: journal})
+	copyFiles(t, c, map[string]string{
+		"index.js": "console.log('foo')",
+		"logo.png": "not really a png",
+	})
+	if assert.Len(t, *journal, 1) {
+		entry := (*journal)[0]
+		assert.Equal(t, JournalCommit, entry.Operation)
+		assert.Equal(t, "my-app", entry.Slug)
+		assert.Equal(t, "1.0.0", entry.Version)
+		assert.Empty(t, entry.Error)
+		assert.Equal(t, 2, entry.Files)
+		assert.EqualValues(t, 34, entry.Size)
+	}
+
+	_, err = c.Start("my-app", "2.0.0")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Abort())
+	if assert.Len(t, *journal, 2) {
+		entry := (*journal)[1]
+		assert.Equal(t, JournalAbort, entry.Operation)
+		assert.Equal(t, "2.0.0", entry.Version)
+		assert.Equal(t, 0, entry.Files)
+		assert.EqualValues(t, 0, entry.Size)
+	}
+}
+
+func TestMemCopier(t *testing.T) {
+	journal := &journalRecorder{}
+	c := NewMemCopier(&CopierOptions{Journal: journal})
+	c.Capacity = 1024
+	copyFiles(t, c, map[string]string{
+		"index.js": "console.log('foo')",
+	})
+	assert.Equal(t, []string{"/index.js"}, c.Files("my-app", "1.0.0"))
+	b, ok := c.File("my-app", "1.0.0", "index.js")
+	assert.True(t, ok)
+	assert.Equal(t, "console.log('foo')", string(b))
+
+	exists, err := c.Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	_, err = c.StartWithSize("my-app", "2.0.0", 2048)
+	assert.Equal(t, ErrInsufficientStorage, err)
+	_, err = c.StartWithSize("my-app", "2.0.0", 512)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Abort())
+	assert.Empty(t, c.Files("my-app", "2.0.0"))
+
+	assert.Equal(t, []MemCopierCall{
+		{Operation: MemCopierStart, Slug: "my-app", Version: "1.0.0"},
+		{Operation: MemCopierCopy, Slug: "my-app", Version: "1.0.0", Name: "/index.js"},
+		{Operation: MemCopierCommit, Slug: "my-app", Version: "1.0.0"},
+		{Operation: MemCopierStart, Slug: "my-app", Version: "1.0.0"},
+		{Operation: MemCopierStart, Slug: "my-app", Version: "2.0.0"},
+		{Operation: MemCopierAbort, Slug: "my-app", Version: "2.0.0"},
+	}, c.Calls())
+	if assert.Len(t, *journal, 2) {
+		assert.Equal(t, JournalCommit, (*journal)[0].Operation)
+		assert.Equal(t, 1, (*journal)[0].Files)
+		assert.Equal(t, JournalAbort, (*journal)[1].Operation)
+	}
+}
+
+func TestAferoAppBudget(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	c := NewAferoCopier(fs, &CopierOptions{
+		MaxSize:  20,
+		MaxSizes: map[string]int64{"big-app": 0},
+	})
+	stat := func(name string, size int) os.FileInfo {
+		return &fileInfo{name: name, size: int64(size), mode: 0644}
+	}
+
+	_, err := c.Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Copy(stat("index.html", 14), strings.NewReader("<p>Welcome</p>")))
+	err = c.Copy(stat("logo.png", 10), strings.NewReader("0123456789"))
+	assert.Equal(t, ErrAppTooBig, err)
+	// The size of a file is not always known in advance
+	err = c.Copy(stat("app.js", 0), strings.NewReader("0123456789"))
+	assert.Equal(t, ErrAppTooBig, err)
+	assert.NoError(t, c.Abort())
+	infos, err := afero.ReadDir(fs, "/my-app")
+	assert.NoError(t, err)
+	assert.Empty(t, infos)
+
+	copyFiles(t, NewAferoCopier(fs, &CopierOptions{MaxSize: 20}), map[string]string{
+		"index.html": "<p>Welcome</p>",
+	})
+	_, err = c.Start("big-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Copy(stat("logo.png", 30), strings.NewReader("012345678901234567890123456789")))
+	assert.NoError(t, c.Commit())
+}
+
+func TestAferoExistsPolicy(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	copyFiles(t, NewAferoCopier(fs, nil), map[string]string{
+		"index.html": "<p>Welcome</p>",
+		"old.js":     "console.log('old')",
+	})
+	names := func() []string {
+		infos, err := afero.ReadDir(fs, "/my-app/1.0.0")
+		assert.NoError(t, err)
+		var names []string
+		for _, info := range infos {
+			if !isSidecarFile(info.Name()) {
+				names = append(names, strings.SplitN(info.Name(), ".", 2)[0])
+			}
+		}
+		return names
+	}
+
+	exists, err := NewAferoCopier(fs, nil).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	_, err = NewAferoCopier(fs, &CopierOptions{OnExists: ExistsError}).Start("my-app", "1.0.0")
+	assert.Equal(t, ErrVersionExists, err)
+
+	copyFiles(t, NewAferoCopier(fs, &CopierOptions{OnExists: ExistsOverwrite}), map[string]string{
+		"index.html": "<p>Fixed</p>",
+	})
+	assert.Equal(t, []string{"index"}, names())
+	infos, err := afero.ReadDir(fs, "/my-app")
+	assert.NoError(t, err)
+	assert.Len(t, infos, 1)
+
+	// An overwrite interrupted between the two renames is reverted
+	assert.NoError(t, fs.Rename("/my-app/1.0.0", "/my-app/1.0.0"+overwrittenSuffix))
+	exists, err = NewAferoCopier(fs, nil).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, []string{"index"}, names())
+
+	// and one interrupted after them is finished
+	assert.NoError(t, fs.MkdirAll("/my-app/1.0.0"+overwrittenSuffix, 0755))
+	exists, err = NewAferoCopier(fs, nil).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	ok, err := afero.DirExists(fs, "/my-app/1.0.0"+overwrittenSuffix)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestAferoVerifyStored(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	copyFiles(t, NewAferoCopier(fs, nil), map[string]string{
+		"index.html": "<p>Welcome</p>",
+		"app.js":     "console.log('app')",
+	})
+	opts := &CopierOptions{VerifyStored: true}
+	exists, err := NewAferoCopier(fs, opts).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// A file modified in the storage, even with a valid compression, makes the
+	// version not stored, and it is copied again over the modified one
+	var evil bytes.Buffer
+	assert.NoError(t, copyCompressed(&evil, strings.NewReader("<p>Evil</p>"), CodecGzip, ""))
+	assert.NoError(t, afero.WriteFile(fs, "/my-app/1.0.0/index.html.gz", evil.Bytes(), 0644))
+	c := NewAferoCopier(fs, opts)
+	exists, err = c.Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.NoError(t, c.Abort())
+	exists, err = NewAferoCopier(fs, nil).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	copyFiles(t, NewAferoCopier(fs, &CopierOptions{OnExists: ExistsOverwrite}), map[string]string{
+		"index.html": "<p>Welcome</p>",
+		"app.js":     "console.log('app')",
+	})
+	exists, err = NewAferoCopier(fs, opts).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// And so does an added file, or a removed one
+	assert.NoError(t, afero.WriteFile(fs, "/my-app/1.0.0/evil.js", []byte("alert(1)"), 0644))
+	exists, err = NewAferoCopier(fs, opts).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.NoError(t, fs.Remove("/my-app/1.0.0/evil.js"))
+	assert.NoError(t, fs.Remove("/my-app/1.0.0/app.js.gz"))
+	exists, err = NewAferoCopier(fs, opts).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// A version copied before the list of the files was recorded is copied
+	// again
+	copyFiles(t, NewAferoCopier(fs, &CopierOptions{OnExists: ExistsOverwrite}), map[string]string{
+		"index.html": "<p>Welcome</p>",
+	})
+	assert.NoError(t, fs.Remove("/my-app/1.0.0/"+etagsFileName))
+	exists, err = NewAferoCopier(fs, opts).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+// countingReader counts the bytes read from its reader.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestCopierSniffLen(t *testing.T) {
+	content := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 2000)...)
+	src := &countingReader{r: bytes.NewReader(content)}
+	opts := CopierOptions{SniffLen: 16}
+	contentType, r := opts.contentType("logo", src)
+	assert.Equal(t, "image/png", contentType)
+	assert.Equal(t, 16, src.n)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, content, b)
+
+	// The content is not read when the extension is known
+	src = &countingReader{r: bytes.NewReader(content)}
+	contentType, _ = opts.contentType("logo.png", src)
+	assert.Equal(t, "image/png", contentType)
+	assert.Equal(t, 0, src.n)
+	assert.EqualValues(t, defaultSniffLen, CopierOptions{}.sniffLen())
+}
+
+func TestCopierFallbackContentType(t *testing.T) {
+	content := []byte("\x01\x02\x03\x04custom asset")
+	contentType, _ := CopierOptions{}.contentType("asset", bytes.NewReader(content))
+	assert.Equal(t, "application/octet-stream", contentType)
+
+	opts := CopierOptions{FallbackContentType: "text/plain"}
+	contentType, _ = opts.contentType("asset", bytes.NewReader(content))
+	assert.Equal(t, "text/plain", contentType)
+
+	// The detector is called before the fallback, and the content it reads is
+	// given back
+	opts.Detector = func(name string, src io.Reader) (string, io.Reader) {
+		head := make([]byte, 4)
+		n, _ := io.ReadFull(src, head)
+		if name == "asset" && bytes.Equal(head[:n], content[:4]) {
+			return "application/x-custom-asset", io.MultiReader(bytes.NewReader(head[:n]), src)
+		}
+		return "", io.MultiReader(bytes.NewReader(head[:n]), src)
+	}
+	contentType, r := opts.contentType("asset", bytes.NewReader(content))
+	assert.Equal(t, "application/x-custom-asset", contentType)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, content, b)
+	contentType, _ = opts.contentType("other", bytes.NewReader(content))
+	assert.Equal(t, "text/plain", contentType)
+}
+
+func TestSwiftObjectNaming(t *testing.T) {
+	srv, err := swifttest.NewSwiftServer("localhost")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer srv.Close()
+	conn := &swift.Connection{
+		UserName: "swifttest",
+		ApiKey:   "swifttest",
+		AuthUrl:  srv.AuthURL,
+	}
+	if !assert.NoError(t, conn.Authenticate()) {
+		return
+	}
+
+	// The two namings are tested on different containers, one for the webapps
+	// and one for the konnectors.
+	for appsType, naming := range map[AppType]ObjectNaming{
+		Webapp:    NestedObjectNaming,
+		Konnector: HashedObjectNaming,
+	} {
+		copyFiles(t, NewSwiftCopier(conn, appsType, &CopierOptions{Naming: naming}), map[string]string{
+			"index.html": "<html></html>",
+			"js/app.js":  "console.log('foo')",
+		})
+
+		objectNames, err := conn.ObjectNamesAll(containerName(appsType), nil)
+		assert.NoError(t, err)
+		assert.Contains(t, objectNames, naming.ObjectName("my-app", "1.0.0", "js/app.js"))
+
+		s := NewSwiftFileServer(conn, appsType, naming)
+		names, err := s.FilesList("my-app", "1.0.0")
+		assert.NoError(t, err)
+		sort.Strings(names)
+		assert.Equal(t, []string{"index.html", "js/app.js"}, names)
+
+		rc, err := s.Open("my-app", "1.0.0", "/js/app.js")
+		if assert.NoError(t, err) {
+			b, err := ioutil.ReadAll(rc)
+			assert.NoError(t, err)
+			assert.Equal(t, "console.log('foo')", string(b))
+			assert.NoError(t, rc.Close())
+		}
+	}
+
+	assert.Equal(t, "my-app/1.0.0/js/app.js", NestedObjectNaming.ObjectName("my-app", "1.0.0", "js/app.js"))
+	hashed := HashedObjectNaming.ObjectName("my-app", "1.0.0", "/js/app.js")
+	assert.Equal(t, hashed, HashedObjectNaming.ObjectName("my-app", "1.0.0", "js/app.js"))
+	assert.True(t, strings.HasPrefix(hashed, HashedObjectNaming.Prefix("my-app", "1.0.0")))
+	assert.NotContains(t, hashed, "/")
+}
+
+func TestSwiftAbortCommit(t *testing.T) {
+	srv, err := swifttest.NewSwiftServer("localhost")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer srv.Close()
+	conn := &swift.Connection{
+		UserName: "swifttest",
+		ApiKey:   "swifttest",
+		AuthUrl:  srv.AuthURL,
+	}
+	if !assert.NoError(t, conn.Authenticate()) {
+		return
+	}
+
+	c := NewSwiftCopier(conn, Webapp, nil).(*swiftCopier)
+	exists, err := c.Start("my-app", "1.0.0")
+	if !assert.NoError(t, err) || !assert.False(t, exists) {
+		return
+	}
+	for _, name := range []string{"index.html", "app.js"} {
+		content := "content of " + name
+		info := &fileInfo{name: name, size: int64(len(content)), mode: 0644}
+		assert.NoError(t, c.Copy(info, strings.NewReader(content)))
+	}
+
+	// A commit interrupted after the move of the first object
+	tmpNames, err := conn.ObjectNamesAll(c.container, &swift.ObjectsOpts{Prefix: c.tmpObj})
+	if !assert.NoError(t, err) || !assert.Len(t, tmpNames, 2) {
+		return
+	}
+	moved := strings.TrimPrefix(tmpNames[0], c.tmpObj)
+	assert.NoError(t, conn.ObjectMove(c.container, tmpNames[0], c.container, moved))
+	assert.NoError(t, c.abortCommit([]string{moved}))
+
+	objectNames, err := conn.ObjectNamesAll(c.container, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, objectNames)
+	exists, err = NewSwiftCopier(conn, Webapp, nil).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestSwiftVerifyStored(t *testing.T) {
+	srv, err := swifttest.NewSwiftServer("localhost")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer srv.Close()
+	conn := &swift.Connection{
+		UserName: "swifttest",
+		ApiKey:   "swifttest",
+		AuthUrl:  srv.AuthURL,
+	}
+	if !assert.NoError(t, conn.Authenticate()) {
+		return
+	}
+
+	copyFiles(t, NewSwiftCopier(conn, Webapp, nil), map[string]string{
+		"index.html": "<p>Welcome</p>",
+		"app.js":     "console.log('app')",
+	})
+	opts := &CopierOptions{VerifyStored: true}
+	exists, err := NewSwiftCopier(conn, Webapp, opts).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// An added object makes the version not stored
+	container := containerName(Webapp)
+	evil := NestedObjectNaming.ObjectName("my-app", "1.0.0", "evil.js")
+	assert.NoError(t, conn.ObjectPutString(container, evil, "alert(1)", ""))
+	exists, err = NewSwiftCopier(conn, Webapp, opts).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.NoError(t, conn.ObjectDelete(container, evil))
+
+	// And so does a removed one
+	appJS := NestedObjectNaming.ObjectName("my-app", "1.0.0", "app.js")
+	assert.NoError(t, conn.ObjectDelete(container, appJS))
+	exists, err = NewSwiftCopier(conn, Webapp, opts).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// A version without the list of its objects is copied again
+	copyFiles(t, NewSwiftCopier(conn, Webapp, &CopierOptions{OnExists: ExistsOverwrite}), map[string]string{
+		"index.html": "<p>Welcome</p>",
+	})
+	assert.NoError(t, conn.ObjectPutString(container, "my-app/1.0.0", "", ""))
+	exists, err = NewSwiftCopier(conn, Webapp, opts).Start("my-app", "1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestSwiftTmpHeaders(t *testing.T) {
+	meta := swift.Metadata{"content-encoding": "gzip"}
+	c := NewSwiftCopier(nil, Webapp, nil).(*swiftCopier)
+	h := c.tmpHeaders(meta)
+	assert.Equal(t, "86400", h["X-Delete-After"])
+	assert.Equal(t, "gzip", h["X-Object-Meta-Content-Encoding"])
+
+	c = NewSwiftCopier(nil, Webapp, &CopierOptions{TmpTTL: time.Hour}).(*swiftCopier)
+	assert.Equal(t, "3600", c.tmpHeaders(meta)["X-Delete-After"])
+
+	c = NewSwiftCopier(nil, Webapp, &CopierOptions{TmpTTL: -1}).(*swiftCopier)
+	assert.NotContains(t, c.tmpHeaders(meta), "X-Delete-After")
+}
+
+func TestAferoCopierStartWithSize(t *testing.T) {
+	osFS := afero.NewOsFs()
+	tmpDir, err := afero.TempDir(osFS, "", "cozy-copier-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer osFS.RemoveAll(tmpDir)
+
+	fs := afero.NewBasePathFs(osFS, tmpDir)
+	c := NewAferoCopier(fs, nil).(SizedCopier)
+	if _, ok := availableSpace(tmpDir); ok {
+		_, err = c.StartWithSize("my-app", "1.0.0", 1<<62)
+		assert.Equal(t, ErrInsufficientStorage, err)
+		ok, err := afero.Exists(fs, "/my-app")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
+
+	exists, err := c.StartWithSize("my-app", "1.0.0", 1024)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.NoError(t, c.Abort())
+}
+
+func TestAferoSlugSize(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	c := NewAferoCopier(fs, nil)
+	_, _, count, err := c.SlugSize("my-app")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	copyFiles(t, c, map[string]string{
+		"index.html": "<p>Welcome</p>",
+		"app.js":     "console.log('app')",
+	})
+	c = NewAferoCopier(fs, nil)
+	exists, err := c.Start("my-app", "2.0.0")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.NoError(t, c.Copy(&fileInfo{name: "index.html", size: 9, mode: 0644}, strings.NewReader("<p>v2</p>")))
+	assert.NoError(t, c.Commit())
+
+	// A copy in progress is not counted
+	c = NewAferoCopier(fs, nil)
+	_, err = c.Start("my-app", "3.0.0")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Copy(&fileInfo{name: "index.html", size: 9, mode: 0644}, strings.NewReader("<p>v3</p>")))
+
+	var stored int64
+	for _, name := range []string{"/my-app/1.0.0/index.html.gz", "/my-app/1.0.0/app.js.gz", "/my-app/2.0.0/index.html.gz"} {
+		info, err := fs.Stat(name)
+		if assert.NoError(t, err) {
+			stored += info.Size()
+		}
+	}
+	compressed, original, count, err := c.SlugSize("my-app")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, stored, compressed)
+	assert.Equal(t, int64(len("<p>Welcome</p>")+len("console.log('app')")+len("<p>v2</p>")), original)
+	assert.NoError(t, c.Abort())
+}
@@ -0,0 +1,117 @@
+package apps
+
+import (
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+// dictionaryIDLen is the length of the identifier of a dictionary, written at
+// the beginning of each file compressed with it.
+const dictionaryIDLen = 16
+
+var (
+	dictionariesOnce  sync.Once
+	dictionariesMu    sync.RWMutex
+	dictionaries      = make(map[string][]byte)
+	defaultDictionary string
+)
+
+// RegisterDictionary adds a preset dictionary that can be used to compress
+// the text files of the applications with CodecDictionary, and returns its
+// identifier, derived from its content. The dictionary must stay registered
+// as long as some files compressed with it are stored.
+func RegisterDictionary(dict []byte) string {
+	sum := sha256.Sum256(dict)
+	id := hex.EncodeToString(sum[:dictionaryIDLen/2])
+	dictionariesMu.Lock()
+	dictionaries[id] = dict
+	dictionariesMu.Unlock()
+	return id
+}
+
+// DefaultDictionary returns the identifier of the dictionary used to compress
+// the files: the first one of the configuration, or an empty string if there
+// is none.
+func DefaultDictionary() string {
+	loadDictionaries()
+	return defaultDictionary
+}
+
+// loadDictionaries registers the dictionaries of the configuration. The
+// other ones are only kept to read the files compressed with them.
+func loadDictionaries() {
+	dictionariesOnce.Do(func() {
+		for i, filename := range config.GetConfig().Fs.AppsDictionaries {
+			dict, err := ioutil.ReadFile(filename)
+			if err != nil {
+				logger.WithNamespace("apps").
+					Errorf("Cannot read the compression dictionary %s: %s", filename, err)
+				continue
+			}
+			id := RegisterDictionary(dict)
+			if i == 0 {
+				defaultDictionary = id
+			}
+		}
+	})
+}
+
+func getDictionary(id string) ([]byte, bool) {
+	loadDictionaries()
+	dictionariesMu.RLock()
+	defer dictionariesMu.RUnlock()
+	dict, ok := dictionaries[id]
+	return dict, ok
+}
+
+// newDictionaryWriter writes the identifier of the dictionary, and returns a
+// writer for the content compressed with it.
+func newDictionaryWriter(w io.Writer, id string) (io.WriteCloser, error) {
+	dict, ok := getDictionary(id)
+	if !ok {
+		return nil, ErrUnknownDictionary
+	}
+	if _, err := io.WriteString(w, id); err != nil {
+		return nil, err
+	}
+	return flate.NewWriterDict(w, flate.BestCompression, dict)
+}
+
+type dictionaryReadCloser struct {
+	fr io.ReadCloser
+	cl io.Closer
+}
+
+// newDictionaryReadCloser reads the identifier of the dictionary at the
+// beginning of r, and returns a reader of the content decompressed with it.
+func newDictionaryReadCloser(r io.ReadCloser) (io.ReadCloser, error) {
+	var id [dictionaryIDLen]byte
+	if _, err := io.ReadFull(r, id[:]); err != nil {
+		return nil, err
+	}
+	dict, ok := getDictionary(string(id[:]))
+	if !ok {
+		return nil, ErrUnknownDictionary
+	}
+	return dictionaryReadCloser{fr: flate.NewReaderDict(r, dict), cl: r}, nil
+}
+
+func (d dictionaryReadCloser) Read(p []byte) (int, error) {
+	return d.fr.Read(p)
+}
+
+func (d dictionaryReadCloser) Close() error {
+	err1 := d.fr.Close()
+	err2 := d.cl.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
@@ -1,6 +1,9 @@
 package apps
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrInvalidSlugName is used when the given slug name is not valid
@@ -31,4 +34,46 @@ var (
 	// ErrBadChecksum is used when the application checksum does not match the
 	// specified one.
 	ErrBadChecksum = errors.New("Application checksum does not match")
+	// ErrDecompressionLimitExceeded is used when the decompressed content of a
+	// file of an application is larger than expected.
+	ErrDecompressionLimitExceeded = errors.New("Decompressed content exceeds the size limit")
+	// ErrInvalidRange is used when the range asked for an application file is
+	// not satisfiable
+	ErrInvalidRange = errors.New("Invalid range for the application file")
+	// ErrInsufficientStorage is used when there is not enough space to store
+	// the files of an application
+	ErrInsufficientStorage = errors.New("Not enough space to install the application")
+	// ErrUnknownDictionary is used when a file of an application has been
+	// compressed with a dictionary that is not registered
+	ErrUnknownDictionary = errors.New("Unknown compression dictionary for the application file")
+	// ErrCorruptStoredObject is used when the stored content of a file of an
+	// application cannot be decompressed (see CorruptObjectError)
+	ErrCorruptStoredObject = errors.New("Stored content of the application file is corrupt")
+	// ErrAppTooBig is used when the files of a version of an application are
+	// bigger than the maximal size allowed for it
+	ErrAppTooBig = errors.New("Application exceeds the maximal size allowed")
+	// ErrVersionExists is used when a version of an application is already
+	// stored, and the copier has been configured to fail in this case
+	ErrVersionExists = errors.New("Application version already exists")
 )
+
+// CorruptObjectError is the error returned when reading a file of an
+// application whose compressed content is corrupt in the storage: bad header,
+// checksum mismatch or truncated content.
+type CorruptObjectError struct {
+	Slug    string
+	Version string
+	File    string
+	Err     error
+}
+
+func (e *CorruptObjectError) Error() string {
+	return fmt.Sprintf("%s: %s/%s%s: %s", ErrCorruptStoredObject,
+		e.Slug, e.Version, e.File, e.Err)
+}
+
+// IsCorruptStoredObject returns true if the error is a CorruptObjectError.
+func IsCorruptStoredObject(err error) bool {
+	_, ok := err.(*CorruptObjectError)
+	return ok
+}
@@ -81,6 +81,7 @@ func copyRec(root, path string, fs Copier) error {
 			name: relpath,
 			size: file.Size(),
 			mode: file.Mode(),
+			time: file.ModTime(),
 		}, f)
 		if err != nil {
 			return err
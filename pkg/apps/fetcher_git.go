@@ -263,6 +263,7 @@ func (g *gitFetcher) fetchWithGit(gitFs afero.Fs, gitDir string, src *url.URL, f
 			name: path,
 			size: info.Size(),
 			mode: info.Mode(),
+			time: info.ModTime(),
 		}, src)
 	})
 }
@@ -352,6 +353,7 @@ func (g *gitFetcher) fetchWithGoGit(gitDir string, src *url.URL, fs Copier, man
 			name: f.Name,
 			size: f.Size,
 			mode: os.FileMode(f.Mode),
+			time: commit.Committer.When,
 		}, r)
 	})
 }
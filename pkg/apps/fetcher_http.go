@@ -99,11 +99,14 @@ func (f *httpFetcher) Fetch(src *url.URL, fs Copier, man Manifest) (err error) {
 	if frag := src.Fragment; frag != "" {
 		shasum, _ = hex.DecodeString(frag)
 	}
-	return fetchHTTP(src, shasum, fs, man, f.prefix)
+	return fetchHTTP(src, shasum, fs, man, f.prefix, 0)
 }
 
-func fetchHTTP(src *url.URL, shasum []byte, fs Copier, man Manifest, prefix string) (err error) {
-	exists, err := fs.Start(man.Slug(), man.Version())
+// fetchHTTP copies the application from the tarball at the given URL. The size
+// of the application is used to check that there is enough space to store it,
+// if it is known (greater than 0).
+func fetchHTTP(src *url.URL, shasum []byte, fs Copier, man Manifest, prefix string, size int64) (err error) {
+	exists, err := startCopier(fs, man.Slug(), man.Version(), size)
 	if err != nil || exists {
 		return err
 	}
@@ -173,6 +176,7 @@ func fetchHTTP(src *url.URL, shasum []byte, fs Copier, man Manifest, prefix stri
 			name: name,
 			size: hdr.Size,
 			mode: os.FileMode(hdr.Mode),
+			time: hdr.ModTime,
 		}, tarReader)
 		if err != nil {
 			return err
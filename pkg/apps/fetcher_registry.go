@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/url"
+	"strconv"
 
 	"github.com/cozy/cozy-stack/pkg/registry"
 	"github.com/sirupsen/logrus"
@@ -53,5 +54,6 @@ func (f *registryFetcher) Fetch(src *url.URL, fs Copier, man Manifest) error {
 		return err
 	}
 	man.SetVersion(v.Version)
-	return fetchHTTP(u, shasum, fs, man, v.TarPrefix)
+	size, _ := strconv.ParseInt(v.Size, 10, 64)
+	return fetchHTTP(u, shasum, fs, man, v.TarPrefix, size)
 }
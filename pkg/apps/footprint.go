@@ -0,0 +1,133 @@
+package apps
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/swift"
+)
+
+// tmpDirPattern matches the names of the temporary directories created by
+// the afero copier next to the versions of an application.
+var tmpDirPattern = regexp.MustCompile(`^` + tmpDirPrefix + `[0-9]+$`)
+
+// SlugSize returns the storage footprint of all the versions of an
+// application: the size of the stored files, the size of their original
+// content, and the number of versions. The temporary and overwritten
+// directories, and the sidecar files, are not counted.
+func (f *aferoCopier) SlugSize(slug string) (totalCompressed, totalOriginal int64, versionCount int, err error) {
+	slugDir := path.Join("/", slug)
+	infos, err := afero.ReadDir(f.fs, slugDir)
+	if os.IsNotExist(err) {
+		return 0, 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() || tmpDirPattern.MatchString(name) ||
+			strings.HasSuffix(name, overwrittenSuffix) {
+			continue
+		}
+		compressed, original, err := f.versionSize(path.Join(slugDir, name))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		totalCompressed += compressed
+		totalOriginal += original
+		versionCount++
+	}
+	return totalCompressed, totalOriginal, versionCount, nil
+}
+
+// versionSize returns the size of the stored files of a version, and of their
+// original content from the metadata sidecar. A file without metadata is
+// counted with its stored size.
+func (f *aferoCopier) versionSize(appDir string) (compressed, original int64, err error) {
+	meta, err := readMetadataFile(f.fs, path.Join(appDir, metadataFileName))
+	if err != nil {
+		return 0, 0, err
+	}
+	originals := make(map[string]int64, len(meta))
+	for name, m := range meta {
+		originals[name+codecExtension(m.ContentEncoding)] = m.OriginalContentLength
+	}
+	err = afero.Walk(f.fs, appDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || isSidecarFile(info.Name()) {
+			return err
+		}
+		compressed += info.Size()
+		if size, ok := originals[strings.TrimPrefix(name, appDir)]; ok {
+			original += size
+		} else {
+			original += info.Size()
+		}
+		return nil
+	})
+	return compressed, original, err
+}
+
+// SlugSize returns the storage footprint of all the versions of an
+// application, from the size of the objects and their original-content-length
+// metadata. The versions are listed from their markers, and the temporary
+// objects are not counted.
+func (f *swiftCopier) SlugSize(slug string) (totalCompressed, totalOriginal int64, versionCount int, err error) {
+	markers, err := f.c.ObjectNamesAll(f.container, &swift.ObjectsOpts{
+		Prefix:    slug + "/",
+		Delimiter: '/',
+	})
+	if err == swift.ContainerNotFound {
+		return 0, 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, marker := range markers {
+		// The pseudo-directories of the nested naming end with a slash.
+		if strings.HasSuffix(marker, "/") {
+			continue
+		}
+		version := strings.TrimPrefix(marker, slug+"/")
+		compressed, original, err := f.versionSize(slug, version)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		totalCompressed += compressed
+		totalOriginal += original
+		versionCount++
+	}
+	return totalCompressed, totalOriginal, versionCount, nil
+}
+
+// versionSize returns the size of the objects of a version, and of their
+// original content. The metadata are not in the listing, so each object is
+// read with a HEAD.
+func (f *swiftCopier) versionSize(slug, version string) (compressed, original int64, err error) {
+	objs, err := f.c.ObjectsAll(f.container, &swift.ObjectsOpts{
+		Prefix: f.naming.Prefix(slug, version),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, obj := range objs {
+		compressed += obj.Bytes
+		_, h, err := f.c.Object(f.container, obj.Name)
+		if err == swift.ObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		size, errp := strconv.ParseInt(h.ObjectMetadata()["original-content-length"], 10, 64)
+		if errp != nil {
+			size = obj.Bytes
+		}
+		original += size
+	}
+	return compressed, original, nil
+}
@@ -298,10 +298,13 @@ func (i *Installer) update() error {
 	//
 	// For git:// and file:// sources, it may be more complicated since we need
 	// to actually fetch the data to extract the exact version of the manifest.
+	//
+	// When the copier overwrites the stored versions, the same version is
+	// fetched again, to install a fixed build for example.
 	makeUpdate := true
 	switch i.src.Scheme {
 	case "registry", "http", "https":
-		makeUpdate = (newManifest.Version() != oldManifest.Version())
+		makeUpdate = newManifest.Version() != oldManifest.Version() || overwrites(i.fs)
 	}
 
 	// Check the possible permissions changes before updating. If the
@@ -182,7 +182,7 @@ func TestMain(m *testing.M) {
 	defer osFS.RemoveAll(tmpDir)
 
 	baseFS = afero.NewBasePathFs(osFS, tmpDir)
-	fs = apps.NewAferoCopier(baseFS)
+	fs = apps.NewAferoCopier(baseFS, nil)
 
 	go serveGitRep()
 
@@ -0,0 +1,66 @@
+package apps
+
+import "time"
+
+// The operations of a copier recorded in its journal.
+const (
+	JournalCommit = "commit"
+	JournalAbort  = "abort"
+)
+
+// JournalEntry is the record of an operation of a copier on a version of an
+// application.
+type JournalEntry struct {
+	Operation string    `json:"operation"`
+	Slug      string    `json:"slug"`
+	Version   string    `json:"version"`
+	Time      time.Time `json:"time"`
+	Error     string    `json:"error,omitempty"`
+	// Files and Size are the number of files copied, and their size before
+	// compression.
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+}
+
+// Journal is a sink for the operations of the copiers, for example to keep a
+// timeline of the installations for the audit. The entries are recorded on a
+// best-effort basis, and Record should not block.
+type Journal interface {
+	Record(entry *JournalEntry)
+}
+
+// copierStats are the counters of a copier for its journal.
+type copierStats struct {
+	slug    string
+	version string
+	files   int
+	size    int64
+}
+
+func (s *copierStats) reset(slug, version string) {
+	*s = copierStats{slug: slug, version: version}
+}
+
+func (s *copierStats) add(size int64) {
+	s.files++
+	s.size += size
+}
+
+// record writes an entry for the operation in the journal, if any.
+func (s *copierStats) record(journal Journal, operation string, err error) {
+	if journal == nil {
+		return
+	}
+	entry := &JournalEntry{
+		Operation: operation,
+		Slug:      s.slug,
+		Version:   s.version,
+		Time:      time.Now(),
+		Files:     s.files,
+		Size:      s.size,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	journal.Record(entry)
+}
@@ -0,0 +1,194 @@
+package apps
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// The operations recorded by the MemCopier.
+const (
+	MemCopierStart      = "start"
+	MemCopierCopy       = "copy"
+	MemCopierCommit     = "commit"
+	MemCopierAbort      = "abort"
+	MemCopierRecompress = "recompress"
+)
+
+// MemCopierCall is a call made to a MemCopier. Name is the file for a copy.
+type MemCopierCall struct {
+	Operation string
+	Slug      string
+	Version   string
+	Name      string
+}
+
+// MemCopier is a Copier that keeps the files in memory, and records the calls
+// made to it, to check the behavior of the installer in the tests without any
+// storage. Capacity, if positive, is the maximal size of an application
+// accepted by StartWithSize.
+type MemCopier struct {
+	Capacity int64
+
+	mu       sync.Mutex
+	opts     CopierOptions
+	calls    []MemCopierCall
+	versions map[string]map[string][]byte
+	tmp      map[string][]byte
+	started  bool
+	stats    copierStats
+}
+
+// NewMemCopier returns a new MemCopier. The files are not compressed, and only
+// the journal, the size limits and the policy for the existing versions of
+// the options are used.
+func NewMemCopier(opts *CopierOptions) *MemCopier {
+	c := &MemCopier{versions: make(map[string]map[string][]byte)}
+	if opts != nil {
+		c.opts = *opts
+	}
+	return c
+}
+
+func (c *MemCopier) record(operation, name string) {
+	c.calls = append(c.calls, MemCopierCall{
+		Operation: operation,
+		Slug:      c.stats.slug,
+		Version:   c.stats.version,
+		Name:      name,
+	})
+}
+
+// Start implements the Copier interface.
+func (c *MemCopier) Start(slug, version string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.reset(slug, version)
+	c.record(MemCopierStart, "")
+	_, exists := c.versions[path.Join(slug, version)]
+	if skip, err := c.opts.onExists(exists); skip || err != nil {
+		return skip, err
+	}
+	c.tmp = make(map[string][]byte)
+	c.started = true
+	return false, nil
+}
+
+// StartWithSize implements the SizedCopier interface.
+func (c *MemCopier) StartWithSize(slug, version string, size int64) (bool, error) {
+	if c.Capacity > 0 && size > c.Capacity {
+		return false, ErrInsufficientStorage
+	}
+	return c.Start(slug, version)
+}
+
+// Copy implements the Copier interface.
+func (c *MemCopier) Copy(stat os.FileInfo, src io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started {
+		panic("copier should call Start() before Copy()")
+	}
+	name := path.Join("/", stat.Name())
+	c.record(MemCopierCopy, name)
+	src, err := c.opts.budget(stat, src, &c.stats)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	c.tmp[name] = b
+	c.stats.add(int64(len(b)))
+	return nil
+}
+
+// Commit implements the Copier interface.
+func (c *MemCopier) Commit() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record(MemCopierCommit, "")
+	c.versions[path.Join(c.stats.slug, c.stats.version)] = c.tmp
+	c.tmp = nil
+	c.started = false
+	c.stats.record(c.opts.Journal, JournalCommit, nil)
+	return nil
+}
+
+// Abort implements the Copier interface.
+func (c *MemCopier) Abort() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record(MemCopierAbort, "")
+	c.tmp = nil
+	c.started = false
+	c.stats.record(c.opts.Journal, JournalAbort, nil)
+	return nil
+}
+
+// Recompress implements the Copier interface. The files are kept as is.
+func (c *MemCopier) Recompress(slug, version string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, MemCopierCall{
+		Operation: MemCopierRecompress,
+		Slug:      slug,
+		Version:   version,
+	})
+	if _, ok := c.versions[path.Join(slug, version)]; !ok {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// SlugSize implements the Copier interface. The files are not compressed, so
+// the two sizes are the same.
+func (c *MemCopier) SlugSize(slug string) (int64, int64, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var size int64
+	var count int
+	for key, files := range c.versions {
+		if path.Dir(key) != slug {
+			continue
+		}
+		for _, b := range files {
+			size += int64(len(b))
+		}
+		count++
+	}
+	return size, size, count, nil
+}
+
+// Calls returns the calls made to the copier, in order.
+func (c *MemCopier) Calls() []MemCopierCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]MemCopierCall(nil), c.calls...)
+}
+
+// Files returns the sorted names of the files of a committed version.
+func (c *MemCopier) Files(slug, version string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for name := range c.versions[path.Join(slug, version)] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// File returns the content of a file of a committed version.
+func (c *MemCopier) File(slug, version, name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.versions[path.Join(slug, version)][path.Join("/", name)]
+	return b, ok
+}
+
+var _ SizedCopier = &MemCopier{}
@@ -0,0 +1,77 @@
+package apps
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"strings"
+)
+
+// ObjectNaming defines how the files of the applications are named in swift.
+type ObjectNaming interface {
+	// Prefix returns the prefix of the names of all the objects of a version
+	// of an application.
+	Prefix(slug, version string) string
+	// ObjectName returns the name of the object for a file of a version of an
+	// application.
+	ObjectName(slug, version, file string) string
+	// FileName returns the path of a file from the name of its object, or
+	// false if it can only be known from the original-path metadata of the
+	// object.
+	FileName(slug, version, objName string) (string, bool)
+}
+
+var (
+	// NestedObjectNaming uses the slug, the version and the path of the file
+	// as the name of the object, like a directory tree. It is the default.
+	NestedObjectNaming ObjectNaming = nestedNaming{}
+	// HashedObjectNaming uses a hash of the slug and version, followed by a
+	// hash of the path of the file, to spread the names of the objects on
+	// very large containers.
+	HashedObjectNaming ObjectNaming = hashedNaming{}
+)
+
+// ObjectNamingByName returns the naming scheme with the given name, "nested"
+// or "hashed", or NestedObjectNaming if the name is not known.
+func ObjectNamingByName(name string) ObjectNaming {
+	if name == "hashed" {
+		return HashedObjectNaming
+	}
+	return NestedObjectNaming
+}
+
+type nestedNaming struct{}
+
+func (nestedNaming) Prefix(slug, version string) string {
+	return path.Join(slug, version) + "/"
+}
+
+func (nestedNaming) ObjectName(slug, version, file string) string {
+	return path.Join(slug, version, file)
+}
+
+func (n nestedNaming) FileName(slug, version, objName string) (string, bool) {
+	return strings.TrimPrefix(objName, n.Prefix(slug, version)), true
+}
+
+type hashedNaming struct{}
+
+func (hashedNaming) Prefix(slug, version string) string {
+	sum := sha256.Sum256([]byte(path.Join(slug, version)))
+	return hex.EncodeToString(sum[:8]) + "-"
+}
+
+func (h hashedNaming) ObjectName(slug, version, file string) string {
+	sum := sha256.Sum256([]byte(cleanFileName(file)))
+	return h.Prefix(slug, version) + hex.EncodeToString(sum[:])
+}
+
+func (hashedNaming) FileName(slug, version, objName string) (string, bool) {
+	return "", false
+}
+
+// cleanFileName returns the path of a file of an application, relative to
+// the root of the application, as stored in the original-path metadata.
+func cleanFileName(file string) string {
+	return strings.TrimPrefix(path.Join("/", file), "/")
+}
@@ -0,0 +1,254 @@
+package apps
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/swift"
+)
+
+// recompressSuffix is added to the name of a file while it is rewritten by
+// Recompress, before being renamed to its final name.
+const recompressSuffix = ".recompress"
+
+// recompressPrefix is the prefix of the swift objects written by Recompress,
+// before being moved to their final name.
+const recompressPrefix = "tmp-recompress/"
+
+// Recompress rewrites the files of an installed version of an application
+// with the codec of the current options: the content is decompressed and
+// compressed again only for the files stored with another codec.
+//
+// The new content is written under a temporary name, moved to its final name,
+// and only then the content with the old codec is removed. The server always
+// prefers the new content, so the application can be served during the
+// operation, and if it is interrupted, it can just be called again. The
+// encoding recorded in the metadata of the files is updated at the end.
+func (f *aferoCopier) Recompress(slug, version string) error {
+	appDir := path.Join("/", slug, version)
+	exists, err := afero.DirExists(f.fs, appDir)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	// The files are listed before being rewritten, grouped by the name of the
+	// original file, as an interrupted operation can have left a file stored
+	// with two codecs.
+	stored := make(map[string][]Codec)
+	var leftovers []string
+	err = afero.Walk(f.fs, appDir, func(name string, infos os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if infos.IsDir() || isSidecarFile(infos.Name()) {
+			return nil
+		}
+		if strings.HasSuffix(name, recompressSuffix) {
+			leftovers = append(leftovers, name)
+			return nil
+		}
+		name, codec := splitCodecExtension(name)
+		stored[name] = append(stored[name], codec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range leftovers {
+		if err = f.fs.Remove(name); err != nil {
+			return err
+		}
+	}
+	meta, err := readMetadataFile(f.fs, path.Join(appDir, metadataFileName))
+	if err != nil {
+		return err
+	}
+	for name, codecs := range stored {
+		key := strings.TrimPrefix(name, appDir)
+		if err = f.recompressFile(name, codecs, key, meta); err != nil {
+			return err
+		}
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	return writeMetadataFile(f.fs, appDir, meta)
+}
+
+func (f *aferoCopier) recompressFile(name string, codecs []Codec, key string, meta map[string]storedFileMetadata) error {
+	// The file is read with the codec preferred by the server
+	codec := codecs[0]
+	for _, c := range storedCodecs {
+		if hasCodec(codecs, c) {
+			codec = c
+			break
+		}
+	}
+
+	src, err := f.fs.Open(storedFileName(name, codec))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	rc, err := newDecompressReadCloser(src, codec, -1)
+	if err != nil {
+		return err
+	}
+	contentType, r := f.opts.contentType(path.Base(name), rc)
+	target := f.opts.codecFor(contentType)
+
+	if !hasCodec(codecs, target) {
+		dstName := storedFileName(name, target)
+		tmpName := dstName + recompressSuffix
+		dst, err := f.fs.Create(tmpName)
+		if err != nil {
+			return err
+		}
+		var size byteCounter
+		err = copyCompressed(dst, io.TeeReader(r, &size), target, f.opts.Dictionary)
+		if errc := dst.Close(); err == nil {
+			err = errc
+		}
+		if err != nil {
+			f.fs.Remove(tmpName) // #nosec
+			return err
+		}
+		mtime := stat.ModTime()
+		f.fs.Chtimes(tmpName, mtime, mtime) // #nosec
+		if err = f.fs.Rename(tmpName, dstName); err != nil {
+			return err
+		}
+		meta[key] = storedFileMetadata{
+			ContentEncoding:       target,
+			OriginalContentLength: int64(size),
+		}
+	} else if m, ok := meta[key]; ok {
+		m.ContentEncoding = target
+		meta[key] = m
+	}
+
+	for _, c := range codecs {
+		if c != target {
+			if err = f.fs.Remove(storedFileName(name, c)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Recompress rewrites the objects of an installed version of an application
+// with the codec of the current options. See aferoCopier.Recompress.
+func (f *swiftCopier) Recompress(slug, version string) error {
+	appObj := path.Join(slug, version)
+	if _, _, err := f.c.Object(f.container, appObj); err != nil {
+		if err == swift.ObjectNotFound {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	prefix := f.naming.Prefix(slug, version)
+	tmpPrefix := recompressPrefix + prefix
+	leftovers, err := f.c.ObjectNamesAll(f.container, &swift.ObjectsOpts{
+		Prefix: tmpPrefix,
+	})
+	if err != nil {
+		return err
+	}
+	if len(leftovers) > 0 {
+		if _, err = f.c.BulkDelete(f.container, leftovers); err != nil {
+			return err
+		}
+	}
+
+	objectNames, err := f.c.ObjectNamesAll(f.container, &swift.ObjectsOpts{
+		Prefix: prefix,
+	})
+	if err != nil {
+		return err
+	}
+	for _, objName := range objectNames {
+		tmpName := tmpPrefix + strings.TrimPrefix(objName, prefix)
+		if err = f.recompressObject(objName, tmpName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *swiftCopier) recompressObject(objName, tmpName string) error {
+	src, h, err := f.c.ObjectOpen(f.container, objName, false, nil)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	objMeta := h.ObjectMetadata()
+	codec := Codec(objMeta["content-encoding"])
+	contentType := h["Content-Type"]
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = strings.TrimSpace(contentType[:i])
+	}
+	target := f.opts.codecFor(contentType)
+	if codec == target {
+		return nil
+	}
+
+	rc, err := newDecompressReadCloser(src, codec, originalContentLength(objMeta))
+	if err != nil {
+		return err
+	}
+	objMeta["content-encoding"] = string(target)
+	dst, err := f.c.ObjectCreate(f.container, tmpName, true, "",
+		h["Content-Type"], objMeta.ObjectHeaders())
+	if err != nil {
+		return err
+	}
+	err = copyCompressed(dst, rc, target, f.opts.Dictionary)
+	if errc := dst.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+	return f.c.ObjectMove(f.container, tmpName, f.container, objName)
+}
+
+// splitCodecExtension returns the name of the original file, and the codec
+// used to store it, from the name of a stored file.
+func splitCodecExtension(name string) (string, Codec) {
+	for _, codec := range storedCodecs {
+		if ext := codecExtension(codec); strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext), codec
+		}
+	}
+	return name, ""
+}
+
+// storedFileName is the reverse of splitCodecExtension.
+func storedFileName(name string, codec Codec) string {
+	if codec == "" {
+		return name
+	}
+	return name + codecExtension(codec)
+}
+
+func hasCodec(codecs []Codec, codec Codec) bool {
+	for _, c := range codecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
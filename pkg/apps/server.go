@@ -5,6 +5,7 @@ import (
 	"compress/gzip"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,8 +14,11 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/magic"
 	web_utils "github.com/cozy/cozy-stack/web/utils"
 	"github.com/cozy/swift"
@@ -24,14 +28,31 @@ import (
 // data files.
 type FileServer interface {
 	Open(slug, version, file string) (io.ReadCloser, error)
+	ModTime(slug, version, file string) (time.Time, error)
+	Size(slug, version, file string) (int64, error)
+	OpenRange(slug, version, file string, start, length int64) (*FileRange, error)
+	SupportsRanges(slug, version, file string) (bool, error)
+	ETag(slug, version, file string) (string, error)
 	FilesList(slug, version string) ([]string, error)
 	ServeFileContent(w http.ResponseWriter, req *http.Request,
 		slug, version, file string) error
 }
 
+// FileRange is a part of the content of an application file, as returned by
+// the OpenRange method of a FileServer.
+type FileRange struct {
+	io.ReadCloser
+	// Size is the total size of the (decompressed) file, or -1 if unknown.
+	Size int64
+	// Efficient is true if the range has been read directly from the storage,
+	// and false if the file had to be decompressed up to the range.
+	Efficient bool
+}
+
 type swiftServer struct {
 	c         *swift.Connection
 	container string
+	naming    ObjectNaming
 }
 
 type aferoServer struct {
@@ -70,12 +91,243 @@ func (g gzipReadCloser) Close() error {
 	return nil
 }
 
+type brotliReadCloser struct {
+	br *brotli.Reader
+	cl io.Closer
+}
+
+func newBrotliReadCloser(r io.ReadCloser) io.ReadCloser {
+	return brotliReadCloser{br: brotli.NewReader(r), cl: r}
+}
+
+func (b brotliReadCloser) Read(p []byte) (int, error) {
+	return b.br.Read(p)
+}
+
+func (b brotliReadCloser) Close() error {
+	return b.cl.Close()
+}
+
+// defaultMaxDecompressedSize is the maximal size of the decompressed content
+// of a file, when it is not configured.
+const defaultMaxDecompressedSize = 100 << 20 // 100 MB
+
+// maxDecompressedSize returns the maximal size of the decompressed content of
+// a file, when its original size has not been recorded.
+func maxDecompressedSize() int64 {
+	if max := config.GetConfig().Fs.AppsMaxDecompressedSize; max > 0 {
+		return max
+	}
+	return defaultMaxDecompressedSize
+}
+
+// limitedReadCloser returns ErrDecompressionLimitExceeded when more than
+// remaining bytes are read from it. It protects against the compression bombs.
+type limitedReadCloser struct {
+	rc        io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.rc.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		return n, ErrDecompressionLimitExceeded
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+func (l *limitedReadCloser) Close() error {
+	return l.rc.Close()
+}
+
+// newDecompressReadCloser returns a reader of the decompressed content of r,
+// given the codec it has been stored with. The decompressed content can't be
+// larger than limit bytes, or than the configured ceiling if limit is
+// negative.
+func newDecompressReadCloser(r io.ReadCloser, codec Codec, limit int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	switch codec {
+	case CodecGzip:
+		gr, err := newGzipReadCloser(r)
+		if err != nil {
+			return nil, err
+		}
+		rc = gr
+	case CodecBrotli:
+		rc = newBrotliReadCloser(r)
+	case CodecDictionary:
+		dr, err := newDictionaryReadCloser(r)
+		if err != nil {
+			return nil, err
+		}
+		rc = dr
+	default:
+		return r, nil
+	}
+	if limit < 0 {
+		limit = maxDecompressedSize()
+	}
+	return &limitedReadCloser{rc: rc, remaining: limit}, nil
+}
+
+// sourceReadCloser keeps the last error of the reader of the stored content,
+// to tell it apart from the errors of the decompression.
+type sourceReadCloser struct {
+	rc  io.ReadCloser
+	err error
+}
+
+func (s *sourceReadCloser) Read(p []byte) (int, error) {
+	n, err := s.rc.Read(p)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+func (s *sourceReadCloser) Close() error {
+	return s.rc.Close()
+}
+
+// checkedReadCloser returns a CorruptObjectError when the decompression of
+// the stored content fails.
+type checkedReadCloser struct {
+	rc  io.ReadCloser
+	src *sourceReadCloser
+	obj CorruptObjectError
+}
+
+func (c *checkedReadCloser) Read(p []byte) (int, error) {
+	n, err := c.rc.Read(p)
+	return n, c.obj.check(c.src, err)
+}
+
+func (c *checkedReadCloser) Close() error {
+	return c.rc.Close()
+}
+
+// check returns a copy of the error with err as its cause if err comes from
+// the decompression, or err unchanged.
+func (e CorruptObjectError) check(src *sourceReadCloser, err error) error {
+	switch err {
+	case nil, io.EOF, ErrDecompressionLimitExceeded, ErrUnknownDictionary, src.err:
+		return err
+	}
+	e.Err = err
+	return &e
+}
+
+// newObjectReadCloser returns a reader of the decompressed content of the
+// file of an application, like newDecompressReadCloser, where the errors of
+// the decompression are reported as a CorruptObjectError.
+func newObjectReadCloser(r io.ReadCloser, codec Codec, limit int64, slug, version, file string) (io.ReadCloser, error) {
+	if !isCompressed(codec) {
+		return r, nil
+	}
+	obj := CorruptObjectError{Slug: slug, Version: version, File: path.Join("/", file)}
+	src := &sourceReadCloser{rc: r}
+	rc, err := newDecompressReadCloser(src, codec, limit)
+	if err != nil {
+		return nil, obj.check(src, err)
+	}
+	return &checkedReadCloser{rc: rc, src: src, obj: obj}, nil
+}
+
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// sliceReadCloser skips the first start bytes of rc, and returns a reader of
+// the next length bytes (or of the rest of the content if length is negative).
+func sliceReadCloser(rc io.ReadCloser, start, length int64) (io.ReadCloser, error) {
+	if start > 0 {
+		n, err := io.CopyN(ioutil.Discard, rc, start)
+		if err == io.EOF && n < start {
+			err = ErrInvalidRange
+		}
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return rc, nil
+	}
+	return rangeReadCloser{Reader: io.LimitReader(rc, length), Closer: rc}, nil
+}
+
+func checkRange(start, length, size int64) error {
+	if start < 0 || (size >= 0 && start > size) {
+		return ErrInvalidRange
+	}
+	return nil
+}
+
+// originalModTime returns the modification time of the source file, as
+// recorded in the metadata of the object, or the last modification of the
+// object if unknown.
+func originalModTime(o swift.Metadata, h swift.Headers) time.Time {
+	if mtime, err := time.Parse(time.RFC3339, o["original-mtime"]); err == nil {
+		return mtime
+	}
+	mtime, _ := time.Parse(http.TimeFormat, h["Last-Modified"])
+	return mtime
+}
+
+// setLastModified adds the Last-Modified header to the response, if the
+// modification time is known.
+func setLastModified(w http.ResponseWriter, mtime time.Time) {
+	if !mtime.IsZero() {
+		w.Header().Set("Last-Modified", mtime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// originalETag returns a strong ETag for the original content of an object,
+// from the md5sum recorded in its metadata, or an empty string if unknown.
+func originalETag(o swift.Metadata) string {
+	if sum := o["original-md5"]; sum != "" {
+		return fmt.Sprintf(`"%s"`, sum)
+	}
+	return ""
+}
+
+// encodedETag returns the ETag of the content sent compressed with the codec:
+// its bytes differ from the original content, so the two representations
+// can't share the same strong ETag.
+func encodedETag(etag string, codec Codec) string {
+	return fmt.Sprintf(`%s-%s"`, strings.TrimSuffix(etag, `"`), codec)
+}
+
+// originalContentLength returns the size of the content before its
+// compression, as recorded in the metadata of the object, or -1 if unknown.
+func originalContentLength(o swift.Metadata) int64 {
+	size, err := strconv.ParseInt(o["original-content-length"], 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
 // NewSwiftFileServer returns provides the apps.FileServer implementation
 // using the swift backend as file server.
-func NewSwiftFileServer(conn *swift.Connection, appsType AppType) FileServer {
+//
+// The naming defines how the objects of the files are named. If nil,
+// NestedObjectNaming is used.
+func NewSwiftFileServer(conn *swift.Connection, appsType AppType, naming ObjectNaming) FileServer {
+	if naming == nil {
+		naming = NestedObjectNaming
+	}
 	return &swiftServer{
 		c:         conn,
 		container: containerName(appsType),
+		naming:    naming,
 	}
 }
 
@@ -86,10 +338,108 @@ func (s *swiftServer) Open(slug, version, file string) (io.ReadCloser, error) {
 		return nil, wrapSwiftErr(err)
 	}
 	o := h.ObjectMetadata()
-	if contentEncoding := o["content-encoding"]; contentEncoding == "gzip" {
-		return newGzipReadCloser(f)
+	return newObjectReadCloser(f, Codec(o["content-encoding"]), originalContentLength(o), slug, version, file)
+}
+
+func (s *swiftServer) ModTime(slug, version, file string) (time.Time, error) {
+	objName := s.makeObjectName(slug, version, file)
+	_, h, err := s.c.Object(s.container, objName)
+	if err != nil {
+		return time.Time{}, wrapSwiftErr(err)
+	}
+	return originalModTime(h.ObjectMetadata(), h), nil
+}
+
+// Size returns the size of the original content of the file, before its
+// compression, or -1 if it is unknown.
+func (s *swiftServer) Size(slug, version, file string) (int64, error) {
+	objName := s.makeObjectName(slug, version, file)
+	info, h, err := s.c.Object(s.container, objName)
+	if err != nil {
+		return 0, wrapSwiftErr(err)
+	}
+	o := h.ObjectMetadata()
+	if isCompressed(Codec(o["content-encoding"])) {
+		return originalContentLength(o), nil
 	}
-	return f, nil
+	return info.Bytes, nil
+}
+
+// OpenRange returns a reader of length bytes of the file content, starting at
+// start (a negative length means until the end of the file). For the objects
+// stored without compression, the range is asked directly to swift.
+func (s *swiftServer) OpenRange(slug, version, file string, start, length int64) (*FileRange, error) {
+	objName := s.makeObjectName(slug, version, file)
+	_, h, err := s.c.Object(s.container, objName)
+	if err != nil {
+		return nil, wrapSwiftErr(err)
+	}
+	o := h.ObjectMetadata()
+	codec := Codec(o["content-encoding"])
+	if isCompressed(codec) {
+		size := originalContentLength(o)
+		if err = checkRange(start, length, size); err != nil {
+			return nil, err
+		}
+		f, _, err := s.c.ObjectOpen(s.container, objName, false, nil)
+		if err != nil {
+			return nil, wrapSwiftErr(err)
+		}
+		rc, err := newObjectReadCloser(f, codec, size, slug, version, file)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		rc, err = sliceReadCloser(rc, start, length)
+		if err != nil {
+			return nil, err
+		}
+		return &FileRange{ReadCloser: rc, Size: size}, nil
+	}
+
+	size, err := strconv.ParseInt(h["Content-Length"], 10, 64)
+	if err != nil {
+		size = -1
+	}
+	if err = checkRange(start, length, size); err != nil {
+		return nil, err
+	}
+	if length == 0 || start == size {
+		return &FileRange{ReadCloser: ioutil.NopCloser(bytes.NewReader(nil)), Size: size, Efficient: true}, nil
+	}
+	bytesRange := fmt.Sprintf("bytes=%d-", start)
+	if length > 0 {
+		bytesRange += strconv.FormatInt(start+length-1, 10)
+	}
+	f, _, err := s.c.ObjectOpen(s.container, objName, false, swift.Headers{"Range": bytesRange})
+	if err != nil {
+		return nil, wrapSwiftErr(err)
+	}
+	return &FileRange{ReadCloser: f, Size: size, Efficient: true}, nil
+}
+
+// SupportsRanges returns true if the file is stored without compression, and
+// a range of its content can be read without reading the whole object.
+func (s *swiftServer) SupportsRanges(slug, version, file string) (bool, error) {
+	objName := s.makeObjectName(slug, version, file)
+	_, h, err := s.c.Object(s.container, objName)
+	if err != nil {
+		return false, wrapSwiftErr(err)
+	}
+	codec := Codec(h.ObjectMetadata()["content-encoding"])
+	return !isCompressed(codec), nil
+}
+
+// ETag returns a strong ETag for the file, computed from its original content
+// when it has been copied. It returns an empty string for the files copied
+// before the md5sum was recorded.
+func (s *swiftServer) ETag(slug, version, file string) (string, error) {
+	objName := s.makeObjectName(slug, version, file)
+	_, h, err := s.c.Object(s.container, objName)
+	if err != nil {
+		return "", wrapSwiftErr(err)
+	}
+	return originalETag(h.ObjectMetadata()), nil
 }
 
 func (s *swiftServer) ServeFileContent(w http.ResponseWriter, req *http.Request, slug, version, file string) error {
@@ -100,8 +450,20 @@ func (s *swiftServer) ServeFileContent(w http.ResponseWriter, req *http.Request,
 	}
 	defer f.Close()
 
+	o := h.ObjectMetadata()
+	codec := Codec(o["content-encoding"])
+	encoded := isCompressed(codec) && acceptEncoding(req, codec)
+	if isCompressed(codec) {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
 	if checkETag := req.Header.Get("Cache-Control") == ""; checkETag {
-		etag := fmt.Sprintf(`"%s"`, h["Etag"][:10])
+		etag := originalETag(o)
+		if etag == "" {
+			etag = fmt.Sprintf(`"%s"`, h["Etag"][:10])
+		}
+		if encoded {
+			etag = encodedETag(etag, codec)
+		}
 		if web_utils.CheckPreconditions(w, req, etag) {
 			return nil
 		}
@@ -111,19 +473,19 @@ func (s *swiftServer) ServeFileContent(w http.ResponseWriter, req *http.Request,
 	var r io.Reader = f
 	contentLength := h["Content-Length"]
 	contentType := h["Content-Type"]
-	o := h.ObjectMetadata()
-	if contentEncoding := o["content-encoding"]; contentEncoding == "gzip" {
-		if acceptGzipEncoding(req) {
-			w.Header().Set("Content-Encoding", "gzip")
+	setLastModified(w, originalModTime(o, h))
+	if isCompressed(codec) {
+		if encoded {
+			w.Header().Set("Content-Encoding", string(codec))
 		} else {
 			contentLength = o["original-content-length"]
-			var gr *gzip.Reader
-			gr, err = gzip.NewReader(f)
+			var rc io.ReadCloser
+			rc, err = newObjectReadCloser(f, codec, originalContentLength(o), slug, version, file)
 			if err != nil {
 				return err
 			}
-			defer gr.Close()
-			r = gr
+			defer rc.Close()
+			r = rc
 		}
 	}
 
@@ -144,20 +506,26 @@ func (s *swiftServer) ServeFileContent(w http.ResponseWriter, req *http.Request,
 }
 
 func (s *swiftServer) makeObjectName(slug, version, file string) string {
-	return path.Join(slug, version, file)
+	return s.naming.ObjectName(slug, version, file)
 }
 
 func (s *swiftServer) FilesList(slug, version string) ([]string, error) {
-	prefix := s.makeObjectName(slug, version, "") + "/"
 	names, err := s.c.ObjectNamesAll(s.container, &swift.ObjectsOpts{
-		Prefix: prefix,
+		Prefix: s.naming.Prefix(slug, version),
 	})
 	if err != nil {
 		return nil, err
 	}
 	filtered := names[:0]
-	for _, n := range names {
-		n = strings.TrimPrefix(n, prefix)
+	for _, objName := range names {
+		n, ok := s.naming.FileName(slug, version, objName)
+		if !ok {
+			_, h, err := s.c.Object(s.container, objName)
+			if err != nil {
+				return nil, wrapSwiftErr(err)
+			}
+			n = h.ObjectMetadata()["original-path"]
+		}
 		if n != "" {
 			filtered = append(filtered, n)
 		}
@@ -182,44 +550,215 @@ func NewAferoFileServer(fs afero.Fs, makePath func(slug, version, file string) s
 }
 
 func (s *aferoServer) Open(slug, version, file string) (io.ReadCloser, error) {
-	isGzipped := true
 	filepath := s.mkPath(slug, version, file)
-	f, err := s.open(filepath + ".gz")
-	if os.IsNotExist(err) {
-		isGzipped = false
-		f, err = s.open(filepath)
+	f, codec, err := s.open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	if codec == "" {
+		return f, nil
 	}
+	size, err := s.originalSize(slug, version, file)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	if isGzipped {
-		return newGzipReadCloser(f)
+	rc, err := newObjectReadCloser(f, codec, size, slug, version, file)
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
-	return f, nil
+	return rc, nil
 }
-func (s *aferoServer) open(filepath string) (io.ReadCloser, error) {
-	return s.fs.Open(filepath)
+
+func (s *aferoServer) ModTime(slug, version, file string) (time.Time, error) {
+	filepath := s.mkPath(slug, version, file)
+	f, _, err := s.open(filepath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	infos, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return infos.ModTime(), nil
 }
 
-func (s *aferoServer) ServeFileContent(w http.ResponseWriter, req *http.Request, slug, version, file string) error {
+// Size returns the size of the original content of the file, before its
+// compression, as recorded by the copier. It is -1 for the compressed files
+// of the versions copied before it was recorded.
+func (s *aferoServer) Size(slug, version, file string) (int64, error) {
+	filepath := s.mkPath(slug, version, file)
+	f, codec, err := s.open(filepath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if codec != "" {
+		return s.originalSize(slug, version, file)
+	}
+	infos, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return infos.Size(), nil
+}
+
+// originalSize returns the original content length recorded by the copier for
+// the file, or -1 if unknown.
+func (s *aferoServer) originalSize(slug, version, file string) (int64, error) {
+	meta, err := readMetadataFile(s.fs, s.mkPath(slug, version, metadataFileName))
+	if err != nil {
+		return 0, err
+	}
+	if m, ok := meta[path.Join("/", file)]; ok {
+		return m.OriginalContentLength, nil
+	}
+	return -1, nil
+}
+
+// OpenRange returns a reader of length bytes of the file content, starting at
+// start (a negative length means until the end of the file). For the files
+// stored without compression, the file is seeked to the start of the range.
+func (s *aferoServer) OpenRange(slug, version, file string, start, length int64) (*FileRange, error) {
+	filepath := s.mkPath(slug, version, file)
+	f, codec, err := s.open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	if codec != "" {
+		size, err := s.originalSize(slug, version, file)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err = checkRange(start, length, size); err != nil {
+			f.Close()
+			return nil, err
+		}
+		rc, err := newObjectReadCloser(f, codec, size, slug, version, file)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		rc, err = sliceReadCloser(rc, start, length)
+		if err != nil {
+			return nil, err
+		}
+		return &FileRange{ReadCloser: rc, Size: size}, nil
+	}
+
+	infos, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := infos.Size()
+	if err = checkRange(start, length, size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err = f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	var rc io.ReadCloser = f
+	if length >= 0 {
+		rc = rangeReadCloser{Reader: io.LimitReader(f, length), Closer: f}
+	}
+	return &FileRange{ReadCloser: rc, Size: size, Efficient: true}, nil
+}
+
+// SupportsRanges returns true if the file is stored without compression, and
+// can be seeked.
+func (s *aferoServer) SupportsRanges(slug, version, file string) (bool, error) {
 	filepath := s.mkPath(slug, version, file)
-	return s.serveFileContent(w, req, filepath)
+	f, codec, err := s.open(filepath)
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+	return codec == "", nil
 }
-func (s *aferoServer) serveFileContent(w http.ResponseWriter, req *http.Request, filepath string) error {
-	isGzipped := true
-	rc, err := s.fs.Open(filepath + ".gz")
+
+// open opens the file stored for the given path, trying first its compressed
+// versions. It returns the codec used for the compression of the file, or an
+// empty codec if it is not compressed.
+func (s *aferoServer) open(filepath string) (afero.File, Codec, error) {
+	for _, codec := range storedCodecs {
+		f, err := s.fs.Open(filepath + codecExtension(codec))
+		if err == nil {
+			return f, codec, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, "", err
+		}
+	}
+	f, err := s.fs.Open(filepath)
+	return f, "", err
+}
+
+// ETag returns a strong ETag for the file, computed from its original content
+// when it has been copied. It returns an empty string for the files copied
+// before the md5sum was recorded.
+func (s *aferoServer) ETag(slug, version, file string) (string, error) {
+	b, err := afero.ReadFile(s.fs, s.mkPath(slug, version, etagsFileName))
 	if os.IsNotExist(err) {
-		isGzipped = false
-		rc, err = s.fs.Open(filepath)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var etags map[string]string
+	if err = json.Unmarshal(b, &etags); err != nil {
+		return "", err
+	}
+	if sum := etags[path.Join("/", file)]; sum != "" {
+		return fmt.Sprintf(`"%s"`, sum), nil
+	}
+	return "", nil
+}
+
+func (s *aferoServer) ServeFileContent(w http.ResponseWriter, req *http.Request, slug, version, file string) error {
+	filepath := s.mkPath(slug, version, file)
+	etag, err := s.ETag(slug, version, file)
+	if err != nil {
+		return err
 	}
+	return s.serveFileContent(w, req, filepath, etag, slug, version, file)
+}
+func (s *aferoServer) serveFileContent(w http.ResponseWriter, req *http.Request, filepath, etag, slug, version, file string) error {
+	rc, codec, err := s.open(filepath)
 	if err != nil {
 		return err
 	}
 	defer rc.Close()
 
+	encoded := codec != "" && acceptEncoding(req, codec)
+	if codec != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	checkEtag := req.Header.Get("Cache-Control") == ""
+	if checkEtag && etag != "" {
+		// The precomputed ETag allows to answer without reading the file
+		if encoded {
+			etag = encodedETag(etag, codec)
+		}
+		if web_utils.CheckPreconditions(w, req, etag) {
+			return nil
+		}
+		w.Header().Set("Etag", etag)
+		checkEtag = false
+	}
+
+	if infos, errs := rc.Stat(); errs == nil {
+		setLastModified(w, infos.ModTime())
+	}
+
 	var content io.Reader
 	var size int64
-	if checkEtag := req.Header.Get("Cache-Control") == ""; checkEtag {
+	if checkEtag {
 		var b []byte
 		h := md5.New()
 		r := io.TeeReader(rc, h)
@@ -228,6 +767,9 @@ func (s *aferoServer) serveFileContent(w http.ResponseWriter, req *http.Request,
 			return err
 		}
 		etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(h.Sum(nil)))
+		if encoded {
+			etag = encodedETag(etag, codec)
+		}
 		if web_utils.CheckPreconditions(w, req, etag) {
 			return nil
 		}
@@ -246,18 +788,18 @@ func (s *aferoServer) serveFileContent(w http.ResponseWriter, req *http.Request,
 		content = rc
 	}
 
-	if isGzipped {
-		if acceptGzipEncoding(req) {
-			w.Header().Set("Content-Encoding", "gzip")
+	if codec != "" {
+		if encoded {
+			w.Header().Set("Content-Encoding", string(codec))
 		} else {
-			var gr *gzip.Reader
+			var dr io.ReadCloser
 			var b []byte
-			gr, err = gzip.NewReader(content)
+			dr, err = newObjectReadCloser(ioutil.NopCloser(content), codec, -1, slug, version, file)
 			if err != nil {
 				return err
 			}
-			defer gr.Close()
-			b, err = ioutil.ReadAll(gr)
+			defer dr.Close()
+			b, err = ioutil.ReadAll(dr)
 			if err != nil {
 				return err
 			}
@@ -281,9 +823,11 @@ func (s *aferoServer) FilesList(slug, version string) ([]string, error) {
 		if err != nil {
 			return err
 		}
-		if !infos.IsDir() {
+		if !infos.IsDir() && !isSidecarFile(infos.Name()) {
 			name := strings.TrimPrefix(path, rootPath)
-			name = strings.TrimSuffix(name, ".gz")
+			for _, codec := range storedCodecs {
+				name = strings.TrimSuffix(name, codecExtension(codec))
+			}
 			names = append(names, name)
 		}
 		return nil
@@ -297,8 +841,13 @@ func defaultMakePath(slug, version, file string) string {
 	return path.Join(basepath, filepath)
 }
 
-func acceptGzipEncoding(req *http.Request) bool {
-	return strings.Contains(req.Header.Get("Accept-Encoding"), "gzip")
+// acceptEncoding returns true if the client accepts the content compressed
+// with the codec. It is never the case for CodecDictionary.
+func acceptEncoding(req *http.Request, codec Codec) bool {
+	if codec == CodecDictionary {
+		return false
+	}
+	return strings.Contains(req.Header.Get("Accept-Encoding"), string(codec))
 }
 
 func containerName(appsType AppType) string {
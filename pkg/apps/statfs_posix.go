@@ -0,0 +1,26 @@
+// +build !windows
+
+package apps
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+// availableSpace returns the number of bytes available for an unprivileged
+// user on the filesystem of the given directory, or false if it can not be
+// known. If the directory does not exist yet, its closest existing parent is
+// used.
+func availableSpace(dir string) (int64, bool) {
+	for {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err == nil {
+			return int64(st.Bavail) * int64(st.Bsize), true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return 0, false
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,9 @@
+// +build windows
+
+package apps
+
+// availableSpace returns the number of bytes available on the filesystem of
+// the given directory. It is not implemented on Windows.
+func availableSpace(dir string) (int64, bool) {
+	return 0, false
+}
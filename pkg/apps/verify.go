@@ -0,0 +1,240 @@
+package apps
+
+import (
+	"crypto/md5" // #nosec
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/swift"
+)
+
+// logTamperedVersion logs a stored version of an application whose files do
+// not match what has been copied: it may have been modified to inject code
+// served to the users, so it is a security event.
+func logTamperedVersion(slug, version, mismatch string) {
+	logger.WithNamespace("apps").
+		WithField("security", true).
+		Errorf("Stored version %s/%s does not match its files (%s): it will be installed again",
+			slug, version, mismatch)
+}
+
+// checkStoredContent reads the stored content of a file of an application,
+// and compares it, once decompressed, with the md5sum and the size of the
+// original content recorded by the copier (a negative size is not checked).
+// It returns a description of the mismatch, or an empty string if they match.
+// The errors of the storage are returned as errors, not as mismatches.
+func checkStoredContent(rc io.ReadCloser, codec Codec, md5sum string, size int64) (string, error) {
+	src := &sourceReadCloser{rc: rc}
+	r, err := newDecompressReadCloser(src, codec, size)
+	if err != nil {
+		if src.err != nil && src.err != io.EOF {
+			return "", src.err
+		}
+		return fmt.Sprintf("cannot decompress: %s", err), nil
+	}
+	defer r.Close()
+	h := md5.New() // #nosec
+	n, err := io.Copy(h, r)
+	if err == ErrDecompressionLimitExceeded {
+		return "bigger than recorded", nil
+	}
+	if err != nil {
+		if err == src.err {
+			return "", err
+		}
+		return fmt.Sprintf("cannot decompress: %s", err), nil
+	}
+	if size >= 0 && n != size {
+		return fmt.Sprintf("size %d instead of %d", n, size), nil
+	}
+	if md5sum != "" && hex.EncodeToString(h.Sum(nil)) != md5sum {
+		return "md5sum mismatch", nil
+	}
+	return "", nil
+}
+
+// verify returns false, after logging it, if the stored version does not
+// match its files.
+func (f *aferoCopier) verify() (bool, error) {
+	mismatch, err := f.verifyStored()
+	if err != nil {
+		return false, err
+	}
+	if mismatch != "" {
+		logTamperedVersion(path.Base(path.Dir(f.appDir)), path.Base(f.appDir), mismatch)
+		return false, nil
+	}
+	return true, nil
+}
+
+// verifyStored checks the files of the stored version against the md5sums
+// and the metadata recorded on commit: each file must be there with the same
+// content, and no other file must have been added. It returns a description
+// of the first mismatch, or an empty string if the version is intact. A
+// version without the list of its files can't be checked, so it is a
+// mismatch too: the versions copied before the md5sums were recorded are
+// installed again once.
+func (f *aferoCopier) verifyStored() (string, error) {
+	b, err := afero.ReadFile(f.fs, path.Join(f.appDir, etagsFileName))
+	if os.IsNotExist(err) {
+		return "no list of the files", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var etags map[string]string
+	if err = json.Unmarshal(b, &etags); err != nil {
+		return "invalid list of the files", nil
+	}
+	meta, err := readMetadataFile(f.fs, path.Join(f.appDir, metadataFileName))
+	if err != nil {
+		return "invalid metadata of the files", nil
+	}
+
+	names := make([]string, 0, len(etags))
+	for name := range etags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stored := make(map[string]struct{}, len(names)+2)
+	stored[path.Join(f.appDir, etagsFileName)] = struct{}{}
+	stored[path.Join(f.appDir, metadataFileName)] = struct{}{}
+	for _, name := range names {
+		size := int64(-1)
+		var codec Codec
+		if m, ok := meta[name]; ok {
+			size = m.OriginalContentLength
+			codec = m.ContentEncoding
+		}
+		file, codec, err := f.openStored(name, codec)
+		if os.IsNotExist(err) {
+			return name + ": missing", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if codec != "" {
+			stored[path.Join(f.appDir, name)+codecExtension(codec)] = struct{}{}
+		} else {
+			stored[path.Join(f.appDir, name)] = struct{}{}
+		}
+		mismatch, err := checkStoredContent(file, codec, etags[name], size)
+		file.Close()
+		if err != nil || mismatch != "" {
+			if mismatch != "" {
+				mismatch = name + ": " + mismatch
+			}
+			return mismatch, err
+		}
+	}
+
+	var added string
+	err = afero.Walk(f.fs, f.appDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || added != "" {
+			return err
+		}
+		if _, ok := stored[name]; !ok {
+			added = strings.TrimPrefix(name, f.appDir) + ": unexpected file"
+		}
+		return nil
+	})
+	return added, err
+}
+
+// openStored opens the stored file of an application version, compressed
+// with the given codec, or looks for it like the afero file server when the
+// codec has not been recorded.
+func (f *aferoCopier) openStored(name string, codec Codec) (afero.File, Codec, error) {
+	fullpath := path.Join(f.appDir, name)
+	if codec != "" {
+		file, err := f.fs.Open(fullpath + codecExtension(codec))
+		return file, codec, err
+	}
+	return (&aferoServer{fs: f.fs}).open(fullpath)
+}
+
+// verify returns false, after logging it, if the stored version does not
+// match its objects.
+func (f *swiftCopier) verify() (bool, error) {
+	mismatch, err := f.verifyStored()
+	if err != nil {
+		return false, err
+	}
+	if mismatch != "" {
+		logTamperedVersion(f.slug, f.version, mismatch)
+		return false, nil
+	}
+	return true, nil
+}
+
+// verifyStored checks the objects of the stored version against the list
+// recorded in its marker, and against the md5sum and the size of their
+// original content recorded in their metadata, and swift checks their stored
+// content against their etag. It returns a description of the first mismatch,
+// or an empty string if the version is intact. As for the afero copier, a
+// version without the list of its objects is a mismatch.
+func (f *swiftCopier) verifyStored() (string, error) {
+	b, err := f.c.ObjectGetBytes(f.container, f.appObj)
+	if err != nil {
+		return "", err
+	}
+	var listed []string
+	if len(b) == 0 || json.Unmarshal(b, &listed) != nil {
+		return "no list of the objects", nil
+	}
+	objNames, err := f.c.ObjectNamesAll(f.container, &swift.ObjectsOpts{
+		Prefix: f.naming.Prefix(f.slug, f.version),
+	})
+	if err != nil {
+		return "", err
+	}
+	expected := make(map[string]struct{}, len(listed))
+	for _, objName := range listed {
+		expected[objName] = struct{}{}
+	}
+	for _, objName := range objNames {
+		if _, ok := expected[objName]; !ok {
+			return objName + ": unexpected object", nil
+		}
+		delete(expected, objName)
+	}
+	for objName := range expected {
+		return objName + ": missing", nil
+	}
+	for _, objName := range objNames {
+		obj, h, err := f.c.ObjectOpen(f.container, objName, true, nil)
+		if err == swift.ObjectNotFound {
+			return objName + ": missing", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		objMeta := h.ObjectMetadata()
+		md5sum := objMeta["original-md5"]
+		size, errp := strconv.ParseInt(objMeta["original-content-length"], 10, 64)
+		if errp != nil {
+			size = -1
+		}
+		mismatch, err := checkStoredContent(obj, Codec(objMeta["content-encoding"]), md5sum, size)
+		obj.Close()
+		if err == swift.ObjectCorrupted {
+			mismatch, err = "etag mismatch", nil
+		}
+		if err != nil || mismatch != "" {
+			if mismatch != "" {
+				mismatch = objName + ": " + mismatch
+			}
+			return mismatch, err
+		}
+	}
+	return "", nil
+}
@@ -155,6 +155,121 @@ func (v *Vault) CredentialsDecryptorKey() *keymgmt.NACLKey {
 type Fs struct {
 	Auth *url.Userinfo
 	URL  *url.URL
+
+	// AppsCodec is the compression used to store the text files of the
+	// applications: "gzip" (default), "br" or "x-cozy-dict".
+	AppsCodec string
+	// AppsDictionaries are the paths of the preset dictionaries for the
+	// compression of the files of the applications with the "x-cozy-dict"
+	// codec. The first one is used for the new files.
+	AppsDictionaries []string
+	// AppsObjectNaming is how the files of the applications are named in
+	// swift: "nested" (default) or "hashed".
+	AppsObjectNaming string
+	// AppsMaxDecompressedSize is the maximal size in bytes of the decompressed
+	// content of a file of an application, when its size is not known.
+	AppsMaxDecompressedSize int64
+	// AppsTmpTTL is the expiration of the temporary objects written in swift
+	// during the installation of an application.
+	AppsTmpTTL time.Duration
+	// AppsMaxSize is the maximal total size in bytes of the files of a version
+	// of an application (no limit if zero), and AppsMaxSizes overrides it for
+	// some applications, by slug.
+	AppsMaxSize  int64
+	AppsMaxSizes map[string]int64
+	// AppsSniffLen is the number of bytes read at the beginning of a file of
+	// an application to detect its content-type, when its extension is not
+	// known (512 if zero).
+	AppsSniffLen int64
+	// AppsFallbackContentType is the content-type of the files of the
+	// applications that is not detected ("application/octet-stream" if
+	// empty).
+	AppsFallbackContentType string
+	// AppsOnExists is what the copiers do when the version of an application
+	// to install is already stored: "skip" (default), "overwrite" or "error".
+	AppsOnExists string
+	// AppsVerifyStored enables the check of all the files of the version of
+	// an application already stored when it is installed again: a version
+	// that has been modified is installed again.
+	AppsVerifyStored bool
+
+	// MinFreeInodes is the number of free inodes under which the bulk
+	// creations of files are refused, and a warning is logged, for a file://
+	// VFS (10000 if zero).
+	MinFreeInodes int64
+	// MaintenanceAbortUploads makes the uploads in progress fail when the
+	// maintenance mode of the VFS is enabled, instead of letting them finish.
+	MaintenanceAbortUploads bool
+
+	// IndexRetryAttempts and IndexRetryDelay define how the index operations
+	// of the VFS are retried on transient couchdb errors.
+	IndexRetryAttempts int
+	IndexRetryDelay    time.Duration
+
+	// ReadFileMaxSize is the maximal size in bytes of a file read in memory
+	// with vfs.ReadFile.
+	ReadFileMaxSize int64
+
+	// CopyBufferSize is the size in bytes of the buffers, shared between the
+	// downloads, used to copy the content of the files to the responses.
+	CopyBufferSize int
+
+	// MetadataExtractionBudget is the number of bytes at the beginning of an
+	// uploaded file that are given to the metadata extractor (no limit if
+	// zero).
+	MetadataExtractionBudget int64
+
+	// MetadataClasses is the list of the classes of files (image, audio, ...)
+	// for which the metadata are extracted (all of them if empty).
+	MetadataClasses []string
+
+	// MaxOpenFiles is the maximal number of files opened for reading by the
+	// afero VFS (no limit if zero), OpenFilesWait how long to wait for a
+	// handle when this limit is reached, and IdleOpenFiles the number of
+	// handles kept open after their closing to be reused.
+	MaxOpenFiles  int
+	OpenFilesWait time.Duration
+	IdleOpenFiles int
+
+	// TmpDir is the directory, in the storage of each instance of the afero
+	// VFS, where the temporary files and the backups of the overwrites are
+	// written. It is the root of the storage if empty.
+	TmpDir string
+
+	// Layout is the way the contents of the files are stored by the afero VFS
+	// for the new instances: "path" (default) mirrors the tree of the
+	// directories, and "flat" stores them under the identifiers of the files.
+	// The existing instances keep their layout.
+	Layout string
+
+	// FilenamePolicy is the set of rules checked on the names of the new
+	// files and directories: "posix" (default) only forbids the characters
+	// that can't be used in a path, and "windows" also forbids the names that
+	// can't be synchronized on Windows. ReservedFilenames replaces the list of
+	// the reserved names (CON, PRN, AUX, NUL, COM1, ... for "windows").
+	FilenamePolicy    string
+	ReservedFilenames []string
+
+	// UndoRetention is how long the old content of an overwritten file is
+	// kept by the afero VFS to be restored with UndoOverwrite (the old content
+	// is removed immediately if zero), and UndoMaxSize the maximal total size
+	// of these old contents for an instance (no limit if zero).
+	UndoRetention time.Duration
+	UndoMaxSize   int64
+
+	// Tiers are the additional storage backends for the files, by name.
+	Tiers map[string]FsTier
+}
+
+// FsTier is an additional storage backend for the files of the instances,
+// with the criteria for choosing it for a new file: its size is at least
+// MinSize (when greater than zero), or it is in one of the directories Dirs,
+// or it has one of the classes Classes.
+type FsTier struct {
+	URL     *url.URL
+	MinSize int64
+	Dirs    []string
+	Classes []string
 }
 
 // CouchDB contains the configuration values of the database
@@ -197,6 +312,41 @@ type Notifications struct {
 	IOSCertificatePassword string
 	IOSKeyID               string
 	IOSTeamID              string
+
+	// AggregationWindow is the duration during which the collapsible
+	// notifications for a device are aggregated in a single one (disabled if
+	// zero), and AggregationSummary the format of its summary text, with the
+	// number of notifications.
+	AggregationWindow  time.Duration
+	AggregationSummary string
+
+	// DedupWindow is the duration during which the notifications with the
+	// same dedup key, from any source, are sent only once to a device
+	// (disabled if zero).
+	DedupWindow time.Duration
+
+	// RetryJitter is the part of the delay before retrying a push that is
+	// randomized, between 0 (no jitter) and 1 (full jitter).
+	RetryJitter float64
+
+	// SendTimeout is the maximal duration of the sending of a notification to
+	// a device, while the timeout of the push job bounds the sending to all
+	// the devices.
+	SendTimeout time.Duration
+
+	// APNSConcurrency and FCMConcurrency are the maximal numbers of
+	// notifications sent concurrently to each provider, by all the push jobs
+	// of the process (16 if zero).
+	APNSConcurrency int
+	FCMConcurrency  int
+
+	// StripData enables the removal of keys from the custom data of the
+	// notifications that are too large for the payload of the providers. The
+	// keys of DataStripOrder are removed first, in this order, then the other
+	// ones from the biggest, but never the keys of DataEssentialKeys.
+	StripData         bool
+	DataEssentialKeys []string
+	DataStripOrder    []string
 }
 
 // Worker contains the configuration fields for a specific worker type.
@@ -379,6 +529,7 @@ func Setup(cfgFile string) (err error) {
 func applyDefaults(v *viper.Viper) {
 	v.SetDefault("password_reset_interval", defaultPasswordResetInterval)
 	v.SetDefault("jobs.imagemagick_convert_cmd", "convert")
+	v.SetDefault("notifications.retry_jitter", 1.0)
 }
 
 func envMap() map[string]string {
@@ -417,11 +568,29 @@ func UseViper(v *viper.Viper) error {
 		couchURL.Path = "/"
 	}
 
+	// The old contents are kept in the directory of the temporary files, that
+	// must not be the root of the storage, shared with the files of the user
+	if v.GetDuration("fs.undo_retention") > 0 && v.GetString("fs.tmp_dir") == "" {
+		return fmt.Errorf("The fs.tmp_dir should be set to keep the old contents of the files with fs.undo_retention")
+	}
+
+	tiers, err := makeTiers(v, fsURL)
+	if err != nil {
+		return err
+	}
+
 	regs, err := makeRegistries(v)
 	if err != nil {
 		return err
 	}
 
+	// The summary is formatted with the number of aggregated notifications
+	if summary := v.GetString("notifications.aggregation_summary"); summary != "" {
+		if strings.Contains(fmt.Sprintf(summary, 1), "%!") {
+			return fmt.Errorf("The aggregation summary should have a single %%d for the number of notifications, was: %q", summary)
+		}
+	}
+
 	var subdomains SubdomainType
 	if subs := v.GetString("subdomains"); subs != "" {
 		switch subs {
@@ -579,7 +748,46 @@ func UseViper(v *viper.Viper) error {
 		CredentialsDecryptorKey: v.GetString("vault.credentials_decryptor_key"),
 
 		Fs: Fs{
-			URL: fsURL,
+			URL:              fsURL,
+			AppsCodec:        v.GetString("fs.apps_codec"),
+			AppsDictionaries: v.GetStringSlice("fs.apps_dictionaries"),
+			AppsObjectNaming: v.GetString("fs.apps_object_naming"),
+
+			AppsMaxDecompressedSize: int64(v.GetInt("fs.apps_max_decompressed_size")),
+			AppsTmpTTL:              v.GetDuration("fs.apps_tmp_ttl"),
+			AppsMaxSize:             int64(v.GetInt("fs.apps_max_size")),
+			AppsMaxSizes:            makeAppsMaxSizes(v),
+			AppsSniffLen:            int64(v.GetInt("fs.apps_sniff_len")),
+			AppsFallbackContentType: v.GetString("fs.apps_fallback_content_type"),
+			AppsOnExists:            v.GetString("fs.apps_on_exists"),
+			AppsVerifyStored:        v.GetBool("fs.apps_verify_stored"),
+
+			MaintenanceAbortUploads: v.GetBool("fs.maintenance_abort_uploads"),
+			MinFreeInodes:           int64(v.GetInt("fs.min_free_inodes")),
+
+			IndexRetryAttempts: v.GetInt("fs.index_retry_attempts"),
+			IndexRetryDelay:    v.GetDuration("fs.index_retry_delay"),
+
+			ReadFileMaxSize: int64(v.GetInt("fs.read_file_max_size")),
+			CopyBufferSize:  v.GetInt("fs.copy_buffer_size"),
+
+			MetadataExtractionBudget: int64(v.GetInt("fs.metadata_extraction_budget")),
+			MetadataClasses:          v.GetStringSlice("fs.metadata_classes"),
+
+			MaxOpenFiles:  v.GetInt("fs.max_open_files"),
+			OpenFilesWait: v.GetDuration("fs.open_files_wait"),
+			IdleOpenFiles: v.GetInt("fs.idle_open_files"),
+
+			TmpDir: v.GetString("fs.tmp_dir"),
+			Layout: v.GetString("fs.layout"),
+
+			FilenamePolicy:    v.GetString("fs.filename_policy"),
+			ReservedFilenames: v.GetStringSlice("fs.reserved_filenames"),
+
+			UndoRetention: v.GetDuration("fs.undo_retention"),
+			UndoMaxSize:   int64(v.GetInt("fs.undo_max_size")),
+
+			Tiers: tiers,
 		},
 		CouchDB: CouchDB{
 			Auth: couchAuth,
@@ -602,6 +810,20 @@ func UseViper(v *viper.Viper) error {
 			IOSCertificatePassword: v.GetString("notifications.ios_certificate_password"),
 			IOSKeyID:               v.GetString("notifications.ios_key_id"),
 			IOSTeamID:              v.GetString("notifications.ios_team_id"),
+
+			AggregationWindow:  v.GetDuration("notifications.aggregation_window"),
+			AggregationSummary: v.GetString("notifications.aggregation_summary"),
+			DedupWindow:        v.GetDuration("notifications.dedup_window"),
+
+			RetryJitter: v.GetFloat64("notifications.retry_jitter"),
+			SendTimeout: v.GetDuration("notifications.send_timeout"),
+
+			APNSConcurrency: v.GetInt("notifications.apns_concurrency"),
+			FCMConcurrency:  v.GetInt("notifications.fcm_concurrency"),
+
+			StripData:         v.GetBool("notifications.strip_data"),
+			DataEssentialKeys: v.GetStringSlice("notifications.data_essential_keys"),
+			DataStripOrder:    v.GetStringSlice("notifications.data_strip_order"),
 		},
 		Lock:                        lockRedis,
 		SessionStorage:              sessionsRedis,
@@ -668,6 +890,57 @@ func MakeVault(c *Config) error {
 	return nil
 }
 
+// makeAppsMaxSizes reads the maximal sizes of the versions of the
+// applications that override the default one, by slug.
+func makeAppsMaxSizes(v *viper.Viper) map[string]int64 {
+	slugs := v.GetStringMap("fs.apps_max_sizes")
+	if len(slugs) == 0 {
+		return nil
+	}
+	sizes := make(map[string]int64, len(slugs))
+	for slug := range slugs {
+		sizes[slug] = int64(v.GetInt("fs.apps_max_sizes." + slug))
+	}
+	return sizes
+}
+
+// makeTiers reads the additional storage backends for the files. Only swift
+// tiers can be added to a local filesystem for now.
+func makeTiers(v *viper.Viper, fsURL *url.URL) (map[string]FsTier, error) {
+	names := v.GetStringMap("fs.tiers")
+	if len(names) == 0 {
+		return nil, nil
+	}
+	if fsURL.Scheme != SchemeFile && fsURL.Scheme != SchemeMem {
+		return nil, fmt.Errorf("Storage tiers are only supported with a local filesystem, not %s", fsURL.Scheme)
+	}
+	tiers := make(map[string]FsTier)
+	for name := range names {
+		if strings.Contains(name, "/") {
+			return nil, fmt.Errorf("The name of the storage tier %q cannot contain a slash", name)
+		}
+		sub := v.Sub("fs.tiers." + name)
+		if sub == nil {
+			return nil, fmt.Errorf(
+				"Bad format in the fs.tiers section of the configuration file for %q", name)
+		}
+		u, err := url.Parse(sub.GetString("url"))
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != SchemeSwift {
+			return nil, fmt.Errorf("The storage tier %q should be on swift, not %q", name, u.Scheme)
+		}
+		tiers[name] = FsTier{
+			URL:     u,
+			MinSize: int64(sub.GetInt("min_size")),
+			Dirs:    sub.GetStringSlice("dirs"),
+			Classes: sub.GetStringSlice("classes"),
+		}
+	}
+	return tiers, nil
+}
+
 func makeRegistries(v *viper.Viper) (map[string][]*url.URL, error) {
 	regs := make(map[string][]*url.URL)
 
@@ -9,10 +9,35 @@ import (
 )
 
 var swiftConn *swift.Connection
+var swiftTierConns map[string]*swift.Connection
 
 // InitSwiftConnection initialize the global swift handler connection. This is
 // not a thread-safe method.
 func InitSwiftConnection(swiftURL *url.URL) error {
+	conn, err := newSwiftConnection(swiftURL)
+	if err != nil {
+		return err
+	}
+	swiftConn = conn
+	return nil
+}
+
+// InitSwiftTierConnections initializes a swift connection for each storage
+// tier, from its own url. This is not a thread-safe method.
+func InitSwiftTierConnections(tiers map[string]FsTier) error {
+	conns := make(map[string]*swift.Connection, len(tiers))
+	for name, tier := range tiers {
+		conn, err := newSwiftConnection(tier.URL)
+		if err != nil {
+			return err
+		}
+		conns[name] = conn
+	}
+	swiftTierConns = conns
+	return nil
+}
+
+func newSwiftConnection(swiftURL *url.URL) (*swift.Connection, error) {
 	q := swiftURL.Query()
 
 	var authURL *url.URL
@@ -39,7 +64,7 @@ func InitSwiftConnection(swiftURL *url.URL) error {
 		password = q.Get("Token")
 	}
 
-	swiftConn = &swift.Connection{
+	conn := &swift.Connection{
 		UserName:       username,
 		ApiKey:         password,
 		AuthUrl:        authURL.String(),
@@ -54,13 +79,13 @@ func InitSwiftConnection(swiftURL *url.URL) error {
 		Timeout:        300 * time.Second,
 	}
 
-	if err = swiftConn.Authenticate(); err != nil {
+	if err = conn.Authenticate(); err != nil {
 		log.Errorf("Authentication failed with the OpenStack Swift server on %s",
-			swiftConn.AuthUrl)
-		return err
+			conn.AuthUrl)
+		return nil, err
 	}
-	log.Infof("Successfully authenticated with server %s", swiftConn.AuthUrl)
-	return nil
+	log.Infof("Successfully authenticated with server %s", conn.AuthUrl)
+	return conn, nil
 }
 
 // GetSwiftConnection returns a swift.Connection pointer created from the
@@ -71,3 +96,13 @@ func GetSwiftConnection() *swift.Connection {
 	}
 	return swiftConn
 }
+
+// GetSwiftTierConnection returns the swift connection of the storage tier with
+// the given name.
+func GetSwiftTierConnection(name string) *swift.Connection {
+	conn, ok := swiftTierConns[name]
+	if !ok {
+		panic(fmt.Sprintf("Called GetSwiftTierConnection(%q) before InitSwiftTierConnections()", name))
+	}
+	return conn
+}
@@ -22,6 +22,8 @@ const (
 	Doctypes = "io.cozy.doctypes"
 	// Files doc type for type for files and directories
 	Files = "io.cozy.files"
+	// FilesTombstones doc type for the tombstones of the destroyed files
+	FilesTombstones = "io.cozy.files.tombstones"
 	// PhotosAlbums doc type for photos albums
 	PhotosAlbums = "io.cozy.photos.albums"
 	// Intents doc type for intents persisted in couchdb
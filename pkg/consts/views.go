@@ -7,7 +7,7 @@ import (
 
 // IndexViewsVersion is the version of current definition of views & indexes.
 // This number should be incremented when this file changes.
-const IndexViewsVersion int = 18
+const IndexViewsVersion int = 20
 
 // globalIndexes is the index list required on the global databases to run
 // properly.
@@ -56,6 +56,8 @@ var Indexes = []*mango.Index{
 	mango.IndexOnFields(Files, "dir-children", []string{"dir_id", "_id"}),
 	// Used to lookup a directory given its path
 	mango.IndexOnFields(Files, "dir-by-path", []string{"path"}),
+	// Used to lookup the hidden documents of the files being uploaded
+	mango.IndexOnFields(Files, "file-by-trashed", []string{"trashed", "type"}),
 
 	// Used to lookup a queued and running jobs
 	mango.IndexOnFields(Jobs, "by-worker-and-state", []string{"worker", "state"}),
@@ -132,6 +134,70 @@ function(doc) {
 	Reduce: "_count",
 }
 
+// FilesByTagView is the view used for fetching the files with a given tag
+var FilesByTagView = &couchdb.View{
+	Name:    "files-by-tag",
+	Doctype: Files,
+	Map: `
+function(doc) {
+  if (doc.type === 'file' && isArray(doc.tags)) {
+    for (var i = 0; i < doc.tags.length; i++) {
+      emit(doc.tags[i]);
+    }
+  }
+}`,
+	Reduce: "_count",
+}
+
+// FilesByUpdatedAtView is the view used for fetching the files changed since a
+// given time. The key is the updated_at date as a timestamp in milliseconds.
+var FilesByUpdatedAtView = &couchdb.View{
+	Name:    "files-by-updated-at",
+	Doctype: Files,
+	Map: `
+function(doc) {
+  if (doc.type === 'file') {
+    var t = Date.parse(doc.updated_at);
+    if (!isNaN(t)) {
+      emit(t);
+    }
+  }
+}`,
+}
+
+// TombstonesByDeletedAtView is the view used for fetching the files destroyed
+// since a given time. The key is the deleted_at date as a timestamp in
+// milliseconds.
+var TombstonesByDeletedAtView = &couchdb.View{
+	Name:    "tombstones-by-deleted-at",
+	Doctype: FilesTombstones,
+	Map: `
+function(doc) {
+  var t = Date.parse(doc.deleted_at);
+  if (!isNaN(t)) {
+    emit(t);
+  }
+}`,
+}
+
+// FilesLastModifiedByParentView is the view used for computing the last
+// modification of the children of a directory. The key is the dir_id and the
+// value the updated_at date as a timestamp in milliseconds.
+var FilesLastModifiedByParentView = &couchdb.View{
+	Name:    "last-modified-by-parent",
+	Doctype: Files,
+	Map: `
+function(doc) {
+  if (doc.dir_id) {
+    var t = Date.parse(doc.updated_at);
+    if (!isNaN(t)) {
+      emit(doc.dir_id, t);
+    }
+  }
+}`,
+	Reduce: "_stats",
+}
+
 // PermissionsShareByCView is the view for fetching the permissions associated
 // to a document via a token code.
 var PermissionsShareByCView = &couchdb.View{
@@ -235,6 +301,10 @@ var Views = []*couchdb.View{
 	FilesReferencedByView,
 	ReferencedBySortedByDatetimeView,
 	FilesByParentView,
+	FilesByTagView,
+	FilesByUpdatedAtView,
+	TombstonesByDeletedAtView,
+	FilesLastModifiedByParentView,
 	PermissionsShareByCView,
 	PermissionsShareByDocView,
 	PermissionsByDoctype,
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -31,6 +32,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfstiered"
 	"github.com/cozy/cozy-stack/pkg/ws"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
@@ -106,6 +108,11 @@ type Instance struct {
 	// Swift cluster number, indexed from 1. If not zero, it indicates we're using swift layout 2, see pkg/vfs/swift.
 	SwiftCluster int `json:"swift_cluster,omitempty"`
 
+	// AferoLayout is the layout of the storage of the files with the afero VFS,
+	// see pkg/vfs/vfsafero. The instances created before the layouts have the
+	// path layout.
+	AferoLayout string `json:"afero_layout,omitempty"`
+
 	// PassphraseHash is a hash of the user's passphrase. For more informations,
 	// see crypto.GenerateFromPassphrase.
 	PassphraseHash       []byte     `json:"passphrase_hash,omitempty"`
@@ -243,7 +250,17 @@ func (i *Instance) makeVFS() error {
 	var err error
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
-		i.vfs, err = vfsafero.New(i, index, disk, mutex, fsURL, i.DirName())
+		i.vfs, err = vfsafero.New(i, index, disk, mutex, fsURL, i.DirName(),
+			vfsafero.Layout(i.AferoLayout))
+		if v, ok := i.vfs.(vfs.WriteVerifier); ok && err == nil {
+			v.SetWriteVerification(i.verifyWrites())
+		}
+		if n, ok := i.vfs.(vfs.NameNormalizer); ok && err == nil {
+			n.SetNameNormalization(i.normalizeNames())
+		}
+		if tiers := config.GetConfig().Fs.Tiers; len(tiers) > 0 && err == nil {
+			i.vfs, err = i.makeTieredVFS(i.vfs, tiers, index, disk, mutex)
+		}
 	case config.SchemeSwift:
 		if i.SwiftCluster > 0 {
 			i.vfs, err = vfsswift.NewV2(i, index, disk, mutex)
@@ -256,10 +273,75 @@ func (i *Instance) makeVFS() error {
 	return err
 }
 
+// makeTieredVFS returns a VFS that stores the files in the primary VFS, or in
+// one of the configured tiers. Each tier is stored on swift with its own
+// connection and containers, with the layout v2 where the objects are named
+// after the identifiers of the files.
+func (i *Instance) makeTieredVFS(primary vfs.VFS, conf map[string]config.FsTier, index vfs.Indexer, disk vfs.DiskThresholder, mutex lock.ErrorRWLocker) (vfs.VFS, error) {
+	names := make([]string, 0, len(conf))
+	for name := range conf {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tiers := make(map[string]vfs.VFS, len(conf))
+	rules := make([]vfstiered.Rule, 0, len(conf))
+	for _, name := range names {
+		conn := config.GetSwiftTierConnection(name)
+		tier, err := vfsswift.NewV2Tier(i, index, disk, mutex, conn, name)
+		if err != nil {
+			return nil, err
+		}
+		tiers[name] = tier
+		rules = append(rules, vfstiered.Rule{
+			Tier:    name,
+			MinSize: conf[name].MinSize,
+			Dirs:    conf[name].Dirs,
+			Classes: conf[name].Classes,
+		})
+	}
+	return vfstiered.New(primary, tiers, rules)
+}
+
+// verifyWrites returns true if the context of the instance enables the
+// verification of the files content after they are written (see
+// vfs.WriteVerifier).
+func (i *Instance) verifyWrites() bool {
+	context, err := i.SettingsContext()
+	if err != nil {
+		return false
+	}
+	enabled, _ := context["verify_after_write"].(bool)
+	return enabled
+}
+
+// normalizeNames returns true if the context of the instance enables the
+// normalization of the names of the files in the NFC form (see
+// vfs.NameNormalizer).
+func (i *Instance) normalizeNames() bool {
+	context, err := i.SettingsContext()
+	if err != nil {
+		return false
+	}
+	enabled, _ := context["normalize_names"].(bool)
+	return enabled
+}
+
 // AppsCopier returns the application copier associated with the specified
 // application type
 func (i *Instance) AppsCopier(appsType apps.AppType) apps.Copier {
 	fsURL := config.FsURL()
+	opts := &apps.CopierOptions{
+		Codec:               apps.Codec(config.GetConfig().Fs.AppsCodec),
+		Naming:              appsObjectNaming(),
+		Dictionary:          apps.DefaultDictionary(),
+		TmpTTL:              config.GetConfig().Fs.AppsTmpTTL,
+		MaxSize:             config.GetConfig().Fs.AppsMaxSize,
+		MaxSizes:            config.GetConfig().Fs.AppsMaxSizes,
+		SniffLen:            config.GetConfig().Fs.AppsSniffLen,
+		OnExists:            apps.ExistsPolicy(config.GetConfig().Fs.AppsOnExists),
+		VerifyStored:        config.GetConfig().Fs.AppsVerifyStored,
+		FallbackContentType: config.GetConfig().Fs.AppsFallbackContentType,
+	}
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
 		var baseDirName string
@@ -271,14 +353,20 @@ func (i *Instance) AppsCopier(appsType apps.AppType) apps.Copier {
 		}
 		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
 			path.Join(fsURL.Path, i.DirName(), baseDirName))
-		return apps.NewAferoCopier(baseFS)
+		return apps.NewAferoCopier(baseFS, opts)
 	case config.SchemeSwift:
-		return apps.NewSwiftCopier(config.GetSwiftConnection(), appsType)
+		return apps.NewSwiftCopier(config.GetSwiftConnection(), appsType, opts)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
 }
 
+// appsObjectNaming returns how the files of the applications are named in
+// swift, as defined in the configuration.
+func appsObjectNaming() apps.ObjectNaming {
+	return apps.ObjectNamingByName(config.GetConfig().Fs.AppsObjectNaming)
+}
+
 // AppsFileServer returns the web-application file server associated to this
 // instance.
 func (i *Instance) AppsFileServer() apps.FileServer {
@@ -289,7 +377,7 @@ func (i *Instance) AppsFileServer() apps.FileServer {
 			path.Join(fsURL.Path, i.DirName(), vfs.WebappsDirName))
 		return apps.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift:
-		return apps.NewSwiftFileServer(config.GetSwiftConnection(), apps.Webapp)
+		return apps.NewSwiftFileServer(config.GetSwiftConnection(), apps.Webapp, appsObjectNaming())
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -305,7 +393,7 @@ func (i *Instance) KonnectorsFileServer() apps.FileServer {
 			path.Join(fsURL.Path, i.DirName(), vfs.KonnectorsDirName))
 		return apps.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift:
-		return apps.NewSwiftFileServer(config.GetSwiftConnection(), apps.Konnector)
+		return apps.NewSwiftFileServer(config.GetSwiftConnection(), apps.Konnector, appsObjectNaming())
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -666,6 +754,7 @@ func CreateWithoutHooks(opts *Options) (*Instance, error) {
 	} else {
 		i.SwiftCluster = opts.SwiftCluster
 	}
+	i.AferoLayout = config.GetConfig().Fs.Layout
 
 	if opts.AuthMode != "" {
 		var authMode AuthMode
@@ -79,6 +79,9 @@ type (
 		FinishedAt  time.Time   `json:"finished_at"`
 		Error       string      `json:"error,omitempty"`
 		ForwardLogs bool        `json:"forward_logs,omitempty"`
+		// Result is set by the workers that report the outcome of their job
+		// (see WorkerContext.SetResult).
+		Result json.RawMessage `json:"result,omitempty"`
 	}
 
 	// JobRequest struct is used to represent a new job request.
@@ -141,6 +144,10 @@ func (j *Job) Clone() couchdb.Doc {
 		j.Event = make([]byte, len(tmp))
 		copy(j.Event[:], tmp)
 	}
+	if j.Result != nil {
+		cloned.Result = make(json.RawMessage, len(j.Result))
+		copy(cloned.Result, j.Result)
+	}
 	return &cloned
 }
 
@@ -2,6 +2,7 @@ package jobs
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -197,6 +198,17 @@ func (c *WorkerContext) TriggerID() (string, bool) {
 	return triggerID, triggerID != ""
 }
 
+// SetResult saves the outcome of the job in its document, with the state of
+// the job when it is acked.
+func (c *WorkerContext) SetResult(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.job.Result = b
+	return nil
+}
+
 // Cookie returns the cookie associated with the worker context.
 func (c *WorkerContext) Cookie() interface{} {
 	return c.cookie
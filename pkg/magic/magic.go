@@ -170,8 +170,14 @@ func MIMEType(hdr []byte) string {
 // that's the concatenation of the bytes sniffed and the remaining
 // reader.
 func MIMETypeFromReader(r io.Reader) (mime string, reader io.Reader) {
+	return MIMETypeFromReaderN(r, 1024)
+}
+
+// MIMETypeFromReaderN is like MIMETypeFromReader, but it reads at most n
+// bytes of the reader to sniff its type.
+func MIMETypeFromReaderN(r io.Reader, n int64) (mime string, reader io.Reader) {
 	var buf bytes.Buffer
-	_, err := io.Copy(&buf, io.LimitReader(r, 1024))
+	_, err := io.Copy(&buf, io.LimitReader(r, n))
 	mime = MIMEType(buf.Bytes())
 	if err != nil {
 		return mime, io.MultiReader(&buf, errReader{err})
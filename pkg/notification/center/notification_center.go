@@ -188,6 +188,10 @@ func makePush(inst *instance.Instance, p *notification.Properties, n *notificati
 				}
 			}
 		case "mail":
+			// A mail can not be recalled: there is nothing to cancel.
+			if n.Cancel {
+				continue
+			}
 			if err := sendMail(inst, p, n); err != nil {
 				errm = multierror.Append(errm, err)
 			}
@@ -222,11 +226,20 @@ func sendPush(inst *instance.Instance, p *notification.Properties, n *notificati
 		NotificationID: n.ID(),
 		Source:         n.Source(),
 		Title:          n.Title,
+		Subtitle:       n.Subtitle,
 		Message:        n.Message,
 		Priority:       n.Priority,
 		Sound:          n.Sound,
+		SoundName:      n.SoundName,
+		SoundCritical:  n.SoundCritical,
+		SoundVolume:    n.SoundVolume,
 		Data:           n.Data,
 		Collapsible:    p.Collapsible,
+		CollapseKey:    n.CollapseKey,
+		DedupKey:       n.DedupKey,
+		Slug:           n.Slug,
+		DeepLink:       n.DeepLink,
+		Cancel:         n.Cancel,
 	}
 	msg, err := jobs.NewMessage(&push)
 	if err != nil {
@@ -48,12 +48,36 @@ type Notification struct {
 	LastSent  time.Time `json:"last_sent"`
 
 	Title    string                 `json:"title,omitempty"`
+	Subtitle string                 `json:"subtitle,omitempty"`
 	Message  string                 `json:"message,omitempty"`
 	Priority string                 `json:"priority,omitempty"`
 	Sound    string                 `json:"sound,omitempty"`
 	State    interface{}            `json:"state,omitempty"`
 	Data     map[string]interface{} `json:"data,omitempty"`
 
+	// CollapseKey is the logical subject of the notification: the mobile
+	// notifications with the same collapse key replace each other.
+	CollapseKey string `json:"collapse_key,omitempty"`
+
+	// SoundName, SoundCritical and SoundVolume describe a critical alert on
+	// iOS, played even in Do Not Disturb mode.
+	SoundName     string  `json:"sound_name,omitempty"`
+	SoundCritical bool    `json:"sound_critical,omitempty"`
+	SoundVolume   float64 `json:"sound_volume,omitempty"`
+
+	// DedupKey identifies the event of the notification, across the sources:
+	// a mobile notification with the same dedup key as one recently sent is
+	// suppressed.
+	DedupKey string `json:"dedup_key,omitempty"`
+
+	// DeepLink is the screen of the application to open when the user taps
+	// on the mobile notification.
+	DeepLink string `json:"deep_link,omitempty"`
+
+	// Cancel is true for a notification that replaces the previous one with
+	// the same collapse key on mobile, to dismiss it or show its final state.
+	Cancel bool `json:"cancel,omitempty"`
+
 	PreferredChannels []string `json:"preferred_channels,omitempty"`
 
 	// XXX retro-compatible fields for sending rich mail
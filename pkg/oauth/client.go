@@ -26,6 +26,15 @@ const (
 	PlatformAPNS = "apns"
 )
 
+const (
+	// EnvironmentSandbox is the APNS environment of the development and
+	// TestFlight builds of the iOS applications
+	EnvironmentSandbox = "sandbox"
+	// EnvironmentProduction is the APNS environment of the App Store builds
+	// of the iOS applications
+	EnvironmentProduction = "production"
+)
+
 // ClientSecretLen is the number of random bytes used for generating the client secret
 const ClientSecretLen = 24 // #nosec
 
@@ -67,6 +76,7 @@ type Client struct {
 
 	NotificationPlatform    string `json:"notification_platform,omitempty"`     // Declared by the client (optional)
 	NotificationDeviceToken string `json:"notification_device_token,omitempty"` // Declared by the client (optional)
+	NotificationEnvironment string `json:"notification_environment,omitempty"`  // Declared by the client (optional)
 
 	// XXX omitempty does not work for time.Time, thus the interface{} type
 	SynchronizedAt interface{} `json:"synchronized_at,omitempty"` // Date of the last synchronization, updated by /settings/synchronized
@@ -210,6 +220,16 @@ func (c *Client) checkMandatoryFields(i *instance.Instance) *ClientRegistrationE
 			Error: "invalid_client_metadata",
 		}
 	}
+	c.NotificationEnvironment = strings.ToLower(c.NotificationEnvironment)
+	switch c.NotificationEnvironment {
+	case "", EnvironmentSandbox, EnvironmentProduction:
+	default:
+		return &ClientRegistrationError{
+			Code:        http.StatusBadRequest,
+			Error:       "invalid_client_metadata",
+			Description: "notification_environment is invalid",
+		}
+	}
 	return nil
 }
 
@@ -340,6 +360,9 @@ func (c *Client) Update(i *instance.Instance, old *Client) *ClientRegistrationEr
 	if c.NotificationDeviceToken == "" {
 		c.NotificationDeviceToken = old.NotificationDeviceToken
 	}
+	if c.NotificationEnvironment == "" {
+		c.NotificationEnvironment = old.NotificationEnvironment
+	}
 
 	if err := couchdb.UpdateDoc(i, c); err != nil {
 		return &ClientRegistrationError{
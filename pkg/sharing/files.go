@@ -799,7 +799,7 @@ func (s *Sharing) UpdateDir(inst *instance.Instance, target map[string]interface
 	copySafeFieldsToDir(target, dir)
 
 	err = fs.UpdateDirDoc(oldDoc, dir)
-	if err == os.ErrExist {
+	if err == os.ErrExist || err == vfs.ErrConflict {
 		name, errr := s.resolveConflictSamePath(inst, dir.DocID, dir.Fullpath)
 		if errr != nil {
 			return errr
@@ -3,6 +3,7 @@ package sharing
 import (
 	"encoding/hex"
 	"fmt"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
@@ -310,6 +311,22 @@ func (s *sharingIndexer) DirChildExists(dirID, name string) (bool, error) {
 	return s.indexer.DirChildExists(dirID, name)
 }
 
+func (s *sharingIndexer) FilesByTag(tag string, cursor couchdb.Cursor) ([]*vfs.FileDoc, error) {
+	return s.indexer.FilesByTag(tag, cursor)
+}
+
+func (s *sharingIndexer) HiddenFiles() ([]*vfs.FileDoc, error) {
+	return s.indexer.HiddenFiles()
+}
+
+func (s *sharingIndexer) ChangedSince(since time.Time, cursor string, limit int) ([]*vfs.FileDoc, string, error) {
+	return s.indexer.ChangedSince(since, cursor, limit)
+}
+
+func (s *sharingIndexer) DirLastModified(doc *vfs.DirDoc) (time.Time, error) {
+	return s.indexer.DirLastModified(doc)
+}
+
 func (s *sharingIndexer) BuildTree() (*vfs.TreeFile, error) {
 	return nil, ErrInternalServerError
 }
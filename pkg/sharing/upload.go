@@ -424,7 +424,7 @@ func (s *Sharing) updateFileMetadata(inst *instance.Instance, target *FileDocWit
 	newdoc.ReferencedBy = buildReferencedBy(target.FileDoc, newdoc, rule)
 
 	err := fs.UpdateFileDoc(olddoc, newdoc)
-	if err == os.ErrExist {
+	if err == os.ErrExist || err == vfs.ErrConflict {
 		pth, errp := newdoc.Path(fs)
 		if errp != nil {
 			return errp
@@ -671,7 +671,7 @@ func (s *Sharing) UploadExistingFile(inst *instance.Instance, target *FileDocWit
 	indexer.UnstashRevision(stash)
 	newdoc.DocRev = tmpdoc.DocRev
 	err = fs.UpdateFileDoc(tmpdoc, newdoc)
-	if err == os.ErrExist {
+	if err == os.ErrExist || err == vfs.ErrConflict {
 		pth, errp := newdoc.Path(fs)
 		if errp != nil {
 			return errp
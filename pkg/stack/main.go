@@ -13,6 +13,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/sessions"
 	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/workers/trash"
 	"github.com/cozy/cozy-stack/pkg/workers/updates"
 
 	"github.com/google/gops/agent"
@@ -91,6 +92,9 @@ security features. Please do not use this binary as your production server.
 			return
 		}
 	}
+	if err = config.InitSwiftTierConnections(config.GetConfig().Fs.Tiers); err != nil {
+		return
+	}
 
 	workersList, err := jobs.GetWorkersList()
 	if err != nil {
@@ -122,9 +126,17 @@ security features. Please do not use this binary as your production server.
 				return jobs.NewMessage(updates.Options{AllDomains: true})
 			},
 		},
+		{
+			Activated:  config.GetConfig().Fs.UndoRetention > 0,
+			Schedule:   trash.Schedule,
+			WorkerType: "trash-expiry",
+			WorkerTemplate: func() (jobs.Message, error) {
+				return jobs.NewMessage(struct{}{})
+			},
+		},
 	}
 
-	// Start update cron for auto-updates
+	// Start the crons for auto-updates and the expiry of the trashes
 	crons, err := jobs.CronJobs(cronSpecs)
 	if err != nil {
 		return
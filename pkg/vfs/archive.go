@@ -1,11 +1,13 @@
 package vfs
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -16,6 +18,16 @@ import (
 // ZipMime is the content-type for zip archives
 const ZipMime = "application/zip"
 
+// TarMime is the content-type for tar archives
+const TarMime = "application/x-tar"
+
+const (
+	// ArchiveFormatZip is the format for a zip archive
+	ArchiveFormatZip = "zip"
+	// ArchiveFormatTar is the format for a tar archive
+	ArchiveFormatTar = "tar"
+)
+
 // Archive is the data to create a zip archive
 type Archive struct {
 	Name   string   `json:"name"`
@@ -107,52 +119,188 @@ func (a *Archive) GetEntries(fs VFS) ([]ArchiveEntry, error) {
 
 // Serve creates on the fly the zip archive and streams in a http response
 func (a *Archive) Serve(fs VFS, w http.ResponseWriter) error {
-	header := w.Header()
-	header.Set("Content-Type", ZipMime)
-	header.Set("Content-Disposition", ContentDisposition("attachment", a.Name+".zip"))
+	return a.ServeFrom(fs, w, "")
+}
 
-	zw := zip.NewWriter(w)
-	defer zw.Close()
+// ServeFrom creates on the fly the zip archive, with only the files after the
+// one with the given name in the manifest (see Manifest), and streams it in a
+// http response: a client whose download has been interrupted can ask for a
+// new archive with the files after the last one it has received completely,
+// instead of starting again from the beginning. The name is used instead of a
+// position, so that the files added or removed in the meantime don't shift
+// the resumed archive. If there is no file with this name in the archive
+// anymore, ErrArchiveCursorNotFound is returned and nothing is written.
+func (a *Archive) ServeFrom(fs VFS, w http.ResponseWriter, after string) error {
+	if _, err := a.GetEntries(fs); err != nil {
+		return err
+	}
 
-	entries, err := a.GetEntries(fs)
-	if err != nil {
+	var zw *zip.Writer
+	start := func() {
+		header := w.Header()
+		header.Set("Content-Type", ZipMime)
+		header.Set("Content-Disposition", ContentDisposition("attachment", a.Name+".zip"))
+		zw = zip.NewWriter(w)
+	}
+	if after == "" {
+		start()
+	}
+
+	a.walkFiles(fs, func(name string, file *FileDoc) error {
+		if zw == nil {
+			if name == after {
+				start()
+			}
+			return nil
+		}
+		header := &zip.FileHeader{
+			Name:   name,
+			Method: zip.Deflate,
+			Flags:  0x800, // bit 11 set to force utf-8
+		}
+		header.SetModTime(file.UpdatedAt) // nolint: megacheck
+		ze, err := zw.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("Can't create zip entry <%s>: %s", name, err)
+		}
+		f, err := fs.OpenFile(file)
+		if err != nil {
+			return fmt.Errorf("Can't open file <%s>: %s", name, err)
+		}
+		defer f.Close()
+		_, err = io.Copy(ze, f)
 		return err
+	})
+
+	if zw == nil {
+		return ErrArchiveCursorNotFound
 	}
+	return zw.Close()
+}
+
+// Manifest returns the names of the files in the archive, in the order in
+// which they are written. This order is stable: the entries are taken in the
+// order they were given, and the content of a directory in the order of the
+// identifiers of its children.
+func (a *Archive) Manifest(fs VFS) ([]string, error) {
+	if _, err := a.GetEntries(fs); err != nil {
+		return nil, err
+	}
+	var names []string
+	err := a.walkFiles(fs, func(name string, file *FileDoc) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
 
-	for _, entry := range entries {
+// walkFiles calls fn for each file of the archive, with its name in the
+// archive. The entries must have been fetched with GetEntries before.
+func (a *Archive) walkFiles(fs VFS, fn func(name string, file *FileDoc) error) error {
+	for _, entry := range a.entries {
 		base := filepath.Dir(entry.root)
-		walk(fs, entry.root, entry.Dir, entry.File, func(name string, dir *DirDoc, file *FileDoc, err error) error {
+		err := walk(fs, entry.root, entry.Dir, entry.File, func(name string, dir *DirDoc, file *FileDoc, err error) error {
 			if err != nil {
 				return err
 			}
 			if dir != nil {
 				return nil
 			}
-			name, err = filepath.Rel(base, name)
+			rel, err := filepath.Rel(base, name)
 			if err != nil {
 				return fmt.Errorf("Invalid filepath <%s>: %s", name, err)
 			}
+			return fn(a.Name+"/"+rel, file)
+		}, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ArchiveFiles streams the given files in an archive of the given format
+// ("zip" or "tar") written to w. The files are placed at the root of the
+// archive with their names, and a suffix is added when several files have the
+// same name. A file that can't be opened is skipped, and the error is added to
+// the returned list: the caller can report them once the archive is written.
+func ArchiveFiles(fs VFS, docs []*FileDoc, w io.Writer, format string) ([]error, error) {
+	var add func(name string, doc *FileDoc, content io.Reader) error
+	var finish func() error
+	switch format {
+	case ArchiveFormatZip:
+		zw := zip.NewWriter(w)
+		add = func(name string, doc *FileDoc, content io.Reader) error {
 			header := &zip.FileHeader{
-				Name:   a.Name + "/" + name,
+				Name:   name,
 				Method: zip.Deflate,
 				Flags:  0x800, // bit 11 set to force utf-8
 			}
-			header.SetModTime(file.UpdatedAt) // nolint: megacheck
+			header.SetModTime(doc.UpdatedAt) // nolint: megacheck
 			ze, err := zw.CreateHeader(header)
 			if err != nil {
 				return fmt.Errorf("Can't create zip entry <%s>: %s", name, err)
 			}
-			f, err := fs.OpenFile(file)
-			if err != nil {
-				return fmt.Errorf("Can't open file <%s>: %s", name, err)
+			_, err = io.Copy(ze, content)
+			return err
+		}
+		finish = zw.Close
+	case ArchiveFormatTar:
+		tw := tar.NewWriter(w)
+		add = func(name string, doc *FileDoc, content io.Reader) error {
+			header := &tar.Header{
+				Name:    name,
+				Mode:    int64(doc.Mode()),
+				Size:    doc.ByteSize,
+				ModTime: doc.UpdatedAt,
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return fmt.Errorf("Can't create tar entry <%s>: %s", name, err)
 			}
-			defer f.Close()
-			_, err = io.Copy(ze, f)
+			_, err := io.Copy(tw, content)
 			return err
-		}, 0)
+		}
+		finish = tw.Close
+	default:
+		return nil, ErrUnknownArchiveFormat
 	}
 
-	return nil
+	var skipped []error
+	names := make(map[string]struct{}, len(docs))
+	for _, doc := range docs {
+		name := uniqueArchiveName(names, doc.DocName)
+		f, err := fs.OpenFile(doc)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("Can't open file <%s>: %s", name, err))
+			continue
+		}
+		err = add(name, doc, f)
+		f.Close() // #nosec
+		if err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, finish()
+}
+
+// uniqueArchiveName returns a name that has not been used yet for a file in
+// the archive, by suffixing the name with a number before the extension if
+// needed. The returned name is marked as used.
+func uniqueArchiveName(names map[string]struct{}, name string) string {
+	unique := name
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; ; i++ {
+		if _, ok := names[unique]; !ok {
+			break
+		}
+		unique = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	names[unique] = struct{}{}
+	return unique
 }
 
 // ID makes Archive a jsonapi.Object
@@ -0,0 +1,190 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+)
+
+// VFSBatch is the set of operations that can be grouped in a batch. See
+// Batch.
+type VFSBatch interface {
+	// CreateDir creates a new directory.
+	CreateDir(doc *DirDoc) error
+	// CreateFile creates a new file with the given content.
+	CreateFile(doc *FileDoc, content io.Reader) error
+	// UpdateFileDoc moves, renames or changes the metadata of a file.
+	UpdateFileDoc(olddoc, newdoc *FileDoc) error
+	// UpdateDirDoc moves, renames or changes the metadata of a directory.
+	UpdateDirDoc(olddoc, newdoc *DirDoc) error
+	// TrashFile moves a file to the trash.
+	TrashFile(doc *FileDoc) (*FileDoc, error)
+	// TrashDir moves a directory to the trash.
+	TrashDir(doc *DirDoc) (*DirDoc, error)
+}
+
+// ErrBatchRollbackFailed is used when a batch has failed and some of its
+// operations could not be reverted. Err is the error that has made the batch
+// fail, and RollbackErrors the errors of the compensating operations.
+type ErrBatchRollbackFailed struct {
+	Err            error
+	RollbackErrors []error
+}
+
+func (e ErrBatchRollbackFailed) Error() string {
+	return fmt.Sprintf("Could not rollback the batch after error: %s (%d operations not reverted)",
+		e.Err, len(e.RollbackErrors))
+}
+
+// Batch calls fn with a VFSBatch, and if fn returns an error, the operations
+// already made by the batch are reverted, in the reverse order.
+//
+// This is a best-effort rollback, by compensation, and not a transaction:
+//   - each operation is applied immediately, on the filesystem and in the
+//     index, and is visible to the other requests before the end of the batch
+//   - on error, a created file or directory is destroyed, and a moved,
+//     renamed, modified or trashed one gets back its previous name, parent
+//     directory and metadata
+//   - a compensating operation can fail (if the document has been changed by
+//     someone else in the meantime for example): the other ones are still
+//     tried, and ErrBatchRollbackFailed is returned.
+//
+// The content of the files is never overwritten by a batch, so the rollback
+// has no content to restore.
+func Batch(fs VFS, fn func(tx VFSBatch) error) error {
+	b := &batch{fs: fs}
+	err := fn(b)
+	if err == nil {
+		return nil
+	}
+	if errs := b.rollback(); len(errs) > 0 {
+		return ErrBatchRollbackFailed{Err: err, RollbackErrors: errs}
+	}
+	return err
+}
+
+type batch struct {
+	fs   VFS
+	undo []func() error
+}
+
+func (b *batch) rollback() []error {
+	var errs []error
+	for i := len(b.undo) - 1; i >= 0; i-- {
+		if err := b.undo[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (b *batch) CreateDir(doc *DirDoc) error {
+	if err := b.fs.CreateDir(doc); err != nil {
+		return err
+	}
+	b.undo = append(b.undo, func() error {
+		cur, err := b.fs.DirByID(doc.ID())
+		if err != nil {
+			return err
+		}
+		return b.fs.DestroyDirAndContent(cur)
+	})
+	return nil
+}
+
+func (b *batch) CreateFile(doc *FileDoc, content io.Reader) error {
+	file, err := b.fs.CreateFile(doc, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, content); err != nil {
+		if aborter, ok := file.(Aborter); ok {
+			aborter.Abort() // #nosec
+		} else if file.Close() == nil {
+			// The truncated file has been committed: it is removed by the
+			// rollback, like the complete ones
+			b.undoFileCreation(doc)
+		}
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	b.undoFileCreation(doc)
+	return nil
+}
+
+func (b *batch) undoFileCreation(doc *FileDoc) {
+	b.undo = append(b.undo, func() error {
+		cur, err := b.fs.FileByID(doc.ID())
+		if err != nil {
+			return err
+		}
+		return b.fs.DestroyFile(cur)
+	})
+}
+
+func (b *batch) UpdateFileDoc(olddoc, newdoc *FileDoc) error {
+	previous := olddoc.Clone().(*FileDoc)
+	if err := b.fs.UpdateFileDoc(olddoc, newdoc); err != nil {
+		return err
+	}
+	b.undoFileUpdate(previous)
+	return nil
+}
+
+func (b *batch) TrashFile(doc *FileDoc) (*FileDoc, error) {
+	previous := doc.Clone().(*FileDoc)
+	newdoc, err := TrashFile(b.fs, doc)
+	if err != nil {
+		return nil, err
+	}
+	b.undoFileUpdate(previous)
+	return newdoc, nil
+}
+
+func (b *batch) UpdateDirDoc(olddoc, newdoc *DirDoc) error {
+	previous := olddoc.Clone().(*DirDoc)
+	if err := b.fs.UpdateDirDoc(olddoc, newdoc); err != nil {
+		return err
+	}
+	b.undoDirUpdate(previous)
+	return nil
+}
+
+func (b *batch) TrashDir(doc *DirDoc) (*DirDoc, error) {
+	previous := doc.Clone().(*DirDoc)
+	newdoc, err := TrashDir(b.fs, doc)
+	if err != nil {
+		return nil, err
+	}
+	b.undoDirUpdate(previous)
+	return newdoc, nil
+}
+
+// undoFileUpdate registers the update of the file back to its previous
+// document.
+func (b *batch) undoFileUpdate(previous *FileDoc) {
+	b.undo = append(b.undo, func() error {
+		cur, err := b.fs.FileByID(previous.ID())
+		if err != nil {
+			return err
+		}
+		restored := previous.Clone().(*FileDoc)
+		restored.SetRev(cur.Rev())
+		return b.fs.UpdateFileDoc(cur, restored)
+	})
+}
+
+// undoDirUpdate registers the update of the directory back to its previous
+// document.
+func (b *batch) undoDirUpdate(previous *DirDoc) {
+	b.undo = append(b.undo, func() error {
+		cur, err := b.fs.DirByID(previous.ID())
+		if err != nil {
+			return err
+		}
+		restored := previous.Clone().(*DirDoc)
+		restored.SetRev(cur.Rev())
+		return b.fs.UpdateDirDoc(cur, restored)
+	})
+}
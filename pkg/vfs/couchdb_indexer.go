@@ -3,8 +3,10 @@ package vfs
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -107,10 +109,23 @@ func (c *couchdbIndexer) UpdateFileDoc(olddoc, newdoc *FileDoc) error {
 
 func (c *couchdbIndexer) DeleteFileDoc(doc *FileDoc) error {
 	// Ensure that fullpath is filled because it's used in realtime/@events
-	if _, err := doc.Path(c); err != nil {
+	fullpath, err := doc.Path(c)
+	if err != nil {
 		return err
 	}
-	return couchdb.DeleteDoc(c.db, doc)
+	// The tombstone is written first, so that a file is never destroyed
+	// without it.
+	tomb := newTombstone(doc, fullpath, time.Now())
+	if tomb != nil {
+		if err = couchdb.CreateDoc(c.db, tomb); err != nil {
+			return err
+		}
+	}
+	err = couchdb.DeleteDoc(c.db, doc)
+	if err != nil && tomb != nil {
+		couchdb.DeleteDoc(c.db, tomb) // #nosec
+	}
+	return err
 }
 
 func (c *couchdbIndexer) CreateDirDoc(doc *DirDoc) error {
@@ -188,6 +203,29 @@ func (c *couchdbIndexer) DeleteDirDocAndContent(doc *DirDoc, onlyContent bool) (
 }
 
 func (c *couchdbIndexer) BatchDelete(docs []couchdb.Doc) error {
+	var tombs []interface{}
+	now := time.Now()
+	for _, doc := range docs {
+		file, ok := doc.(*FileDoc)
+		if !ok {
+			continue
+		}
+		// The path of a file can't be computed if its parent is missing, as
+		// for some fsck deletions: it is then only hidden if it is trashed.
+		fullpath, _ := file.Path(c)
+		if tomb := newTombstone(file, fullpath, now); tomb != nil {
+			tombs = append(tombs, tomb)
+		}
+	}
+	if len(tombs) > 0 {
+		if err := couchdb.EnsureDBExist(c.db, consts.FilesTombstones); err != nil {
+			return err
+		}
+		olddocs := make([]interface{}, len(tombs))
+		if err := couchdb.BulkUpdateDocs(c.db, consts.FilesTombstones, tombs, olddocs); err != nil {
+			return err
+		}
+	}
 	return couchdb.BulkDeleteDocs(c.db, consts.Files, docs)
 }
 
@@ -452,6 +490,236 @@ func (c *couchdbIndexer) DirChildExists(dirID, name string) (bool, error) {
 	return int(f64) > 0, nil
 }
 
+func (c *couchdbIndexer) FilesByTag(tag string, cursor couchdb.Cursor) ([]*FileDoc, error) {
+	req := couchdb.ViewRequest{
+		Key:         tag,
+		IncludeDocs: true,
+	}
+	var res couchdb.ViewResponse
+	cursor.ApplyTo(&req)
+	err := couchdb.ExecView(c.db, consts.FilesByTagView, &req, &res)
+	if err != nil {
+		return nil, err
+	}
+	cursor.UpdateFrom(&res)
+
+	docs := make([]*FileDoc, len(res.Rows))
+	for i, row := range res.Rows {
+		var doc FileDoc
+		if err := json.Unmarshal(row.Doc, &doc); err != nil {
+			return nil, err
+		}
+		docs[i] = &doc
+	}
+	return docs, nil
+}
+
+// HiddenFiles uses the file-by-trashed index to find the trashed files, and
+// keeps the ones that are not in the trash.
+func (c *couchdbIndexer) HiddenFiles() ([]*FileDoc, error) {
+	var hidden []*FileDoc
+	sel := mango.And(mango.Equal("trashed", true), mango.Equal("type", consts.FileType))
+	limit := 256
+	for skip := 0; ; skip += limit {
+		var docs []*FileDoc
+		req := &couchdb.FindRequest{
+			UseIndex: "file-by-trashed",
+			Selector: sel,
+			Skip:     skip,
+			Limit:    limit,
+		}
+		if err := couchdb.FindDocs(c.db, consts.Files, req, &docs); err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			fullpath, _ := doc.Path(c)
+			if isHiddenUpload(doc, fullpath) {
+				hidden = append(hidden, doc)
+			}
+		}
+		if len(docs) < limit {
+			return hidden, nil
+		}
+	}
+}
+
+// deletedCursorPrefix is the prefix of the cursors of ChangedSince for the
+// destroyed files.
+const deletedCursorPrefix = "deleted:"
+
+// ChangedSince uses the consts.FilesByUpdatedAtView, whose keys are the
+// timestamps of the modifications, with the doc ID as a tie-breaker: the
+// pagination stays stable when files are modified between two batches, as a
+// file modified now is moved after the current position, and will be
+// returned again in a later batch. The files in the trash are returned with
+// Trashed set, but not the hidden documents of the files being uploaded.
+//
+// Once all the files have been listed, the files destroyed since the given
+// time are listed from their tombstones, with the
+// consts.TombstonesByDeletedAtView, as couchdb views don't index the deleted
+// documents: they are returned with Deleted set.
+func (c *couchdbIndexer) ChangedSince(since time.Time, cursor string, limit int) ([]*FileDoc, string, error) {
+	key := since.UnixNano() / int64(time.Millisecond)
+	var docID string
+	deleted := strings.HasPrefix(cursor, deletedCursorPrefix)
+	if cursor != "" {
+		parts := strings.SplitN(strings.TrimPrefix(cursor, deletedCursorPrefix), ":", 2)
+		ms, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || len(parts) != 2 {
+			return nil, "", ErrInvalidCursor
+		}
+		key, docID = ms, parts[1]
+	}
+
+	var docs []*FileDoc
+	if !deleted {
+		rows, nextKey, nextID, err := c.viewSince(consts.FilesByUpdatedAtView, key, docID, limit)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, row := range rows {
+			var doc FileDoc
+			if err := json.Unmarshal(row.Doc, &doc); err != nil {
+				return nil, "", err
+			}
+			if doc.Trashed {
+				fullpath, _ := doc.Path(c)
+				if isHiddenUpload(&doc, fullpath) {
+					continue
+				}
+			}
+			docs = append(docs, &doc)
+		}
+		if nextID != "" {
+			return docs, fmt.Sprintf("%d:%s", nextKey, nextID), nil
+		}
+		// All the files have been listed: the destroyed files come next.
+		key = since.UnixNano() / int64(time.Millisecond)
+		docID = ""
+		if limit > 0 {
+			if limit -= len(docs); limit <= 0 {
+				return docs, fmt.Sprintf("%s%d:", deletedCursorPrefix, key), nil
+			}
+		}
+	}
+
+	rows, nextKey, nextID, err := c.viewSince(consts.TombstonesByDeletedAtView, key, docID, limit)
+	if couchdb.IsNoDatabaseError(err) {
+		return docs, "", nil
+	}
+	if couchdb.IsNotFoundError(err) {
+		// The view is missing for the instances created before it was added.
+		views := []*couchdb.View{consts.TombstonesByDeletedAtView}
+		if err = couchdb.DefineViews(c.db, views); err == nil {
+			rows, nextKey, nextID, err = c.viewSince(consts.TombstonesByDeletedAtView, key, docID, limit)
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	for _, row := range rows {
+		var tomb fileTombstone
+		if err := json.Unmarshal(row.Doc, &tomb); err != nil {
+			return nil, "", err
+		}
+		docs = append(docs, tomb.fileDoc())
+	}
+	if nextID != "" {
+		return docs, fmt.Sprintf("%s%d:%s", deletedCursorPrefix, nextKey, nextID), nil
+	}
+	return docs, "", nil
+}
+
+// viewSince returns a batch of the rows of a view whose keys are timestamps
+// in milliseconds, from the given key and doc ID, with the key and the doc ID
+// of the next row if there are more.
+func (c *couchdbIndexer) viewSince(view *couchdb.View, key int64, docID string, limit int) ([]*couchdb.ViewResponseRow, int64, string, error) {
+	cur := couchdb.NewKeyCursor(limit, key, docID).(*couchdb.StartKeyCursor)
+	req := couchdb.ViewRequest{
+		StartKey:    key,
+		IncludeDocs: true,
+	}
+	var res couchdb.ViewResponse
+	cur.ApplyTo(&req)
+	if err := couchdb.ExecView(c.db, view, &req, &res); err != nil {
+		return nil, 0, "", err
+	}
+	cur.UpdateFrom(&res)
+
+	var nextKey int64
+	var nextID string
+	if ms, ok := cur.NextKey.(float64); ok && cur.HasMore() {
+		nextKey, nextID = int64(ms), cur.NextDocID
+	}
+	return res.Rows, nextKey, nextID, nil
+}
+
+// DirLastModified uses the consts.FilesLastModifiedByParentView to get the
+// most recent modification of the children of the directory and of its sub
+// directories, found by their paths, without walking the tree.
+func (c *couchdbIndexer) DirLastModified(doc *DirDoc) (time.Time, error) {
+	last := doc.UpdatedAt
+	keys := []interface{}{doc.DocID}
+	prefix := doc.Fullpath + "/"
+	if doc.Fullpath == "/" {
+		prefix = "/"
+	}
+
+	limit := 256
+	for skip := 0; ; skip += limit {
+		var children []*DirDoc
+		req := &couchdb.FindRequest{
+			UseIndex: "dir-by-path",
+			Selector: mango.StartWith("path", prefix),
+			Skip:     skip,
+			Limit:    limit,
+		}
+		if err := couchdb.FindDocs(c.db, consts.Files, req, &children); err != nil {
+			return time.Time{}, err
+		}
+		for _, child := range children {
+			if child.DocID != doc.DocID {
+				keys = append(keys, child.DocID)
+			}
+		}
+		if len(children) < limit {
+			break
+		}
+	}
+
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > limit {
+			batch = batch[:limit]
+		}
+		keys = keys[len(batch):]
+		var res couchdb.ViewResponse
+		err := couchdb.ExecView(c.db, consts.FilesLastModifiedByParentView, &couchdb.ViewRequest{
+			Keys:   batch,
+			Reduce: true,
+			Group:  true,
+		}, &res)
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, row := range res.Rows {
+			// Reduce of _stats should give us an object with a max field
+			stats, ok := row.Value.(map[string]interface{})
+			if !ok {
+				return time.Time{}, ErrWrongCouchdbState
+			}
+			ms, ok := stats["max"].(float64)
+			if !ok {
+				return time.Time{}, ErrWrongCouchdbState
+			}
+			if t := time.Unix(0, int64(ms)*int64(time.Millisecond)); t.After(last) {
+				last = t
+			}
+		}
+	}
+	return last, nil
+}
+
 func (c *couchdbIndexer) setTrashedForFilesInsideDir(doc *DirDoc, trashed bool) error {
 	var files, olddocs []interface{}
 	parent := doc
@@ -37,6 +37,40 @@ type DirDoc struct {
 	Fullpath string `json:"path,omitempty"`
 
 	ReferencedBy []couchdb.DocReference `json:"referenced_by,omitempty"`
+
+	// Defaults are the settings applied to the files and directories created
+	// in this directory.
+	Defaults *InheritableSettings `json:"defaults,omitempty"`
+
+	// AllowInTrash can be set by the stack to create the directory in the
+	// trash. Without it, ErrParentInTrash is returned.
+	AllowInTrash bool `json:"-"`
+}
+
+// InheritableSettings are the settings of a directory that are inherited by
+// its new children. The inheritance is shallow: the settings are copied on
+// the child when it is created, and the later changes of the directory are
+// not propagated to its existing children.
+type InheritableSettings struct {
+	Tags         []string               `json:"tags,omitempty"`
+	ReferencedBy []couchdb.DocReference `json:"referenced_by,omitempty"`
+}
+
+// Clone returns a deep copy of the settings
+func (s *InheritableSettings) Clone() *InheritableSettings {
+	if s == nil {
+		return nil
+	}
+	cloned := &InheritableSettings{}
+	if s.Tags != nil {
+		cloned.Tags = make([]string, len(s.Tags))
+		copy(cloned.Tags, s.Tags)
+	}
+	if s.ReferencedBy != nil {
+		cloned.ReferencedBy = make([]couchdb.DocReference, len(s.ReferencedBy))
+		copy(cloned.ReferencedBy, s.ReferencedBy)
+	}
+	return cloned
 }
 
 // ID returns the directory qualified identifier
@@ -55,6 +89,7 @@ func (d *DirDoc) Clone() couchdb.Doc {
 	copy(cloned.Tags, d.Tags)
 	cloned.ReferencedBy = make([]couchdb.DocReference, len(d.ReferencedBy))
 	copy(cloned.ReferencedBy, d.ReferencedBy)
+	cloned.Defaults = d.Defaults.Clone()
 	return &cloned
 }
 
@@ -111,6 +146,76 @@ func (d *DirDoc) AddReferencedBy(ri ...couchdb.DocReference) {
 	d.ReferencedBy = append(d.ReferencedBy, ri...)
 }
 
+// parentDefaults returns the settings that the children of the given
+// directory inherit, or nil if it has none.
+func parentDefaults(fs Indexer, dirID string) (*InheritableSettings, error) {
+	if dirID == "" {
+		return nil, nil
+	}
+	parent, err := fs.DirByID(dirID)
+	if err != nil {
+		return nil, err
+	}
+	return parent.Defaults, nil
+}
+
+// mergeReferences returns the references, with the inherited ones that are
+// not already in the list appended to them.
+func mergeReferences(refs, inherited []couchdb.DocReference) []couchdb.DocReference {
+	for _, ref := range inherited {
+		if !containsReferencedBy(refs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// InheritFileDefaults applies to a new file the default settings of its
+// parent directory.
+func InheritFileDefaults(fs Indexer, doc *FileDoc) error {
+	defaults, err := parentDefaults(fs, doc.DirID)
+	if err != nil || defaults == nil {
+		return err
+	}
+	doc.Tags = uniqueTags(append(doc.Tags, defaults.Tags...))
+	doc.ReferencedBy = mergeReferences(doc.ReferencedBy, defaults.ReferencedBy)
+	return nil
+}
+
+// InheritDirDefaults applies to a new directory the default settings of its
+// parent directory. They are also copied as the defaults of the new directory,
+// if it has none, to be inherited by its own children.
+func InheritDirDefaults(fs Indexer, doc *DirDoc) error {
+	defaults, err := parentDefaults(fs, doc.DirID)
+	if err != nil || defaults == nil {
+		return err
+	}
+	doc.Tags = uniqueTags(append(doc.Tags, defaults.Tags...))
+	doc.ReferencedBy = mergeReferences(doc.ReferencedBy, defaults.ReferencedBy)
+	if doc.Defaults == nil {
+		doc.Defaults = defaults.Clone()
+	}
+	return nil
+}
+
+// CheckParentNotInTrash returns ErrParentInTrash if the parent of the new
+// directory is the trash or one of its descendants, unless the directory
+// allows it. The path of the parent is read from the index, as the one of the
+// document may be stale if the parent has been trashed concurrently.
+func CheckParentNotInTrash(fs Indexer, doc *DirDoc) error {
+	if doc.AllowInTrash || doc.DirID == "" {
+		return nil
+	}
+	parent, err := fs.DirByID(doc.DirID)
+	if err != nil {
+		return err
+	}
+	if parent.Fullpath == TrashDirName || strings.HasPrefix(parent.Fullpath, TrashDirName+"/") {
+		return ErrParentInTrash
+	}
+	return nil
+}
+
 // RemoveReferencedBy adds referenced_by to the directory
 func (d *DirDoc) RemoveReferencedBy(ri ...couchdb.DocReference) {
 	// https://github.com/golang/go/wiki/SliceTricks#filtering-without-allocating
@@ -223,6 +328,7 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 	newdoc.CreatedAt = cdate
 	newdoc.UpdatedAt = *patch.UpdatedAt
 	newdoc.ReferencedBy = olddoc.ReferencedBy
+	newdoc.Defaults = olddoc.Defaults.Clone()
 
 	if err = fs.UpdateDirDoc(olddoc, newdoc); err != nil {
 		return nil, err
@@ -230,6 +336,27 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 	return newdoc, nil
 }
 
+// CheckNoCycle returns ErrForbiddenDocMove if moving the directory inside the
+// directory with the given identifier would make it one of its own ancestors.
+// The ancestors are walked in the index, and not deduced from the paths of
+// the documents, that can be stale when directories are moved concurrently.
+// It must be called with the VFS lock held.
+func CheckNoCycle(fs Indexer, doc *DirDoc, parentID string) error {
+	seen := make(map[string]bool)
+	for id := parentID; id != "" && id != consts.RootDirID; {
+		if id == doc.ID() || seen[id] {
+			return ErrForbiddenDocMove
+		}
+		seen[id] = true
+		parent, err := fs.DirByID(id)
+		if err != nil {
+			return err
+		}
+		id = parent.DirID
+	}
+	return nil
+}
+
 // TrashDir is used to delete a directory given its document
 func TrashDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 	oldpath, err := olddoc.Path(fs)
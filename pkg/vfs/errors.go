@@ -1,6 +1,9 @@
 package vfs
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrParentDoesNotExist is used when the parent directory does not
@@ -40,4 +43,77 @@ var (
 	ErrWrongCouchdbState = errors.New("Wrong couchdb reduce value")
 	// ErrFileTooBig is used when there is no more space left on the filesystem
 	ErrFileTooBig = errors.New("The file is too big and exceeds the disk quota")
+	// ErrContentRejected is used when the content of a file has been rejected
+	// by the content inspector
+	ErrContentRejected = errors.New("The content of the file has been rejected")
+	// ErrTooManyOpenFiles is used when the maximal number of files opened for
+	// reading has been reached
+	ErrTooManyOpenFiles = errors.New("Too many open files")
+	// ErrMaintenance is used when a write is refused because the VFS is in
+	// maintenance mode
+	ErrMaintenance = errors.New("The files are in maintenance, only reads are allowed")
+	// ErrNoInodes is used when there are not enough free inodes on the
+	// filesystem for the files to create, even if there is free space
+	ErrNoInodes = errors.New("There are not enough free inodes on the filesystem")
+	// ErrFileTooBigToRead is used when a file is too big to be read in memory
+	ErrFileTooBigToRead = errors.New("The file is too big to be read in memory")
+	// ErrForbiddenSymlink is used when the real path of a file, once its
+	// symbolic links are resolved, is outside of the storage of the instance
+	ErrForbiddenSymlink = errors.New("The file is a symbolic link to outside of the instance")
+	// ErrReadLimitExceeded is used when reading a file opened with
+	// OpenFileLimited goes over its size or time budget
+	ErrReadLimitExceeded = errors.New("The read limit of the file has been exceeded")
+	// ErrTruncateExtend is used when trying to truncate a file to a size larger
+	// than its current size without allowing it to be extended
+	ErrTruncateExtend = errors.New("Cannot truncate the file to a larger size")
+	// ErrUnknownArchiveFormat is used when the requested format for an archive
+	// is not supported
+	ErrUnknownArchiveFormat = errors.New("Unknown archive format")
+	// ErrFileNotFound is used when there is no file at the given path
+	ErrFileNotFound = errors.New("File not found")
+	// ErrIsDirectory is used when a file was expected but the given path is
+	// the one of a directory
+	ErrIsDirectory = errors.New("Path is a directory")
+	// ErrFileInUse is used when trying to modify a file while its content is
+	// being written
+	ErrFileInUse = errors.New("File content is being written")
+	// ErrPostWriteVerificationFailed is used when the content read back from
+	// the storage after an upload does not match the expected md5sum
+	ErrPostWriteVerificationFailed = errors.New("Content stored does not match the uploaded content")
+	// ErrInvalidCursor is used when a cursor given for the pagination can not
+	// be parsed
+	ErrInvalidCursor = errors.New("Invalid cursor")
+	// ErrArchiveCursorNotFound is used when the file after which an archive
+	// must be resumed is no longer in the archive
+	ErrArchiveCursorNotFound = errors.New("The file of the cursor is no longer in the archive")
+	// ErrNoOverwriteToUndo is used when there is no old content kept for a
+	// file to undo its last overwrite, or when it has expired
+	ErrNoOverwriteToUndo = errors.New("There is no overwrite to undo for this file")
+	// ErrPingTimeout is used when the storage backend has not answered to a
+	// probe in time
+	ErrPingTimeout = errors.New("The storage backend has not answered in time")
 )
+
+// ErrPartialUpload is returned by the Close of an upload cut short, when its
+// content has been kept to be resumed (see PartialKeeper). Written is the
+// number of bytes kept, and PartialSum their md5sum (nil for a trusted
+// content).
+type ErrPartialUpload struct {
+	Written    int64
+	PartialSum []byte
+}
+
+func (e ErrPartialUpload) Error() string {
+	return fmt.Sprintf("Upload is incomplete: %d bytes have been kept to be resumed", e.Written)
+}
+
+// ErrRestoreFailed is used when the content of a file could not be restored
+// after a failed overwrite. The file may be in a bad state and its index has
+// not been updated. Err contains the error that triggered the restoration.
+type ErrRestoreFailed struct {
+	Err error
+}
+
+func (e ErrRestoreFailed) Error() string {
+	return fmt.Sprintf("Could not restore file content after error: %s", e.Err)
+}
@@ -1,15 +1,18 @@
 package vfs
 
 import (
+	"bytes"
 	// #nosec
-	"encoding/base64"
-	"fmt"
+	"crypto/md5"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 )
@@ -42,9 +45,29 @@ type FileDoc struct {
 	Tags       []string `json:"tags"`
 
 	Metadata Metadata `json:"metadata,omitempty"`
+	// TrustedMetadata can be set when creating a file to keep the given
+	// metadata, instead of extracting them from the content. It is useful for
+	// imports, where the metadata are already known.
+	TrustedMetadata bool `json:"-"`
+	// TrustedContent can be set by the stack when it copies a content that
+	// has already been verified, like a backup: with the MD5Sum and the
+	// ByteSize, the content is not hashed again by the VFS that support it,
+	// only its size is checked. It must never be set for a user upload.
+	TrustedContent bool `json:"-"`
+	// AllowInTrash can be set by the stack to create the file in a directory
+	// of the trash. Without it, ErrParentInTrash is returned.
+	AllowInTrash bool `json:"-"`
 
 	ReferencedBy []couchdb.DocReference `json:"referenced_by,omitempty"`
 
+	// Backend is the name of the storage backend of the content, when the
+	// files of the instance are stored in several tiers (see vfstiered).
+	Backend string `json:"backend,omitempty"`
+
+	// Deleted is only set for the destroyed files returned by ChangedSince,
+	// from their tombstones.
+	Deleted bool `json:"_deleted,omitempty"`
+
 	// Cache of the fullpath of the file. Should not have to be invalidated
 	// since we use FileDoc as immutable data-structures.
 	fullpath string
@@ -197,34 +220,13 @@ func NewFileDoc(name, dirID string, size int64, md5Sum []byte, mime, class strin
 }
 
 // ServeFileContent replies to a http request using the content of a
-// file given its FileDoc.
-//
-// It uses internally http.ServeContent and benefits from it by
-// offering support to Range, If-Modified-Since and If-None-Match
-// requests. It uses the revision of the file as the Etag value for
-// non-ranged requests
-//
-// The content disposition is inlined.
+// file given its FileDoc, with the given content disposition (if not empty).
+// See ServeFile.
 func ServeFileContent(fs VFS, doc *FileDoc, disposition string, req *http.Request, w http.ResponseWriter) error {
-	header := w.Header()
-	header.Set("Content-Type", doc.Mime)
 	if disposition != "" {
-		header.Set("Content-Disposition", ContentDisposition(disposition, doc.DocName))
-	}
-
-	if header.Get("Range") == "" {
-		eTag := base64.StdEncoding.EncodeToString(doc.MD5Sum)
-		header.Set("Etag", fmt.Sprintf(`"%s"`, eTag))
-	}
-
-	content, err := fs.OpenFile(doc)
-	if err != nil {
-		return err
+		w.Header().Set("Content-Disposition", ContentDisposition(disposition, doc.DocName))
 	}
-	defer content.Close()
-
-	http.ServeContent(w, req, doc.DocName, doc.UpdatedAt, content)
-	return nil
+	return ServeFile(w, req, fs, doc)
 }
 
 // ModifyFileMetadata modify the metadata associated to a file. It can
@@ -293,6 +295,13 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 	return newdoc, nil
 }
 
+// SetTags replaces the tags of a file. Only the index is updated, the content
+// of the file is left untouched.
+func SetTags(fs VFS, olddoc *FileDoc, tags []string) (*FileDoc, error) {
+	tags = uniqueTags(tags)
+	return ModifyFileMetadata(fs, olddoc, &DocPatch{Tags: &tags})
+}
+
 // TrashFile is used to delete a file given its document
 func TrashFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 	oldpath, err := olddoc.Path(fs)
@@ -349,6 +358,239 @@ func RestoreFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 	return newdoc, err
 }
 
+// MoveFile moves a file to the given directory, with a new name if newName is
+// not empty. The directory is fetched from the index: ErrParentDoesNotExist is
+// returned if it no longer exists, and ErrConflict if it already has a child
+// with the same name. Moving a file inside the trash trashes it, and moving a
+// trashed file outside of the trash restores it.
+func MoveFile(fs VFS, olddoc *FileDoc, destDir *DirDoc, newName string) (*FileDoc, error) {
+	if newName == "" {
+		newName = olddoc.DocName
+	}
+	if err := checkFileName(newName); err != nil {
+		return nil, err
+	}
+
+	dir, err := fs.DirByID(destDir.ID())
+	if os.IsNotExist(err) {
+		return nil, ErrParentDoesNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dir.DocID == olddoc.DirID && newName == olddoc.DocName {
+		return olddoc, nil
+	}
+
+	exists, err := fs.DirChildExists(dir.DocID, newName)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrConflict
+	}
+
+	newdoc := olddoc.Clone().(*FileDoc)
+	newdoc.DirID = dir.DocID
+	newdoc.DocName = newName
+	newdoc.fullpath = path.Join(dir.Fullpath, newName)
+	if path.Ext(newName) != path.Ext(olddoc.DocName) {
+		newdoc.Mime, newdoc.Class = ExtractMimeAndClassFromFilename(newName)
+	}
+
+	inTrash := dir.DocID == consts.TrashDirID ||
+		strings.HasPrefix(dir.Fullpath, TrashDirName+"/")
+	switch {
+	case inTrash && !olddoc.Trashed:
+		oldpath, err := olddoc.Path(fs)
+		if err != nil {
+			return nil, err
+		}
+		newdoc.Trashed = true
+		if dir.DocID == consts.TrashDirID {
+			newdoc.RestorePath = path.Dir(oldpath)
+		}
+	case !inTrash && olddoc.Trashed:
+		newdoc.Trashed = false
+		newdoc.RestorePath = ""
+	case inTrash && dir.DocID != consts.TrashDirID:
+		newdoc.RestorePath = ""
+	}
+
+	if err = fs.UpdateFileDoc(olddoc, newdoc); err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+// MoveAcross moves a file from a VFS to a directory of another VFS (of
+// another instance for example). The content is streamed from the source and
+// checked against its md5sum on the destination, and the source file is
+// destroyed only when the copy has succeeded.
+//
+// If a previous move has been interrupted after the copy, a file with the
+// same name, size and md5sum is already in the destination: it is kept and
+// only the source file is destroyed. If it has been interrupted during the
+// copy, the destination has a hidden file that is destroyed before copying
+// again. A file with the same name but another content makes the move fail
+// with os.ErrExist.
+func MoveAcross(src VFS, srcDoc *FileDoc, dst VFS, destDir *DirDoc) error {
+	name := srcDoc.DocName
+	existing, err := dst.FileByPath(path.Join(destDir.Fullpath, name))
+	switch {
+	case err == nil && existing.Trashed:
+		// The hidden document of an interrupted copy already has the
+		// md5sum of the source, but not its content
+		if err = dst.DestroyFile(existing); err != nil {
+			return err
+		}
+	case err == nil:
+		if existing.ByteSize != srcDoc.ByteSize || !bytes.Equal(existing.MD5Sum, srcDoc.MD5Sum) {
+			return os.ErrExist
+		}
+		return src.DestroyFile(srcDoc)
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	newdoc, err := NewFileDoc(name, destDir.ID(), srcDoc.ByteSize,
+		srcDoc.MD5Sum, srcDoc.Mime, srcDoc.Class, srcDoc.CreatedAt,
+		srcDoc.Executable, false, srcDoc.Tags)
+	if err != nil {
+		return err
+	}
+	newdoc.UpdatedAt = srcDoc.UpdatedAt
+	newdoc.Metadata = srcDoc.Metadata
+	newdoc.TrustedMetadata = true
+
+	content, err := src.OpenFile(srcDoc)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	file, err := dst.CreateFile(newdoc, nil)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	// The size and md5sum are checked on close: an incomplete or corrupted
+	// copy is not committed on the destination.
+	if errc := file.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+	return src.DestroyFile(srcDoc)
+}
+
+// defaultReadFileMaxSize is the maximal size of a file read by ReadFile, when
+// it is not configured.
+const defaultReadFileMaxSize = 10 << 20
+
+func readFileMaxSize() int64 {
+	if size := config.GetConfig().Fs.ReadFileMaxSize; size > 0 {
+		return size
+	}
+	return defaultReadFileMaxSize
+}
+
+// ReadFile returns the whole content of a file. It is meant for small files,
+// and it returns ErrFileTooBigToRead if the file is larger than the
+// configured limit. The content is checked against the md5sum of the index,
+// and ErrInvalidHash is returned if they don't match.
+func ReadFile(fs VFS, doc *FileDoc) ([]byte, error) {
+	max := readFileMaxSize()
+	if doc.ByteSize > max {
+		return nil, ErrFileTooBigToRead
+	}
+	f, err := fs.OpenFile(doc)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := md5.New() // #nosec
+	data, err := ioutil.ReadAll(io.TeeReader(io.LimitReader(f, max+1), h))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, ErrFileTooBigToRead
+	}
+	if !bytes.Equal(h.Sum(nil), doc.MD5Sum) {
+		return nil, ErrInvalidHash
+	}
+	return data, nil
+}
+
+// VerifyFile reads the content of a file, and checks it against the md5sum and
+// the size of its document. It returns if they match, and the md5sum of the
+// content. The content is streamed, not loaded in memory.
+func VerifyFile(fs VFS, doc *FileDoc) (bool, []byte, error) {
+	f, err := fs.OpenFile(doc)
+	if err != nil {
+		return false, nil, err
+	}
+	defer f.Close()
+	md5sum, size, err := ContentSum(f)
+	if err != nil {
+		return false, nil, err
+	}
+	ok := bytes.Equal(md5sum, doc.MD5Sum) && size == doc.ByteSize
+	return ok, md5sum, nil
+}
+
+// ContentSum returns the md5sum and the size of the content read from r.
+func ContentSum(r io.Reader) ([]byte, int64, error) {
+	h := md5.New() // #nosec
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), size, nil
+}
+
+// WriteFile writes the data as the content of the file. The file is created
+// if there is no file with the same name in the directory, or else its
+// content is overwritten. The document is updated with the new size, md5sum
+// and revision.
+func WriteFile(fs VFS, doc *FileDoc, data []byte) error {
+	var olddoc *FileDoc
+	var err error
+	if doc.ID() != "" {
+		olddoc, err = fs.FileByID(doc.ID())
+		if err != nil {
+			return err
+		}
+	} else {
+		var parent *DirDoc
+		parent, err = fs.DirByID(doc.DirID)
+		if err != nil {
+			return err
+		}
+		olddoc, err = fs.FileByPath(path.Join(parent.Fullpath, doc.DocName))
+		if os.IsNotExist(err) {
+			olddoc = nil
+		} else if err != nil {
+			return err
+		}
+	}
+	sum := md5.Sum(data) // #nosec
+	doc.ByteSize = int64(len(data))
+	doc.MD5Sum = sum[:]
+	file, err := fs.CreateFile(doc, olddoc)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if errc := file.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
 func getFileMode(executable bool) os.FileMode {
 	if executable {
 		return 0755 // -rwxr-xr-x
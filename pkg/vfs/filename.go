@@ -0,0 +1,69 @@
+package vfs
+
+import (
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// The policies for the names of the files and directories.
+const (
+	// FilenamePolicyPOSIX only forbids the characters of
+	// ForbiddenFilenameChars.
+	FilenamePolicyPOSIX = "posix"
+	// FilenamePolicyWindows also forbids the names that can't be used on
+	// Windows, for the instances synchronized with Windows clients.
+	FilenamePolicyWindows = "windows"
+)
+
+// windowsForbiddenChars is the list of the characters that can't be used in a
+// filename on Windows, in addition to the control characters.
+const windowsForbiddenChars = `<>:"\|?*`
+
+// windowsReservedNames is the list of the names reserved by Windows for the
+// devices. They can't be used as a filename, even with an extension.
+var windowsReservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// checkFilenamePolicy checks the name against the policy of the
+// configuration, the unknown policies being treated as FilenamePolicyPOSIX.
+// The names of the existing files are not checked again, so changing the
+// policy only applies to the new names.
+func checkFilenamePolicy(name string) error {
+	conf := config.GetConfig().Fs
+	reserved := conf.ReservedFilenames
+	if conf.FilenamePolicy == FilenamePolicyWindows {
+		if strings.ContainsAny(name, windowsForbiddenChars) ||
+			strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+			return ErrIllegalFilename
+		}
+		for _, r := range name {
+			if r < 0x20 {
+				return ErrIllegalFilename
+			}
+		}
+		if len(reserved) == 0 {
+			reserved = windowsReservedNames
+		}
+	}
+	if isReservedFilename(name, reserved) {
+		return ErrIllegalFilename
+	}
+	return nil
+}
+
+// isReservedFilename returns true if the name, or the name without its
+// extension, is one of the reserved names, without regard to the case.
+func isReservedFilename(name string, reserved []string) bool {
+	base := strings.TrimSuffix(name, path.Ext(name))
+	for _, r := range reserved {
+		if strings.EqualFold(name, r) || strings.EqualFold(base, r) {
+			return true
+		}
+	}
+	return false
+}
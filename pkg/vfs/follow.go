@@ -0,0 +1,122 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+// OpenFileFollow opens the content of a file to follow it, like `tail -f`:
+// when the reader reaches the end of the content, it waits for the bytes
+// appended to the file (see OpenOrCreate) instead of returning io.EOF. The
+// reader returns io.EOF when the deadline has passed (unless zero), or when
+// the file is deleted or truncated.
+//
+// The appended bytes are known by the realtime events of the file, and so
+// they can be read only when the writer has been closed.
+func OpenFileFollow(fs VFS, doc *FileDoc, deadline time.Time) (io.ReadCloser, error) {
+	// The subscription is made before opening the file to not miss an event
+	// between the two.
+	sub := realtime.GetHub().Subscriber(fs)
+	if err := sub.Watch(consts.Files, doc.ID()); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	f, err := fs.OpenFile(doc)
+	if err != nil {
+		sub.Close()
+		return nil, err
+	}
+	return &followedFile{
+		fs:       fs,
+		f:        f,
+		sub:      sub,
+		deadline: deadline,
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+type followedFile struct {
+	fs        VFS
+	f         File
+	offset    int64
+	sub       *realtime.DynamicSubscriber
+	deadline  time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (f *followedFile) Read(p []byte) (int, error) {
+	for {
+		n, err := f.f.Read(p)
+		f.offset += int64(n)
+		if n > 0 || err != io.EOF {
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		if err = f.wait(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait blocks until some content is appended to the file, and reopens it at
+// the current offset.
+func (f *followedFile) wait() error {
+	var timeout <-chan time.Time
+	if !f.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(f.deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case <-f.closed:
+			return os.ErrClosed
+		case <-timeout:
+			return io.EOF
+		case e, ok := <-f.sub.Channel:
+			if !ok || e.Verb == realtime.EventDelete {
+				return io.EOF
+			}
+			doc, ok := e.Doc.(*FileDoc)
+			if !ok || doc.ByteSize == f.offset {
+				continue
+			}
+			if doc.Trashed || doc.ByteSize < f.offset {
+				return io.EOF
+			}
+			return f.reopen(doc)
+		}
+	}
+}
+
+func (f *followedFile) reopen(doc *FileDoc) error {
+	file, err := f.fs.OpenFile(doc)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Seek(f.offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	f.f.Close()
+	f.f = file
+	return nil
+}
+
+func (f *followedFile) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		close(f.closed)
+		f.sub.Close()
+		err = f.f.Close()
+	})
+	return err
+}
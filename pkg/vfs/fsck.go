@@ -195,6 +195,9 @@ func FsckPrune(fs VFS, indexer Indexer, entry *FsckLog, dryrun bool) {
 			return
 		}
 		entry.PruneAction = "updating the index informations to match the stored data"
+		if dryrun {
+			return
+		}
 		if err := indexer.UpdateFileDoc(entry.OldFileDoc, entry.FileDoc); err != nil {
 			entry.PruneError = err
 		}
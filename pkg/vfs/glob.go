@@ -0,0 +1,101 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// globMeta are the characters with a special meaning in a glob pattern.
+const globMeta = `*?[\`
+
+// Glob returns the files whose path matches the given pattern. See GlobFunc.
+func Glob(fs Indexer, pattern string) ([]*FileDoc, error) {
+	var docs []*FileDoc
+	err := GlobFunc(fs, pattern, func(doc *FileDoc) error {
+		docs = append(docs, doc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// GlobFunc calls fn for each file whose path matches the given pattern, with
+// the syntax of path.Match. The pattern must be an absolute path. Only the
+// index is used: the directories are listed level by level, starting from the
+// longest prefix without special characters, and as the wildcards never match
+// a slash, the depth of the search is limited by the number of components in
+// the pattern. If fn returns an error, the iteration stops with this error.
+func GlobFunc(fs Indexer, pattern string, fn func(doc *FileDoc) error) error {
+	if !path.IsAbs(pattern) {
+		return ErrNonAbsolutePath
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	pattern = path.Clean(pattern)
+	segments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+
+	i := 0
+	for i < len(segments) && !strings.ContainsAny(segments[i], globMeta) {
+		i++
+	}
+	if i == len(segments) {
+		doc, err := fs.FileByPath(pattern)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(doc)
+	}
+
+	dir, err := fs.DirByPath("/" + path.Join(segments[:i]...))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return globDir(fs, dir, segments[i:], fn)
+}
+
+func globDir(fs Indexer, dir *DirDoc, segments []string, fn func(doc *FileDoc) error) error {
+	inTrash := strings.HasPrefix(dir.Fullpath, TrashDirName)
+	iter := fs.DirIterator(dir, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == ErrIteratorDone {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var name string
+		if d != nil {
+			name = d.DocName
+		} else {
+			name = f.DocName
+		}
+		if ok, _ := path.Match(segments[0], name); !ok {
+			continue
+		}
+		if len(segments) > 1 {
+			if d != nil {
+				if err = globDir(fs, d, segments[1:], fn); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		// The files being uploaded are hidden with the trashed flag
+		if f != nil && (inTrash || !f.Trashed) {
+			if err = fn(f); err != nil {
+				return err
+			}
+		}
+	}
+}
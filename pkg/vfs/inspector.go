@@ -0,0 +1,73 @@
+package vfs
+
+import "io"
+
+// ContentInspector receives the content of a file while it is uploaded, to
+// check it, with a virus scanner for example. It can reject the content by
+// returning ErrContentRejected from Write or Close: the upload then fails,
+// and the file is not modified.
+type ContentInspector io.WriteCloser
+
+// ContentInspectorFunc returns the inspector for the upload of a file, or nil
+// if the file does not need to be inspected.
+type ContentInspectorFunc func(doc *FileDoc) ContentInspector
+
+// inspectorQueueLen is the number of chunks of content that can wait to be
+// inspected, before the writes of the upload are blocked.
+const inspectorQueueLen = 16
+
+type asyncInspector struct {
+	inspector ContentInspector
+	chunks    chan []byte
+	done      chan struct{}
+	err       error
+}
+
+// NewAsyncInspector returns an inspector that runs the given one in its own
+// goroutine, so that the upload is not slowed down by the inspection of each
+// chunk of content. The chunks are queued in a bounded buffer: if the
+// inspector is slower than the upload, the writes wait for it.
+func NewAsyncInspector(inspector ContentInspector) ContentInspector {
+	a := &asyncInspector{
+		inspector: inspector,
+		chunks:    make(chan []byte, inspectorQueueLen),
+		done:      make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *asyncInspector) run() {
+	defer close(a.done)
+	for chunk := range a.chunks {
+		if _, err := a.inspector.Write(chunk); err != nil {
+			a.inspector.Close() // #nosec
+			a.err = err
+			return
+		}
+	}
+	a.err = a.inspector.Close()
+}
+
+func (a *asyncInspector) Write(p []byte) (int, error) {
+	select {
+	case <-a.done:
+		return 0, a.err
+	default:
+	}
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+	select {
+	case a.chunks <- chunk:
+		return len(p), nil
+	case <-a.done:
+		return 0, a.err
+	}
+}
+
+// Close waits for the end of the inspection, and returns its verdict.
+func (a *asyncInspector) Close() error {
+	close(a.chunks)
+	<-a.done
+	return a.err
+}
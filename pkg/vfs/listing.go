@@ -0,0 +1,118 @@
+package vfs
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+// The orders of the entries of a listing.
+const (
+	ListSortByName  = "name"
+	ListSortBySize  = "size"
+	ListSortByMTime = "mtime"
+)
+
+// ListDirOptions are the options of ListDirJSON.
+type ListDirOptions struct {
+	// Cursor is the cursor of the previous page, to list the next entries.
+	Cursor string
+	// Limit is the maximal number of entries in the page, or zero for all of
+	// them.
+	Limit int
+	// IncludeTrash adds the trash directory and the trashed files to the
+	// entries.
+	IncludeTrash bool
+	// IncludeHidden adds the entries whose name starts with a dot.
+	IncludeHidden bool
+	// SortBy is the order of the entries in the page: name, size or mtime.
+	// The pages are always made in the order of the identifiers, so the
+	// entries are only sorted inside a page.
+	SortBy string
+}
+
+// DirEntry is an entry of a listing, for a file or a directory. Size is zero
+// for a directory.
+type DirEntry struct {
+	ID    string    `json:"id"`
+	Name  string    `json:"name"`
+	Type  string    `json:"type"`
+	Size  int64     `json:"size"`
+	MTime time.Time `json:"mtime"`
+}
+
+// DirListing is a page of the entries of a directory. Cursor is empty on the
+// last page.
+type DirListing struct {
+	Entries []*DirEntry `json:"entries"`
+	Cursor  string      `json:"cursor,omitempty"`
+}
+
+// ListDirJSON returns a page of the entries of the directory, from the index,
+// in a form that can be marshaled to JSON for a file browser.
+func ListDirJSON(fs VFS, doc *DirDoc, opts *ListDirOptions) (*DirListing, error) {
+	if opts == nil {
+		opts = &ListDirOptions{}
+	}
+	iter := fs.DirIterator(doc, &IteratorOptions{AfterID: opts.Cursor})
+	listing := &DirListing{Entries: []*DirEntry{}}
+	for {
+		d, f, err := iter.Next()
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry := newDirEntry(d, f)
+		if !opts.IncludeTrash && (entry.ID == consts.TrashDirID || (f != nil && f.Trashed)) {
+			continue
+		}
+		if !opts.IncludeHidden && strings.HasPrefix(entry.Name, ".") {
+			continue
+		}
+		if opts.Limit > 0 && len(listing.Entries) == opts.Limit {
+			// There is at least one more entry for the next page
+			listing.Cursor = listing.Entries[len(listing.Entries)-1].ID
+			break
+		}
+		listing.Entries = append(listing.Entries, entry)
+	}
+	sortDirEntries(listing.Entries, opts.SortBy)
+	return listing, nil
+}
+
+func newDirEntry(d *DirDoc, f *FileDoc) *DirEntry {
+	if d != nil {
+		return &DirEntry{
+			ID:    d.ID(),
+			Name:  d.DocName,
+			Type:  consts.DirType,
+			MTime: d.UpdatedAt,
+		}
+	}
+	return &DirEntry{
+		ID:    f.ID(),
+		Name:  f.DocName,
+		Type:  consts.FileType,
+		Size:  f.ByteSize,
+		MTime: f.UpdatedAt,
+	}
+}
+
+func sortDirEntries(entries []*DirEntry, sortBy string) {
+	var less func(a, b *DirEntry) bool
+	switch sortBy {
+	case ListSortByName:
+		less = func(a, b *DirEntry) bool { return a.Name < b.Name }
+	case ListSortBySize:
+		less = func(a, b *DirEntry) bool { return a.Size < b.Size }
+	case ListSortByMTime:
+		less = func(a, b *DirEntry) bool { return a.MTime.Before(b.MTime) }
+	default:
+		return
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+}
@@ -18,6 +18,8 @@ import (
 	// Same for image/webp
 	_ "golang.org/x/image/webp"
 
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/magic"
 	"github.com/cozy/goexif2/exif"
 	"github.com/dhowden/tag"
 )
@@ -46,8 +48,13 @@ type MetaExtractor interface {
 }
 
 // NewMetaExtractor returns an extractor for metadata if the mime type has one,
-// or null else
+// or null else. There is also no extractor for a document with trusted
+// metadata, or with a class for which the extraction has not been enabled in
+// the configuration.
 func NewMetaExtractor(doc *FileDoc) *MetaExtractor {
+	if doc.TrustedMetadata || !metadataClassEnabled(doc) {
+		return nil
+	}
 	var e MetaExtractor
 	switch doc.Mime {
 	case "image/jpeg":
@@ -59,12 +66,194 @@ func NewMetaExtractor(doc *FileDoc) *MetaExtractor {
 	case "audio/mp3", "audio/mpeg", "audio/ogg", "audio/x-m4a", "audio/flac":
 		e = NewAudioExtractor()
 	}
-	if e != nil {
-		return &e
+	if e == nil {
+		return nil
+	}
+	if budget := metadataExtractionBudget(); budget > 0 {
+		e = &budgetMetaExtractor{MetaExtractor: e, remaining: budget}
+	}
+	return &e
+}
+
+func metadataExtractionBudget() int64 {
+	return config.GetConfig().Fs.MetadataExtractionBudget
+}
+
+// metadataClassEnabled returns true if the metadata can be extracted for the
+// class of the document: the configuration can restrict the extraction to some
+// classes (all of them by default).
+func metadataClassEnabled(doc *FileDoc) bool {
+	classes := config.GetConfig().Fs.MetadataClasses
+	if len(classes) == 0 {
+		return true
+	}
+	class := doc.Class
+	if class == "" {
+		_, class = ExtractMimeAndClass(doc.Mime)
+	}
+	for _, c := range classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// budgetMetaExtractor is a MetaExtractor that only gives the first bytes of
+// the content to the underlying extractor: the metadata are usually at the
+// beginning of the files, and the rest of the content is just ignored.
+type budgetMetaExtractor struct {
+	MetaExtractor
+	remaining int64
+}
+
+func (e *budgetMetaExtractor) Write(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		return len(p), nil
+	}
+	l := len(p)
+	if int64(l) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.MetaExtractor.Write(p)
+	e.remaining -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return l, nil
+}
+
+// SniffLen is the number of bytes at the beginning of a file that are used to
+// detect its content type.
+const SniffLen = 512
+
+// RefreshContentType updates the mime type and class of a document, by
+// looking at the first bytes of its content. The mime type given by the
+// client is kept, unless it is the generic one or, when the document
+// overwrites olddoc, the one of the old content, which may have been carried
+// over. olddoc is nil for a new document. The sniffing is done by the magic
+// package, like for the files of the applications, and the text and zip types
+// are too generic to replace the type of the document. It returns true if the
+// mime type has been changed.
+func RefreshContentType(newdoc, olddoc *FileDoc, head []byte) bool {
+	if newdoc.Mime != DefaultContentType && (olddoc == nil || newdoc.Mime != olddoc.Mime) {
+		return false
+	}
+	mime, class := ExtractMimeAndClass(magic.MIMEType(head))
+	switch mime {
+	case "", DefaultContentType, "text/plain", "application/zip", newdoc.Mime:
+		return false
+	}
+	newdoc.Mime = mime
+	newdoc.Class = class
+	return true
+}
+
+// ContentSniffer is given the content of a new file while it is written: it
+// keeps its first bytes to refresh the type of the document (see
+// RefreshContentType), and then runs the metadata extractor for this type. The
+// extraction starts once the type is known, so the content never has to be
+// read again when the type given by the client is replaced.
+type ContentSniffer struct {
+	doc       *FileDoc // clone of the new document, with the refreshed type
+	olddoc    *FileDoc
+	head      []byte
+	meta      *MetaExtractor
+	sniffed   bool
+	refreshed bool
+	extracted bool
+	metadata  Metadata
+}
+
+// NewContentSniffer returns a sniffer for the content of newdoc, which
+// overwrites olddoc (nil for a new file).
+func NewContentSniffer(newdoc, olddoc *FileDoc) *ContentSniffer {
+	return &ContentSniffer{
+		doc:    newdoc.Clone().(*FileDoc),
+		olddoc: olddoc,
+	}
+}
+
+// Write implements io.Writer. It never fails, the extraction of the metadata
+// is just stopped on an error.
+func (s *ContentSniffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if !s.sniffed {
+		l := SniffLen - len(s.head)
+		if l > len(p) {
+			l = len(p)
+		}
+		s.head = append(s.head, p[:l]...)
+		p = p[l:]
+		if len(s.head) < SniffLen {
+			return n, nil
+		}
+		s.sniff()
+	}
+	s.extract(p)
+	return n, nil
+}
+
+// sniff refreshes the type of the document from the first bytes, and starts
+// the extraction of the metadata for this type.
+func (s *ContentSniffer) sniff() {
+	s.sniffed = true
+	s.refreshed = RefreshContentType(s.doc, s.olddoc, s.head)
+	s.meta = NewMetaExtractor(s.doc)
+	s.extract(s.head)
+}
+
+func (s *ContentSniffer) extract(p []byte) {
+	if s.meta == nil || len(p) == 0 {
+		return
+	}
+	if _, err := (*s.meta).Write(p); err != nil && err != io.ErrClosedPipe {
+		(*s.meta).Abort(err)
+		s.meta = nil
+	}
+}
+
+// Abort stops the extraction of the metadata.
+func (s *ContentSniffer) Abort(err error) {
+	s.sniffed = true
+	if s.meta != nil {
+		(*s.meta).Abort(err)
+		s.meta = nil
+	}
+}
+
+// Close finishes the detection of the type, for a content shorter than
+// SniffLen, and the extraction of the metadata.
+func (s *ContentSniffer) Close() error {
+	if !s.sniffed {
+		s.sniff()
+	}
+	if s.meta != nil {
+		if err := (*s.meta).Close(); err == nil {
+			s.metadata = (*s.meta).Result()
+			s.extracted = true
+		}
+		s.meta = nil
 	}
 	return nil
 }
 
+// Update sets the refreshed type and the extracted metadata on the document.
+// The stale metadata of an overwritten file are removed when its type has
+// changed, except if they have been given and are trusted.
+func (s *ContentSniffer) Update(newdoc *FileDoc) {
+	if s.refreshed {
+		newdoc.Mime = s.doc.Mime
+		newdoc.Class = s.doc.Class
+		if !newdoc.TrustedMetadata {
+			newdoc.Metadata = nil
+		}
+	}
+	if s.extracted {
+		newdoc.Metadata = s.metadata
+	}
+}
+
 // ImageExtractor is used to extract width/height from images
 type ImageExtractor struct {
 	w         *io.PipeWriter
@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -31,6 +32,27 @@ func TestImageMetadataExtractor(t *testing.T) {
 	assert.Equal(t, 140, h)
 }
 
+func TestContentSniffer(t *testing.T) {
+	doc := &FileDoc{Mime: DefaultContentType, Class: "files"}
+	sniffer := NewContentSniffer(doc, nil)
+	f, err := os.Open("../../assets/images/happycloud.png")
+	assert.NoError(t, err)
+	defer f.Close()
+	// Small writes, so the type is only known after a few of them
+	buf := make([]byte, 100)
+	_, err = io.CopyBuffer(struct{ io.Writer }{sniffer}, f, buf)
+	assert.NoError(t, err)
+	assert.NoError(t, sniffer.Close())
+	assert.Equal(t, DefaultContentType, doc.Mime)
+	sniffer.Update(doc)
+	assert.Equal(t, "image/png", doc.Mime)
+	assert.Equal(t, "image", doc.Class)
+	if assert.NotNil(t, doc.Metadata) {
+		assert.Equal(t, 140, doc.Metadata["width"])
+		assert.Equal(t, 140, doc.Metadata["height"])
+	}
+}
+
 func TestExifMetadataExtractor(t *testing.T) {
 	doc := &FileDoc{Mime: "image/jpeg"}
 	extractor := NewMetaExtractor(doc)
@@ -58,3 +80,42 @@ func TestExifMetadataExtractor(t *testing.T) {
 	assert.True(t, ok, "height is present")
 	assert.Equal(t, 294, h)
 }
+
+type countingExtractor struct {
+	written int
+}
+
+func (e *countingExtractor) Write(p []byte) (int, error) {
+	e.written += len(p)
+	return len(p), nil
+}
+func (e *countingExtractor) Close() error     { return nil }
+func (e *countingExtractor) Abort(err error)  {}
+func (e *countingExtractor) Result() Metadata { return NewMetadata() }
+
+func TestBudgetMetaExtractor(t *testing.T) {
+	counter := &countingExtractor{}
+	e := &budgetMetaExtractor{MetaExtractor: counter, remaining: 10}
+	n, err := e.Write([]byte("0123456"))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, n)
+	n, err = e.Write([]byte("789abcdef"))
+	assert.NoError(t, err)
+	assert.Equal(t, 9, n)
+	n, err = e.Write([]byte("ghijk"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, 10, counter.written)
+}
+
+func TestMetadataClasses(t *testing.T) {
+	defer func() { config.GetConfig().Fs.MetadataClasses = nil }()
+	config.GetConfig().Fs.MetadataClasses = []string{"audio"}
+	assert.Nil(t, NewMetaExtractor(&FileDoc{Mime: "image/png", Class: "image"}))
+	assert.Nil(t, NewMetaExtractor(&FileDoc{Mime: "image/jpeg"}))
+	assert.NotNil(t, NewMetaExtractor(&FileDoc{Mime: "audio/mpeg", Class: "audio"}))
+
+	config.GetConfig().Fs.MetadataClasses = []string{"image", "audio"}
+	assert.NotNil(t, NewMetaExtractor(&FileDoc{Mime: "image/png", Class: "image"}))
+	assert.NotNil(t, NewMetaExtractor(&FileDoc{Mime: "image/jpeg"}))
+}
@@ -35,8 +35,8 @@ func reseed() uint32 {
 }
 
 // tryOrUseSuffix will try the given function until it succeed without
-// an os.ErrExist error. It is used for renaming safely a file without
-// collision.
+// an os.ErrExist or ErrConflict error. It is used for renaming safely a file
+// without collision.
 func tryOrUseSuffix(name, format string, do func(suffix string) error) error {
 	var err error
 	nconflict := 0
@@ -48,7 +48,7 @@ func tryOrUseSuffix(name, format string, do func(suffix string) error) error {
 			newname = fmt.Sprintf(format, name, nextSuffix())
 		}
 		err = do(newname)
-		if !os.IsExist(err) {
+		if !os.IsExist(err) && err != ErrConflict {
 			break
 		}
 		if nconflict++; nconflict > 10 {
@@ -0,0 +1,93 @@
+package vfs
+
+import (
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+const (
+	defaultIndexRetryAttempts = 2
+	defaultIndexRetryDelay    = 200 * time.Millisecond
+)
+
+// RetryPolicy describes how the operations on the index are retried when
+// couchdb returns a transient error (5xx or unreachable server). Conflicts
+// are never retried, and only the idempotent operations must be retried: the
+// updates of a document with its revision, and the creations with an
+// identifier chosen by the stack.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of calls, including the first one.
+	MaxAttempts int
+	// Delay is the time to wait before a new attempt. It is multiplied by the
+	// number of attempts already made.
+	Delay time.Duration
+}
+
+// IndexRetryPolicy returns the retry policy for the index operations, as
+// configured in the fs section of the configuration.
+func IndexRetryPolicy() RetryPolicy {
+	r := RetryPolicy{
+		MaxAttempts: defaultIndexRetryAttempts,
+		Delay:       defaultIndexRetryDelay,
+	}
+	conf := config.GetConfig().Fs
+	if conf.IndexRetryAttempts > 0 {
+		r.MaxAttempts = conf.IndexRetryAttempts
+	}
+	if conf.IndexRetryDelay > 0 {
+		r.Delay = conf.IndexRetryDelay
+	}
+	return r
+}
+
+// Do calls fn until it succeeds, returns an error that is not transient, or
+// the maximum number of attempts is reached.
+func (r RetryPolicy) Do(fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= r.MaxAttempts || !isTransientError(err) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * r.Delay)
+	}
+}
+
+// CreateFileDoc adds the document to the index. The creation is retried only
+// if the document already has an identifier: with an identifier generated by
+// couchdb, a creation that has landed despite an error would be duplicated.
+func (r RetryPolicy) CreateFileDoc(index Indexer, doc *FileDoc) error {
+	if doc.ID() == "" {
+		return index.CreateFileDoc(doc)
+	}
+	return r.Do(func() error {
+		return index.CreateNamedFileDoc(doc)
+	})
+}
+
+// CreateDirDoc is like CreateFileDoc, for a directory.
+func (r RetryPolicy) CreateDirDoc(index Indexer, doc *DirDoc) error {
+	if doc.ID() == "" {
+		return index.CreateDirDoc(doc)
+	}
+	return r.Do(func() error {
+		return index.CreateNamedDirDoc(doc)
+	})
+}
+
+// isTransientError returns true for a 5xx response of couchdb, and for an
+// error of connection to the server (they are usually wrapped by the couchdb
+// package in a 503 error).
+func isTransientError(err error) bool {
+	if couchdb.IsInternalServerError(err) {
+		return true
+	}
+	switch err.(type) {
+	case *url.Error, net.Error:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package vfs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// defaultCopyBufferSize is the size of the buffers used to copy the content of
+// the files, when it is not configured.
+const defaultCopyBufferSize = 32 << 10
+
+// copyBuffers is the pool of the buffers used by CopyPooled.
+var copyBuffers sync.Pool
+
+func copyBufferSize() int {
+	if size := config.GetConfig().Fs.CopyBufferSize; size > 0 {
+		return size
+	}
+	return defaultCopyBufferSize
+}
+
+// ServeFile replies to a http request with the content of a file, using
+// http.ServeContent: it offers the support of the Range, If-Range,
+// If-Modified-Since and If-None-Match requests. The size, the modification
+// time and the ETag (from the md5sum) come from the document in the index,
+// not from the storage.
+//
+// The files of the applications, which can be stored compressed, are served
+// by their apps.FileServer instead.
+func ServeFile(w http.ResponseWriter, req *http.Request, fs VFS, doc *FileDoc) error {
+	header := w.Header()
+	header.Set("Content-Type", doc.Mime)
+	eTag := base64.StdEncoding.EncodeToString(doc.MD5Sum)
+	header.Set("Etag", fmt.Sprintf(`"%s"`, eTag))
+
+	content, err := fs.OpenFile(doc)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	http.ServeContent(pooledResponse{w}, req, doc.DocName, doc.UpdatedAt, &sizedContent{content, doc.ByteSize})
+	return nil
+}
+
+// sizedContent is the content of a file, with the size of its document: it is
+// what http.ServeContent gets when it seeks to the end of the content to know
+// its size, without asking it to the storage.
+type sizedContent struct {
+	File
+	size int64
+}
+
+func (s *sizedContent) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekEnd {
+		offset, whence = s.size+offset, io.SeekStart
+	}
+	return s.File.Seek(offset, whence)
+}
+
+// pooledResponse is the response given to http.ServeContent: the content is
+// copied to it with CopyPooled, where the ReadFrom of the http server would
+// allocate a new buffer for each download.
+type pooledResponse struct {
+	http.ResponseWriter
+}
+
+func (w pooledResponse) ReadFrom(src io.Reader) (int64, error) {
+	return CopyPooled(w.ResponseWriter, src)
+}
+
+// CopyPooled copies src to dst, like io.Copy, but with a buffer taken from a
+// pool shared by all the copies instead of a new one. The WriterTo and
+// ReaderFrom of src and dst are not used, as they would bypass the buffer.
+//
+// With the default size of 32KB, a copy allocates a few bytes instead of the
+// whole buffer, once the pool is warm.
+func CopyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	size := copyBufferSize()
+	buf, ok := copyBuffers.Get().(*[]byte)
+	if !ok || len(*buf) != size {
+		b := make([]byte, size)
+		buf = &b
+	}
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *buf)
+}
+
+// writerOnly and readerOnly hide the optional interfaces of a writer or a
+// reader to io.CopyBuffer.
+type writerOnly struct{ io.Writer }
+type readerOnly struct{ io.Reader }
@@ -0,0 +1,60 @@
+package vfs
+
+import (
+	"os"
+	"time"
+)
+
+// fileInfo is an os.FileInfo built from the fields of a document of the
+// index. Its Sys method returns the document.
+type fileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+	doc   interface{}
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return f.size }
+func (f *fileInfo) Mode() os.FileMode  { return f.mode }
+func (f *fileInfo) ModTime() time.Time { return f.mtime }
+func (f *fileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f *fileInfo) Sys() interface{}   { return f.doc }
+
+// StatFile returns the information about a file, from its document only. If
+// checkBackend is true and the VFS implements BackendStater, the size of the
+// content in the storage backend is also compared with the size in the index,
+// and ErrContentLengthMismatch is returned if they differ.
+func StatFile(fs VFS, doc *FileDoc, checkBackend bool) (os.FileInfo, error) {
+	if checkBackend {
+		if stater, ok := fs.(BackendStater); ok {
+			size, err := stater.BackendStat(doc)
+			if err != nil {
+				return nil, err
+			}
+			if size != doc.ByteSize {
+				return nil, ErrContentLengthMismatch
+			}
+		}
+	}
+	return &fileInfo{
+		name:  doc.DocName,
+		size:  doc.ByteSize,
+		mode:  doc.Mode(),
+		mtime: doc.UpdatedAt,
+		doc:   doc,
+	}, nil
+}
+
+// StatDir returns the information about a directory, from its document.
+func StatDir(fs VFS, doc *DirDoc) (os.FileInfo, error) {
+	return &fileInfo{
+		name:  doc.DocName,
+		mode:  os.ModeDir | doc.Mode(),
+		mtime: doc.UpdatedAt,
+		doc:   doc,
+	}, nil
+}
+
+var _ os.FileInfo = &fileInfo{}
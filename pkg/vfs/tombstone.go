@@ -0,0 +1,76 @@
+package vfs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// fileTombstone is the document kept in the index when a file is destroyed.
+// The couchdb views don't index the deleted documents: the tombstones are used
+// by ChangedSince to report the destroyed files to the clients.
+type fileTombstone struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	FileID    string    `json:"file_id"`
+	DirID     string    `json:"dir_id"`
+	Name      string    `json:"name"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// newTombstone returns the tombstone of the file with the given path, or nil
+// for the hidden document of a file being uploaded, as the clients have never
+// seen it.
+func newTombstone(doc *FileDoc, fullpath string, now time.Time) *fileTombstone {
+	if isHiddenUpload(doc, fullpath) {
+		return nil
+	}
+	return &fileTombstone{
+		FileID:    doc.ID(),
+		DirID:     doc.DirID,
+		Name:      doc.DocName,
+		DeletedAt: now,
+	}
+}
+
+// isHiddenUpload returns true if the file with the given path is the hidden
+// document of a new file whose content is being uploaded: it is trashed, but
+// not in the trash.
+func isHiddenUpload(doc *FileDoc, fullpath string) bool {
+	return doc.Trashed && !strings.HasPrefix(fullpath, TrashDirName+"/")
+}
+
+// fileDoc returns the document of the destroyed file, with Deleted set.
+func (t *fileTombstone) fileDoc() *FileDoc {
+	return &FileDoc{
+		Type:      consts.FileType,
+		DocID:     t.FileID,
+		DocName:   t.Name,
+		DirID:     t.DirID,
+		UpdatedAt: t.DeletedAt,
+		Deleted:   true,
+	}
+}
+
+// ID implements couchdb.Doc
+func (t *fileTombstone) ID() string { return t.DocID }
+
+// Rev implements couchdb.Doc
+func (t *fileTombstone) Rev() string { return t.DocRev }
+
+// DocType implements couchdb.Doc
+func (t *fileTombstone) DocType() string { return consts.FilesTombstones }
+
+// Clone implements couchdb.Doc
+func (t *fileTombstone) Clone() couchdb.Doc {
+	cloned := *t
+	return &cloned
+}
+
+// SetID implements couchdb.Doc
+func (t *fileTombstone) SetID(id string) { t.DocID = id }
+
+// SetRev implements couchdb.Doc
+func (t *fileTombstone) SetRev(rev string) { t.DocRev = rev }
@@ -0,0 +1,118 @@
+package vfs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+// trashBatchSize is the number of elements of the trash fetched at once by
+// EmptyTrash and RestoreAllTrash.
+const trashBatchSize = 100
+
+// TrashFailure is an element at the root of the trash that could not be
+// destroyed or restored.
+type TrashFailure struct {
+	ID   string
+	Name string
+	Err  error
+}
+
+// ErrTrashFailures is returned by EmptyTrash and RestoreAllTrash when some
+// elements of the trash could not be processed. The other elements have been
+// processed, so calling the function again only retries the failed ones.
+type ErrTrashFailures []TrashFailure
+
+func (e ErrTrashFailures) Error() string {
+	msgs := make([]string, len(e))
+	for i, failure := range e {
+		msgs[i] = fmt.Sprintf("%s: %s", failure.Name, failure.Err)
+	}
+	return fmt.Sprintf("%d elements of the trash have failed (%s)",
+		len(e), strings.Join(msgs, ", "))
+}
+
+// EmptyTrash destroys the files and directories of the trash, with their
+// content. An element that can not be destroyed does not stop the others: the
+// failures are returned in an ErrTrashFailures.
+func EmptyTrash(fs VFS) error {
+	return forEachInTrash(fs, func(dir *DirDoc, file *FileDoc) error {
+		if dir != nil {
+			return fs.DestroyDirAndContent(dir)
+		}
+		return fs.DestroyFile(file)
+	})
+}
+
+// RestoreAllTrash moves the files and directories of the trash back to their
+// original location. As for RestoreFile and RestoreDir, an element whose name
+// is already taken is restored with a suffix, and an element whose directory
+// no longer exists is restored at the root. An element that can not be
+// restored does not stop the others: the failures are returned in an
+// ErrTrashFailures.
+func RestoreAllTrash(fs VFS) error {
+	return forEachInTrash(fs, func(dir *DirDoc, file *FileDoc) error {
+		if dir != nil {
+			_, err := RestoreDir(fs, dir)
+			return err
+		}
+		_, err := RestoreFile(fs, file)
+		return err
+	})
+}
+
+// forEachInTrash calls fn for each element at the root of the trash. The
+// elements are fetched by batches, in the order of their identifiers, with a
+// new iterator each time as the elements processed are no longer in the
+// trash.
+func forEachInTrash(fs VFS, fn func(dir *DirDoc, file *FileDoc) error) error {
+	trash, err := fs.DirByID(consts.TrashDirID)
+	if err != nil {
+		return err
+	}
+
+	var failures ErrTrashFailures
+	afterID := ""
+	for {
+		iter := fs.DirIterator(trash, &IteratorOptions{
+			AfterID: afterID,
+			ByFetch: trashBatchSize,
+		})
+		var dirs []*DirDoc
+		var files []*FileDoc
+		for len(dirs) < trashBatchSize {
+			d, f, err := iter.Next()
+			if err == ErrIteratorDone {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, d)
+			files = append(files, f)
+		}
+		if len(dirs) == 0 {
+			break
+		}
+
+		for i, dir := range dirs {
+			file := files[i]
+			var id, name string
+			if dir != nil {
+				id, name = dir.ID(), dir.DocName
+			} else {
+				id, name = file.ID(), file.DocName
+			}
+			afterID = id
+			if err = fn(dir, file); err != nil {
+				failures = append(failures, TrashFailure{ID: id, Name: name, Err: err})
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -88,12 +89,44 @@ type Fs interface {
 
 	// Fsck return the list of inconsistencies in the VFS
 	Fsck(opts FsckOptions) (logbook []*FsckLog, err error)
+
+	// Capabilities returns the storage backend of the VFS, and the features
+	// that it supports.
+	Capabilities() Capabilities
+}
+
+// Capabilities describes the storage backend of a VFS, for the callers that
+// choose a strategy depending on it.
+type Capabilities struct {
+	// Backend is the scheme of the storage: "file", "mem" or "swift".
+	Backend string `json:"backend"`
+	// StatFS is true if the free space of the storage can be asked to the
+	// filesystem of the server.
+	StatFS bool `json:"statfs"`
+	// Symlinks is true if the storage can have symbolic links.
+	Symlinks bool `json:"symlinks"`
+	// AtomicRename is true if the content of a file is moved atomically, and
+	// not copied and then deleted.
+	AtomicRename bool `json:"atomic_rename"`
+	// RangeReads is true if a part of the content of a file can be read
+	// without reading it from the beginning.
+	RangeReads bool `json:"range_reads"`
 }
 
 // FsckOptions contains the options for the filesystem check process.
 type FsckOptions struct {
 	Prune  bool
 	DryRun bool
+	// CheckContent is true to read the content of the files and compare it
+	// with their md5sum in the index, which is slow on large instances. It is
+	// only supported by the afero VFS.
+	CheckContent bool
+	// Workers is the number of files whose content is checked concurrently
+	// (one if zero).
+	Workers int
+	// Progress, if not nil, is called with the number of files whose content
+	// has been checked so far. It can be called concurrently.
+	Progress func(checked int)
 }
 
 // File is a reader, writer, seeker, closer iterface representing an opened
@@ -181,6 +214,21 @@ type Indexer interface {
 	DirBatch(*DirDoc, couchdb.Cursor) ([]DirOrFileDoc, error)
 	DirLength(*DirDoc) (int, error)
 	DirChildExists(dirID, filename string) (bool, error)
+
+	// FilesByTag returns a batch of the files that have the given tag.
+	FilesByTag(tag string, cursor couchdb.Cursor) ([]*FileDoc, error)
+	// HiddenFiles returns the hidden documents of the new files whose content
+	// is being uploaded, or has been left by an unfinished upload: they are
+	// trashed, but not in the trash.
+	HiddenFiles() ([]*FileDoc, error)
+	// ChangedSince returns a batch of the files that have been modified since
+	// the given time, ordered by modification date, then of the files that
+	// have been destroyed since this time, with Deleted set, and the cursor
+	// for the next batch (empty when there are no more files).
+	ChangedSince(since time.Time, cursor string, limit int) ([]*FileDoc, string, error)
+	// DirLastModified returns the most recent modification date of the
+	// directory and of all its descendants.
+	DirLastModified(doc *DirDoc) (time.Time, error)
 	BatchDelete([]couchdb.Doc) error
 
 	BuildTree() (*TreeFile, error)
@@ -204,6 +252,269 @@ type Thumbser interface {
 		img *FileDoc, format string) error
 }
 
+// PathOpener is an interface that can be implemented by a VFS to open a file
+// from its path, without having to fetch its document first.
+type PathOpener interface {
+	// OpenPath returns a handle to read the content of the file at the given
+	// path, and its document. It returns ErrFileNotFound if there is nothing
+	// at this path, and ErrIsDirectory if it is a directory.
+	OpenPath(name string) (File, *FileDoc, error)
+}
+
+// Globber is an interface that can be implemented by a VFS to list the files
+// matching a pattern.
+type Globber interface {
+	// Glob returns the files whose path matches the pattern.
+	Glob(pattern string) ([]*FileDoc, error)
+	// GlobFunc calls fn for each file whose path matches the pattern, without
+	// keeping them all in memory.
+	GlobFunc(pattern string, fn func(doc *FileDoc) error) error
+}
+
+// WriteVerifier is an interface that can be implemented by a VFS to read back
+// the content of the files after they have been written, and check it against
+// their md5sum. It is expensive, and disabled by default.
+type WriteVerifier interface {
+	SetWriteVerification(enabled bool)
+}
+
+// NameNormalizer is an interface that can be implemented by a VFS to store the
+// names of the files and directories in the NFC form of unicode, so that the
+// names sent in the NFD form (by macOS for example) collide with the
+// visually-identical ones. It is disabled by default.
+type NameNormalizer interface {
+	SetNameNormalization(enabled bool)
+}
+
+// InspectorSetter is an interface that can be implemented by a VFS to inspect
+// the content of the files while they are uploaded (see ContentInspector).
+type InspectorSetter interface {
+	SetContentInspector(fn ContentInspectorFunc)
+}
+
+// Batcher is an interface that can be implemented by a VFS to group several
+// operations, with a best-effort rollback on error (see Batch).
+type Batcher interface {
+	Batch(fn func(tx VFSBatch) error) error
+}
+
+// IndexFlusher is an interface that can be implemented by a VFS, or by its
+// indexer, to force the writes of the index to be committed.
+type IndexFlusher interface {
+	// FlushIndex returns once all the index writes made before its call are
+	// durably committed: a process that crashes after it won't lose them. The
+	// couchdb indexer writes each document synchronously, so it has nothing
+	// to do.
+	FlushIndex() error
+}
+
+// FlushIndex forces the pending writes of the index of the VFS to be
+// committed, if it implements IndexFlusher. It can be used at the end of a
+// bulk operation, before recording a checkpoint to resume it.
+func FlushIndex(fs VFS) error {
+	if flusher, ok := fs.(IndexFlusher); ok {
+		return flusher.FlushIndex()
+	}
+	return nil
+}
+
+// MaintenanceSetter is an interface that can be implemented by a VFS to
+// freeze the writes on the instance, while still serving the reads.
+type MaintenanceSetter interface {
+	// SetMaintenance enables or disables the maintenance mode: the methods
+	// that modify the files and directories return ErrMaintenance. It waits
+	// for the modifications in progress before returning.
+	SetMaintenance(enabled bool) error
+	// InMaintenance returns true if the maintenance mode is enabled.
+	InMaintenance() (bool, error)
+}
+
+// InodeChecker is an interface that can be implemented by a VFS stored on a
+// filesystem with a limited number of inodes.
+type InodeChecker interface {
+	// CheckInodes returns ErrNoInodes if there are not enough free inodes to
+	// create count files and directories.
+	CheckInodes(count int64) error
+}
+
+// CheckInodes is a pre-flight check for the bulk creations: it returns
+// ErrNoInodes if the VFS implements InodeChecker and there are not enough
+// free inodes for count files and directories.
+func CheckInodes(fs VFS, count int64) error {
+	if checker, ok := fs.(InodeChecker); ok {
+		return checker.CheckInodes(count)
+	}
+	return nil
+}
+
+// Pinger is an interface that can be implemented by a VFS to probe its
+// storage backend.
+type Pinger interface {
+	// Ping makes a cheap request to the storage backend, to check that it is
+	// reachable. It is safe to call frequently.
+	Ping() error
+}
+
+// PingTimeout is the maximal duration of a probe of the storage backend.
+const PingTimeout = 2 * time.Second
+
+// Ping probes the storage backend of the VFS, if it implements Pinger. See
+// WithPingTimeout for the timeout.
+func Ping(fs VFS) error {
+	if pinger, ok := fs.(Pinger); ok {
+		return WithPingTimeout("vfs:"+fs.DomainName(), pinger.Ping)
+	}
+	return nil
+}
+
+// pingCall is a probe of a storage backend that is running.
+type pingCall struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	pingsMu sync.Mutex
+	pings   = make(map[string]*pingCall)
+)
+
+// WithPingTimeout calls the probe of the storage backend identified by key,
+// and returns ErrPingTimeout if it has not returned after PingTimeout. The
+// probe is left running in the background, as a stat on a hung filesystem
+// can't be interrupted, but only one probe by key is running at a time: the
+// calls made while it is running wait for its result instead of starting a
+// new one, so a hung backend doesn't pile up goroutines.
+func WithPingTimeout(key string, probe func() error) error {
+	pingsMu.Lock()
+	call, ok := pings[key]
+	if !ok {
+		call = &pingCall{done: make(chan struct{})}
+		pings[key] = call
+		go func() {
+			call.err = probe()
+			pingsMu.Lock()
+			delete(pings, key)
+			pingsMu.Unlock()
+			close(call.done)
+		}()
+	}
+	pingsMu.Unlock()
+	select {
+	case <-call.done:
+		return call.err
+	case <-time.After(PingTimeout):
+		return ErrPingTimeout
+	}
+}
+
+// Swapper is an interface that can be implemented by a VFS to swap the
+// contents of two files.
+type Swapper interface {
+	// SwapFiles exchanges the contents of the two files, with the fields of
+	// their documents that depend on the content (size, md5sum, mime type and
+	// metadata). The identifiers and paths of the files are kept.
+	SwapFiles(a, b *FileDoc) error
+}
+
+// BackendStater is an interface that can be implemented by a VFS to check the
+// information of the index against its storage backend (see StatFile).
+type BackendStater interface {
+	// BackendStat returns the size of the content of the file in the storage
+	// backend, or os.ErrNotExist if there is no content for this file.
+	BackendStat(doc *FileDoc) (int64, error)
+}
+
+// Truncater is an interface that can be implemented by a VFS to truncate the
+// content of a file to a given size.
+type Truncater interface {
+	// Truncate changes the size of the file and updates its size and md5sum in
+	// the index. Truncating to a size larger than the current one is rejected
+	// with ErrTruncateExtend, unless zeroFill is true: in that case, the file
+	// is extended with zeroes. It returns the updated document.
+	Truncate(doc *FileDoc, size int64, zeroFill bool) (*FileDoc, error)
+}
+
+// Aborter is an interface that can be implemented by the files returned by
+// CreateFile to cancel the creation, for example when the client disconnects
+// in the middle of an upload.
+type Aborter interface {
+	// Abort removes the partial content and the document reserved in the
+	// index for a new file, without committing anything. The old content of an
+	// overwritten file is kept. A Close after Abort does nothing.
+	Abort() error
+}
+
+// ProgressReporter is an interface that can be implemented by the files
+// returned by CreateFile to let the client check the integrity of a large
+// upload progressively, for example after each chunk.
+type ProgressReporter interface {
+	// Progress returns the number of bytes written, and the md5sum of these
+	// bytes. It must not be called concurrently with Write. The final check
+	// of the whole content is still done by Close.
+	Progress() (written int64, partialSum []byte)
+}
+
+// OverwriteUndoer is an interface that can be implemented by a VFS to keep
+// the old content of the overwritten files for some time, and restore it.
+type OverwriteUndoer interface {
+	// UndoOverwrite puts back the content that the file had before its last
+	// overwrite, if it has been kept, or returns ErrNoOverwriteToUndo. It
+	// returns the updated document.
+	UndoOverwrite(doc *FileDoc) (*FileDoc, error)
+	// PurgeExpiredUndos removes the old contents kept for longer than the
+	// retention. It returns the number of bytes reclaimed.
+	PurgeExpiredUndos() (int64, error)
+}
+
+// PartialKeeper is an interface that can be implemented by the files returned
+// by CreateFile to keep the content of an upload cut short, instead of
+// discarding it, so that it can be resumed (see UploadResumer).
+type PartialKeeper interface {
+	// KeepPartial makes Close keep the content when less bytes than the
+	// declared size have been written: Close returns an ErrPartialUpload, and
+	// the document of a new file stays hidden in the index.
+	KeepPartial()
+}
+
+// UploadResumer is an interface that can be implemented by a VFS to resume
+// an upload kept after it was cut short.
+type UploadResumer interface {
+	// ResumeFile reopens the upload of the new content of a file, with the
+	// same documents as given to CreateFile (newdoc has the identifier given
+	// by CreateFile for a new file). The bytes after the ones already kept
+	// are written to the returned file, and it is closed like for CreateFile.
+	ResumeFile(newdoc, olddoc *FileDoc) (File, error)
+}
+
+// UploadSession is a file creation in progress, or the temporary content
+// left by an upload that has not been finished.
+type UploadSession struct {
+	// DocID is the identifier of the file being created or overwritten
+	DocID string `json:"doc_id,omitempty"`
+	// TmpPath is the path of the temporary content in the storage
+	TmpPath string `json:"tmp_path"`
+	// Size is the number of bytes written so far
+	Size int64 `json:"size"`
+	// StartedAt is the start of the upload (zero for a leftover)
+	StartedAt time.Time `json:"started_at,omitempty"`
+	// LastActivity is the time of the last write
+	LastActivity time.Time `json:"last_activity"`
+	// Active is true if the upload is in progress in this process
+	Active bool `json:"active"`
+}
+
+// UploadSessionManager is an interface that can be implemented by a VFS to
+// list and purge the uploads that have been abandoned.
+type UploadSessionManager interface {
+	// ListUploadSessions returns the uploads in progress, and the temporary
+	// contents left by the unfinished ones.
+	ListUploadSessions() ([]*UploadSession, error)
+	// PurgeExpiredUploadSessions aborts the uploads without any write for
+	// more than olderThan, and removes their temporary content. It returns
+	// the number of bytes reclaimed.
+	PurgeExpiredUploadSessions(olderThan time.Duration) (int64, error)
+}
+
 // ThumbFiler defines a interface to handle the creation of thumbnails. It is
 // an io.Writer that can be aborted in case of error, or committed in case of
 // success.
@@ -268,6 +579,7 @@ type DirOrFileDoc struct {
 	Executable bool     `json:"executable,omitempty"`
 	Trashed    bool     `json:"trashed,omitempty"`
 	Metadata   Metadata `json:"metadata,omitempty"`
+	Backend    string   `json:"backend,omitempty"`
 }
 
 // Clone is part of the couchdb.Doc interface
@@ -300,6 +612,7 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			Tags:         fd.Tags,
 			Metadata:     fd.Metadata,
 			ReferencedBy: fd.ReferencedBy,
+			Backend:      fd.Backend,
 		}
 	}
 	return nil, nil
@@ -372,12 +685,140 @@ func OpenFile(fs VFS, name string, flag int, perm os.FileMode) (File, error) {
 	return fs.CreateFile(newdoc, olddoc)
 }
 
+// OpenFileLimited opens the content of a file, like the OpenFile method of
+// the VFS, but the returned reader fails with ErrReadLimitExceeded when the
+// content is longer than maxBytes (unless negative), or when the deadline has
+// passed (unless zero). The file must still be closed by the caller.
+func OpenFileLimited(fs VFS, doc *FileDoc, maxBytes int64, deadline time.Time) (io.ReadCloser, error) {
+	f, err := fs.OpenFile(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedFile{f: f, remaining: maxBytes, deadline: deadline}, nil
+}
+
+type limitedFile struct {
+	f         File
+	remaining int64
+	deadline  time.Time
+}
+
+func (l *limitedFile) Read(p []byte) (int, error) {
+	if !l.deadline.IsZero() && time.Now().After(l.deadline) {
+		return 0, ErrReadLimitExceeded
+	}
+	if l.remaining < 0 {
+		return l.f.Read(p)
+	}
+	// One more byte is read to know if the content goes over the limit.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.f.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		return n, ErrReadLimitExceeded
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+func (l *limitedFile) Close() error {
+	return l.f.Close()
+}
+
 // Create creates a new file with specified and returns a File handler
 // that can be used for writing.
 func Create(fs VFS, name string) (File, error) {
 	return OpenFile(fs, name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 }
 
+// openOrCreateAttempts is the number of attempts of OpenOrCreate when the file
+// is created or removed by another caller at the same time.
+const openOrCreateAttempts = 5
+
+// OpenOrCreate opens the file with the given name in the parent directory to
+// append to it, or creates it if it does not exist. It returns the file to
+// write, the document that is saved when the file is closed, and true if the
+// file has been created.
+//
+// The content of an existing file is copied in its new version before the
+// file is returned, so that the writes are appended, and the whole content
+// goes through the hashing and the checks of an upload. If another caller is
+// creating the same file, it waits for the end of the creation, and returns
+// ErrFileInUse if it takes too long.
+func OpenOrCreate(fs VFS, parent *DirDoc, name string, mode os.FileMode) (File, *FileDoc, bool, error) {
+	exec := mode&0100 != 0
+	mime, class := ExtractMimeAndClassFromFilename(name)
+	fullpath := path.Join(parent.Fullpath, name)
+	for attempt := 0; attempt < openOrCreateAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		newdoc, err := NewFileDoc(name, parent.ID(), -1, nil, mime, class, time.Now(), exec, false, []string{})
+		if err != nil {
+			return nil, nil, false, err
+		}
+		file, err := fs.CreateFile(newdoc, nil)
+		if err == nil {
+			return file, newdoc, true, nil
+		}
+		if !os.IsExist(err) {
+			return nil, nil, false, err
+		}
+
+		olddoc, err := fs.FileByPath(fullpath)
+		if os.IsNotExist(err) {
+			if _, errd := fs.DirByPath(fullpath); errd == nil {
+				return nil, nil, false, ErrIsDirectory
+			}
+			continue // The file has just been removed
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+		// A file is hidden in the index until the end of its creation.
+		if olddoc.Trashed && !strings.HasPrefix(fullpath, TrashDirName+"/") {
+			continue
+		}
+		file, newdoc, err = openForAppend(fs, olddoc)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		return file, newdoc, false, nil
+	}
+	return nil, nil, false, ErrFileInUse
+}
+
+// openForAppend creates a new version of the file, starting with its current
+// content.
+func openForAppend(fs VFS, olddoc *FileDoc) (File, *FileDoc, error) {
+	content, err := fs.OpenFile(olddoc)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer content.Close()
+
+	newdoc := olddoc.Clone().(*FileDoc)
+	newdoc.ByteSize = -1
+	newdoc.MD5Sum = nil
+	newdoc.UpdatedAt = time.Now()
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = io.Copy(file, content); err != nil {
+		if aborter, ok := file.(Aborter); ok {
+			aborter.Abort() // #nosec
+		} else {
+			file.Close() // #nosec
+		}
+		return nil, nil, err
+	}
+	return file, newdoc, nil
+}
+
 // Mkdir creates a new directory with the specified name
 func Mkdir(fs VFS, name string, tags []string) (*DirDoc, error) {
 	name = path.Clean(name)
@@ -778,7 +1219,7 @@ func checkFileName(str string) error {
 	if str == "" || strings.ContainsAny(str, ForbiddenFilenameChars) {
 		return ErrIllegalFilename
 	}
-	return nil
+	return checkFilenamePolicy(str)
 }
 
 func uniqueTags(tags []string) []string {
@@ -3,14 +3,19 @@ package vfs_test
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/md5"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -32,6 +37,9 @@ import (
 var fs vfs.VFS
 var diskQuota int64
 
+// isAfero is true when the tests are run on the afero implementation
+var isAfero bool
+
 type diskImpl struct{}
 
 func (d *diskImpl) DiskQuota() int64 {
@@ -653,6 +661,281 @@ func TestArchive(t *testing.T) {
 		"test/bar/baz/two.png": nil,
 		"test/bar/z.gif":       nil,
 	}, zipfiles)
+
+	manifest, err := a.Manifest(fs)
+	assert.NoError(t, err)
+	if !assert.Len(t, manifest, 5) {
+		return
+	}
+	assert.Equal(t, "test/foobar.jpg", manifest[0])
+	assert.Equal(t, "test/foo.jpg", manifest[1])
+
+	// Resuming the download after the second file
+	w = httptest.NewRecorder()
+	assert.NoError(t, a.ServeFrom(fs, w, manifest[1]))
+	b, err = ioutil.ReadAll(w.Result().Body)
+	assert.NoError(t, err)
+	z, err = zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	assert.NoError(t, err)
+	var names []string
+	for _, f := range z.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, manifest[2:], names)
+
+	// The cursor is the name of the file, not its position: a file removed
+	// before it does not shift the resumed archive
+	removed, err := fs.FileByPath("/archive/" + strings.TrimPrefix(manifest[2], "test/"))
+	if assert.NoError(t, err) {
+		assert.NoError(t, fs.DestroyFile(removed))
+	}
+	w = httptest.NewRecorder()
+	assert.NoError(t, a.ServeFrom(fs, w, manifest[3]))
+	b, err = ioutil.ReadAll(w.Result().Body)
+	assert.NoError(t, err)
+	z, err = zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	assert.NoError(t, err)
+	names = nil
+	for _, f := range z.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, manifest[4:], names)
+
+	// And the file of the cursor must still be in the archive
+	w = httptest.NewRecorder()
+	assert.Equal(t, vfs.ErrArchiveCursorNotFound, a.ServeFrom(fs, w, manifest[2]))
+	assert.Equal(t, 0, w.Body.Len())
+}
+
+func TestArchiveFiles(t *testing.T) {
+	tree := H{
+		"archivefiles/": H{
+			"foo.jpg": nil,
+			"bar/": H{
+				"foo.jpg": nil,
+				"baz.png": nil,
+			},
+		},
+	}
+	_, err := createTree(tree, consts.RootDirID)
+	assert.NoError(t, err)
+
+	var docs []*vfs.FileDoc
+	for _, name := range []string{
+		"/archivefiles/foo.jpg",
+		"/archivefiles/bar/foo.jpg",
+		"/archivefiles/bar/baz.png",
+	} {
+		doc, err := fs.FileByPath(name)
+		if !assert.NoError(t, err) {
+			return
+		}
+		docs = append(docs, doc)
+	}
+
+	buf := new(bytes.Buffer)
+	skipped, err := vfs.ArchiveFiles(fs, docs, buf, vfs.ArchiveFormatZip)
+	assert.NoError(t, err)
+	assert.Len(t, skipped, 0)
+
+	b := buf.Bytes()
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	assert.NoError(t, err)
+	zipfiles := H{}
+	for _, f := range z.File {
+		zipfiles[f.Name] = nil
+	}
+	assert.EqualValues(t, H{
+		"foo.jpg":     nil,
+		"foo (2).jpg": nil,
+		"baz.png":     nil,
+	}, zipfiles)
+
+	_, err = vfs.ArchiveFiles(fs, docs, buf, "rar")
+	assert.Equal(t, vfs.ErrUnknownArchiveFormat, err)
+}
+
+func TestChangedSince(t *testing.T) {
+	since := time.Now().Add(-1 * time.Second)
+	dir, err := createTree(H{"changedsince/": H{"one": nil, "two": nil, "three": nil}}, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// changed returns the names of the files of the directory that have been
+	// changed since the given time, with the destroyed files as false
+	changed := func() map[string]bool {
+		seen := make(map[string]bool)
+		cursor := ""
+		for {
+			docs, next, err := fs.ChangedSince(since, cursor, 2)
+			if !assert.NoError(t, err) {
+				return nil
+			}
+			assert.True(t, len(docs) <= 2)
+			for _, doc := range docs {
+				if doc.DirID == dir.ID() {
+					seen[doc.DocName] = !doc.Deleted
+				}
+			}
+			if next == "" {
+				return seen
+			}
+			cursor = next
+		}
+	}
+	assert.Equal(t, map[string]bool{"one": true, "two": true, "three": true}, changed())
+
+	// A destroyed file is listed from its tombstone, but not the hidden
+	// document of a file being uploaded
+	two, err := fs.FileByPath("/changedsince/two")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, fs.DestroyFile(two))
+	uploading, err := vfs.NewFileDoc("uploading", dir.ID(), 3, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(uploading, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]bool{"one": true, "two": false, "three": true}, changed())
+	assert.Error(t, f.Close())
+
+	docs, _, err := fs.ChangedSince(time.Now().Add(1*time.Hour), "", 10)
+	assert.NoError(t, err)
+	assert.Len(t, docs, 0)
+
+	_, _, err = fs.ChangedSince(since, "not-a-cursor", 10)
+	assert.Equal(t, vfs.ErrInvalidCursor, err)
+}
+
+func TestOverwriteRefreshContentType(t *testing.T) {
+	pdf := "%PDF-1.4\nnot really a pdf"
+	olddoc, err := vfs.NewFileDoc("report", consts.RootDirID, int64(len(pdf)),
+		nil, "application/pdf", "pdf", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	olddoc.ReferencedBy = []couchdb.DocReference{{Type: "io.cozy.albums", ID: "123"}}
+	f, err := fs.CreateFile(olddoc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte(pdf))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	buf := new(bytes.Buffer)
+	if !assert.NoError(t, png.Encode(buf, img)) {
+		return
+	}
+	newdoc, err := vfs.NewFileDoc("report", consts.RootDirID, int64(buf.Len()),
+		nil, vfs.DefaultContentType, "files", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(newdoc, olddoc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.Copy(f, buf)
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	doc, err := fs.FileByID(olddoc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "image/png", doc.Mime)
+	assert.Equal(t, "image", doc.Class)
+	assert.Equal(t, olddoc.CreatedAt.Unix(), doc.CreatedAt.Unix())
+	assert.Equal(t, olddoc.ReferencedBy, doc.ReferencedBy)
+	if assert.NotNil(t, doc.Metadata) {
+		assert.EqualValues(t, 4, doc.Metadata["width"])
+		assert.EqualValues(t, 3, doc.Metadata["height"])
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	buf := new(bytes.Buffer)
+	if !assert.NoError(t, png.Encode(buf, img)) {
+		return
+	}
+	tests := []struct {
+		name    string
+		content string
+		mime    string
+		class   string
+		want    string
+		wantCls string
+	}{
+		{"detect-png", buf.String(), vfs.DefaultContentType, "files", "image/png", "image"},
+		{"detect-pdf", "%PDF-1.4\nnot really a pdf", vfs.DefaultContentType, "files", "application/pdf", "pdf"},
+		{"detect-gif", "GIF89a not really a gif", vfs.DefaultContentType, "files", "image/gif", "image"},
+		{"detect-jpeg", "\xff\xd8\xff\xe0 not really a jpeg", vfs.DefaultContentType, "files", "image/jpeg", "image"},
+		{"detect-zip", "PK\x03\x04 too generic", vfs.DefaultContentType, "files", vfs.DefaultContentType, "files"},
+		{"detect-text", "just some text", vfs.DefaultContentType, "files", vfs.DefaultContentType, "files"},
+		{"detect-explicit", "%PDF-1.4\nnot really a pdf", "text/markdown", "text", "text/markdown", "text"},
+	}
+	for _, test := range tests {
+		doc, err := vfs.NewFileDoc(test.name, consts.RootDirID, int64(len(test.content)),
+			nil, test.mime, test.class, time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		f, err := fs.CreateFile(doc, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = f.Write([]byte(test.content))
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
+		stored, err := fs.FileByID(doc.ID())
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, test.want, stored.Mime, test.name)
+		assert.Equal(t, test.wantCls, stored.Class, test.name)
+		if test.name == "detect-png" && assert.NotNil(t, stored.Metadata) {
+			assert.EqualValues(t, 4, stored.Metadata["width"])
+			assert.EqualValues(t, 3, stored.Metadata["height"])
+		}
+	}
+}
+
+func TestOpenPath(t *testing.T) {
+	opener, ok := fs.(vfs.PathOpener)
+	if !ok {
+		t.Skip("OpenPath is not supported by this VFS")
+	}
+	_, err := createTree(H{"openpath/": H{"file": nil, "dir/": H{}}}, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	f, doc, err := opener.OpenPath("/openpath/file")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "file", doc.DocName)
+		_, err = ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+
+	_, _, err = opener.OpenPath("/openpath/dir")
+	assert.Equal(t, vfs.ErrIsDirectory, err)
+	_, _, err = opener.OpenPath("/openpath/missing")
+	assert.Equal(t, vfs.ErrFileNotFound, err)
 }
 
 func TestCreateFileTooBig(t *testing.T) {
@@ -764,127 +1047,2427 @@ func TestCreateFileTooBig(t *testing.T) {
 	assert.NoError(t, fs.DestroyDirContent(root))
 }
 
-func TestMain(m *testing.M) {
-	config.UseTestFile()
-
-	check, err := checkup.HTTPChecker{URL: config.CouchURL().String()}.Check()
-	if err != nil || check.Status() != checkup.Healthy {
-		fmt.Println("This test need couchdb to run.")
-		os.Exit(1)
+func TestGlob(t *testing.T) {
+	globber, ok := fs.(vfs.Globber)
+	if !ok {
+		t.Skip("glob is not supported by this vfs")
 	}
-
-	var rollback func()
-	fs, rollback, err = makeAferoFS()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	_, err := createTree(H{
+		"globphotos/": H{
+			"2017/": H{"a.jpg": nil},
+			"2018/": H{"b.jpg": nil, "c.png": nil, "sub/": H{"d.jpg": nil}},
+		},
+	}, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
 	}
-	res1 := m.Run()
-	rollback()
 
-	fs, rollback, err = makeSwiftFS(true)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	names := func(docs []*vfs.FileDoc) []string {
+		var res []string
+		for _, doc := range docs {
+			res = append(res, doc.DocName)
+		}
+		sort.Strings(res)
+		return res
 	}
-	res2 := m.Run()
-	rollback()
 
-	fs, rollback, err = makeSwiftFS(false)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-	res3 := m.Run()
-	rollback()
+	docs, err := globber.Glob("/globphotos/2018/*.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.jpg"}, names(docs))
 
-	os.Exit(res1 + res2 + res3)
+	docs, err = globber.Glob("/globphotos/201[78]/?.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.jpg", "b.jpg"}, names(docs))
+
+	docs, err = globber.Glob("/globphotos/2018/c.png")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c.png"}, names(docs))
+
+	docs, err = globber.Glob("/globphotos/missing/*")
+	assert.NoError(t, err)
+	assert.Len(t, docs, 0)
+
+	_, err = globber.Glob("globphotos/*")
+	assert.Equal(t, vfs.ErrNonAbsolutePath, err)
+	_, err = globber.Glob("/globphotos/[")
+	assert.Equal(t, path.ErrBadPattern, err)
 }
 
-func makeAferoFS() (vfs.VFS, func(), error) {
-	tempdir, err := ioutil.TempDir("", "cozy-stack")
-	if err != nil {
-		return nil, nil, errors.New("could not create temporary directory")
+func TestWriteVerification(t *testing.T) {
+	verifier, ok := fs.(vfs.WriteVerifier)
+	if !ok {
+		t.Skip("write verification is not supported by this vfs")
 	}
+	verifier.SetWriteVerification(true)
+	defer verifier.SetWriteVerification(false)
 
-	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
-	index := vfs.NewCouchdbIndexer(db)
-	aferoFs, err := vfsafero.New(db, index, &diskImpl{}, lock.ReadWrite(db, "vfs-afero-test"),
-		&url.URL{Scheme: "file", Host: "localhost", Path: tempdir}, "io.cozy.vfs.test")
-	if err != nil {
-		return nil, nil, err
+	doc, err := vfs.NewFileDoc("verified.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
 	}
-
-	err = couchdb.ResetDB(db, consts.Files)
-	if err != nil {
-		return nil, nil, err
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
 	}
-
-	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
-	if err != nil {
-		return nil, nil, err
+	_, err = io.WriteString(f, "foo")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
 	}
 
-	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
-		return nil, nil, err
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	newdoc.ByteSize = -1
+	newdoc.MD5Sum = nil
+	f, err = fs.CreateFile(newdoc, doc)
+	if !assert.NoError(t, err) {
+		return
 	}
-
-	err = aferoFs.InitFs()
-	if err != nil {
-		return nil, nil, err
+	_, err = io.WriteString(f, "bar baz")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
 	}
 
-	return aferoFs, func() {
-		os.RemoveAll(tempdir)
-		couchdb.DeleteDB(db, consts.Files)
-	}, nil
+	content, err := fs.OpenFile(newdoc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer content.Close()
+	buf, err := ioutil.ReadAll(content)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar baz", string(buf))
 }
 
-func makeSwiftFS(layoutV2 bool) (vfs.VFS, func(), error) {
-	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
-	index := vfs.NewCouchdbIndexer(db)
-	swiftSrv, err := swifttest.NewSwiftServer("localhost")
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create swift server %s", err)
+func TestMoveFile(t *testing.T) {
+	dst, err := vfs.Mkdir(fs, "/movefile", nil)
+	if !assert.NoError(t, err) {
+		return
 	}
-
-	err = config.InitSwiftConnection(&url.URL{
-		Scheme:   "swift",
-		Host:     "localhost",
-		RawQuery: "UserName=swifttest&Password=swifttest&AuthURL=" + url.QueryEscape(swiftSrv.AuthURL),
-	})
-	if err != nil {
-		return nil, nil, err
+	doc, err := vfs.NewFileDoc("tomove.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
 	}
-
-	var swiftFs vfs.VFS
-	if layoutV2 {
-		swiftFs, err = vfsswift.NewV2(db,
-			index, &diskImpl{}, lock.ReadWrite(db, "vfs-swiftv2-test"))
-	} else {
-		swiftFs, err = vfsswift.New(db,
-			index, &diskImpl{}, lock.ReadWrite(db, "vfs-swift-test"))
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
 	}
-	if err != nil {
-		return nil, nil, err
+	_, err = io.WriteString(f, "content to move")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
 	}
 
-	err = couchdb.ResetDB(db, consts.Files)
-	if err != nil {
-		return nil, nil, err
+	moved, err := vfs.MoveFile(fs, doc, dst, "")
+	if !assert.NoError(t, err) {
+		return
 	}
+	assert.Equal(t, dst.ID(), moved.DirID)
+	_, err = fs.FileByPath("/tomove.txt")
+	assert.True(t, os.IsNotExist(err))
+	content, err := vfs.ReadFile(fs, moved)
+	assert.NoError(t, err)
+	assert.Equal(t, "content to move", string(content))
 
-	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
-	if err != nil {
-		return nil, nil, err
+	// The name can be changed, and the mime follows the extension
+	root, err := fs.DirByID(consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
 	}
-
-	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
-		return nil, nil, err
+	renamed, err := vfs.MoveFile(fs, moved, root, "tomove.pdf")
+	if !assert.NoError(t, err) {
+		return
 	}
+	assert.Equal(t, "tomove.pdf", renamed.DocName)
+	assert.Equal(t, "application/pdf", renamed.Mime)
+	_, err = fs.FileByPath("/tomove.pdf")
+	assert.NoError(t, err)
 
-	err = swiftFs.InitFs()
-	if err != nil {
+	_, err = vfs.Mkdir(fs, "/movefile/tomove.pdf", nil)
+	assert.NoError(t, err)
+	_, err = vfs.MoveFile(fs, renamed, dst, "")
+	assert.Equal(t, vfs.ErrConflict, err)
+
+	gone := &vfs.DirDoc{DocID: "missing-dir-for-movefile"}
+	_, err = vfs.MoveFile(fs, renamed, gone, "")
+	assert.Equal(t, vfs.ErrParentDoesNotExist, err)
+
+	// Moving to the trash trashes the file, and moving it back restores it
+	trash, err := fs.DirByID(consts.TrashDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	trashed, err := vfs.MoveFile(fs, renamed, trash, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, trashed.Trashed)
+	assert.Equal(t, "/", trashed.RestorePath)
+	restored, err := vfs.MoveFile(fs, trashed, root, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, restored.Trashed)
+	assert.Equal(t, "", restored.RestorePath)
+	assert.NoError(t, fs.DestroyFile(restored))
+}
+
+func TestMoveAcross(t *testing.T) {
+	dst, err := vfs.Mkdir(fs, "/moveacross", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	doc, err := vfs.NewFileDoc("moved.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, []string{"foo"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "moved content")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	assert.NoError(t, vfs.MoveAcross(fs, doc, fs, dst))
+	_, err = fs.FileByPath("/moved.txt")
+	assert.True(t, os.IsNotExist(err))
+	moved, err := fs.FileByPath("/moveacross/moved.txt")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, doc.MD5Sum, moved.MD5Sum)
+	assert.Equal(t, []string{"foo"}, moved.Tags)
+
+	// Resuming a move already copied only destroys the source
+	again, err := vfs.NewFileDoc("moved.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(again, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "moved content")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	assert.NoError(t, vfs.MoveAcross(fs, again, fs, dst))
+	_, err = fs.FileByPath("/moved.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	// A different file with the same name is not overwritten
+	other, err := vfs.NewFileDoc("moved.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(other, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "other content")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	assert.Equal(t, os.ErrExist, vfs.MoveAcross(fs, other, fs, dst))
+	_, err = fs.FileByPath("/moved.txt")
+	assert.NoError(t, err)
+}
+
+func TestMoveAcrossResume(t *testing.T) {
+	dst, err := vfs.Mkdir(fs, "/moveacross-resume", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	doc, err := vfs.NewFileDoc("resumed.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "resumed content")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	// A move interrupted during the copy leaves a hidden document with the
+	// md5sum of the source in the destination
+	hidden, err := vfs.NewFileDoc("resumed.txt", dst.ID(), doc.ByteSize, doc.MD5Sum, "text/plain", "text", time.Now(), false, true, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, fs.CreateFileDoc(hidden)) {
+		return
+	}
+
+	assert.NoError(t, vfs.MoveAcross(fs, doc, fs, dst))
+	_, err = fs.FileByPath("/resumed.txt")
+	assert.True(t, os.IsNotExist(err))
+	moved, err := fs.FileByPath("/moveacross-resume/resumed.txt")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, moved.Trashed)
+	assert.NotEqual(t, hidden.ID(), moved.ID())
+	content, err := vfs.ReadFile(fs, moved)
+	assert.NoError(t, err)
+	assert.Equal(t, "resumed content", string(content))
+}
+
+func TestReadWriteFile(t *testing.T) {
+	doc, err := vfs.NewFileDoc("readwrite.json", consts.RootDirID, -1, nil, "application/json", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, vfs.WriteFile(fs, doc, []byte(`{"foo":"bar"}`))) {
+		return
+	}
+	data, err := vfs.ReadFile(fs, doc)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"foo":"bar"}`, string(data))
+
+	// Writing a new document with the same name overwrites the file
+	again, err := vfs.NewFileDoc("readwrite.json", consts.RootDirID, -1, nil, "application/json", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, vfs.WriteFile(fs, again, []byte(`{"foo":"baz"}`))) {
+		return
+	}
+	assert.Equal(t, doc.ID(), again.ID())
+	data, err = vfs.ReadFile(fs, again)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"foo":"baz"}`, string(data))
+
+	// The content is checked against the md5sum of the document
+	_, err = vfs.ReadFile(fs, doc)
+	assert.Equal(t, vfs.ErrInvalidHash, err)
+
+	big := again.Clone().(*vfs.FileDoc)
+	big.ByteSize = 1 << 40
+	_, err = vfs.ReadFile(fs, big)
+	assert.Equal(t, vfs.ErrFileTooBigToRead, err)
+}
+
+func TestMoveConflictInIndex(t *testing.T) {
+	doc, err := vfs.NewFileDoc("conflict-index-a.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, f.Close())
+
+	// A document only present in the index, without a file on the disk
+	ghost, err := vfs.NewFileDoc("conflict-index-b.txt", consts.RootDirID, 0, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, fs.CreateFileDoc(ghost)) {
+		return
+	}
+	defer fs.DeleteFileDoc(ghost)
+
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	newdoc.DocName = "conflict-index-b.txt"
+	newdoc.ResetFullpath()
+	assert.Equal(t, vfs.ErrConflict, fs.UpdateFileDoc(doc, newdoc))
+
+	dir, err := vfs.Mkdir(fs, "/conflict-index-dir", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	newdir := dir.Clone().(*vfs.DirDoc)
+	newdir.DocName = "conflict-index-b.txt"
+	newdir.Fullpath = "/conflict-index-b.txt"
+	assert.Equal(t, vfs.ErrConflict, fs.UpdateDirDoc(dir, newdir))
+}
+
+func TestMoveConflictOnDisk(t *testing.T) {
+	if !isAfero {
+		t.Skip("the files are only indexed by path on the disk for afero")
+	}
+
+	docs := make([]*vfs.FileDoc, 2)
+	for i, name := range []string{"conflict-disk-a.txt", "conflict-disk-b.txt"} {
+		doc, err := vfs.NewFileDoc(name, consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		f, err := fs.CreateFile(doc, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, f.Close())
+		docs[i] = doc
+	}
+
+	// The file b stays on the disk, but is no longer in the index
+	if !assert.NoError(t, fs.DeleteFileDoc(docs[1])) {
+		return
+	}
+
+	newdoc := docs[0].Clone().(*vfs.FileDoc)
+	newdoc.DocName = "conflict-disk-b.txt"
+	newdoc.ResetFullpath()
+	assert.Equal(t, vfs.ErrConflict, fs.UpdateFileDoc(docs[0], newdoc))
+	_, err := fs.FileByPath("/conflict-disk-a.txt")
+	assert.NoError(t, err)
+}
+
+func TestInheritDefaults(t *testing.T) {
+	ref := couchdb.DocReference{Type: "io.cozy.sharings", ID: "shared-with-group"}
+	parent, err := vfs.NewDirDoc(fs, "inherit-parent", consts.RootDirID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	parent.Defaults = &vfs.InheritableSettings{
+		Tags:         []string{"shared"},
+		ReferencedBy: []couchdb.DocReference{ref},
+	}
+	if !assert.NoError(t, fs.CreateDir(parent)) {
+		return
+	}
+
+	doc, err := vfs.NewFileDoc("inherited.txt", parent.ID(), -1, nil, "text/plain", "text", time.Now(), false, false, []string{"foo"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, f.Close())
+	file, err := fs.FileByID(doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"foo", "shared"}, file.Tags)
+	assert.Equal(t, []couchdb.DocReference{ref}, file.ReferencedBy)
+
+	child, err := vfs.NewDirDoc(fs, "inherit-child", parent.ID(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, fs.CreateDir(child)) {
+		return
+	}
+	dir, err := fs.DirByID(child.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"shared"}, dir.Tags)
+	assert.Equal(t, []couchdb.DocReference{ref}, dir.ReferencedBy)
+	if assert.NotNil(t, dir.Defaults) {
+		assert.Equal(t, []string{"shared"}, dir.Defaults.Tags)
+	}
+
+	// The inheritance is not live-linked
+	newparent := parent.Clone().(*vfs.DirDoc)
+	newparent.Defaults = nil
+	if !assert.NoError(t, fs.UpdateDirDoc(parent, newparent)) {
+		return
+	}
+	file, err = fs.FileByID(doc.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo", "shared"}, file.Tags)
+}
+
+func TestRenameDirKeepsDefaults(t *testing.T) {
+	olddoc, err := vfs.NewDirDoc(fs, "defaults-before", consts.RootDirID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	olddoc.Defaults = &vfs.InheritableSettings{Tags: []string{"renamed"}}
+	if !assert.NoError(t, fs.CreateDir(olddoc)) {
+		return
+	}
+
+	name := "defaults-after"
+	newdoc, err := vfs.ModifyDirMetadata(fs, olddoc, &vfs.DocPatch{Name: &name})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.NotNil(t, newdoc.Defaults) {
+		assert.Equal(t, []string{"renamed"}, newdoc.Defaults.Tags)
+	}
+
+	child, err := vfs.NewDirDoc(fs, "child", newdoc.ID(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, fs.CreateDir(child)) {
+		return
+	}
+	dir, err := fs.DirByID(child.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"renamed"}, dir.Tags)
+}
+
+func TestBatch(t *testing.T) {
+	batcher, ok := fs.(vfs.Batcher)
+	if !ok {
+		t.Skip("batch is not supported by this vfs")
+	}
+
+	old, err := vfs.NewFileDoc("batch-old.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(old, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, f.Close())
+
+	errBatch := errors.New("batch failed")
+	err = batcher.Batch(func(tx vfs.VFSBatch) error {
+		dir, err := vfs.NewDirDoc(fs, "batch-dir", consts.RootDirID, nil)
+		if err != nil {
+			return err
+		}
+		if err = tx.CreateDir(dir); err != nil {
+			return err
+		}
+		doc, err := vfs.NewFileDoc("batch-new.txt", dir.ID(), -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+		if err != nil {
+			return err
+		}
+		if err = tx.CreateFile(doc, strings.NewReader("new content")); err != nil {
+			return err
+		}
+		if _, err = tx.TrashFile(old); err != nil {
+			return err
+		}
+		return errBatch
+	})
+	assert.Equal(t, errBatch, err)
+
+	_, err = fs.DirByPath("/batch-dir")
+	assert.True(t, os.IsNotExist(err))
+	restored, err := fs.FileByPath("/batch-old.txt")
+	if assert.NoError(t, err) {
+		assert.False(t, restored.Trashed)
+		assert.Equal(t, old.ID(), restored.ID())
+	}
+
+	err = batcher.Batch(func(tx vfs.VFSBatch) error {
+		dir, err := vfs.NewDirDoc(fs, "batch-dir", consts.RootDirID, nil)
+		if err != nil {
+			return err
+		}
+		return tx.CreateDir(dir)
+	})
+	assert.NoError(t, err)
+	_, err = fs.DirByPath("/batch-dir")
+	assert.NoError(t, err)
+}
+
+type brokenReader struct{}
+
+func (brokenReader) Read(p []byte) (int, error) {
+	return 0, errors.New("broken reader")
+}
+
+func TestBatchCopyError(t *testing.T) {
+	batcher, ok := fs.(vfs.Batcher)
+	if !ok {
+		t.Skip("batch is not supported by this vfs")
+	}
+
+	err := batcher.Batch(func(tx vfs.VFSBatch) error {
+		doc, err := vfs.NewFileDoc("batch-truncated.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+		if err != nil {
+			return err
+		}
+		content := io.MultiReader(strings.NewReader("partial"), brokenReader{})
+		return tx.CreateFile(doc, content)
+	})
+	assert.Error(t, err)
+	_, err = fs.FileByPath("/batch-truncated.txt")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTrustedMetadata(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	buf := new(bytes.Buffer)
+	if !assert.NoError(t, png.Encode(buf, img)) {
+		return
+	}
+	content := buf.Bytes()
+
+	create := func(name string, trusted bool) *vfs.FileDoc {
+		doc, err := vfs.NewFileDoc(name, consts.RootDirID, int64(len(content)),
+			nil, "image/png", "image", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		doc.Metadata = vfs.Metadata{"width": 1920, "height": 1080}
+		doc.TrustedMetadata = trusted
+		f, err := fs.CreateFile(doc, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		_, err = f.Write(content)
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return nil
+		}
+		doc, err = fs.FileByID(doc.ID())
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return doc
+	}
+
+	doc := create("trusted.png", true)
+	if assert.NotNil(t, doc) && assert.NotNil(t, doc.Metadata) {
+		assert.EqualValues(t, 1920, doc.Metadata["width"])
+		assert.EqualValues(t, 1080, doc.Metadata["height"])
+		assert.Equal(t, int64(len(content)), doc.ByteSize)
+		assert.NotEmpty(t, doc.MD5Sum)
+	}
+
+	doc = create("untrusted.png", false)
+	if assert.NotNil(t, doc) && assert.NotNil(t, doc.Metadata) {
+		assert.EqualValues(t, 4, doc.Metadata["width"])
+		assert.EqualValues(t, 3, doc.Metadata["height"])
+	}
+
+	// The content is still verified
+	doc, err := vfs.NewFileDoc("trusted-bad-hash.png", consts.RootDirID,
+		int64(len(content)), []byte("badhash"), "image/png", "image",
+		time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc.Metadata = vfs.Metadata{"width": 1920}
+	doc.TrustedMetadata = true
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write(content)
+	assert.NoError(t, err)
+	assert.Equal(t, vfs.ErrInvalidHash, f.Close())
+}
+
+func TestStat(t *testing.T) {
+	content := []byte("stat me")
+	doc, err := vfs.NewFileDoc("stat.txt", consts.RootDirID, int64(len(content)),
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write(content)
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	for _, checkBackend := range []bool{false, true} {
+		infos, err := vfs.StatFile(fs, doc, checkBackend)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "stat.txt", infos.Name())
+			assert.Equal(t, int64(len(content)), infos.Size())
+			assert.False(t, infos.IsDir())
+			assert.Equal(t, doc.UpdatedAt, infos.ModTime())
+			assert.Equal(t, doc, infos.Sys())
+		}
+	}
+
+	// The index is trusted, except when the backend is checked
+	wrong := doc.Clone().(*vfs.FileDoc)
+	wrong.ByteSize = 42
+	infos, err := vfs.StatFile(fs, wrong, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(42), infos.Size())
+	}
+	_, err = vfs.StatFile(fs, wrong, true)
+	assert.Equal(t, vfs.ErrContentLengthMismatch, err)
+
+	root, err := fs.DirByID(consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	infos, err = vfs.StatDir(fs, root)
+	if assert.NoError(t, err) {
+		assert.True(t, infos.IsDir())
+		assert.True(t, infos.Mode().IsDir())
+		assert.Equal(t, root, infos.Sys())
+	}
+}
+
+func TestMoveCycle(t *testing.T) {
+	a, err := vfs.Mkdir(fs, "/cycle-a", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := vfs.Mkdir(fs, "/cycle-b", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	c, err := vfs.Mkdir(fs, "/cycle-b/c", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Move a into b/c
+	cID := c.ID()
+	movedA, err := vfs.ModifyDirMetadata(fs, a, &vfs.DocPatch{DirID: &cID})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/cycle-b/c/cycle-a", movedA.Fullpath)
+
+	// Moving b into a, with a stale document for b: its path is not a prefix
+	// of the destination, but the ancestors of a in the index include b.
+	staleB := b.Clone().(*vfs.DirDoc)
+	staleB.DirID = a.ID()
+	staleB.Fullpath = "/cycle-a/cycle-b"
+	assert.Equal(t, vfs.ErrForbiddenDocMove, fs.UpdateDirDoc(b, staleB))
+
+	// Moving b into a with an up-to-date document is rejected too
+	b, err = fs.DirByID(b.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	aID := a.ID()
+	_, err = vfs.ModifyDirMetadata(fs, b, &vfs.DocPatch{DirID: &aID})
+	assert.Equal(t, vfs.ErrForbiddenDocMove, err)
+
+	// Swapping a and c through intermediate moves: c can not go into a, that
+	// is already inside it
+	c, err = fs.DirByID(cID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = vfs.ModifyDirMetadata(fs, c, &vfs.DocPatch{DirID: &aID})
+	assert.Equal(t, vfs.ErrForbiddenDocMove, err)
+
+	bDoc, err := fs.DirByID(b.ID())
+	if assert.NoError(t, err) {
+		assert.Equal(t, consts.RootDirID, bDoc.DirID)
+		assert.Equal(t, "/cycle-b", bDoc.Fullpath)
+	}
+	cDoc, err := fs.DirByID(cID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, b.ID(), cDoc.DirID)
+	}
+}
+
+func TestMoveTreeUpdatesDescendantPaths(t *testing.T) {
+	tree := H{
+		"deepmove/": H{
+			"child/": H{
+				"grandchild/": H{
+					"leaf.txt": nil,
+				},
+				"file.txt": nil,
+			},
+		},
+	}
+	root, err := createTree(tree, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dst, err := vfs.Mkdir(fs, "/deepmove-dst", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dstID := dst.ID()
+	_, err = vfs.ModifyDirMetadata(fs, root, &vfs.DocPatch{DirID: &dstID})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	grandchild, err := fs.DirByPath("/deepmove-dst/deepmove/child/grandchild")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/deepmove-dst/deepmove/child/grandchild", grandchild.Fullpath)
+	}
+	leaf, err := fs.FileByPath("/deepmove-dst/deepmove/child/grandchild/leaf.txt")
+	if assert.NoError(t, err) && grandchild != nil {
+		assert.Equal(t, grandchild.ID(), leaf.DirID)
+	}
+	_, err = fs.FileByPath("/deepmove-dst/deepmove/child/file.txt")
+	assert.NoError(t, err)
+
+	_, err = fs.DirByPath("/deepmove/child/grandchild")
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.FileByPath("/deepmove/child/grandchild/leaf.txt")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// signatureInspector rejects the content with a given signature.
+type signatureInspector struct {
+	signature string
+	content   bytes.Buffer
+}
+
+func (i *signatureInspector) Write(p []byte) (int, error) {
+	return i.content.Write(p)
+}
+
+func (i *signatureInspector) Close() error {
+	if strings.Contains(i.content.String(), i.signature) {
+		return vfs.ErrContentRejected
+	}
+	return nil
+}
+
+func TestContentInspector(t *testing.T) {
+	setter, ok := fs.(vfs.InspectorSetter)
+	if !ok {
+		t.Skip("content inspection is not supported by this vfs")
+	}
+	setter.SetContentInspector(func(doc *vfs.FileDoc) vfs.ContentInspector {
+		return &signatureInspector{signature: "EICAR"}
+	})
+	defer setter.SetContentInspector(nil)
+
+	upload := func(doc, olddoc *vfs.FileDoc, content string) error {
+		f, err := fs.CreateFile(doc, olddoc)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, content)
+		if errc := f.Close(); err == nil {
+			err = errc
+		}
+		return err
+	}
+
+	doc, err := vfs.NewFileDoc("infected.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, vfs.ErrContentRejected, upload(doc, nil, "foo EICAR bar"))
+	_, err = fs.FileByPath("/infected.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	doc, err = vfs.NewFileDoc("inspected.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, upload(doc, nil, "clean content")) {
+		return
+	}
+
+	// The old content is kept when the new one is rejected
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	newdoc.ByteSize = -1
+	newdoc.MD5Sum = nil
+	assert.Equal(t, vfs.ErrContentRejected, upload(newdoc, doc, strings.Repeat("x", 100000)+"EICAR"))
+	content, err := vfs.ReadFile(fs, doc)
+	assert.NoError(t, err)
+	assert.Equal(t, "clean content", string(content))
+}
+
+func TestEmptyFile(t *testing.T) {
+	emptyMD5 := md5.Sum(nil)
+	doc, err := vfs.NewFileDoc("empty-file", consts.RootDirID, 0,
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	created, err := fs.FileByID(doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 0, created.ByteSize)
+	assert.Equal(t, emptyMD5[:], created.MD5Sum)
+	assert.False(t, created.Trashed)
+	data, err := vfs.ReadFile(fs, created)
+	assert.NoError(t, err)
+	assert.Len(t, data, 0)
+
+	// Some content for a file declared as empty is rejected
+	again, err := vfs.NewFileDoc("empty-file", consts.RootDirID, 0,
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(again, created)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("not empty"))
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	assert.Equal(t, vfs.ErrContentLengthMismatch, err)
+
+	// Overwrite a file with an empty content
+	content := "some content"
+	full, err := vfs.NewFileDoc("not-empty-file", consts.RootDirID, int64(len(content)),
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(full, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte(content))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	emptied, err := vfs.NewFileDoc("not-empty-file", consts.RootDirID, 0,
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(emptied, full)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	updated, err := fs.FileByID(full.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 0, updated.ByteSize)
+	assert.Equal(t, emptyMD5[:], updated.MD5Sum)
+	assert.Equal(t, full.CreatedAt.Unix(), updated.CreatedAt.Unix())
+	data, err = vfs.ReadFile(fs, updated)
+	assert.NoError(t, err)
+	assert.Len(t, data, 0)
+}
+
+func TestAbortFileCreation(t *testing.T) {
+	doc, err := vfs.NewFileDoc("aborted-file", consts.RootDirID, -1,
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	aborter, ok := f.(vfs.Aborter)
+	if !ok {
+		f.Close()
+		t.Skip("Abort is not supported by this VFS")
+	}
+	_, err = f.Write([]byte("partial"))
+	assert.NoError(t, err)
+	assert.NoError(t, aborter.Abort())
+	assert.NoError(t, f.Close())
+	exists, err := fs.DirChildExists(consts.RootDirID, "aborted-file")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// The old content of an overwritten file is kept
+	content := "old content"
+	olddoc, err := vfs.NewFileDoc("aborted-overwrite", consts.RootDirID, int64(len(content)),
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(olddoc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte(content))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	newdoc, err := vfs.NewFileDoc("aborted-overwrite", consts.RootDirID, -1,
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(newdoc, olddoc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("new"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.(vfs.Aborter).Abort())
+	assert.NoError(t, f.Close())
+	doc, err = fs.FileByID(olddoc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, olddoc.Rev(), doc.Rev())
+	data, err := vfs.ReadFile(fs, doc)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data))
+}
+
+func TestAbortDuringWrite(t *testing.T) {
+	doc, err := vfs.NewFileDoc("aborted-during-write", consts.RootDirID, -1,
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	aborter, ok := f.(vfs.Aborter)
+	if !ok {
+		f.Close()
+		t.Skip("Abort is not supported by this VFS")
+	}
+
+	// The writes go on while the creation is aborted, like an upload whose
+	// client disconnects: run with -race to check the concurrent accesses
+	written := make(chan error)
+	go func() {
+		chunk := bytes.Repeat([]byte("a"), 1024)
+		for {
+			if _, err := f.Write(chunk); err != nil {
+				written <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, aborter.Abort())
+	assert.Error(t, <-written)
+	assert.NoError(t, f.Close())
+	exists, err := fs.DirChildExists(consts.RootDirID, "aborted-during-write")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestUploadSessions(t *testing.T) {
+	manager, ok := fs.(vfs.UploadSessionManager)
+	if !ok {
+		t.Skip("The upload sessions are not supported by this VFS")
+	}
+	doc, err := vfs.NewFileDoc("abandoned-upload", consts.RootDirID, -1,
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("partial content"))
+	assert.NoError(t, err)
+
+	sessions, err := manager.ListUploadSessions()
+	assert.NoError(t, err)
+	var found *vfs.UploadSession
+	for _, s := range sessions {
+		if s.DocID == doc.ID() {
+			found = s
+		}
+	}
+	if assert.NotNil(t, found) {
+		assert.True(t, found.Active)
+		assert.EqualValues(t, len("partial content"), found.Size)
+	}
+
+	// The session is still active
+	reclaimed, err := manager.PurgeExpiredUploadSessions(time.Hour)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, reclaimed)
+	_, err = f.Write([]byte(", and more"))
+	assert.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	reclaimed, err = manager.PurgeExpiredUploadSessions(5 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len("partial content, and more"), reclaimed)
+	assert.NoError(t, f.Close())
+	exists, err := fs.DirChildExists(consts.RootDirID, "abandoned-upload")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	sessions, err = manager.ListUploadSessions()
+	assert.NoError(t, err)
+	for _, s := range sessions {
+		assert.NotEqual(t, doc.ID(), s.DocID)
+	}
+
+	// The hidden document of a new file left by an upload in another process
+	// is listed, and purged when it is too old
+	left, err := vfs.NewFileDoc("left-upload", consts.RootDirID, 42,
+		nil, "text/plain", "text", time.Now().Add(-2*time.Hour), false, true, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, fs.CreateFileDoc(left)) {
+		return
+	}
+	sessions, err = manager.ListUploadSessions()
+	assert.NoError(t, err)
+	found = nil
+	for _, s := range sessions {
+		if s.DocID == left.ID() {
+			found = s
+		}
+	}
+	if assert.NotNil(t, found) {
+		assert.False(t, found.Active)
+	}
+	_, err = manager.PurgeExpiredUploadSessions(time.Hour)
+	assert.NoError(t, err)
+	_, err = fs.FileByID(left.ID())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUploadProgress(t *testing.T) {
+	doc, err := vfs.NewFileDoc("progressive-file", consts.RootDirID, -1,
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	reporter, ok := f.(vfs.ProgressReporter)
+	if !ok {
+		t.Skip("Progress is not supported by this VFS")
+	}
+
+	h := md5.New()
+	buf := new(bytes.Buffer)
+	for _, chunk := range []string{"first chunk, ", "second chunk"} {
+		_, err = f.Write([]byte(chunk))
+		assert.NoError(t, err)
+		h.Write([]byte(chunk))
+		buf.WriteString(chunk)
+		written, sum := reporter.Progress()
+		assert.Equal(t, h.Sum(nil), sum)
+		assert.Equal(t, int64(buf.Len()), written)
+	}
+	assert.NoError(t, f.Close())
+
+	fileDoc, err := fs.FileByPath("/progressive-file")
+	if assert.NoError(t, err) {
+		assert.Equal(t, h.Sum(nil), fileDoc.MD5Sum)
+	}
+}
+
+func TestOpenFileLimited(t *testing.T) {
+	content := "content with a budget"
+	doc, err := vfs.NewFileDoc("limited-file", consts.RootDirID, int64(len(content)),
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte(content))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	doc, err = fs.FileByPath("/limited-file")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	rc, err := vfs.OpenFileLimited(fs, doc, int64(len(content)), time.Time{})
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(b))
+		assert.NoError(t, rc.Close())
+	}
+
+	rc, err = vfs.OpenFileLimited(fs, doc, 7, time.Time{})
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(rc)
+		assert.Equal(t, vfs.ErrReadLimitExceeded, err)
+		assert.Equal(t, "content", string(b))
+		assert.NoError(t, rc.Close())
+	}
+
+	rc, err = vfs.OpenFileLimited(fs, doc, -1, time.Now().Add(-time.Second))
+	if assert.NoError(t, err) {
+		_, err = ioutil.ReadAll(rc)
+		assert.Equal(t, vfs.ErrReadLimitExceeded, err)
+		assert.NoError(t, rc.Close())
+	}
+}
+
+func TestOpenOrCreate(t *testing.T) {
+	root, err := fs.DirByID(consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	f, doc, created, err := vfs.OpenOrCreate(fs, root, "activity.log", 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, created)
+	assert.Equal(t, "activity.log", doc.DocName)
+	_, err = f.Write([]byte("first line\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	f, doc, created, err = vfs.OpenOrCreate(fs, root, "activity.log", 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, created)
+	_, err = f.Write([]byte("second line\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	content := "first line\nsecond line\n"
+	sum := md5.Sum([]byte(content))
+	fileDoc, err := fs.FileByPath("/activity.log")
+	if assert.NoError(t, err) {
+		assert.Equal(t, doc.ID(), fileDoc.ID())
+		assert.Equal(t, int64(len(content)), fileDoc.ByteSize)
+		assert.Equal(t, sum[:], fileDoc.MD5Sum)
+		rc, err := fs.OpenFile(fileDoc)
+		if assert.NoError(t, err) {
+			b, err := ioutil.ReadAll(rc)
+			assert.NoError(t, err)
+			assert.Equal(t, content, string(b))
+			assert.NoError(t, rc.Close())
+		}
+	}
+
+	_, err = vfs.Mkdir(fs, "/activity-dir", nil)
+	assert.NoError(t, err)
+	_, _, _, err = vfs.OpenOrCreate(fs, root, "activity-dir", 0644)
+	assert.Equal(t, vfs.ErrIsDirectory, err)
+}
+
+func TestOpenFileFollow(t *testing.T) {
+	root, err := fs.DirByID(consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, doc, _, err := vfs.OpenOrCreate(fs, root, "follow.log", 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("first line\n"))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	rc, err := vfs.OpenFileFollow(fs, doc, time.Now().Add(2*time.Second))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rc.Close()
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(rc, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "first line\n", string(buf))
+
+	go func() {
+		f, _, _, err := vfs.OpenOrCreate(fs, root, "follow.log", 0644)
+		if assert.NoError(t, err) {
+			_, err = f.Write([]byte("next\n"))
+			assert.NoError(t, err)
+			assert.NoError(t, f.Close())
+		}
+	}()
+	buf = make([]byte, 5)
+	_, err = io.ReadFull(rc, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "next\n", string(buf))
+
+	// Nothing more is appended before the deadline
+	n, err := rc.Read(buf)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNameNormalization(t *testing.T) {
+	normalizer, ok := fs.(vfs.NameNormalizer)
+	if !ok {
+		t.Skip("the VFS does not normalize the names")
+	}
+	normalizer.SetNameNormalization(true)
+	defer normalizer.SetNameNormalization(false)
+
+	nfd := "cafe\u0301.txt"
+	nfc := "caf\u00e9.txt"
+	f, err := vfs.Create(fs, "/"+nfd)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, f.Close())
+
+	doc, err := fs.FileByPath("/" + nfc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, nfc, doc.DocName)
+	doc2, err := fs.FileByPath("/" + nfd)
+	if assert.NoError(t, err) {
+		assert.Equal(t, doc.ID(), doc2.ID())
+	}
+	newdoc, err := vfs.NewFileDoc(nfc, consts.RootDirID, -1, nil, "text/plain",
+		"text", time.Now(), false, false, nil)
+	if assert.NoError(t, err) {
+		_, err = fs.CreateFile(newdoc, nil)
+		assert.Equal(t, os.ErrExist, err)
+	}
+
+	newname := "r\u00e9sum\u00e9.txt"
+	nfdname := "re\u0301sume\u0301.txt"
+	doc, err = vfs.ModifyFileMetadata(fs, doc, &vfs.DocPatch{Name: &nfdname})
+	if assert.NoError(t, err) {
+		assert.Equal(t, newname, doc.DocName)
+		_, err = fs.FileByPath("/" + newname)
+		assert.NoError(t, err)
+	}
+
+	dir, err := vfs.Mkdir(fs, "/e\u0301te\u0301", nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "\u00e9t\u00e9", dir.DocName)
+		assert.Equal(t, "/\u00e9t\u00e9", dir.Fullpath)
+		_, err = fs.DirByPath("/e\u0301te\u0301")
+		assert.NoError(t, err)
+	}
+}
+
+func TestListDirJSON(t *testing.T) {
+	dir, err := vfs.Mkdir(fs, "/listing", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, name := range []string{"b.txt", "a.txt", ".hidden"} {
+		f, err := vfs.Create(fs, "/listing/"+name)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = f.Write([]byte(name))
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+	_, err = vfs.Mkdir(fs, "/listing/sub", nil)
+	assert.NoError(t, err)
+
+	listing, err := vfs.ListDirJSON(fs, dir, &vfs.ListDirOptions{SortBy: vfs.ListSortByName})
+	if assert.NoError(t, err) {
+		assert.Empty(t, listing.Cursor)
+		if assert.Len(t, listing.Entries, 3) {
+			assert.Equal(t, "a.txt", listing.Entries[0].Name)
+			assert.Equal(t, consts.FileType, listing.Entries[0].Type)
+			assert.Equal(t, int64(5), listing.Entries[0].Size)
+			assert.Equal(t, "b.txt", listing.Entries[1].Name)
+			assert.Equal(t, "sub", listing.Entries[2].Name)
+			assert.Equal(t, consts.DirType, listing.Entries[2].Type)
+		}
+		b, err := json.Marshal(listing)
+		assert.NoError(t, err)
+		assert.Contains(t, string(b), `"name":"a.txt"`)
+	}
+
+	opts := &vfs.ListDirOptions{Limit: 2, IncludeHidden: true}
+	var names []string
+	for i := 0; i < 3; i++ {
+		listing, err = vfs.ListDirJSON(fs, dir, opts)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, entry := range listing.Entries {
+			names = append(names, entry.Name)
+		}
+		if listing.Cursor == "" {
+			break
+		}
+		opts.Cursor = listing.Cursor
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{".hidden", "a.txt", "b.txt", "sub"}, names)
+
+	root, err := fs.DirByID(consts.RootDirID)
+	if assert.NoError(t, err) {
+		listing, err = vfs.ListDirJSON(fs, root, &vfs.ListDirOptions{IncludeHidden: true})
+		assert.NoError(t, err)
+		for _, entry := range listing.Entries {
+			assert.NotEqual(t, consts.TrashDirID, entry.ID)
+		}
+	}
+}
+
+func TestDestroyMissingContent(t *testing.T) {
+	// The documents are only created in the index, as if their content had
+	// been removed out of band
+	doc, err := vfs.NewFileDoc("missing-content.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, fs.CreateFileDoc(doc)) {
+		return
+	}
+	assert.NoError(t, fs.DestroyFile(doc))
+	_, err = fs.FileByID(doc.ID())
+	assert.True(t, os.IsNotExist(err))
+
+	dir, err := vfs.NewDirDoc(fs, "missing-content", consts.RootDirID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, fs.CreateDirDoc(dir)) {
+		return
+	}
+	child, err := vfs.NewFileDoc("child.txt", dir.ID(), -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, fs.CreateFileDoc(child)) {
+		return
+	}
+	assert.NoError(t, fs.DestroyDirAndContent(dir))
+	_, err = fs.DirByID(dir.ID())
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.FileByID(child.ID())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUndoOverwrite(t *testing.T) {
+	undoer, ok := fs.(vfs.OverwriteUndoer)
+	if !ok {
+		t.Skip("undo of the overwrites is not supported by this vfs")
+	}
+	cfg := config.GetConfig()
+	retention, maxSize := cfg.Fs.UndoRetention, cfg.Fs.UndoMaxSize
+	defer func() {
+		cfg.Fs.UndoRetention = retention
+		cfg.Fs.UndoMaxSize = maxSize
+	}()
+	cfg.Fs.UndoRetention = time.Hour
+	cfg.Fs.UndoMaxSize = 0
+
+	overwrite := func(olddoc *vfs.FileDoc, content string) *vfs.FileDoc {
+		newdoc, err := vfs.NewFileDoc("undo.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		f, err := fs.CreateFile(newdoc, olddoc)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		_, err = io.WriteString(f, content)
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			t.FailNow()
+		}
+		doc, err := fs.FileByID(newdoc.ID())
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return doc
+	}
+	content := func(doc *vfs.FileDoc) string {
+		f, err := fs.OpenFile(doc)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer f.Close()
+		buf, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		return string(buf)
+	}
+
+	doc := overwrite(nil, "first version")
+	_, err := undoer.UndoOverwrite(doc)
+	assert.Equal(t, vfs.ErrNoOverwriteToUndo, err)
+
+	doc = overwrite(doc, "second")
+	assert.Equal(t, "second", content(doc))
+	stale := doc.Clone().(*vfs.FileDoc)
+	stale.SetRev("1-123")
+	_, err = undoer.UndoOverwrite(stale)
+	assert.Equal(t, vfs.ErrConflict, err)
+
+	undone, err := undoer.UndoOverwrite(doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, len("first version"), undone.ByteSize)
+	expected := md5.Sum([]byte("first version"))
+	assert.Equal(t, expected[:], undone.MD5Sum)
+	assert.Equal(t, "first version", content(undone))
+	_, err = undoer.UndoOverwrite(undone)
+	assert.Equal(t, vfs.ErrNoOverwriteToUndo, err)
+
+	// The old contents are removed when they are over the size limit
+	cfg.Fs.UndoMaxSize = 3
+	doc = overwrite(undone, "third")
+	_, err = undoer.UndoOverwrite(doc)
+	assert.Equal(t, vfs.ErrNoOverwriteToUndo, err)
+
+	// And immediately when the undo is disabled
+	cfg.Fs.UndoMaxSize = 0
+	cfg.Fs.UndoRetention = 0
+	doc = overwrite(doc, "fourth")
+	_, err = undoer.UndoOverwrite(doc)
+	assert.Equal(t, vfs.ErrNoOverwriteToUndo, err)
+	reclaimed, err := undoer.PurgeExpiredUndos()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, reclaimed)
+	assert.NoError(t, fs.DestroyFile(doc))
+}
+
+func TestCapabilities(t *testing.T) {
+	caps := fs.Capabilities()
+	if isAfero {
+		assert.Equal(t, "file", caps.Backend)
+		assert.True(t, caps.StatFS)
+		assert.True(t, caps.AtomicRename)
+	} else {
+		assert.Equal(t, "swift", caps.Backend)
+		assert.False(t, caps.StatFS)
+		assert.False(t, caps.Symlinks)
+	}
+	assert.True(t, caps.RangeReads)
+}
+
+func TestResumePartialUpload(t *testing.T) {
+	resumer, ok := fs.(vfs.UploadResumer)
+	if !ok {
+		t.Skip("resuming the uploads is not supported by this vfs")
+	}
+	read := func(doc *vfs.FileDoc) string {
+		f, err := fs.OpenFile(doc)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer f.Close()
+		buf, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		return string(buf)
+	}
+
+	// Without the flag, a short upload is discarded
+	doc, err := vfs.NewFileDoc("partial-discarded.txt", consts.RootDirID, 10, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "0123")
+	assert.NoError(t, err)
+	assert.Equal(t, vfs.ErrContentLengthMismatch, f.Close())
+	_, err = fs.FileByPath("/partial-discarded.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	// A new file
+	doc, err = vfs.NewFileDoc("partial.txt", consts.RootDirID, 10, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f.(vfs.PartialKeeper).KeepPartial()
+	_, err = io.WriteString(f, "0123")
+	assert.NoError(t, err)
+	sum := md5.Sum([]byte("0123"))
+	assert.Equal(t, vfs.ErrPartialUpload{Written: 4, PartialSum: sum[:]}, f.Close())
+
+	f, err = resumer.ResumeFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "456789")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	olddoc, err := fs.FileByPath("/partial.txt")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, olddoc.Trashed)
+	assert.EqualValues(t, 10, olddoc.ByteSize)
+	assert.Equal(t, "0123456789", read(olddoc))
+
+	// An overwrite
+	newdoc, err := vfs.NewFileDoc("partial.txt", consts.RootDirID, 8, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.CreateFile(newdoc, olddoc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f.(vfs.PartialKeeper).KeepPartial()
+	_, err = io.WriteString(f, "abc")
+	assert.NoError(t, err)
+	_, ok = f.Close().(vfs.ErrPartialUpload)
+	assert.True(t, ok)
+	assert.Equal(t, "0123456789", read(olddoc))
+
+	f, err = resumer.ResumeFile(newdoc, olddoc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = resumer.ResumeFile(newdoc, olddoc)
+	assert.Equal(t, vfs.ErrFileInUse, err)
+	_, err = io.WriteString(f, "defgh")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	assert.Equal(t, "abcdefgh", read(newdoc))
+	assert.NoError(t, fs.DestroyFile(newdoc))
+}
+
+func TestEmptyAndRestoreAllTrash(t *testing.T) {
+	// The other tests may have left some elements in the trash
+	if !assert.NoError(t, vfs.EmptyTrash(fs)) {
+		return
+	}
+	trash, err := fs.DirByID(consts.TrashDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	countChildren := func(dir *vfs.DirDoc) int {
+		count := 0
+		iter := fs.DirIterator(dir, nil)
+		for {
+			_, _, err := iter.Next()
+			if err == vfs.ErrIteratorDone {
+				return count
+			}
+			if !assert.NoError(t, err) {
+				return count
+			}
+			count++
+		}
+	}
+
+	dir, err := vfs.Mkdir(fs, "/trash-all", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	create := func(name string) *vfs.FileDoc {
+		doc, err := vfs.NewFileDoc(name, dir.ID(), -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		f, err := fs.CreateFile(doc, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		_, err = io.WriteString(f, name)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		return doc
+	}
+	a := create("a.txt")
+	b := create("b.txt")
+	sub, err := vfs.Mkdir(fs, "/trash-all/sub", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = vfs.TrashFile(fs, a)
+	assert.NoError(t, err)
+	_, err = vfs.TrashFile(fs, b)
+	assert.NoError(t, err)
+	_, err = vfs.TrashDir(fs, sub)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, countChildren(trash))
+	// The name of a trashed file is taken again
+	create("a.txt")
+
+	assert.NoError(t, vfs.RestoreAllTrash(fs))
+	assert.Equal(t, 0, countChildren(trash))
+	assert.Equal(t, 4, countChildren(dir))
+	_, err = fs.DirByPath("/trash-all/sub")
+	assert.NoError(t, err)
+	b, err = fs.FileByPath("/trash-all/b.txt")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = vfs.TrashFile(fs, b)
+	assert.NoError(t, err)
+	dir, err = fs.DirByID(dir.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = vfs.TrashDir(fs, dir)
+	assert.NoError(t, err)
+	assert.NoError(t, vfs.EmptyTrash(fs))
+	assert.Equal(t, 0, countChildren(trash))
+	_, err = fs.FileByID(b.ID())
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.DirByID(dir.ID())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCopyPooled(t *testing.T) {
+	content := bytes.Repeat([]byte("pooled content "), 10000)
+	var buf bytes.Buffer
+	for i := 0; i < 3; i++ {
+		buf.Reset()
+		n, err := vfs.CopyPooled(&buf, bytes.NewReader(content))
+		assert.NoError(t, err)
+		assert.EqualValues(t, len(content), n)
+		assert.Equal(t, content, buf.Bytes())
+	}
+
+	doc, err := vfs.NewFileDoc("pooled.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, vfs.WriteFile(fs, doc, content))
+	f, err := fs.OpenFile(doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf.Reset()
+	_, err = io.Copy(&buf, f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, content, buf.Bytes())
+	assert.NoError(t, fs.DestroyFile(doc))
+}
+
+func TestFlushIndex(t *testing.T) {
+	_, err := vfs.Mkdir(fs, "/flushindex", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, vfs.FlushIndex(fs))
+	if _, ok := fs.(vfs.IndexFlusher); !ok && isAfero {
+		t.Fatal("the afero VFS should implement IndexFlusher")
+	}
+	_, err = fs.DirByPath("/flushindex")
+	assert.NoError(t, err)
+}
+
+func TestFilenamePolicy(t *testing.T) {
+	conf := config.GetConfig()
+	prev := conf.Fs
+	defer func() { conf.Fs = prev }()
+
+	newFile := func(name string) error {
+		_, err := vfs.NewFileDoc(name, consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+		return err
+	}
+	names := []string{"CON", "aux.txt", "a:b", "trailing.", "trailing ", "tab\tname"}
+
+	conf.Fs.FilenamePolicy = vfs.FilenamePolicyPOSIX
+	for _, name := range names {
+		assert.NoError(t, newFile(name), name)
+	}
+
+	conf.Fs.FilenamePolicy = vfs.FilenamePolicyWindows
+	for _, name := range names {
+		assert.Equal(t, vfs.ErrIllegalFilename, newFile(name), name)
+	}
+	assert.NoError(t, newFile("console.txt"))
+	_, err := vfs.Mkdir(fs, "/nul", nil)
+	assert.Equal(t, vfs.ErrIllegalFilename, err)
+
+	conf.Fs.ReservedFilenames = []string{"desktop.ini"}
+	assert.NoError(t, newFile("CON"))
+	assert.Equal(t, vfs.ErrIllegalFilename, newFile("Desktop.ini"))
+
+	conf.Fs.FilenamePolicy = vfs.FilenamePolicyPOSIX
+	assert.Equal(t, vfs.ErrIllegalFilename, newFile("desktop.ini"))
+}
+
+func TestVerifyFile(t *testing.T) {
+	doc, err := vfs.NewFileDoc("verified.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	content := []byte("content to verify")
+	assert.NoError(t, vfs.WriteFile(fs, doc, content))
+	expected := md5.Sum(content)
+
+	ok, md5sum, err := vfs.VerifyFile(fs, doc)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, expected[:], md5sum)
+
+	stale := doc.Clone().(*vfs.FileDoc)
+	stale.MD5Sum = []byte("stale")
+	ok, md5sum, err = vfs.VerifyFile(fs, stale)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, expected[:], md5sum)
+
+	assert.NoError(t, fs.DestroyFile(doc))
+	_, _, err = vfs.VerifyFile(fs, doc)
+	assert.Error(t, err)
+}
+
+func TestFlatLayout(t *testing.T) {
+	if !isAfero {
+		t.Skip("The flat layout is only for the afero VFS")
+	}
+	flat, rollback, err := makeAferoFS("io.cozy.vfs.test.flat", vfsafero.FlatLayout)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rollback()
+
+	dir, err := vfs.MkdirAll(flat, "/flat/deep")
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc, err := vfs.NewFileDoc("file.txt", dir.ID(), -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := flat.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "flat content")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	empty, err := vfs.NewFileDoc("empty.txt", dir.ID(), 0, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = flat.CreateFile(empty, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	// The contents are read from their identifiers, even after a move of the
+	// file and of its directory
+	root, err := flat.DirByID(consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	moved, err := vfs.MoveFile(flat, doc, root, "moved.txt")
+	if !assert.NoError(t, err) {
+		return
+	}
+	content, err := vfs.ReadFile(flat, moved)
+	assert.NoError(t, err)
+	assert.Equal(t, "flat content", string(content))
+	newName := "renamed"
+	_, err = vfs.ModifyDirMetadata(flat, dir, &vfs.DocPatch{Name: &newName})
+	assert.NoError(t, err)
+	emptyDoc, err := flat.FileByPath("/flat/renamed/empty.txt")
+	if assert.NoError(t, err) {
+		content, err = vfs.ReadFile(flat, emptyDoc)
+		assert.NoError(t, err)
+		assert.Empty(t, content)
+	}
+
+	// The content is overwritten in place
+	newdoc := moved.Clone().(*vfs.FileDoc)
+	newdoc.ByteSize = -1
+	newdoc.MD5Sum = nil
+	f, err = flat.CreateFile(newdoc, moved)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "new flat content")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	content, err = vfs.ReadFile(flat, newdoc)
+	assert.NoError(t, err)
+	assert.Equal(t, "new flat content", string(content))
+
+	logbook, err := flat.Fsck(vfs.FsckOptions{CheckContent: true})
+	assert.NoError(t, err)
+	assert.Empty(t, logbook)
+
+	// The contents are removed with their files
+	parent, err := flat.DirByPath("/flat")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, flat.DestroyDirAndContent(parent))
+	assert.NoError(t, flat.DestroyFile(newdoc))
+	_, err = flat.OpenFile(emptyDoc)
+	assert.True(t, os.IsNotExist(err))
+	_, err = flat.OpenFile(newdoc)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCreateInTrashedDir(t *testing.T) {
+	dir, err := vfs.Mkdir(fs, "/tobetrashed", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// The documents are prepared with the directory before it is trashed, like
+	// a client with a stale reference to it
+	filedoc, err := vfs.NewFileDoc("late.txt", dir.ID(), -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	subdir, err := vfs.NewDirDocWithParent("late", dir, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = vfs.TrashDir(fs, dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = fs.CreateFile(filedoc, nil)
+	assert.Equal(t, vfs.ErrParentInTrash, err)
+	assert.Equal(t, vfs.ErrParentInTrash, fs.CreateDir(subdir))
+	trashed, err := fs.DirByID(dir.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = vfs.Mkdir(fs, path.Join(trashed.Fullpath, "late"), nil)
+	assert.Equal(t, vfs.ErrParentInTrash, err)
+	direct, err := vfs.NewDirDoc(fs, "direct", consts.TrashDirID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, vfs.ErrParentInTrash, fs.CreateDir(direct))
+
+	// Unless it is explicitly allowed
+	allowed, err := vfs.NewDirDocWithParent("allowed", trashed, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	allowed.AllowInTrash = true
+	assert.NoError(t, fs.CreateDir(allowed))
+}
+
+func TestPing(t *testing.T) {
+	assert.NoError(t, vfs.Ping(fs))
+	assert.Equal(t, vfs.ErrPingTimeout, vfs.WithPingTimeout("hung", func() error {
+		time.Sleep(vfs.PingTimeout + time.Second)
+		return errors.New("hung")
+	}))
+
+	// The probe that has timed out is still running: its result is reused
+	started := false
+	err := vfs.WithPingTimeout("hung", func() error {
+		started = true
+		return nil
+	})
+	assert.EqualError(t, err, "hung")
+	assert.False(t, started)
+}
+
+func TestMaintenance(t *testing.T) {
+	setter, ok := fs.(vfs.MaintenanceSetter)
+	if !ok {
+		t.Skip("maintenance mode is not supported by this vfs")
+	}
+	cfg := config.GetConfig()
+	abortUploads := cfg.Fs.MaintenanceAbortUploads
+	defer func() {
+		cfg.Fs.MaintenanceAbortUploads = abortUploads
+		assert.NoError(t, setter.SetMaintenance(false))
+	}()
+
+	newFile := func(name string) *vfs.FileDoc {
+		doc, err := vfs.NewFileDoc(name, consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return doc
+	}
+	readable := newFile("maintenance-readable.txt")
+	f, err := fs.CreateFile(readable, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "hello")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// An upload in progress is allowed to finish by default
+	inflight, err := fs.CreateFile(newFile("maintenance-inflight.txt"), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, setter.SetMaintenance(true))
+	enabled, err := setter.InMaintenance()
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+	_, err = io.WriteString(inflight, "world")
+	assert.NoError(t, err)
+	assert.NoError(t, inflight.Close())
+
+	_, err = fs.CreateFile(newFile("maintenance-new.txt"), nil)
+	assert.Equal(t, vfs.ErrMaintenance, err)
+	_, err = vfs.Mkdir(fs, "/maintenance-dir", nil)
+	assert.Equal(t, vfs.ErrMaintenance, err)
+	doc, err := fs.FileByPath("/maintenance-readable.txt")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, vfs.ErrMaintenance, fs.DestroyFile(doc))
+	r, err := fs.OpenFile(doc)
+	if assert.NoError(t, err) {
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(content))
+		assert.NoError(t, r.Close())
+	}
+
+	// Or it fails, if configured so
+	assert.NoError(t, setter.SetMaintenance(false))
+	inflight, err = fs.CreateFile(newFile("maintenance-aborted.txt"), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cfg.Fs.MaintenanceAbortUploads = true
+	assert.NoError(t, setter.SetMaintenance(true))
+	_, err = io.WriteString(inflight, "world")
+	assert.Equal(t, vfs.ErrMaintenance, err)
+	assert.Equal(t, vfs.ErrMaintenance, inflight.Close())
+
+	assert.NoError(t, setter.SetMaintenance(false))
+	enabled, err = setter.InMaintenance()
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+	_, err = fs.FileByPath("/maintenance-aborted.txt")
+	assert.Error(t, err)
+	assert.NoError(t, fs.DestroyFile(doc))
+}
+
+func TestServeFile(t *testing.T) {
+	content := "content served with ranges"
+	doc, err := vfs.NewFileDoc("served-file", consts.RootDirID, int64(len(content)),
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte(content))
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	doc, err = fs.FileByPath("/served-file")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	req := httptest.NewRequest("GET", "/served-file", nil)
+	w := httptest.NewRecorder()
+	assert.NoError(t, vfs.ServeFile(w, req, fs, doc))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, content, w.Body.String())
+	assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	etag := w.Header().Get("Etag")
+	assert.NotEmpty(t, etag)
+
+	req = httptest.NewRequest("GET", "/served-file", nil)
+	req.Header.Set("Range", "bytes=8-13")
+	w = httptest.NewRecorder()
+	assert.NoError(t, vfs.ServeFile(w, req, fs, doc))
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, "served", w.Body.String())
+	assert.Equal(t, fmt.Sprintf("bytes 8-13/%d", len(content)), w.Header().Get("Content-Range"))
+
+	req = httptest.NewRequest("GET", "/served-file", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	assert.NoError(t, vfs.ServeFile(w, req, fs, doc))
+	assert.Equal(t, 304, w.Code)
+}
+
+func TestDirLastModified(t *testing.T) {
+	dir, err := vfs.MkdirAll(fs, "/lastmod/sub/subsub")
+	if !assert.NoError(t, err) {
+		return
+	}
+	top, err := fs.DirByPath("/lastmod")
+	if !assert.NoError(t, err) {
+		return
+	}
+	last, err := fs.DirLastModified(top)
+	assert.NoError(t, err)
+	assert.False(t, last.Before(top.UpdatedAt))
+
+	updatedAt := time.Now().Add(24 * time.Hour).Truncate(time.Millisecond)
+	doc, err := vfs.NewFileDoc("deep-file", dir.ID(), -1,
+		nil, "text/plain", "text", updatedAt, false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write([]byte("deep"))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	last, err = fs.DirLastModified(top)
+	assert.NoError(t, err)
+	assert.True(t, updatedAt.Equal(last), "%s != %s", updatedAt, last)
+
+	// A sibling directory is not changed
+	other, err := vfs.MkdirAll(fs, "/lastmod-other")
+	if assert.NoError(t, err) {
+		last, err = fs.DirLastModified(other)
+		assert.NoError(t, err)
+		assert.True(t, last.Before(updatedAt))
+	}
+}
+
+func TestTrustedContent(t *testing.T) {
+	content := []byte("trusted content")
+	sum := md5.Sum(content)
+	wrongSum := md5.Sum([]byte("another content"))
+	create := func(name string, size int64, md5sum []byte, trusted bool, data []byte) (vfs.File, error) {
+		doc, err := vfs.NewFileDoc(name, consts.RootDirID, size,
+			md5sum, "text/plain", "text", time.Now(), false, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		doc.TrustedContent = trusted
+		f, err := fs.CreateFile(doc, nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = f.Write(data); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+
+	// An upload is always hashed
+	f, err := create("untrusted-content", int64(len(content)), wrongSum[:], false, content)
+	if assert.NoError(t, err) {
+		assert.Equal(t, vfs.ErrInvalidHash, f.Close())
+	}
+	// The flag cannot be given by a client
+	var doc vfs.FileDoc
+	assert.NoError(t, json.Unmarshal([]byte(`{"TrustedContent": true}`), &doc))
+	assert.False(t, doc.TrustedContent)
+	// Without the size, the content is hashed
+	f, err = create("trusted-without-size", -1, wrongSum[:], true, content)
+	if assert.NoError(t, err) {
+		assert.Equal(t, vfs.ErrInvalidHash, f.Close())
+	}
+	// The size of a trusted content is still checked
+	f, err = create("trusted-wrong-size", 4, sum[:], true, content)
+	if err == nil {
+		err = f.Close()
+	}
+	assert.Equal(t, vfs.ErrContentLengthMismatch, err)
+
+	f, err = create("trusted-content", int64(len(content)), sum[:], true, content)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if reporter, ok := f.(vfs.ProgressReporter); ok {
+		written, partialSum := reporter.Progress()
+		assert.Equal(t, int64(len(content)), written)
+		assert.Nil(t, partialSum)
+	}
+	assert.NoError(t, f.Close())
+	fileDoc, err := fs.FileByPath("/trusted-content")
+	if assert.NoError(t, err) {
+		assert.Equal(t, sum[:], fileDoc.MD5Sum)
+		assert.Equal(t, int64(len(content)), fileDoc.ByteSize)
+	}
+}
+
+func TestSwapFiles(t *testing.T) {
+	swapper, ok := fs.(vfs.Swapper)
+	if !ok {
+		t.Skip("swap is not supported by this vfs")
+	}
+
+	docs := make([]*vfs.FileDoc, 2)
+	for i, content := range []string{"active config", "staging"} {
+		doc, err := vfs.NewFileDoc(fmt.Sprintf("swap%d.txt", i), consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		f, err := fs.CreateFile(doc, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.WriteString(f, content)
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
+		docs[i] = doc
+	}
+	a, b := docs[0], docs[1]
+	ida, idb := a.ID(), b.ID()
+
+	if !assert.NoError(t, swapper.SwapFiles(a, b)) {
+		return
+	}
+	assert.Equal(t, ida, a.ID())
+	assert.Equal(t, "swap0.txt", a.DocName)
+	assert.EqualValues(t, len("staging"), a.ByteSize)
+	expected := md5.Sum([]byte("staging"))
+	assert.Equal(t, expected[:], a.MD5Sum)
+	assert.Equal(t, idb, b.ID())
+	assert.EqualValues(t, len("active config"), b.ByteSize)
+
+	f, err := fs.OpenFile(a)
+	if assert.NoError(t, err) {
+		buf, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, "staging", string(buf))
+		assert.NoError(t, f.Close())
+	}
+
+	stale := a.Clone().(*vfs.FileDoc)
+	stale.SetRev("1-123")
+	assert.Equal(t, vfs.ErrConflict, swapper.SwapFiles(stale, b))
+}
+
+func TestTruncate(t *testing.T) {
+	truncater, ok := fs.(vfs.Truncater)
+	if !ok {
+		t.Skip("truncate is not supported by this vfs")
+	}
+
+	doc, err := vfs.NewFileDoc("truncate.txt", consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "foo bar baz")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	_, err = truncater.Truncate(doc, 20, false)
+	assert.Equal(t, vfs.ErrTruncateExtend, err)
+
+	newdoc, err := truncater.Truncate(doc, 3, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 3, newdoc.ByteSize)
+	expected := md5.Sum([]byte("foo"))
+	assert.Equal(t, expected[:], newdoc.MD5Sum)
+
+	newdoc, err = truncater.Truncate(newdoc, 5, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	content, err := fs.OpenFile(newdoc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer content.Close()
+	buf, err := ioutil.ReadAll(content)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("foo\x00\x00"), buf)
+
+	// The content being overwritten can't be truncated at the same time
+	overwrite := newdoc.Clone().(*vfs.FileDoc)
+	overwrite.ByteSize = -1
+	f, err = fs.CreateFile(overwrite, newdoc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = truncater.Truncate(newdoc, 1, false)
+	assert.Equal(t, vfs.ErrFileInUse, err)
+	assert.NoError(t, f.(vfs.Aborter).Abort())
+	_, err = truncater.Truncate(newdoc, 1, false)
+	assert.NoError(t, err)
+}
+
+func TestFilesByTag(t *testing.T) {
+	_, err := createTree(H{"tagged/": H{"invoice1": nil, "invoice2": nil}}, consts.RootDirID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc, err := fs.FileByPath("/tagged/invoice1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	newdoc, err := vfs.SetTags(fs, doc, []string{"invoice", "2018", "invoice"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"invoice", "2018"}, newdoc.Tags)
+
+	files, err := fs.FilesByTag("invoice", couchdb.NewSkipCursor(10, 0))
+	if assert.NoError(t, err) && assert.Len(t, files, 1) {
+		assert.Equal(t, newdoc.ID(), files[0].ID())
+	}
+	files, err = fs.FilesByTag("unknown", couchdb.NewSkipCursor(10, 0))
+	assert.NoError(t, err)
+	assert.Len(t, files, 0)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+
+	check, err := checkup.HTTPChecker{URL: config.CouchURL().String()}.Check()
+	if err != nil || check.Status() != checkup.Healthy {
+		fmt.Println("This test need couchdb to run.")
+		os.Exit(1)
+	}
+
+	var rollback func()
+	fs, rollback, err = makeAferoFS("io.cozy.vfs.test", vfsafero.PathLayout)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	isAfero = true
+	res1 := m.Run()
+	isAfero = false
+	rollback()
+
+	fs, rollback, err = makeSwiftFS(true)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res2 := m.Run()
+	rollback()
+
+	fs, rollback, err = makeSwiftFS(false)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res3 := m.Run()
+	rollback()
+
+	os.Exit(res1 + res2 + res3)
+}
+
+func makeAferoFS(name string, layout vfsafero.Layout) (vfs.VFS, func(), error) {
+	tempdir, err := ioutil.TempDir("", "cozy-stack")
+	if err != nil {
+		return nil, nil, errors.New("could not create temporary directory")
+	}
+
+	db := prefixer.NewPrefixer(name, name)
+	index := vfs.NewCouchdbIndexer(db)
+	aferoFs, err := vfsafero.New(db, index, &diskImpl{}, lock.ReadWrite(db, "vfs-afero-test"),
+		&url.URL{Scheme: "file", Host: "localhost", Path: tempdir}, name, layout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
+		return nil, nil, err
+	}
+
+	err = aferoFs.InitFs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return aferoFs, func() {
+		os.RemoveAll(tempdir)
+		couchdb.DeleteDB(db, consts.Files)
+	}, nil
+}
+
+func makeSwiftFS(layoutV2 bool) (vfs.VFS, func(), error) {
+	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
+	index := vfs.NewCouchdbIndexer(db)
+	swiftSrv, err := swifttest.NewSwiftServer("localhost")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create swift server %s", err)
+	}
+
+	err = config.InitSwiftConnection(&url.URL{
+		Scheme:   "swift",
+		Host:     "localhost",
+		RawQuery: "UserName=swifttest&Password=swifttest&AuthURL=" + url.QueryEscape(swiftSrv.AuthURL),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var swiftFs vfs.VFS
+	if layoutV2 {
+		swiftFs, err = vfsswift.NewV2(db,
+			index, &diskImpl{}, lock.ReadWrite(db, "vfs-swiftv2-test"))
+	} else {
+		swiftFs, err = vfsswift.New(db,
+			index, &diskImpl{}, lock.ReadWrite(db, "vfs-swift-test"))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
+		return nil, nil, err
+	}
+
+	err = swiftFs.InitFs()
+	if err != nil {
 		return nil, nil, err
 	}
 
@@ -895,3 +3478,45 @@ func makeSwiftFS(layoutV2 bool) (vfs.VFS, func(), error) {
 		}
 	}, nil
 }
+
+func TestRetryPolicy(t *testing.T) {
+	r := vfs.RetryPolicy{MaxAttempts: 3, Delay: time.Millisecond}
+
+	calls := 0
+	err := r.Do(func() error {
+		calls++
+		if calls < 3 {
+			return &couchdb.Error{StatusCode: 503}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = r.Do(func() error {
+		calls++
+		return &couchdb.Error{StatusCode: 409}
+	})
+	assert.True(t, couchdb.IsConflictError(err))
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	err = r.Do(func() error {
+		calls++
+		return &couchdb.Error{StatusCode: 500}
+	})
+	assert.True(t, couchdb.IsInternalServerError(err))
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = r.Do(func() error {
+		calls++
+		if calls < 2 {
+			return &url.Error{Op: "Post", URL: "http://localhost:5984/", Err: errors.New("connection refused")}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,110 @@
+package vfsafero
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// contentChecker reads the content of the files with a pool of workers, and
+// compares their md5sum with the one of the index. The files are given to the
+// workers through a channel with a small buffer, so that the walk of the tree
+// waits for them instead of keeping all the files in memory.
+type contentChecker struct {
+	afs      *aferoVFS
+	files    chan *contentCheck
+	wg       sync.WaitGroup
+	progress func(checked int)
+
+	mu      sync.Mutex
+	logbook []*vfs.FsckLog
+	checked int
+	err     error
+}
+
+type contentCheck struct {
+	doc      *vfs.FileDoc
+	fullpath string
+}
+
+func newContentChecker(afs *aferoVFS, opts vfs.FsckOptions) *contentChecker {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	c := &contentChecker{
+		afs:      afs,
+		files:    make(chan *contentCheck, workers),
+		progress: opts.Progress,
+	}
+	c.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go c.work()
+	}
+	return c
+}
+
+// push gives a file to check to the workers. It blocks when they are all busy.
+func (c *contentChecker) push(doc *vfs.FileDoc, fullpath string) {
+	c.files <- &contentCheck{doc: doc, fullpath: fullpath}
+}
+
+// wait returns the inconsistencies found, once all the files have been
+// checked. push must not be called after it.
+func (c *contentChecker) wait() ([]*vfs.FsckLog, error) {
+	close(c.files)
+	c.wg.Wait()
+	return c.logbook, c.err
+}
+
+func (c *contentChecker) work() {
+	defer c.wg.Done()
+	for check := range c.files {
+		c.mu.Lock()
+		failed := c.err != nil
+		c.mu.Unlock()
+		if failed {
+			continue
+		}
+		log, err := c.check(check)
+		c.mu.Lock()
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+		if log != nil {
+			c.logbook = append(c.logbook, log)
+		}
+		c.checked++
+		checked := c.checked
+		c.mu.Unlock()
+		if c.progress != nil {
+			c.progress(checked)
+		}
+	}
+}
+
+func (c *contentChecker) check(check *contentCheck) (*vfs.FsckLog, error) {
+	f, err := c.afs.fs.Open(check.fullpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	md5sum, size, err := vfs.ContentSum(f)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(md5sum, check.doc.MD5Sum) && size == check.doc.ByteSize {
+		return nil, nil
+	}
+	newdoc := check.doc.Clone().(*vfs.FileDoc)
+	newdoc.MD5Sum = md5sum
+	newdoc.ByteSize = size
+	return &vfs.FsckLog{
+		Type:       vfs.ContentMismatch,
+		IsFile:     true,
+		FileDoc:    newdoc,
+		OldFileDoc: check.doc,
+		Filename:   check.fullpath,
+	}, nil
+}
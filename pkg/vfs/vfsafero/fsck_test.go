@@ -0,0 +1,51 @@
+package vfsafero
+
+import (
+	"crypto/md5"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentChecker(t *testing.T) {
+	afs := &aferoVFS{fs: afero.NewMemMapFs()}
+	var calls int32
+	checker := newContentChecker(afs, vfs.FsckOptions{
+		Workers:  4,
+		Progress: func(checked int) { atomic.AddInt32(&calls, 1) },
+	})
+
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("/file%d", i)
+		content := []byte(name)
+		assert.NoError(t, afero.WriteFile(afs.fs, name, content, 0644))
+		md5sum := md5.Sum(content)
+		doc := &vfs.FileDoc{DocID: name, ByteSize: int64(len(content)), MD5Sum: md5sum[:]}
+		if i == 7 {
+			doc.MD5Sum = []byte("stale")
+		}
+		checker.push(doc, name)
+	}
+
+	logbook, err := checker.wait()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 20, atomic.LoadInt32(&calls))
+	if assert.Len(t, logbook, 1) {
+		log := logbook[0]
+		assert.Equal(t, vfs.ContentMismatch, log.Type)
+		assert.Equal(t, "/file7", log.Filename)
+		assert.Equal(t, []byte("stale"), log.OldFileDoc.MD5Sum)
+		expected := md5.Sum([]byte("/file7"))
+		assert.Equal(t, expected[:], log.FileDoc.MD5Sum)
+	}
+
+	// A file that can not be read stops the check
+	checker = newContentChecker(afs, vfs.FsckOptions{Workers: 2})
+	checker.push(&vfs.FileDoc{DocID: "missing"}, "/missing")
+	_, err = checker.wait()
+	assert.Error(t, err)
+}
@@ -0,0 +1,208 @@
+package vfsafero
+
+import (
+	"container/list"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// handlePool limits the number of files opened for reading by the afero VFS,
+// as the file descriptors are shared by all the instances of the process.
+// The handles of the files recently closed are kept idle, to be reused if the
+// same file is opened again. The idle handles count in the limit, and the
+// least recently used is closed when a slot is needed.
+//
+// The handles are identified by the identifier and revision of the file: a
+// change of the content gives a new revision, so an idle handle is never
+// used to read an outdated content.
+type handlePool struct {
+	slots   chan struct{} // nil if the number of handles is not limited
+	wait    time.Duration
+	maxIdle int
+
+	mu    sync.Mutex
+	idle  *list.List // of *idleHandle, the most recent at the front
+	byKey map[string]*list.Element
+}
+
+type idleHandle struct {
+	key string
+	f   afero.File
+}
+
+var (
+	handlesOnce sync.Once
+	handles     *handlePool
+)
+
+// getHandlePool returns the pool of handles, configured from the fs section
+// of the configuration.
+func getHandlePool() *handlePool {
+	handlesOnce.Do(func() {
+		conf := config.GetConfig().Fs
+		handles = newHandlePool(conf.MaxOpenFiles, conf.OpenFilesWait, conf.IdleOpenFiles)
+	})
+	return handles
+}
+
+func newHandlePool(max int, wait time.Duration, maxIdle int) *handlePool {
+	p := &handlePool{
+		wait:    wait,
+		maxIdle: maxIdle,
+		idle:    list.New(),
+		byKey:   make(map[string]*list.Element),
+	}
+	if max > 0 {
+		p.slots = make(chan struct{}, max)
+		if p.maxIdle >= max {
+			p.maxIdle = max - 1
+		}
+	}
+	return p
+}
+
+func handleKey(prefix string, doc *vfs.FileDoc) string {
+	return prefix + "/" + doc.ID() + "/" + doc.Rev()
+}
+
+// open returns a handle for the file with the given key, reusing an idle one
+// if possible. It returns vfs.ErrTooManyOpenFiles if the limit has been
+// reached and no handle has been released in the configured delay.
+func (p *handlePool) open(key string, open func() (afero.File, error)) (afero.File, error) {
+	if f := p.takeIdle(key); f != nil {
+		if _, err := f.Seek(0, io.SeekStart); err == nil {
+			return f, nil
+		}
+		p.discard(f)
+	}
+	if err := p.acquire(); err != nil {
+		return nil, err
+	}
+	f, err := open()
+	if err != nil {
+		p.releaseSlot()
+		return nil, err
+	}
+	return f, nil
+}
+
+// release gives back a handle: it is kept idle for the key, or closed.
+func (p *handlePool) release(key string, f afero.File) error {
+	if p.maxIdle <= 0 {
+		return p.discard(f)
+	}
+	p.mu.Lock()
+	if _, ok := p.byKey[key]; ok {
+		p.mu.Unlock()
+		return p.discard(f)
+	}
+	p.byKey[key] = p.idle.PushFront(&idleHandle{key: key, f: f})
+	var evicted *idleHandle
+	if p.idle.Len() > p.maxIdle {
+		evicted = p.removeElement(p.idle.Back())
+	}
+	p.mu.Unlock()
+	if evicted != nil {
+		p.discard(evicted.f)
+	}
+	return nil
+}
+
+// forget closes the idle handles of the file with the given identifier, to
+// not keep open a file that has been removed from the disk.
+func (p *handlePool) forget(prefix, id string) {
+	keyPrefix := prefix + "/" + id + "/"
+	var forgotten []*idleHandle
+	p.mu.Lock()
+	for e := p.idle.Front(); e != nil; {
+		next := e.Next()
+		if h := e.Value.(*idleHandle); strings.HasPrefix(h.key, keyPrefix) {
+			forgotten = append(forgotten, p.removeElement(e))
+		}
+		e = next
+	}
+	p.mu.Unlock()
+	for _, h := range forgotten {
+		p.discard(h.f)
+	}
+}
+
+func (p *handlePool) takeIdle(key string) afero.File {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.byKey[key]
+	if !ok {
+		return nil
+	}
+	return p.removeElement(e).f
+}
+
+// evictIdle closes the least recently used idle handle, and returns false if
+// there was none.
+func (p *handlePool) evictIdle() bool {
+	p.mu.Lock()
+	e := p.idle.Back()
+	var evicted *idleHandle
+	if e != nil {
+		evicted = p.removeElement(e)
+	}
+	p.mu.Unlock()
+	if evicted == nil {
+		return false
+	}
+	p.discard(evicted.f)
+	return true
+}
+
+// removeElement must be called with the lock held.
+func (p *handlePool) removeElement(e *list.Element) *idleHandle {
+	h := p.idle.Remove(e).(*idleHandle)
+	delete(p.byKey, h.key)
+	return h
+}
+
+func (p *handlePool) acquire() error {
+	if p.slots == nil {
+		return nil
+	}
+	for {
+		select {
+		case p.slots <- struct{}{}:
+			return nil
+		default:
+		}
+		if !p.evictIdle() {
+			break
+		}
+	}
+	if p.wait <= 0 {
+		return vfs.ErrTooManyOpenFiles
+	}
+	timer := time.NewTimer(p.wait)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return vfs.ErrTooManyOpenFiles
+	}
+}
+
+func (p *handlePool) releaseSlot() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// discard closes the handle and frees its slot.
+func (p *handlePool) discard(f afero.File) error {
+	err := f.Close()
+	p.releaseSlot()
+	return err
+}
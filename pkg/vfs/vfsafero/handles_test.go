@@ -0,0 +1,61 @@
+package vfsafero
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlePool(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/foo", []byte("foo"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, "/bar", []byte("bar"), 0644))
+	opener := func(name string) func() (afero.File, error) {
+		return func() (afero.File, error) { return fs.Open(name) }
+	}
+
+	p := newHandlePool(1, 10*time.Millisecond, 0)
+	f, err := p.open("foo", opener("/foo"))
+	assert.NoError(t, err)
+	_, err = p.open("bar", opener("/bar"))
+	assert.Equal(t, vfs.ErrTooManyOpenFiles, err)
+	assert.NoError(t, p.release("foo", f))
+	g, err := p.open("bar", opener("/bar"))
+	assert.NoError(t, err)
+	assert.NoError(t, p.release("bar", g))
+
+	// An idle handle is reused, from the start of the file
+	p = newHandlePool(2, 0, 1)
+	f, err = p.open("foo", opener("/foo"))
+	assert.NoError(t, err)
+	buf := make([]byte, 3)
+	_, err = f.Read(buf)
+	assert.NoError(t, err)
+	assert.NoError(t, p.release("foo", f))
+	g, err = p.open("foo", opener("/foo"))
+	assert.NoError(t, err)
+	assert.True(t, f == g)
+	_, err = g.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(buf))
+	assert.NoError(t, p.release("foo", g))
+
+	// The idle handles are evicted when a slot is needed
+	f, err = p.open("bar", opener("/bar"))
+	assert.NoError(t, err)
+	g, err = p.open("prefix/foo/1-abc", opener("/foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, p.idle.Len())
+	assert.NoError(t, p.release("bar", f))
+	assert.NoError(t, p.release("prefix/foo/1-abc", g))
+	assert.Equal(t, 1, p.idle.Len())
+
+	// The idle handles of a removed file are closed
+	p.forget("prefix", "fo")
+	assert.Equal(t, 1, p.idle.Len())
+	p.forget("prefix", "foo")
+	assert.Equal(t, 0, p.idle.Len())
+}
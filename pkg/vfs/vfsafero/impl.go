@@ -4,6 +4,7 @@ package vfsafero
 import (
 	"bytes"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -12,7 +13,11 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/logger"
@@ -35,6 +40,24 @@ type aferoVFS struct {
 	fs     afero.Fs
 	mu     lock.ErrorRWLocker
 	pth    string
+	retry  vfs.RetryPolicy
+
+	// the directory where the temporary files of the overwrites are written
+	tmpDir string
+
+	// the way the contents of the files are laid out on the storage
+	layout Layout
+
+	// whether or not the content of the files is read back after being
+	// written, to check its md5sum
+	verifyWrites bool
+
+	// whether or not the names of the files and directories are normalized in
+	// the NFC form when they are created or renamed
+	normalizeNames bool
+
+	// returns the inspector of the content of the uploaded files, if any
+	inspector vfs.ContentInspectorFunc
 
 	// whether or not the localfilesystem requires an initialisation of its root
 	// directory
@@ -46,7 +69,10 @@ type aferoVFS struct {
 //
 // The supported scheme of the storage url are file://, for an OS-FS store, and
 // mem:// for an in-memory store. The backend used is the afero package.
-func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsURL *url.URL, pathSegment string) (vfs.VFS, error) {
+//
+// The layout is the way the contents of the files are stored: it must not
+// change for an existing storage.
+func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsURL *url.URL, pathSegment string, layout Layout) (vfs.VFS, error) {
 	if fsURL.Scheme != "mem" && fsURL.Path == "" {
 		return nil, fmt.Errorf("vfsafero: please check the supplied fs url: %s",
 			fsURL.String())
@@ -54,11 +80,15 @@ func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu l
 	if pathSegment == "" {
 		return nil, fmt.Errorf("vfsafero: specified path segment is empty")
 	}
+	layout, err := ParseLayout(string(layout))
+	if err != nil {
+		return nil, err
+	}
 	pth := path.Join(fsURL.Path, pathSegment)
 	var fs afero.Fs
 	switch fsURL.Scheme {
 	case "file":
-		fs = afero.NewBasePathFs(afero.NewOsFs(), pth)
+		fs = newRealPathFs(pth)
 	case "mem":
 		fs = afero.NewMemMapFs()
 	default:
@@ -73,6 +103,9 @@ func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu l
 		fs:     fs,
 		mu:     mu,
 		pth:    pth,
+		retry:  vfs.IndexRetryPolicy(),
+		tmpDir: configuredTmpDir(),
+		layout: layout,
 		// for now, only the file:// scheme needs a specific initialisation of its
 		// root directory.
 		osFS: fsURL.Scheme == "file",
@@ -92,13 +125,30 @@ func (afs *aferoVFS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
 		Indexer:         index,
 		DiskThresholder: afs.DiskThresholder,
 		domain:          afs.domain,
+		prefix:          afs.prefix,
 		fs:              afs.fs,
 		mu:              afs.mu,
 		pth:             afs.pth,
+		retry:           afs.retry,
+		tmpDir:          afs.tmpDir,
+		layout:          afs.layout,
+		verifyWrites:    afs.verifyWrites,
+		normalizeNames:  afs.normalizeNames,
+		inspector:       afs.inspector,
 		osFS:            afs.osFS,
 	}
 }
 
+// SetWriteVerification implements the vfs.WriteVerifier interface.
+func (afs *aferoVFS) SetWriteVerification(enabled bool) {
+	afs.verifyWrites = enabled
+}
+
+// SetContentInspector implements the vfs.InspectorSetter interface.
+func (afs *aferoVFS) SetContentInspector(fn vfs.ContentInspectorFunc) {
+	afs.inspector = fn
+}
+
 // Init creates the root directory document and the trash directory for this
 // file system.
 func (afs *aferoVFS) InitFs() error {
@@ -118,7 +168,7 @@ func (afs *aferoVFS) InitFs() error {
 	if err := afs.fs.Mkdir(vfs.TrashDirName, 0755); err != nil && !os.IsExist(err) {
 		return err
 	}
-	return nil
+	return afs.mkdirTmp()
 }
 
 // Delete removes all the elements associated with the filesystem.
@@ -133,21 +183,65 @@ func (afs *aferoVFS) Delete() error {
 	return nil
 }
 
+// Capabilities implements the vfs.Fs interface.
+func (afs *aferoVFS) Capabilities() vfs.Capabilities {
+	backend := config.SchemeMem
+	if afs.osFS {
+		backend = config.SchemeFile
+	}
+	return vfs.Capabilities{
+		Backend:      backend,
+		StatFS:       afs.osFS,
+		Symlinks:     afs.osFS,
+		AtomicRename: true,
+		RangeReads:   true,
+	}
+}
+
+// Ping implements the vfs.Pinger interface. It does not take the lock, as it
+// only stats the root of the storage, which is trivially OK for a mem://.
+func (afs *aferoVFS) Ping() error {
+	if !afs.osFS {
+		return nil
+	}
+	_, err := afs.fs.Stat("/")
+	return err
+}
+
+// PingStorage checks that the storage of the file:// VFS, shared by all the
+// instances, is reachable. It is trivially OK for a mem:// VFS.
+func PingStorage(fsURL *url.URL) error {
+	if fsURL.Scheme != config.SchemeFile {
+		return nil
+	}
+	_, err := os.Stat(fsURL.Path)
+	return err
+}
+
 func (afs *aferoVFS) CreateDir(doc *vfs.DirDoc) error {
 	if lockerr := afs.mu.Lock(); lockerr != nil {
 		return lockerr
 	}
 	defer afs.mu.Unlock()
-	err := afs.fs.Mkdir(doc.Fullpath, 0755)
-	if err != nil {
+	if err := afs.checkWritable(); err != nil {
 		return err
 	}
-	if doc.ID() == "" {
-		err = afs.Indexer.CreateDirDoc(doc)
-	} else {
-		err = afs.Indexer.CreateNamedDirDoc(doc)
+	afs.warnLowInodes()
+	afs.normalizeDirDoc(doc)
+	if err := vfs.CheckParentNotInTrash(afs.Indexer, doc); err != nil {
+		return err
 	}
-	if err != nil {
+	if err := vfs.InheritDirDefaults(afs.Indexer, doc); err != nil {
+		return err
+	}
+	// With the flat layout, the directories only exist in the index.
+	if !afs.isFlat() {
+		if err := afs.fs.Mkdir(doc.Fullpath, 0755); err != nil {
+			return err
+		}
+	}
+	err := afs.retry.CreateDirDoc(afs.Indexer, doc)
+	if err != nil && !afs.isFlat() {
 		afs.fs.Remove(doc.Fullpath) // #nosec
 	}
 	return err
@@ -158,50 +252,45 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		return nil, lockerr
 	}
 	defer afs.mu.Unlock()
+	if err := afs.checkWritable(); err != nil {
+		return nil, err
+	}
+	afs.warnLowInodes()
 
-	diskQuota := afs.DiskQuota()
-
-	var maxsize, newsize, capsize int64
-	newsize = newdoc.ByteSize
-	if diskQuota > 0 {
-		diskUsage, err := afs.DiskUsage()
-		if err != nil {
-			return nil, err
-		}
-
-		var oldsize int64
-		if olddoc != nil {
-			oldsize = olddoc.Size()
-		}
-		maxsize = diskQuota - diskUsage
-		if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
-			return nil, vfs.ErrFileTooBig
-		}
-
-		if quotaBytes := int64(9.0 / 10.0 * float64(diskQuota)); diskUsage <= quotaBytes {
-			capsize = quotaBytes - diskUsage
-		}
-	} else {
-		maxsize = -1 // no limit
+	newsize := newdoc.ByteSize
+	newdoc.DocName = afs.normalize(newdoc.DocName)
+	var oldsize int64
+	if olddoc != nil {
+		oldsize = olddoc.Size()
+	}
+	maxsize, capsize, err := afs.sizeLimits(newsize, oldsize)
+	if err != nil {
+		return nil, err
 	}
 
 	newpath, err := afs.Indexer.FilePath(newdoc)
 	if err != nil {
 		return nil, err
 	}
-	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+	if !newdoc.AllowInTrash && strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
 		return nil, vfs.ErrParentInTrash
 	}
 
 	tmppath := newpath
 	if olddoc != nil {
-		tmppath = fmt.Sprintf("/.%s_%s", olddoc.ID(), olddoc.Rev())
+		if err = afs.mkdirTmp(); err != nil {
+			return nil, err
+		}
+		tmppath = afs.tmpPath(olddoc)
 	}
 
 	if olddoc != nil {
 		newdoc.SetID(olddoc.ID())
 		newdoc.SetRev(olddoc.Rev())
 		newdoc.CreatedAt = olddoc.CreatedAt
+		if newdoc.ReferencedBy == nil {
+			newdoc.ReferencedBy = olddoc.ReferencedBy
+		}
 	}
 
 	// Avoid storing negative size in the index.
@@ -219,28 +308,84 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 			return nil, os.ErrExist
 		}
 
+		if err = vfs.InheritFileDefaults(afs.Indexer, newdoc); err != nil {
+			return nil, err
+		}
+	}
+
+	// An empty file has no content to hash, extract or inspect: it is created
+	// directly with its index document when the file is closed.
+	if newsize == 0 {
+		return &aferoEmptyFileCreation{
+			afs:    afs,
+			newdoc: newdoc,
+			olddoc: olddoc,
+		}, nil
+	}
+
+	if olddoc == nil {
 		// When added to the index, the document is first considered hidden. This
 		// flag will only be removed at the end of the upload when all its metadata
 		// are known. See the Close() method.
 		newdoc.Trashed = true
 
-		if newdoc.ID() == "" {
-			err = afs.Indexer.CreateFileDoc(newdoc)
-		} else {
-			err = afs.Indexer.CreateNamedFileDoc(newdoc)
-		}
+		err = afs.retry.CreateFileDoc(afs.Indexer, newdoc)
 		if err != nil {
 			return nil, err
 		}
+		// With the flat layout, the location of the content of a new file
+		// depends on its identifier.
+		if afs.isFlat() {
+			if tmppath, err = afs.contentPath(newdoc); err != nil {
+				return nil, err
+			}
+			if err = afs.mkdirBucket(tmppath); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	f, err := safeCreateFile(tmppath, newdoc.Mode(), afs.fs)
 	if err != nil {
 		return nil, err
 	}
+	fc := afs.newFileCreation(f, newdoc, olddoc, tmppath, newsize, maxsize, capsize)
+	uploads.add(afs.prefix, fc)
+	return fc, nil
+}
 
+// sizeLimits returns the maximal size allowed for a file by the disk quota (-1
+// for no limit), and the size from which the user is alerted that the quota
+// is almost reached, or ErrFileTooBig if the new size is not allowed.
+func (afs *aferoVFS) sizeLimits(newsize, oldsize int64) (maxsize, capsize int64, err error) {
+	diskQuota := afs.DiskQuota()
+	if diskQuota <= 0 {
+		return -1, 0, nil
+	}
+	diskUsage, err := afs.DiskUsage()
+	if err != nil {
+		return 0, 0, err
+	}
+	maxsize = diskQuota - diskUsage
+	if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
+		return 0, 0, vfs.ErrFileTooBig
+	}
+	if quotaBytes := int64(9.0 / 10.0 * float64(diskQuota)); diskUsage <= quotaBytes {
+		capsize = quotaBytes - diskUsage
+	}
+	return maxsize, capsize, nil
+}
+
+// newFileCreation returns the handler for writing the content of a file in
+// the temporary file f.
+func (afs *aferoVFS) newFileCreation(f afero.File, newdoc, olddoc *vfs.FileDoc, tmppath string, newsize, maxsize, capsize int64) *aferoFileCreation {
 	hash := md5.New() // #nosec
-	extractor := vfs.NewMetaExtractor(newdoc)
+	var inspector vfs.ContentInspector
+	if afs.inspector != nil {
+		if i := afs.inspector(newdoc); i != nil {
+			inspector = vfs.NewAsyncInspector(i)
+		}
+	}
 
 	return &aferoFileCreation{
 		w:    0,
@@ -254,9 +399,14 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		maxsize: maxsize,
 		capsize: capsize,
 
-		hash: hash,
-		meta: extractor,
-	}, nil
+		hash:      hash,
+		sniffer:   vfs.NewContentSniffer(newdoc, olddoc),
+		inspector: inspector,
+		trusted:   newdoc.TrustedContent && len(newdoc.MD5Sum) > 0 && newsize > 0,
+
+		started:  time.Now(),
+		activity: time.Now().UnixNano(),
+	}
 }
 
 func (afs *aferoVFS) DestroyDirContent(doc *vfs.DirDoc) error {
@@ -264,13 +414,23 @@ func (afs *aferoVFS) DestroyDirContent(doc *vfs.DirDoc) error {
 		return lockerr
 	}
 	defer afs.mu.Unlock()
+	if err := afs.checkWritable(); err != nil {
+		return err
+	}
 	diskUsage, _ := afs.DiskUsage()
-	destroyed, _, err := afs.Indexer.DeleteDirDocAndContent(doc, true)
+	destroyed, ids, err := afs.Indexer.DeleteDirDocAndContent(doc, true)
 	if err != nil {
 		return err
 	}
 	vfs.DiskQuotaAfterDestroy(afs, diskUsage, destroyed)
+	if afs.isFlat() {
+		return afs.removeContents(ids)
+	}
 	infos, err := afero.ReadDir(afs.fs, doc.Fullpath)
+	if os.IsNotExist(err) {
+		afs.logMissingContent(doc.Fullpath)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -293,12 +453,18 @@ func (afs *aferoVFS) DestroyDirAndContent(doc *vfs.DirDoc) error {
 		return lockerr
 	}
 	defer afs.mu.Unlock()
+	if err := afs.checkWritable(); err != nil {
+		return err
+	}
 	diskUsage, _ := afs.DiskUsage()
-	destroyed, _, err := afs.Indexer.DeleteDirDocAndContent(doc, false)
+	destroyed, ids, err := afs.Indexer.DeleteDirDocAndContent(doc, false)
 	if err != nil {
 		return err
 	}
 	vfs.DiskQuotaAfterDestroy(afs, diskUsage, destroyed)
+	if afs.isFlat() {
+		return afs.removeContents(ids)
+	}
 	return afs.fs.RemoveAll(doc.Fullpath)
 }
 
@@ -307,33 +473,368 @@ func (afs *aferoVFS) DestroyFile(doc *vfs.FileDoc) error {
 		return lockerr
 	}
 	defer afs.mu.Unlock()
+	if err := afs.checkWritable(); err != nil {
+		return err
+	}
 	diskUsage, _ := afs.DiskUsage()
-	name, err := afs.Indexer.FilePath(doc)
+	name, err := afs.contentPath(doc)
 	if err != nil {
 		return err
 	}
 	vfs.DiskQuotaAfterDestroy(afs, diskUsage, doc.ByteSize)
+	getHandlePool().forget(afs.prefix, doc.ID())
+	afs.removeUndo(doc.ID())
+	// The goal is to have no content for the file: when the content is
+	// already missing, the document is still removed from the index.
 	err = afs.fs.Remove(name)
-	if err != nil && !os.IsNotExist(err) {
+	if os.IsNotExist(err) {
+		afs.logMissingContent(name)
+	} else if err != nil {
 		return err
 	}
 	return afs.Indexer.DeleteFileDoc(doc)
 }
 
+// logMissingContent logs the destruction of a file or directory of the index
+// that was missing on the filesystem.
+func (afs *aferoVFS) logMissingContent(name string) {
+	logger.WithNamespace("vfsafero").
+		Warnf("Destroying %s on %s whose content was already missing", name, afs.domain)
+}
+
+func (afs *aferoVFS) BackendStat(doc *vfs.FileDoc) (int64, error) {
+	if lockerr := afs.mu.RLock(); lockerr != nil {
+		return 0, lockerr
+	}
+	defer afs.mu.RUnlock()
+	name, err := afs.contentPath(doc)
+	if err != nil {
+		return 0, err
+	}
+	infos, err := afs.fs.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return infos.Size(), nil
+}
+
 func (afs *aferoVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if lockerr := afs.mu.RLock(); lockerr != nil {
 		return nil, lockerr
 	}
 	defer afs.mu.RUnlock()
-	name, err := afs.Indexer.FilePath(doc)
+	name, err := afs.contentPath(doc)
+	if err != nil {
+		return nil, err
+	}
+	return afs.openHandle(name, doc)
+}
+
+// openHandle opens the file for reading, with a handle from the pool.
+func (afs *aferoVFS) openHandle(name string, doc *vfs.FileDoc) (*aferoFileOpen, error) {
+	pool := getHandlePool()
+	key := handleKey(afs.prefix, doc)
+	f, err := pool.open(key, func() (afero.File, error) {
+		return afs.fs.Open(name)
+	})
 	if err != nil {
 		return nil, err
 	}
-	f, err := afs.fs.Open(name)
+	return &aferoFileOpen{f: f, pool: pool, key: key}, nil
+}
+
+// OpenPath implements the vfs.PathOpener interface.
+func (afs *aferoVFS) OpenPath(name string) (vfs.File, *vfs.FileDoc, error) {
+	if lockerr := afs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer afs.mu.RUnlock()
+	var dir *vfs.DirDoc
+	var doc *vfs.FileDoc
+	err := afs.lookupPath(name, func(name string) (err error) {
+		dir, doc, err = afs.Indexer.DirOrFileByPath(name)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return nil, nil, vfs.ErrFileNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if dir != nil {
+		return nil, nil, vfs.ErrIsDirectory
+	}
+	fullpath, err := afs.contentPath(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := afs.openHandle(fullpath, doc)
+	if os.IsNotExist(err) {
+		return nil, nil, vfs.ErrFileNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, doc, nil
+}
+
+// Glob implements the vfs.Globber interface.
+func (afs *aferoVFS) Glob(pattern string) ([]*vfs.FileDoc, error) {
+	if lockerr := afs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer afs.mu.RUnlock()
+	return vfs.Glob(afs.Indexer, pattern)
+}
+
+// GlobFunc implements the vfs.Globber interface.
+func (afs *aferoVFS) GlobFunc(pattern string, fn func(doc *vfs.FileDoc) error) error {
+	if lockerr := afs.mu.RLock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.RUnlock()
+	return vfs.GlobFunc(afs.Indexer, pattern, fn)
+}
+
+// Batch implements the vfs.Batcher interface.
+func (afs *aferoVFS) Batch(fn func(tx vfs.VFSBatch) error) error {
+	return vfs.Batch(afs, fn)
+}
+
+// FlushIndex implements the vfs.IndexFlusher interface. The index writes are
+// synchronous, unless the indexer says otherwise: the exclusive lock waits for
+// the operations in progress, and the indexer is then flushed if it can be.
+func (afs *aferoVFS) FlushIndex() error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	if flusher, ok := afs.Indexer.(vfs.IndexFlusher); ok {
+		return flusher.FlushIndex()
+	}
+	return nil
+}
+
+// SwapFiles implements the vfs.Swapper interface.
+//
+// The contents are swapped on the filesystem with three renames, and then the
+// two documents are updated in the index. If the index can't be updated, the
+// renames are reverted. If the process crashes between the two updates, the
+// md5sum of the second file won't match its content: it will be reported by
+// fsck, and can be fixed from the first file document.
+func (afs *aferoVFS) SwapFiles(a, b *vfs.FileDoc) error {
+	if a.ID() == b.ID() {
+		return os.ErrInvalid
+	}
+	if a.Trashed || b.Trashed {
+		return vfs.ErrFileInTrash
+	}
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	if err := afs.checkWritable(); err != nil {
+		return err
+	}
+
+	// Check that the documents are up-to-date and that no new content is
+	// being written for them (see CreateFile for the temporary path).
+	olddocs := make([]*vfs.FileDoc, 2)
+	paths := make([]string, 2)
+	for i, doc := range []*vfs.FileDoc{a, b} {
+		olddoc, err := afs.Indexer.FileByID(doc.ID())
+		if err != nil {
+			return err
+		}
+		if olddoc.Rev() != doc.Rev() {
+			return vfs.ErrConflict
+		}
+		if _, err = afs.fs.Stat(afs.tmpPath(olddoc)); err == nil {
+			return vfs.ErrFileInUse
+		}
+		if paths[i], err = afs.contentPath(olddoc); err != nil {
+			return err
+		}
+		olddocs[i] = olddoc
+	}
+
+	if err := afs.mkdirTmp(); err != nil {
+		return err
+	}
+	tmppath := path.Join(afs.tmpDir, fmt.Sprintf(".swap_%s_%s", a.ID(), b.ID()))
+	if err := afs.fs.Rename(paths[0], tmppath); err != nil {
+		return err
+	}
+	if err := afs.fs.Rename(paths[1], paths[0]); err != nil {
+		afs.fs.Rename(tmppath, paths[0]) // #nosec
+		return err
+	}
+	if err := afs.fs.Rename(tmppath, paths[1]); err != nil {
+		afs.fs.Rename(paths[0], paths[1]) // #nosec
+		afs.fs.Rename(tmppath, paths[0])  // #nosec
+		return err
+	}
+	revert := func() {
+		afs.fs.Rename(paths[0], tmppath)  // #nosec
+		afs.fs.Rename(paths[1], paths[0]) // #nosec
+		afs.fs.Rename(tmppath, paths[1])  // #nosec
+	}
+
+	now := time.Now()
+	newa := swappedFileDoc(olddocs[0], olddocs[1], now)
+	newb := swappedFileDoc(olddocs[1], olddocs[0], now)
+	err := afs.retry.Do(func() error {
+		return afs.Indexer.UpdateFileDoc(olddocs[0], newa)
+	})
+	if err != nil {
+		revert()
+		return err
+	}
+	err = afs.retry.Do(func() error {
+		return afs.Indexer.UpdateFileDoc(olddocs[1], newb)
+	})
+	if err != nil {
+		// Put back the content of the first document in the index, to keep it
+		// consistent with the reverted filesystem.
+		reverta := olddocs[0].Clone().(*vfs.FileDoc)
+		if erru := afs.Indexer.UpdateFileDoc(newa, reverta); erru == nil {
+			revert()
+		}
+		return err
+	}
+	pool := getHandlePool()
+	pool.forget(afs.prefix, a.ID())
+	pool.forget(afs.prefix, b.ID())
+	*a = *newa
+	*b = *newb
+	return nil
+}
+
+// swappedFileDoc returns a copy of doc with the content fields of other.
+func swappedFileDoc(doc, other *vfs.FileDoc, now time.Time) *vfs.FileDoc {
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	newdoc.ByteSize = other.ByteSize
+	newdoc.MD5Sum = other.MD5Sum
+	newdoc.Mime = other.Mime
+	newdoc.Class = other.Class
+	newdoc.Metadata = other.Metadata
+	newdoc.UpdatedAt = now
+	return newdoc
+}
+
+// Truncate implements the vfs.Truncater interface.
+func (afs *aferoVFS) Truncate(doc *vfs.FileDoc, size int64, zeroFill bool) (*vfs.FileDoc, error) {
+	if size < 0 {
+		return nil, os.ErrInvalid
+	}
+	if size > doc.ByteSize && !zeroFill {
+		return nil, vfs.ErrTruncateExtend
+	}
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer afs.mu.Unlock()
+	if err := afs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	if diskQuota := afs.DiskQuota(); diskQuota > 0 && size > doc.ByteSize {
+		diskUsage, err := afs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		if size-doc.ByteSize > diskQuota-diskUsage {
+			return nil, vfs.ErrFileTooBig
+		}
+	}
+
+	name, err := afs.contentPath(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// As for an overwrite, the truncated content is written in a temporary
+	// file that replaces the current one, kept aside as a backup until the
+	// index is updated. The temporary path is the one of an overwrite of the
+	// same revision, so that the two can't run at the same time.
+	if err = afs.mkdirTmp(); err != nil {
+		return nil, err
+	}
+	tmppath := afs.tmpPath(doc)
+	md5sum, err := afs.copyTruncated(name, tmppath, doc, size)
+	if os.IsExist(err) {
+		return nil, vfs.ErrFileInUse
+	}
+	if err != nil {
+		afs.fs.Remove(tmppath) // #nosec
+		return nil, err
+	}
+
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	newdoc.ByteSize = size
+	newdoc.MD5Sum = md5sum
+	newdoc.UpdatedAt = time.Now()
+
+	bakpath := tmppath + ".bak"
+	if err = afs.fs.Rename(name, bakpath); err != nil {
+		afs.fs.Remove(tmppath) // #nosec
+		return nil, err
+	}
+	if err = afs.fs.Rename(tmppath, name); err != nil {
+		afs.fs.Remove(tmppath) // #nosec
+		return nil, afs.restoreBackup(doc, bakpath, name, err)
+	}
+	err = afs.retry.Do(func() error {
+		return afs.Indexer.UpdateFileDoc(doc, newdoc)
+	})
+	if err != nil {
+		return nil, afs.restoreBackup(doc, bakpath, name, err)
+	}
+	getHandlePool().forget(afs.prefix, newdoc.ID())
+	afs.releaseBackup(doc, newdoc, bakpath)
+	return newdoc, nil
+}
+
+// copyTruncated copies the first size bytes of the content of the file at
+// name to a new file at tmppath, completed with zeros if the content is
+// shorter, and returns the md5sum of the copy.
+func (afs *aferoVFS) copyTruncated(name, tmppath string, doc *vfs.FileDoc, size int64) ([]byte, error) {
+	src, err := afs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	dst, err := safeCreateFile(tmppath, doc.Mode(), afs.fs)
+	if err != nil {
+		return nil, err
+	}
+	h := md5.New() // #nosec
+	_, err = io.Copy(io.MultiWriter(dst, h), io.LimitReader(src, size))
+	if err == nil {
+		var written int64
+		if written, err = dst.Seek(0, io.SeekCurrent); err == nil && written < size {
+			if err = dst.Truncate(size); err == nil {
+				_, err = io.CopyN(h, zeroReader{}, size-written)
+			}
+		}
+	}
+	if errc := dst.Close(); errc != nil && err == nil {
+		err = errc
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &aferoFileOpen{f}, nil
+	return h.Sum(nil), nil
+}
+
+// zeroReader is an endless reader of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
 }
 
 func (afs *aferoVFS) Fsck(opts vfs.FsckOptions) (logbook []*vfs.FsckLog, err error) {
@@ -352,8 +853,23 @@ func (afs *aferoVFS) Fsck(opts vfs.FsckOptions) (logbook []*vfs.FsckLog, err err
 	if err != nil {
 		return nil, err
 	}
+	var checker *contentChecker
+	if opts.CheckContent {
+		checker = newContentChecker(afs, opts)
+	}
 	var newLogs []*vfs.FsckLog
-	newLogs, err = afs.fsckWalk(root, newLogs)
+	if afs.isFlat() {
+		newLogs, err = afs.fsckWalkFlat(root, newLogs, checker)
+	} else {
+		newLogs, err = afs.fsckWalk(root, newLogs, checker)
+	}
+	if checker != nil {
+		contentLogs, errc := checker.wait()
+		if err == nil {
+			err = errc
+		}
+		newLogs = append(newLogs, contentLogs...)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -367,7 +883,7 @@ func (afs *aferoVFS) Fsck(opts vfs.FsckOptions) (logbook []*vfs.FsckLog, err err
 	return logbook, nil
 }
 
-func (afs *aferoVFS) fsckWalk(dir *vfs.DirDoc, logbook []*vfs.FsckLog) ([]*vfs.FsckLog, error) {
+func (afs *aferoVFS) fsckWalk(dir *vfs.DirDoc, logbook []*vfs.FsckLog, checker *contentChecker) ([]*vfs.FsckLog, error) {
 	entries := make(map[string]struct{})
 	iter := afs.Indexer.DirIterator(dir, nil)
 	for {
@@ -406,6 +922,8 @@ func (afs *aferoVFS) fsckWalk(dir *vfs.DirDoc, logbook []*vfs.FsckLog) ([]*vfs.F
 					FileDoc:  f,
 					Filename: fullpath,
 				})
+			} else if checker != nil {
+				checker.push(f, fullpath)
 			}
 		} else {
 			entries[d.DocName] = struct{}{}
@@ -422,7 +940,7 @@ func (afs *aferoVFS) fsckWalk(dir *vfs.DirDoc, logbook []*vfs.FsckLog) ([]*vfs.F
 				return nil, err
 			} else if !stat.IsDir() {
 				var fileDoc *vfs.FileDoc
-				fileDoc, err = fileInfosToFileDoc(dir, d.Fullpath, stat)
+				fileDoc, err = fileInfosToFileDoc(afs.fs, dir, d.Fullpath, stat)
 				if err != nil {
 					return nil, err
 				}
@@ -434,7 +952,7 @@ func (afs *aferoVFS) fsckWalk(dir *vfs.DirDoc, logbook []*vfs.FsckLog) ([]*vfs.F
 					Filename: d.Fullpath,
 				})
 			} else {
-				if logbook, err = afs.fsckWalk(d, logbook); err != nil {
+				if logbook, err = afs.fsckWalk(d, logbook, checker); err != nil {
 					return nil, err
 				}
 			}
@@ -451,13 +969,15 @@ func (afs *aferoVFS) fsckWalk(dir *vfs.DirDoc, logbook []*vfs.FsckLog) ([]*vfs.F
 			filename := path.Join(dir.Fullpath, fileinfo.Name())
 			if filename == vfs.WebappsDirName ||
 				filename == vfs.KonnectorsDirName ||
-				filename == vfs.ThumbsDirName {
+				filename == vfs.ThumbsDirName ||
+				filename == afs.tmpDir ||
+				filename == afs.undoDir() {
 				continue
 			}
 			if fileinfo.Size() == 0 {
 				continue
 			}
-			fileDoc, err := fileInfosToFileDoc(dir, filename, fileinfo)
+			fileDoc, err := fileInfosToFileDoc(afs.fs, dir, filename, fileinfo)
 			if err != nil {
 				continue
 			}
@@ -473,9 +993,49 @@ func (afs *aferoVFS) fsckWalk(dir *vfs.DirDoc, logbook []*vfs.FsckLog) ([]*vfs.F
 	return logbook, nil
 }
 
-func fileInfosToFileDoc(dir *vfs.DirDoc, fullpath string, fileinfo os.FileInfo) (*vfs.FileDoc, error) {
+// fsckWalkFlat is like fsckWalk for the flat layout, where the directories only
+// exist in the index: only the contents of the files are looked for on the
+// storage, and the contents without a file in the index are not detected.
+func (afs *aferoVFS) fsckWalkFlat(dir *vfs.DirDoc, logbook []*vfs.FsckLog, checker *contentChecker) ([]*vfs.FsckLog, error) {
+	iter := afs.Indexer.DirIterator(dir, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == vfs.ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			if logbook, err = afs.fsckWalkFlat(d, logbook, checker); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		name, err := afs.contentPath(f)
+		if err != nil {
+			return nil, err
+		}
+		_, err = afs.fs.Stat(name)
+		if _, ok := err.(*os.PathError); ok {
+			logbook = append(logbook, &vfs.FsckLog{
+				Type:     vfs.FileMissing,
+				IsFile:   true,
+				FileDoc:  f,
+				Filename: path.Join(dir.Fullpath, f.DocName),
+			})
+		} else if err != nil {
+			return nil, err
+		} else if checker != nil {
+			checker.push(f, name)
+		}
+	}
+	return logbook, nil
+}
+
+func fileInfosToFileDoc(fs afero.Fs, dir *vfs.DirDoc, fullpath string, fileinfo os.FileInfo) (*vfs.FileDoc, error) {
 	trashed := strings.HasPrefix(fullpath, vfs.TrashDirName)
-	contentType, md5sum, err := extractContentTypeAndMD5(fullpath)
+	contentType, md5sum, err := extractContentTypeAndMD5(fs, fullpath)
 	if err != nil {
 		return nil, err
 	}
@@ -497,7 +1057,7 @@ func fileInfosToFileDoc(dir *vfs.DirDoc, fullpath string, fileinfo os.FileInfo)
 func (afs *aferoVFS) fsckPrune(logbook []*vfs.FsckLog, dryrun bool) {
 	for _, entry := range logbook {
 		switch entry.Type {
-		case vfs.IndexOrphanTree, vfs.IndexBadFullpath, vfs.FileMissing, vfs.IndexMissing:
+		case vfs.IndexOrphanTree, vfs.IndexBadFullpath, vfs.FileMissing, vfs.IndexMissing, vfs.ContentMismatch:
 			vfs.FsckPrune(afs, afs.Indexer, entry, dryrun)
 		case vfs.TypeMismatch:
 			if entry.IsFile {
@@ -555,31 +1115,59 @@ func (afs *aferoVFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
 		return lockerr
 	}
 	defer afs.mu.Unlock()
-	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
-		oldpath, err := afs.Indexer.FilePath(olddoc)
-		if err != nil {
+	if err := afs.checkWritable(); err != nil {
+		return err
+	}
+	var oldpath, newpath string
+	var err error
+	newdoc.DocName = afs.normalize(newdoc.DocName)
+	moved := newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName
+	chmoded := newdoc.Executable != olddoc.Executable
+	if moved {
+		if err = afs.checkNameConflict(newdoc.DirID, newdoc.DocName); err != nil {
 			return err
 		}
-		newpath, err := afs.Indexer.FilePath(newdoc)
-		if err != nil {
+	}
+	// With the flat layout, the content stays at the same location when the
+	// file is moved: only the index is updated.
+	if afs.isFlat() {
+		moved = false
+	}
+	if moved || chmoded {
+		if newpath, err = afs.contentPath(newdoc); err != nil {
 			return err
 		}
-		err = safeRenameFile(afs.fs, oldpath, newpath)
-		if err != nil {
+	}
+	if moved {
+		if oldpath, err = afs.Indexer.FilePath(olddoc); err != nil {
 			return err
 		}
-	}
-	if newdoc.Executable != olddoc.Executable {
-		newpath, err := afs.Indexer.FilePath(newdoc)
-		if err != nil {
+		if err = safeRenameFile(afs.fs, oldpath, newpath); err != nil {
 			return err
 		}
-		err = afs.fs.Chmod(newpath, newdoc.Mode())
-		if err != nil {
+	}
+	if chmoded {
+		if err = afs.fs.Chmod(newpath, newdoc.Mode()); err != nil {
+			if moved {
+				afs.fs.Rename(newpath, oldpath) // #nosec
+			}
 			return err
 		}
 	}
-	return afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	err = afs.retry.Do(func() error {
+		return afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	})
+	if err != nil {
+		// The index has not been updated, so the changes made on the
+		// filesystem are reverted to keep both of them consistent.
+		if chmoded {
+			afs.fs.Chmod(newpath, olddoc.Mode()) // #nosec
+		}
+		if moved {
+			afs.fs.Rename(newpath, oldpath) // #nosec
+		}
+	}
+	return err
 }
 
 // UpdateDirDoc overrides the indexer's one since the afero.Fs is by essence
@@ -592,12 +1180,53 @@ func (afs *aferoVFS) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
 		return lockerr
 	}
 	defer afs.mu.Unlock()
-	if newdoc.Fullpath != olddoc.Fullpath {
-		if err := safeRenameDir(afs, olddoc.Fullpath, newdoc.Fullpath); err != nil {
+	if err := afs.checkWritable(); err != nil {
+		return err
+	}
+	afs.normalizeDirDoc(newdoc)
+	moved := newdoc.Fullpath != olddoc.Fullpath
+	if moved {
+		if newdoc.DirID != olddoc.DirID {
+			if err := vfs.CheckNoCycle(afs.Indexer, olddoc, newdoc.DirID); err != nil {
+				return err
+			}
+		}
+		if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+			if err := afs.checkNameConflict(newdoc.DirID, newdoc.DocName); err != nil {
+				return err
+			}
+		}
+		// With the flat layout, the directories only exist in the index.
+		if afs.isFlat() {
+			moved = false
+		} else if err := safeRenameDir(afs, olddoc.Fullpath, newdoc.Fullpath); err != nil {
 			return err
 		}
 	}
-	return afs.Indexer.UpdateDirDoc(olddoc, newdoc)
+	err := afs.retry.Do(func() error {
+		return afs.Indexer.UpdateDirDoc(olddoc, newdoc)
+	})
+	if err != nil && moved {
+		// The index has not been updated, so the directory is moved back to
+		// keep the filesystem consistent with it.
+		afs.fs.Rename(newdoc.Fullpath, olddoc.Fullpath) // #nosec
+	}
+	return err
+}
+
+// checkNameConflict returns vfs.ErrConflict if the index has already a file
+// or directory with the given name in the directory. The filesystem is checked
+// too when renaming, but the index can have a document that has no
+// counterpart with the same path on the disk.
+func (afs *aferoVFS) checkNameConflict(dirID, name string) error {
+	exists, err := afs.Indexer.DirChildExists(dirID, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return vfs.ErrConflict
+	}
+	return nil
 }
 
 func (afs *aferoVFS) DirByID(fileID string) (*vfs.DirDoc, error) {
@@ -613,7 +1242,12 @@ func (afs *aferoVFS) DirByPath(name string) (*vfs.DirDoc, error) {
 		return nil, lockerr
 	}
 	defer afs.mu.RUnlock()
-	return afs.Indexer.DirByPath(name)
+	var doc *vfs.DirDoc
+	err := afs.lookupPath(name, func(name string) (err error) {
+		doc, err = afs.Indexer.DirByPath(name)
+		return err
+	})
+	return doc, err
 }
 
 func (afs *aferoVFS) FileByID(fileID string) (*vfs.FileDoc, error) {
@@ -629,7 +1263,12 @@ func (afs *aferoVFS) FileByPath(name string) (*vfs.FileDoc, error) {
 		return nil, lockerr
 	}
 	defer afs.mu.RUnlock()
-	return afs.Indexer.FileByPath(name)
+	var doc *vfs.FileDoc
+	err := afs.lookupPath(name, func(name string) (err error) {
+		doc, err = afs.Indexer.FileByPath(name)
+		return err
+	})
+	return doc, err
 }
 
 func (afs *aferoVFS) FilePath(doc *vfs.FileDoc) (string, error) {
@@ -653,12 +1292,21 @@ func (afs *aferoVFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, er
 		return nil, nil, lockerr
 	}
 	defer afs.mu.RUnlock()
-	return afs.Indexer.DirOrFileByPath(name)
+	var dir *vfs.DirDoc
+	var doc *vfs.FileDoc
+	err := afs.lookupPath(name, func(name string) (err error) {
+		dir, doc, err = afs.Indexer.DirOrFileByPath(name)
+		return err
+	})
+	return dir, doc, err
 }
 
 // aferoFileOpen represents a file handle opened for reading.
 type aferoFileOpen struct {
-	f afero.File
+	f    afero.File
+	pool *handlePool
+	key  string
+	once sync.Once
 }
 
 func (f *aferoFileOpen) Read(p []byte) (int, error) {
@@ -673,12 +1321,29 @@ func (f *aferoFileOpen) Seek(offset int64, whence int) (int64, error) {
 	return f.f.Seek(offset, whence)
 }
 
+// WriteTo implements the io.WriterTo interface: the content of a file of the
+// OS is given to the ReadFrom of the writer, which can use sendfile, and it is
+// copied with a pooled buffer otherwise.
+func (f *aferoFileOpen) WriteTo(w io.Writer) (int64, error) {
+	if osf, ok := f.f.(*os.File); ok {
+		if rf, ok := w.(io.ReaderFrom); ok {
+			return rf.ReadFrom(osf)
+		}
+	}
+	return vfs.CopyPooled(w, f.f)
+}
+
 func (f *aferoFileOpen) Write(p []byte) (int, error) {
 	return 0, os.ErrInvalid
 }
 
-func (f *aferoFileOpen) Close() error {
-	return f.f.Close()
+// Close gives back the handle to the pool, where it can be kept idle to be
+// reused.
+func (f *aferoFileOpen) Close() (err error) {
+	f.once.Do(func() {
+		err = f.pool.release(f.key, f.f)
+	})
+	return err
 }
 
 // aferoFileCreation represents a file open for writing. It is used to
@@ -686,18 +1351,28 @@ func (f *aferoFileOpen) Close() error {
 //
 // aferoFileCreation implements io.WriteCloser.
 type aferoFileCreation struct {
-	f       afero.File         // file handle
-	w       int64              // total size written
-	size    int64              // total file size, -1 if unknown
-	afs     *aferoVFS          // parent vfs
-	newdoc  *vfs.FileDoc       // new document
-	olddoc  *vfs.FileDoc       // old document
-	tmppath string             // temporary file path for uploading a new version of this file
-	maxsize int64              // maximum size allowed for the file
-	capsize int64              // size cap from which we send a notification to the user
-	hash    hash.Hash          // hash we build up along the file
-	meta    *vfs.MetaExtractor // extracts metadata from the content
-	err     error              // write error
+	f         afero.File           // file handle
+	w         int64                // total size written
+	size      int64                // total file size, -1 if unknown
+	afs       *aferoVFS            // parent vfs
+	newdoc    *vfs.FileDoc         // new document
+	olddoc    *vfs.FileDoc         // old document
+	tmppath   string               // temporary file path for uploading a new version of this file
+	maxsize   int64                // maximum size allowed for the file
+	capsize   int64                // size cap from which we send a notification to the user
+	hash      hash.Hash            // hash we build up along the file
+	sniffer   *vfs.ContentSniffer  // detects the type and extracts the metadata of the content
+	inspector vfs.ContentInspector // inspects the content, and can reject it
+	trusted   bool                 // true if the content is not hashed
+	keep      bool                 // true to keep the content of a short upload
+	kept      bool                 // true if the content has been kept by Close
+	err       error                // write error
+	mu        sync.Mutex           // serializes Write, Close and Abort
+	closed    bool                 // true after a Close or an Abort
+	started   time.Time            // start of the upload
+	activity  int64                // time of the last write in unix nanoseconds, accessed atomically
+	written   int64                // number of bytes written, accessed atomically
+	checked   time.Time            // last check of the maintenance mode by Write
 }
 
 func (f *aferoFileCreation) Read(p []byte) (int, error) {
@@ -713,48 +1388,84 @@ func (f *aferoFileCreation) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *aferoFileCreation) Write(p []byte) (int, error) {
+	// Abort can be called from another goroutine, when the client disconnects
+	// in the middle of the upload.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if err := f.checkUploadWritableEvery(); err != nil {
+		f.err = err
+		return 0, err
+	}
 	n, err := f.f.Write(p)
 	if err != nil {
 		f.err = err
 		return n, err
 	}
+	return n, f.consume(p)
+}
 
+// consume updates the size, hash, metadata and inspection of the content with
+// the bytes p that have been written.
+func (f *aferoFileCreation) consume(p []byte) error {
+	n := len(p)
 	f.w += int64(n)
+	atomic.StoreInt64(&f.written, f.w)
+	atomic.StoreInt64(&f.activity, time.Now().UnixNano())
 	if f.maxsize >= 0 && f.w > f.maxsize {
 		f.err = vfs.ErrFileTooBig
-		return n, f.err
+		return f.err
 	}
 
 	if f.size >= 0 && f.w > f.size {
 		f.err = vfs.ErrContentLengthMismatch
-		return n, f.err
+		return f.err
 	}
 
-	if f.meta != nil {
-		if _, err = (*f.meta).Write(p); err != nil && err != io.ErrClosedPipe {
-			(*f.meta).Abort(err)
-			f.meta = nil
+	f.sniffer.Write(p) // #nosec
+
+	if f.inspector != nil {
+		if _, err := f.inspector.Write(p); err != nil {
+			f.err = err
+			return err
 		}
 	}
 
-	_, err = f.hash.Write(p)
-	return n, err
+	// A trusted content has a known md5sum, and only its size is checked.
+	if f.trusted {
+		return nil
+	}
+	_, err := f.hash.Write(p)
+	return err
+}
+
+// Progress returns the number of bytes written, and the md5sum of the content
+// up to now (nil for a trusted content, which is not hashed). The hash state
+// is not changed, so it can be called at the end of each chunk of the upload.
+func (f *aferoFileCreation) Progress() (int64, []byte) {
+	if f.trusted {
+		return f.w, nil
+	}
+	return f.w, f.hash.Sum(nil)
 }
 
 func (f *aferoFileCreation) Close() (err error) {
-	var newpath string
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	defer uploads.remove(f.afs.prefix, f)
+
 	defer func() {
 		if err == nil {
-			if f.olddoc != nil {
-				// move the temporary file to its final location
-				if errf := f.afs.fs.Rename(f.tmppath, newpath); errf != nil {
-					logger.WithNamespace("vfsafero").Warnf("Error on close file: %s", errf)
-				}
-			}
 			if f.capsize > 0 && f.size >= f.capsize {
 				vfs.PushDiskQuotaAlert(f.afs, true)
 			}
-		} else if err != nil {
+		} else if !f.kept {
 			// remove the temporary file if an error occurred
 			f.afs.fs.Remove(f.tmppath) // #nosec
 			// If an error has occurred that is not due to the index update, we should
@@ -768,30 +1479,45 @@ func (f *aferoFileCreation) Close() (err error) {
 	}()
 
 	if err = f.f.Close(); err != nil {
-		if f.meta != nil {
-			(*f.meta).Abort(err)
-		}
+		f.sniffer.Abort(err)
 		if f.err == nil {
 			f.err = err
 		}
 	}
 
+	// The verdict of the inspector is waited for before the new content
+	// replaces the old one.
+	if f.inspector != nil {
+		if errc := f.inspector.Close(); errc != nil && f.err == nil {
+			f.err = errc
+		}
+	}
+
 	newdoc, olddoc, written := f.newdoc, f.olddoc, f.w
 	if olddoc == nil {
 		olddoc = newdoc.Clone().(*vfs.FileDoc)
 	}
 
-	if f.meta != nil {
-		if errc := (*f.meta).Close(); errc == nil {
-			newdoc.Metadata = (*f.meta).Result()
-		}
-	}
+	f.sniffer.Close() // #nosec
 
 	if f.err != nil {
 		return f.err
 	}
 
-	md5sum := f.hash.Sum(nil)
+	// An upload cut short is kept to be resumed, if asked.
+	if f.keep && f.size > 0 && written < f.size {
+		f.kept = true
+		partial := vfs.ErrPartialUpload{Written: written}
+		if !f.trusted {
+			partial.PartialSum = f.hash.Sum(nil)
+		}
+		return partial
+	}
+
+	md5sum := newdoc.MD5Sum
+	if !f.trusted {
+		md5sum = f.hash.Sum(nil)
+	}
 	if newdoc.MD5Sum == nil {
 		newdoc.MD5Sum = md5sum
 	}
@@ -808,27 +1534,326 @@ func (f *aferoFileCreation) Close() (err error) {
 		return vfs.ErrContentLengthMismatch
 	}
 
+	// The type of a new file without an explicit type is detected from its
+	// content. And when overwriting a file, the new content may have another
+	// type than the old one: the type and the metadata derived from the content
+	// are refreshed instead of keeping the stale ones (except if the metadata
+	// have been given and are trusted).
+	f.sniffer.Update(newdoc)
+
 	// The document is already added to the index when closing the file creation
 	// handler. When updating the content of the document with the final
 	// informations (size, md5, ...) we can reuse the same document as olddoc.
 	if f.olddoc == nil || !f.olddoc.Trashed {
 		newdoc.Trashed = false
 	}
+	lockerr := f.afs.mu.Lock()
+	if lockerr != nil {
+		return lockerr
+	}
+	defer f.afs.mu.Unlock()
+	if err = f.checkUploadWritable(); err != nil {
+		return err
+	}
+
+	newpath, err := f.afs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return err
+	}
+	if !newdoc.AllowInTrash && strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return vfs.ErrParentInTrash
+	}
+
+	if f.olddoc == nil {
+		if err = f.verifyContent(f.tmppath, newdoc.MD5Sum); err != nil {
+			return err
+		}
+		return f.afs.retry.Do(func() error {
+			return f.afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+		})
+	}
+	if f.afs.isFlat() {
+		if newpath, err = f.afs.contentPath(newdoc); err != nil {
+			return err
+		}
+	}
+
+	// When overwriting a file, the old content is kept aside as a backup while
+	// the temporary file is moved to its final location. If the index can not
+	// be updated, the backup is restored.
+	bakpath := f.tmppath + ".bak"
+	if err = f.afs.fs.Rename(newpath, bakpath); err != nil {
+		return err
+	}
+	if err = f.afs.fs.Rename(f.tmppath, newpath); err != nil {
+		return f.afs.restoreBackup(f.olddoc, bakpath, newpath, err)
+	}
+	if err = f.verifyContent(newpath, newdoc.MD5Sum); err != nil {
+		return f.afs.restoreBackup(f.olddoc, bakpath, newpath, err)
+	}
+	err = f.afs.retry.Do(func() error {
+		return f.afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	})
+	if err != nil {
+		return f.afs.restoreBackup(f.olddoc, bakpath, newpath, err)
+	}
+	getHandlePool().forget(f.afs.prefix, newdoc.ID())
+	f.afs.releaseBackup(f.olddoc, newdoc, bakpath)
+	return nil
+}
+
+// Abort cancels the file creation: the temporary file is removed, and so is
+// the document added to the index for a new file. The old content of an
+// overwritten file is only replaced in Close, so there is nothing to restore.
+func (f *aferoFileCreation) Abort() error {
+	_, err := f.abort()
+	return err
+}
+
+// abort is like Abort, but it also returns false if the file creation was
+// already closed or aborted.
+func (f *aferoFileCreation) abort() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false, nil
+	}
+	f.closed = true
+	defer uploads.remove(f.afs.prefix, f)
+
+	f.f.Close() // #nosec
+	f.sniffer.Abort(errFileCreationAborted)
+	if f.inspector != nil {
+		f.inspector.Close() // #nosec
+	}
+	err := f.afs.fs.Remove(f.tmppath)
+	if f.olddoc == nil {
+		if errd := f.deleteNewDoc(); errd != nil && err == nil {
+			err = errd
+		}
+	}
+	return true, err
+}
+
+// deleteNewDoc removes the document added to the index for a new file, with
+// the lock of the VFS.
+func (f *aferoFileCreation) deleteNewDoc() error {
+	if lockerr := f.afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer f.afs.mu.Unlock()
+	return f.afs.Indexer.DeleteFileDoc(f.newdoc)
+}
+
+// verifyContent reads back the content of the file, if the write verification
+// is enabled, and checks that it has the expected md5sum.
+func (f *aferoFileCreation) verifyContent(name string, md5sum []byte) error {
+	if !f.afs.verifyWrites {
+		return nil
+	}
+	file, err := f.afs.fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := md5.New() // #nosec
+	if _, err = io.Copy(h, file); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), md5sum) {
+		logger.WithNamespace("vfsafero").
+			Errorf("Content of %s does not match its md5sum after write", name)
+		return vfs.ErrPostWriteVerificationFailed
+	}
+	return nil
+}
+
+// restoreBackup moves the backup of the old content of an overwritten file
+// back to its location, and checks that the restored file has the expected
+// size. It returns the given error, or a vfs.ErrRestoreFailed wrapping it if
+// the restoration did not succeed.
+func (afs *aferoVFS) restoreBackup(olddoc *vfs.FileDoc, bakpath, newpath string, err error) error {
+	log := logger.WithNamespace("vfsafero")
+	if errr := afs.fs.Rename(bakpath, newpath); errr != nil {
+		log.Errorf("Could not restore backup file %s: %s", bakpath, errr)
+		return vfs.ErrRestoreFailed{Err: err}
+	}
+	infos, errs := afs.fs.Stat(newpath)
+	if errs != nil {
+		log.Errorf("Could not check restored file %s: %s", newpath, errs)
+		return vfs.ErrRestoreFailed{Err: err}
+	}
+	if infos.Size() != olddoc.ByteSize {
+		log.Errorf("Restored file %s has size %d instead of %d",
+			newpath, infos.Size(), olddoc.ByteSize)
+		return vfs.ErrRestoreFailed{Err: err}
+	}
+	return err
+}
+
+// errFileCreationAborted is given to the metadata extractor of an aborted
+// file creation.
+var errFileCreationAborted = errors.New("vfsafero: file creation aborted")
+
+// emptyMD5Sum is the md5sum of an empty content.
+var emptyMD5Sum = md5.New().Sum(nil) // #nosec
+
+// aferoEmptyFileCreation is the file returned by CreateFile when the declared
+// size of the content is zero. It has no handle opened on the storage, and the
+// file and its index document are only written when it is closed.
+type aferoEmptyFileCreation struct {
+	afs    *aferoVFS    // parent vfs
+	newdoc *vfs.FileDoc // new document
+	olddoc *vfs.FileDoc // old document
+	err    error        // write error
+	mu     sync.Mutex   // serializes Close and Abort
+	closed bool         // true after a Close or an Abort
+}
+
+func (f *aferoEmptyFileCreation) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *aferoEmptyFileCreation) ReadAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *aferoEmptyFileCreation) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *aferoEmptyFileCreation) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		f.err = vfs.ErrContentLengthMismatch
+		return 0, f.err
+	}
+	return 0, nil
+}
+
+func (f *aferoEmptyFileCreation) Progress() (int64, []byte) {
+	return 0, emptyMD5Sum
+}
+
+func (f *aferoEmptyFileCreation) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	if f.err != nil {
+		return f.err
+	}
+	newdoc, olddoc := f.newdoc, f.olddoc
+	if newdoc.MD5Sum == nil {
+		newdoc.MD5Sum = emptyMD5Sum
+	}
+	if !bytes.Equal(newdoc.MD5Sum, emptyMD5Sum) {
+		return vfs.ErrInvalidHash
+	}
+	if olddoc == nil || !olddoc.Trashed {
+		newdoc.Trashed = false
+	}
+
 	lockerr := f.afs.mu.Lock()
 	if lockerr != nil {
 		return lockerr
 	}
 	defer f.afs.mu.Unlock()
 
-	newpath, err = f.afs.Indexer.FilePath(newdoc)
+	newpath, err := f.afs.Indexer.FilePath(newdoc)
 	if err != nil {
 		return err
 	}
-	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+	if !newdoc.AllowInTrash && strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
 		return vfs.ErrParentInTrash
 	}
 
-	return f.afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	if olddoc == nil {
+		var exists bool
+		exists, err = f.afs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+		if f.afs.isFlat() {
+			return f.createEmptyFlat(newdoc)
+		}
+		if err = f.createEmpty(newpath); err != nil {
+			return err
+		}
+		err = f.afs.retry.CreateFileDoc(f.afs.Indexer, newdoc)
+		if err != nil {
+			f.afs.fs.Remove(newpath) // #nosec
+		}
+		return err
+	}
+	if f.afs.isFlat() {
+		if newpath, err = f.afs.contentPath(newdoc); err != nil {
+			return err
+		}
+	}
+
+	// Like for the other files, the old content is kept aside as a backup
+	// until the index has been updated.
+	if err = f.afs.mkdirTmp(); err != nil {
+		return err
+	}
+	bakpath := f.afs.tmpPath(olddoc) + ".bak"
+	if err = f.afs.fs.Rename(newpath, bakpath); err != nil {
+		return err
+	}
+	if err = f.createEmpty(newpath); err != nil {
+		return f.afs.restoreBackup(olddoc, bakpath, newpath, err)
+	}
+	err = f.afs.retry.Do(func() error {
+		return f.afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	})
+	if err != nil {
+		return f.afs.restoreBackup(olddoc, bakpath, newpath, err)
+	}
+	getHandlePool().forget(f.afs.prefix, newdoc.ID())
+	f.afs.releaseBackup(olddoc, newdoc, bakpath)
+	return nil
+}
+
+// Abort cancels the creation of the empty file: nothing has been written yet.
+func (f *aferoEmptyFileCreation) Abort() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// createEmptyFlat creates a new empty file with the flat layout, where the
+// location of the content depends on the identifier of the file: the document
+// is added to the index first, and removed if the content can't be created.
+func (f *aferoEmptyFileCreation) createEmptyFlat(newdoc *vfs.FileDoc) error {
+	err := f.afs.retry.CreateFileDoc(f.afs.Indexer, newdoc)
+	if err != nil {
+		return err
+	}
+	name, err := f.afs.contentPath(newdoc)
+	if err == nil {
+		if err = f.afs.mkdirBucket(name); err == nil {
+			err = f.createEmpty(name)
+		}
+	}
+	if err != nil {
+		f.afs.Indexer.DeleteFileDoc(newdoc) // #nosec
+	}
+	return err
+}
+
+func (f *aferoEmptyFileCreation) createEmpty(name string) error {
+	file, err := safeCreateFile(name, f.newdoc.Mode(), f.afs.fs)
+	if err != nil {
+		return err
+	}
+	return file.Close()
 }
 
 func safeCreateFile(name string, mode os.FileMode, fs afero.Fs) (afero.File, error) {
@@ -848,7 +1873,7 @@ func safeRenameFile(fs afero.Fs, oldpath, newpath string) error {
 
 	_, err := fs.Stat(newpath)
 	if err == nil {
-		return os.ErrExist
+		return vfs.ErrConflict
 	}
 	if err != nil && !os.IsNotExist(err) {
 		return err
@@ -871,7 +1896,7 @@ func safeRenameDir(afs *aferoVFS, oldpath, newpath string) error {
 
 	_, err := afs.fs.Stat(newpath)
 	if err == nil {
-		return os.ErrExist
+		return vfs.ErrConflict
 	}
 	if err != nil && !os.IsNotExist(err) {
 		return err
@@ -880,8 +1905,8 @@ func safeRenameDir(afs *aferoVFS, oldpath, newpath string) error {
 	return afs.fs.Rename(oldpath, newpath)
 }
 
-func extractContentTypeAndMD5(filename string) (contentType string, md5sum []byte, err error) {
-	f, err := os.Open(filename)
+func extractContentTypeAndMD5(fs afero.Fs, filename string) (contentType string, md5sum []byte, err error) {
+	f, err := fs.Open(filename)
 	if err != nil {
 		return
 	}
@@ -897,7 +1922,29 @@ func extractContentTypeAndMD5(filename string) (contentType string, md5sum []byt
 }
 
 var (
-	_ vfs.VFS  = &aferoVFS{}
-	_ vfs.File = &aferoFileOpen{}
-	_ vfs.File = &aferoFileCreation{}
+	_ vfs.VFS                  = &aferoVFS{}
+	_ vfs.BackendStater        = &aferoVFS{}
+	_ vfs.Batcher              = &aferoVFS{}
+	_ vfs.Globber              = &aferoVFS{}
+	_ vfs.IndexFlusher         = &aferoVFS{}
+	_ vfs.InodeChecker         = &aferoVFS{}
+	_ vfs.InspectorSetter      = &aferoVFS{}
+	_ vfs.MaintenanceSetter    = &aferoVFS{}
+	_ vfs.NameNormalizer       = &aferoVFS{}
+	_ vfs.OverwriteUndoer      = &aferoVFS{}
+	_ vfs.PathOpener           = &aferoVFS{}
+	_ vfs.Pinger               = &aferoVFS{}
+	_ vfs.Swapper              = &aferoVFS{}
+	_ vfs.Truncater            = &aferoVFS{}
+	_ vfs.UploadResumer        = &aferoVFS{}
+	_ vfs.UploadSessionManager = &aferoVFS{}
+	_ vfs.WriteVerifier        = &aferoVFS{}
+	_ vfs.File                 = &aferoFileOpen{}
+	_ vfs.File                 = &aferoFileCreation{}
+	_ vfs.Aborter              = &aferoFileCreation{}
+	_ vfs.PartialKeeper        = &aferoFileCreation{}
+	_ vfs.ProgressReporter     = &aferoFileCreation{}
+	_ vfs.File                 = &aferoEmptyFileCreation{}
+	_ vfs.Aborter              = &aferoEmptyFileCreation{}
+	_ vfs.ProgressReporter     = &aferoEmptyFileCreation{}
 )
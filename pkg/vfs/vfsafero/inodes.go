@@ -0,0 +1,70 @@
+package vfsafero
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// defaultMinFreeInodes is the number of free inodes under which the bulk
+// creations are refused, if not configured.
+const defaultMinFreeInodes = 10000
+
+// inodesWarningInterval is the minimal interval between two checks of the
+// free inodes made on the creation of a file or directory.
+const inodesWarningInterval = time.Minute
+
+// lastInodesCheck is the time of the last check of the free inodes on a
+// creation, in unix nanoseconds, accessed atomically. It is shared by the
+// aferoVFS of the process, as they use the same filesystem.
+var lastInodesCheck int64
+
+func minFreeInodes() int64 {
+	if n := config.GetConfig().Fs.MinFreeInodes; n > 0 {
+		return n
+	}
+	return defaultMinFreeInodes
+}
+
+// CheckInodes implements the vfs.InodeChecker interface. It returns
+// ErrNoInodes if creating count files or directories would leave less than the
+// minimal number of free inodes on the filesystem. It is a no-op for a mem://
+// VFS, or when the number of inodes can not be known.
+func (afs *aferoVFS) CheckInodes(count int64) error {
+	if !afs.osFS {
+		return nil
+	}
+	free, ok := availableInodes(afs.pth)
+	if !ok {
+		return nil
+	}
+	if free-count < minFreeInodes() {
+		logger.WithNamespace("vfsafero").
+			Warnf("Refusing to create %d files for %s: only %d free inodes left on %s",
+				count, afs.domain, free, afs.pth)
+		return vfs.ErrNoInodes
+	}
+	return nil
+}
+
+// warnLowInodes logs a warning if the number of free inodes is below the
+// minimum. It is called on the creation of the files and directories, but the
+// filesystem is only asked once per inodesWarningInterval.
+func (afs *aferoVFS) warnLowInodes() {
+	if !afs.osFS {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&lastInodesCheck)
+	if now-last < int64(inodesWarningInterval) ||
+		!atomic.CompareAndSwapInt64(&lastInodesCheck, last, now) {
+		return
+	}
+	if free, ok := availableInodes(afs.pth); ok && free < minFreeInodes() {
+		logger.WithNamespace("vfsafero").
+			Warnf("Only %d free inodes left on %s", free, afs.pth)
+	}
+}
@@ -0,0 +1,35 @@
+package vfsafero
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckInodes(t *testing.T) {
+	config.UseTestFile()
+
+	// No-op for a mem:// VFS
+	afs := &aferoVFS{fs: afero.NewMemMapFs()}
+	assert.NoError(t, afs.CheckInodes(1<<62))
+
+	tmpDir, err := ioutil.TempDir("", "cozy-inodes")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	afs = &aferoVFS{fs: newRealPathFs(tmpDir), pth: tmpDir, osFS: true}
+	free, ok := availableInodes(tmpDir)
+	if !ok {
+		t.Skip("the number of inodes is not known for this filesystem")
+	}
+	assert.Equal(t, vfs.ErrNoInodes, afs.CheckInodes(free))
+	if free > 2*defaultMinFreeInodes {
+		assert.NoError(t, afs.CheckInodes(1))
+	}
+}
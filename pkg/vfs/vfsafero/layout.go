@@ -0,0 +1,95 @@
+package vfsafero
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// Layout is the way the contents of the files are laid out on the storage of
+// an afero VFS.
+type Layout string
+
+const (
+	// PathLayout stores the content of a file at its path in the VFS: the
+	// storage mirrors the tree of the directories, and moving a file or a
+	// directory moves its content on the disk. It is the default layout.
+	PathLayout Layout = "path"
+	// FlatLayout stores the content of a file under its identifier, in a
+	// bucket named after the first characters of the identifier. The
+	// directories only exist in the index, and moving a file or a directory
+	// does not touch the storage.
+	FlatLayout Layout = "flat"
+)
+
+// flatDirName is the directory where the contents of the files are stored
+// with the flat layout.
+const flatDirName = "/.cozy_files"
+
+// flatBucketLen is the number of characters of the identifier of a file used
+// to name its bucket with the flat layout.
+const flatBucketLen = 2
+
+// ParseLayout returns the layout with the given name, or PathLayout if the
+// name is empty.
+func ParseLayout(name string) (Layout, error) {
+	switch Layout(name) {
+	case "", PathLayout:
+		return PathLayout, nil
+	case FlatLayout:
+		return FlatLayout, nil
+	}
+	return "", fmt.Errorf("vfsafero: unknown layout %s", name)
+}
+
+func (afs *aferoVFS) isFlat() bool {
+	return afs.layout == FlatLayout
+}
+
+// contentPath returns the path on the storage of the content of the file. The
+// document must already have an identifier with the flat layout.
+func (afs *aferoVFS) contentPath(doc *vfs.FileDoc) (string, error) {
+	if !afs.isFlat() {
+		return afs.Indexer.FilePath(doc)
+	}
+	id := doc.ID()
+	if len(id) < flatBucketLen {
+		return "", fmt.Errorf("vfsafero: invalid identifier %q for the flat layout", id)
+	}
+	return path.Join(flatDirName, id[:flatBucketLen], id), nil
+}
+
+// mkdirBucket creates the bucket of the content of a file, for the flat
+// layout, before the content is written.
+func (afs *aferoVFS) mkdirBucket(name string) error {
+	if !afs.isFlat() {
+		return nil
+	}
+	if err := afs.fs.MkdirAll(path.Dir(name), 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeContents removes the contents of the files with the given
+// identifiers, for the flat layout, where they are not in the directory of
+// their parent on the storage.
+func (afs *aferoVFS) removeContents(ids []string) error {
+	for _, id := range ids {
+		name, err := afs.contentPath(&vfs.FileDoc{DocID: id})
+		if err != nil {
+			return err
+		}
+		getHandlePool().forget(afs.prefix, id)
+		afs.removeUndo(id)
+		err = afs.fs.Remove(name)
+		if os.IsNotExist(err) {
+			afs.logMissingContent(name)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
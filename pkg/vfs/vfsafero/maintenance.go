@@ -0,0 +1,141 @@
+package vfsafero
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/go-redis/redis"
+)
+
+// maintenanceStore keeps the instances in maintenance mode. It is shared by
+// all the processes of the stack through redis, when the locks are in redis,
+// and else by the aferoVFS of the process, as a new one is made for each
+// request on an instance.
+type maintenanceStore interface {
+	set(prefix string, enabled bool) error
+	has(prefix string) (bool, error)
+}
+
+var (
+	maintenancesMu sync.Mutex
+	maintenances   maintenanceStore
+)
+
+// getMaintenanceStore returns the store of the maintenance mode, in redis if
+// the locks are in redis.
+func getMaintenanceStore() maintenanceStore {
+	maintenancesMu.Lock()
+	defer maintenancesMu.Unlock()
+	if maintenances != nil {
+		return maintenances
+	}
+	if cli := config.GetConfig().Lock.Client(); cli != nil {
+		maintenances = &redisMaintenanceStore{cli}
+	} else {
+		maintenances = &memMaintenanceStore{prefixes: make(map[string]struct{})}
+	}
+	return maintenances
+}
+
+func maintenanceKey(prefix string) string {
+	return prefix + "/vfs-maintenance"
+}
+
+type memMaintenanceStore struct {
+	mu       sync.RWMutex
+	prefixes map[string]struct{}
+}
+
+func (s *memMaintenanceStore) set(prefix string, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if enabled {
+		s.prefixes[prefix] = struct{}{}
+	} else {
+		delete(s.prefixes, prefix)
+	}
+	return nil
+}
+
+func (s *memMaintenanceStore) has(prefix string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.prefixes[prefix]
+	return ok, nil
+}
+
+// redisMaintenanceStore keeps a key without expiration for each instance in
+// maintenance mode, so that the mode survives the restarts of the stack.
+type redisMaintenanceStore struct {
+	c redis.UniversalClient
+}
+
+func (s *redisMaintenanceStore) set(prefix string, enabled bool) error {
+	if enabled {
+		return s.c.Set(maintenanceKey(prefix), "1", 0).Err()
+	}
+	return s.c.Del(maintenanceKey(prefix)).Err()
+}
+
+func (s *redisMaintenanceStore) has(prefix string) (bool, error) {
+	n, err := s.c.Exists(maintenanceKey(prefix)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SetMaintenance implements the vfs.MaintenanceSetter interface. The lock is
+// taken to wait for the modifications in progress, but the uploads are only
+// checked when they write or close: they finish, or fail if configured so.
+func (afs *aferoVFS) SetMaintenance(enabled bool) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	return getMaintenanceStore().set(afs.prefix, enabled)
+}
+
+// InMaintenance implements the vfs.MaintenanceSetter interface.
+func (afs *aferoVFS) InMaintenance() (bool, error) {
+	return getMaintenanceStore().has(afs.prefix)
+}
+
+// checkWritable returns ErrMaintenance if the instance is in maintenance mode.
+// It must be called with the lock held, so that it does not race with
+// SetMaintenance.
+func (afs *aferoVFS) checkWritable() error {
+	enabled, err := afs.InMaintenance()
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return vfs.ErrMaintenance
+	}
+	return nil
+}
+
+// maintenanceCheckInterval is the minimal interval between two checks of the
+// maintenance mode by the writes of an upload.
+const maintenanceCheckInterval = time.Second
+
+// checkUploadWritableEvery is like checkUploadWritable, but it only asks the
+// store once per maintenanceCheckInterval, as it is called for each write.
+func (f *aferoFileCreation) checkUploadWritableEvery() error {
+	if now := time.Now(); now.Sub(f.checked) >= maintenanceCheckInterval {
+		f.checked = now
+		return f.checkUploadWritable()
+	}
+	return nil
+}
+
+// checkUploadWritable returns ErrMaintenance if the instance is in
+// maintenance mode, and the uploads in progress must fail.
+func (f *aferoFileCreation) checkUploadWritable() error {
+	if config.GetConfig().Fs.MaintenanceAbortUploads {
+		return f.afs.checkWritable()
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package vfsafero
+
+import (
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"golang.org/x/text/unicode/norm"
+)
+
+// SetNameNormalization implements the vfs.NameNormalizer interface.
+func (afs *aferoVFS) SetNameNormalization(enabled bool) {
+	afs.normalizeNames = enabled
+}
+
+// normalize returns the name in the NFC form if the normalization of the
+// names is enabled, or the name unchanged.
+func (afs *aferoVFS) normalize(name string) string {
+	if !afs.normalizeNames {
+		return name
+	}
+	return norm.NFC.String(name)
+}
+
+// normalizeDirDoc normalizes the name of the directory, and the last segment
+// of its path. The parent directories are left as is: they can have been
+// created before the normalization was enabled.
+func (afs *aferoVFS) normalizeDirDoc(doc *vfs.DirDoc) {
+	if !afs.normalizeNames {
+		return
+	}
+	doc.DocName = afs.normalize(doc.DocName)
+	if doc.Fullpath != "" && doc.Fullpath != "/" {
+		doc.Fullpath = path.Join(path.Dir(doc.Fullpath), doc.DocName)
+	}
+}
+
+// lookupPath calls fn with the given path, and if nothing is found and the
+// normalization of the names is enabled, with the NFC form of the path. The
+// names that were not normalized when they were created can still be found
+// with their exact form.
+func (afs *aferoVFS) lookupPath(name string, fn func(name string) error) error {
+	err := fn(name)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if normalized := afs.normalize(name); normalized != name {
+		return fn(normalized)
+	}
+	return err
+}
@@ -0,0 +1,30 @@
+// +build !windows
+
+package vfsafero
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+// availableInodes returns the number of free inodes on the filesystem of the
+// given directory, or false if it can not be known. The filesystems without a
+// fixed number of inodes (btrfs for example) report zero inodes, and are also
+// unknown. If the directory does not exist yet, its closest existing parent is
+// used.
+func availableInodes(dir string) (int64, bool) {
+	for {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err == nil {
+			if st.Files == 0 {
+				return 0, false
+			}
+			return int64(st.Ffree), true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return 0, false
+		}
+		dir = parent
+	}
+}
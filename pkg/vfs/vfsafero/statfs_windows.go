@@ -0,0 +1,9 @@
+// +build windows
+
+package vfsafero
+
+// availableInodes returns the number of free inodes on the filesystem of the
+// given directory. It is not implemented on Windows.
+func availableInodes(dir string) (int64, bool) {
+	return 0, false
+}
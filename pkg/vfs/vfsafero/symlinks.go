@@ -0,0 +1,90 @@
+package vfsafero
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// checkRealPath returns vfs.ErrForbiddenSymlink if the file with the given
+// name in the base directory is, once its symbolic links are resolved, outside
+// of the base directory. The afero.BasePathFs only checks the name before its
+// resolution by the OS, so it is a defense in depth against the symbolic links
+// that could have been imported in the storage of an instance.
+func checkRealPath(base, name string) error {
+	realBase, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return err
+	}
+	realPath, err := filepath.EvalSymlinks(filepath.Join(base, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	if !isInDir(realBase, realPath) {
+		return vfs.ErrForbiddenSymlink
+	}
+	return nil
+}
+
+func isInDir(dir, name string) bool {
+	return name == dir || strings.HasPrefix(name, dir+string(filepath.Separator))
+}
+
+// realPathFs is the afero.Fs of an OS-FS store: the files are opened, created
+// and renamed only after a check of their real path with checkRealPath, so
+// that no content can be read or written through a symbolic link to outside
+// of the instance.
+type realPathFs struct {
+	afero.Fs
+	base string
+}
+
+// newRealPathFs returns the afero.Fs of the files of the OS-FS store at base.
+func newRealPathFs(base string) afero.Fs {
+	return &realPathFs{Fs: afero.NewBasePathFs(afero.NewOsFs(), base), base: base}
+}
+
+// check checks the real path of the file with the given name, or of its
+// parent directory if it does not exist yet.
+func (fs *realPathFs) check(name string) error {
+	err := checkRealPath(fs.base, name)
+	if os.IsNotExist(err) {
+		err = checkRealPath(fs.base, path.Dir(name))
+	}
+	return err
+}
+
+func (fs *realPathFs) Create(name string) (afero.File, error) {
+	if err := fs.check(name); err != nil {
+		return nil, err
+	}
+	return fs.Fs.Create(name)
+}
+
+func (fs *realPathFs) Open(name string) (afero.File, error) {
+	if err := fs.check(name); err != nil {
+		return nil, err
+	}
+	return fs.Fs.Open(name)
+}
+
+func (fs *realPathFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if err := fs.check(name); err != nil {
+		return nil, err
+	}
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+func (fs *realPathFs) Rename(oldname, newname string) error {
+	if err := fs.check(oldname); err != nil {
+		return err
+	}
+	if err := fs.check(newname); err != nil {
+		return err
+	}
+	return fs.Fs.Rename(oldname, newname)
+}
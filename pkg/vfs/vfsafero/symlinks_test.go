@@ -0,0 +1,69 @@
+package vfsafero
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckRealPath(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cozy-symlinks")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	base := filepath.Join(tmpDir, "instance")
+	assert.NoError(t, os.MkdirAll(filepath.Join(base, "dir"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(base, "dir", "foo"), []byte("foo"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "secret"), []byte("secret"), 0644))
+
+	assert.NoError(t, os.Symlink(filepath.Join(base, "dir", "foo"), filepath.Join(base, "inside")))
+	assert.NoError(t, os.Symlink("/etc/passwd", filepath.Join(base, "passwd")))
+	assert.NoError(t, os.Symlink("../../secret", filepath.Join(base, "dir", "relative")))
+	assert.NoError(t, os.Symlink(tmpDir, filepath.Join(base, "parent")))
+
+	assert.NoError(t, checkRealPath(base, "/dir/foo"))
+	assert.NoError(t, checkRealPath(base, "/inside"))
+	assert.Equal(t, vfs.ErrForbiddenSymlink, checkRealPath(base, "/passwd"))
+	assert.Equal(t, vfs.ErrForbiddenSymlink, checkRealPath(base, "/dir/relative"))
+	assert.Equal(t, vfs.ErrForbiddenSymlink, checkRealPath(base, "/parent/secret"))
+	assert.True(t, os.IsNotExist(checkRealPath(base, "/missing")))
+
+	// The handles are not opened for the links to outside of the instance
+	afs := &aferoVFS{
+		fs:     newRealPathFs(base),
+		pth:    base,
+		prefix: "symlinks-test",
+		osFS:   true,
+	}
+	doc := &vfs.FileDoc{DocID: "passwd", DocRev: "1-abc"}
+	_, err = afs.openHandle("/passwd", doc)
+	assert.Equal(t, vfs.ErrForbiddenSymlink, err)
+	doc = &vfs.FileDoc{DocID: "inside", DocRev: "1-abc"}
+	f, err := afs.openHandle("/inside", doc)
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", string(b))
+		assert.NoError(t, f.Close())
+	}
+
+	// And no content is written or moved through them
+	_, err = afs.fs.OpenFile("/passwd", os.O_RDWR, 0644)
+	assert.Equal(t, vfs.ErrForbiddenSymlink, err)
+	_, err = safeCreateFile("/parent/new", 0644, afs.fs)
+	assert.Equal(t, vfs.ErrForbiddenSymlink, err)
+	assert.Equal(t, vfs.ErrForbiddenSymlink, afs.fs.Rename("/dir/foo", "/parent/foo"))
+	assert.Equal(t, vfs.ErrForbiddenSymlink, afs.fs.Rename("/dir/relative", "/dir/bar"))
+	_, err = os.Stat(filepath.Join(tmpDir, "new"))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, afs.fs.Rename("/dir/foo", "/dir/bar"))
+	created, err := safeCreateFile("/dir/new", 0644, afs.fs)
+	if assert.NoError(t, err) {
+		assert.NoError(t, created.Close())
+	}
+}
@@ -0,0 +1,282 @@
+package vfsafero
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// undoDirName is the name of the directory, inside the directory of the
+// temporary files, where the old contents of the overwritten files are kept.
+// There is at most one old content by file, named with its identifier, and a
+// JSON file with the same name and the .json extension describes it.
+const undoDirName = ".undo"
+
+// undoSizeName is the name of the file, inside the undo directory, with the
+// total size of the old contents kept: the limit of the configuration can be
+// enforced on an overwrite without listing them.
+const undoSizeName = ".size"
+
+// undoEntry is the description of an old content kept to undo an overwrite.
+type undoEntry struct {
+	// Doc is the document of the file before the overwrite
+	Doc *vfs.FileDoc `json:"doc"`
+	// MD5Sum is the md5sum of the content written by the overwrite
+	MD5Sum []byte `json:"md5sum"`
+	// OverwrittenAt is the time of the overwrite
+	OverwrittenAt time.Time `json:"overwritten_at"`
+}
+
+func undoRetention() time.Duration {
+	return config.GetConfig().Fs.UndoRetention
+}
+
+func (afs *aferoVFS) undoDir() string {
+	return path.Join(afs.tmpDir, undoDirName)
+}
+
+func (afs *aferoVFS) undoPath(fileID string) string {
+	return path.Join(afs.undoDir(), fileID)
+}
+
+// releaseBackup is called with the backup of the old content of a file, once
+// the overwrite has succeeded. The backup is kept to undo the overwrite if it
+// is enabled, and if the old contents already kept leave room for it, or
+// removed. The expired old contents are removed by the trash-expiry worker.
+func (afs *aferoVFS) releaseBackup(olddoc, newdoc *vfs.FileDoc, bakpath string) {
+	log := logger.WithNamespace("vfsafero")
+	if undoRetention() <= 0 {
+		if errr := afs.fs.Remove(bakpath); errr != nil {
+			log.Warnf("Error on removing backup file: %s", errr)
+		}
+		return
+	}
+
+	// The old content kept for a previous overwrite of the file can't be
+	// restored anymore.
+	afs.removeUndo(olddoc.ID())
+	maxSize := config.GetConfig().Fs.UndoMaxSize
+	if maxSize > 0 && afs.undoSize()+olddoc.ByteSize > maxSize {
+		if errr := afs.fs.Remove(bakpath); errr != nil {
+			log.Warnf("Error on removing backup file: %s", errr)
+		}
+		return
+	}
+
+	if err := afs.keepBackup(olddoc, newdoc, bakpath); err != nil {
+		log.Warnf("Error on keeping backup file %s: %s", bakpath, err)
+		afs.removeUndo(olddoc.ID())
+		if errr := afs.fs.Remove(bakpath); errr != nil && !os.IsNotExist(errr) {
+			log.Warnf("Error on removing backup file: %s", errr)
+		}
+	}
+}
+
+func (afs *aferoVFS) keepBackup(olddoc, newdoc *vfs.FileDoc, bakpath string) error {
+	if err := afs.fs.MkdirAll(afs.undoDir(), 0755); err != nil {
+		return err
+	}
+	entry, err := json.Marshal(&undoEntry{
+		Doc:           olddoc,
+		MD5Sum:        newdoc.MD5Sum,
+		OverwrittenAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	name := afs.undoPath(olddoc.ID())
+	if err = afs.fs.Rename(bakpath, name); err != nil {
+		return err
+	}
+	afs.setUndoSize(afs.undoSize() + olddoc.ByteSize)
+	return afero.WriteFile(afs.fs, name+".json", entry, 0644)
+}
+
+// undoSize returns the total size of the old contents kept, as counted on
+// each change. It is zero if it has never been counted.
+func (afs *aferoVFS) undoSize() int64 {
+	buf, err := afero.ReadFile(afs.fs, path.Join(afs.undoDir(), undoSizeName))
+	if err != nil {
+		return 0
+	}
+	size, _ := strconv.ParseInt(string(buf), 10, 64)
+	return size
+}
+
+func (afs *aferoVFS) setUndoSize(size int64) {
+	if size < 0 {
+		size = 0
+	}
+	name := path.Join(afs.undoDir(), undoSizeName)
+	if err := afero.WriteFile(afs.fs, name, []byte(strconv.FormatInt(size, 10)), 0644); err != nil {
+		logger.WithNamespace("vfsafero").Warnf("Error on counting the old contents: %s", err)
+	}
+}
+
+// readUndo returns the description of the old content kept for the file, or
+// nil if there is none or if it has expired.
+func (afs *aferoVFS) readUndo(fileID string) *undoEntry {
+	buf, err := afero.ReadFile(afs.fs, afs.undoPath(fileID)+".json")
+	if err != nil {
+		return nil
+	}
+	var entry undoEntry
+	if err = json.Unmarshal(buf, &entry); err != nil || entry.Doc == nil {
+		return nil
+	}
+	if time.Since(entry.OverwrittenAt) > undoRetention() {
+		return nil
+	}
+	return &entry
+}
+
+// removeUndo removes the old content kept for the file, if any.
+func (afs *aferoVFS) removeUndo(fileID string) {
+	name := afs.undoPath(fileID)
+	if info, err := afs.fs.Stat(name); err == nil {
+		if err = afs.fs.Remove(name); err == nil {
+			afs.setUndoSize(afs.undoSize() - info.Size())
+		}
+	}
+	afs.fs.Remove(name + ".json") // #nosec
+}
+
+// UndoOverwrite implements the vfs.OverwriteUndoer interface.
+func (afs *aferoVFS) UndoOverwrite(doc *vfs.FileDoc) (*vfs.FileDoc, error) {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer afs.mu.Unlock()
+	if err := afs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	olddoc, err := afs.Indexer.FileByID(doc.ID())
+	if err != nil {
+		return nil, err
+	}
+	if olddoc.Rev() != doc.Rev() {
+		return nil, vfs.ErrConflict
+	}
+	if olddoc.Trashed {
+		return nil, vfs.ErrFileInTrash
+	}
+	if _, err = afs.fs.Stat(afs.tmpPath(olddoc)); err == nil {
+		return nil, vfs.ErrFileInUse
+	}
+
+	// The old content can only be restored if the content has not been
+	// modified by something else than an overwrite since.
+	entry := afs.readUndo(olddoc.ID())
+	if entry == nil || !bytes.Equal(entry.MD5Sum, olddoc.MD5Sum) {
+		return nil, vfs.ErrNoOverwriteToUndo
+	}
+
+	if diskQuota := afs.DiskQuota(); diskQuota > 0 && entry.Doc.ByteSize > olddoc.ByteSize {
+		diskUsage, err := afs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		if entry.Doc.ByteSize-olddoc.ByteSize > diskQuota-diskUsage {
+			return nil, vfs.ErrFileTooBig
+		}
+	}
+
+	name, err := afs.contentPath(olddoc)
+	if err != nil {
+		return nil, err
+	}
+	undopath := afs.undoPath(olddoc.ID())
+	tmppath := afs.tmpPath(olddoc) + ".undo"
+	if err = afs.fs.Rename(name, tmppath); err != nil {
+		return nil, err
+	}
+	if err = afs.fs.Rename(undopath, name); err != nil {
+		afs.fs.Rename(tmppath, name) // #nosec
+		return nil, err
+	}
+
+	newdoc := swappedFileDoc(olddoc, entry.Doc, time.Now())
+	err = afs.retry.Do(func() error {
+		return afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	})
+	if err != nil {
+		afs.fs.Rename(name, undopath) // #nosec
+		afs.fs.Rename(tmppath, name)  // #nosec
+		return nil, err
+	}
+	getHandlePool().forget(afs.prefix, newdoc.ID())
+	afs.setUndoSize(afs.undoSize() - entry.Doc.ByteSize)
+	afs.removeUndo(newdoc.ID())
+	if errr := afs.fs.Remove(tmppath); errr != nil {
+		logger.WithNamespace("vfsafero").Warnf("Error on removing overwritten file: %s", errr)
+	}
+	return newdoc, nil
+}
+
+// PurgeExpiredUndos implements the vfs.OverwriteUndoer interface.
+func (afs *aferoVFS) PurgeExpiredUndos() (int64, error) {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return 0, lockerr
+	}
+	defer afs.mu.Unlock()
+	return afs.purgeUndos()
+}
+
+// purgeUndos removes the old contents that have expired, and the oldest ones
+// when their total size is over the limit of the configuration. The total size
+// of the old contents kept is counted again.
+func (afs *aferoVFS) purgeUndos() (int64, error) {
+	infos, err := afero.ReadDir(afs.fs, afs.undoDir())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	type kept struct {
+		id   string
+		size int64
+		at   time.Time
+	}
+	var keeps []kept
+	var reclaimed int64
+	for _, info := range infos {
+		id := info.Name()
+		if info.IsDir() || id == undoSizeName || strings.HasSuffix(id, ".json") {
+			continue
+		}
+		if entry := afs.readUndo(id); entry != nil {
+			keeps = append(keeps, kept{id, info.Size(), entry.OverwrittenAt})
+			continue
+		}
+		afs.removeUndo(id)
+		reclaimed += info.Size()
+	}
+
+	maxSize := config.GetConfig().Fs.UndoMaxSize
+	sort.Slice(keeps, func(i, j int) bool { return keeps[i].at.After(keeps[j].at) })
+	var total, kept int64
+	for _, k := range keeps {
+		total += k.size
+		if maxSize > 0 && total > maxSize {
+			afs.removeUndo(k.id)
+			reclaimed += k.size
+		} else {
+			kept += k.size
+		}
+	}
+	afs.setUndoSize(kept)
+	return reclaimed, nil
+}
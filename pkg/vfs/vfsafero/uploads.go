@@ -0,0 +1,408 @@
+package vfsafero
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// uploadRegistry keeps the file creations in progress, by instance. It is
+// shared by the aferoVFS of the process, as a new one is made for each
+// request on an instance.
+type uploadRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]map[*aferoFileCreation]struct{}
+}
+
+var uploads = &uploadRegistry{
+	sessions: make(map[string]map[*aferoFileCreation]struct{}),
+}
+
+func (r *uploadRegistry) add(prefix string, f *aferoFileCreation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	byFile, ok := r.sessions[prefix]
+	if !ok {
+		byFile = make(map[*aferoFileCreation]struct{})
+		r.sessions[prefix] = byFile
+	}
+	byFile[f] = struct{}{}
+}
+
+func (r *uploadRegistry) remove(prefix string, f *aferoFileCreation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if byFile, ok := r.sessions[prefix]; ok {
+		delete(byFile, f)
+		if len(byFile) == 0 {
+			delete(r.sessions, prefix)
+		}
+	}
+}
+
+func (r *uploadRegistry) list(prefix string) []*aferoFileCreation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var list []*aferoFileCreation
+	for f := range r.sessions[prefix] {
+		list = append(list, f)
+	}
+	return list
+}
+
+// configuredTmpDir returns the directory of the temporary files of the
+// overwrites, from the configuration.
+func configuredTmpDir() string {
+	dir := config.GetConfig().Fs.TmpDir
+	if dir == "" {
+		return "/"
+	}
+	return path.Join("/", dir)
+}
+
+// mkdirTmp creates the directory of the temporary files if it does not exist
+// yet, for the instances created before it was configured.
+func (afs *aferoVFS) mkdirTmp() error {
+	if afs.tmpDir == "/" {
+		return nil
+	}
+	if err := afs.fs.Mkdir(afs.tmpDir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// tmpPath returns the path of the temporary file where the new content of
+// the file is written when it is overwritten.
+func (afs *aferoVFS) tmpPath(olddoc *vfs.FileDoc) string {
+	return path.Join(afs.tmpDir, fmt.Sprintf(".%s_%s", olddoc.ID(), olddoc.Rev()))
+}
+
+// leftoverReg matches the names of the temporary files used when overwriting a
+// file (see CreateFile): a dot, the identifier and the revision of the file.
+var leftoverReg = regexp.MustCompile(`^\.(.+)_([0-9]+-[0-9a-f]+)$`)
+
+func (f *aferoFileCreation) session() *vfs.UploadSession {
+	return &vfs.UploadSession{
+		DocID:        f.newdoc.ID(),
+		TmpPath:      f.tmppath,
+		Size:         atomic.LoadInt64(&f.written),
+		StartedAt:    f.started,
+		LastActivity: time.Unix(0, atomic.LoadInt64(&f.activity)),
+		Active:       true,
+	}
+}
+
+// ListUploadSessions returns the file creations in progress in this process,
+// the temporary files left by the overwrites that have not been finished, for
+// example because the process has crashed, and the hidden documents of the
+// new files whose upload has not been finished.
+func (afs *aferoVFS) ListUploadSessions() ([]*vfs.UploadSession, error) {
+	var sessions []*vfs.UploadSession
+	active := make(map[string]bool)
+	for _, f := range uploads.list(afs.prefix) {
+		sessions = append(sessions, f.session())
+		active[f.tmppath] = true
+	}
+	leftovers, err := afs.leftovers(active)
+	if err != nil {
+		return nil, err
+	}
+	sessions = append(sessions, leftovers...)
+	hidden, err := afs.hiddenUploads(active)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hidden {
+		sessions = append(sessions, h.session)
+	}
+	return sessions, nil
+}
+
+// hiddenUpload is the hidden document of a new file that is not uploaded in
+// this process, with the session of its partial content, written at the
+// final location of the content.
+type hiddenUpload struct {
+	doc     *vfs.FileDoc
+	session *vfs.UploadSession
+}
+
+// hiddenUploads returns the hidden documents of the new files that are not
+// uploaded in this process. Their last activity is the last write of their
+// partial content, or their last update if they have no content.
+func (afs *aferoVFS) hiddenUploads(active map[string]bool) ([]hiddenUpload, error) {
+	docs, err := afs.Indexer.HiddenFiles()
+	if err != nil {
+		return nil, err
+	}
+	var hidden []hiddenUpload
+	for _, doc := range docs {
+		name, err := afs.contentPath(doc)
+		if err != nil {
+			return nil, err
+		}
+		if active[name] {
+			continue
+		}
+		s := &vfs.UploadSession{
+			DocID:        doc.ID(),
+			TmpPath:      name,
+			LastActivity: doc.UpdatedAt,
+		}
+		if info, err := afs.fs.Stat(name); err == nil {
+			s.Size = info.Size()
+			s.LastActivity = info.ModTime()
+		}
+		hidden = append(hidden, hiddenUpload{doc: doc, session: s})
+	}
+	return hidden, nil
+}
+
+// purgeHiddenUpload removes the hidden document of a new file, and then its
+// partial content, with the lock of the VFS. The document is not removed if
+// it has been updated since it was listed, for example if the upload has been
+// resumed.
+func (afs *aferoVFS) purgeHiddenUpload(h hiddenUpload) (bool, error) {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return false, lockerr
+	}
+	defer afs.mu.Unlock()
+	if err := afs.Indexer.DeleteFileDoc(h.doc); err != nil {
+		if couchdb.IsConflictError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := afs.fs.Remove(h.session.TmpPath); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+// leftovers returns the temporary files that are not used by an upload in
+// progress in this process. They are looked for in the directory of the
+// temporary files, and at the root of the storage where they were written
+// before this directory was configured. A file of the user with a similar
+// name is recognized with the index.
+func (afs *aferoVFS) leftovers(active map[string]bool) ([]*vfs.UploadSession, error) {
+	sessions, err := afs.leftoversIn("/", active)
+	if err != nil || afs.tmpDir == "/" {
+		return sessions, err
+	}
+	more, err := afs.leftoversIn(afs.tmpDir, active)
+	if err != nil {
+		return nil, err
+	}
+	return append(sessions, more...), nil
+}
+
+func (afs *aferoVFS) leftoversIn(dir string, active map[string]bool) ([]*vfs.UploadSession, error) {
+	infos, err := afero.ReadDir(afs.fs, dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*vfs.UploadSession
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		if info.IsDir() || active[name] || strings.HasPrefix(info.Name(), ".swap_") {
+			continue
+		}
+		matches := leftoverReg.FindStringSubmatch(info.Name())
+		if matches == nil {
+			continue
+		}
+		if _, err = afs.Indexer.FileByPath(name); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		sessions = append(sessions, &vfs.UploadSession{
+			DocID:        matches[1],
+			TmpPath:      name,
+			Size:         info.Size(),
+			LastActivity: info.ModTime(),
+		})
+	}
+	return sessions, nil
+}
+
+// PurgeExpiredUploadSessions aborts the file creations without any write for
+// more than olderThan, and removes the temporary files left by the unfinished
+// overwrites, and the hidden documents of the unfinished new files with their
+// partial contents, that are older than that. The uploads that are still
+// written are not touched.
+func (afs *aferoVFS) PurgeExpiredUploadSessions(olderThan time.Duration) (int64, error) {
+	limit := time.Now().Add(-olderThan)
+	var reclaimed int64
+	active := make(map[string]bool)
+	for _, f := range uploads.list(afs.prefix) {
+		s := f.session()
+		if !s.LastActivity.Before(limit) {
+			active[f.tmppath] = true
+			continue
+		}
+		aborted, err := f.abort()
+		if err != nil {
+			return reclaimed, err
+		}
+		if aborted {
+			reclaimed += s.Size
+		} else {
+			active[f.tmppath] = true
+		}
+	}
+
+	leftovers, err := afs.leftovers(active)
+	if err != nil {
+		return reclaimed, err
+	}
+	for _, s := range leftovers {
+		if !s.LastActivity.Before(limit) {
+			continue
+		}
+		if err = afs.fs.Remove(s.TmpPath); err != nil && !os.IsNotExist(err) {
+			return reclaimed, err
+		}
+		reclaimed += s.Size
+	}
+
+	hidden, err := afs.hiddenUploads(active)
+	if err != nil {
+		return reclaimed, err
+	}
+	for _, h := range hidden {
+		if !h.session.LastActivity.Before(limit) {
+			continue
+		}
+		purged, err := afs.purgeHiddenUpload(h)
+		if purged {
+			reclaimed += h.session.Size
+		}
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
+
+// KeepPartial implements the vfs.PartialKeeper interface.
+func (f *aferoFileCreation) KeepPartial() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keep = true
+}
+
+// ResumeFile implements the vfs.UploadResumer interface. The content already
+// kept is read again to compute its hash and to give it to the metadata
+// extractor and to the inspector, as their states were not kept.
+func (afs *aferoVFS) ResumeFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer afs.mu.Unlock()
+	if err := afs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	var tmppath string
+	var oldsize int64
+	var err error
+	if olddoc != nil {
+		tmppath = afs.tmpPath(olddoc)
+		oldsize = olddoc.Size()
+		newdoc.SetID(olddoc.ID())
+		newdoc.SetRev(olddoc.Rev())
+		newdoc.CreatedAt = olddoc.CreatedAt
+		if newdoc.ReferencedBy == nil {
+			newdoc.ReferencedBy = olddoc.ReferencedBy
+		}
+	} else {
+		// The document of a new file has been kept hidden in the index, and
+		// its declared size is already counted in the disk usage.
+		reserved, err := afs.Indexer.FileByID(newdoc.ID())
+		if err != nil {
+			return nil, err
+		}
+		if tmppath, err = afs.contentPath(reserved); err != nil {
+			return nil, err
+		}
+		oldsize = reserved.ByteSize
+		newdoc.SetRev(reserved.Rev())
+		newdoc.Trashed = true
+	}
+	for _, f := range uploads.list(afs.prefix) {
+		if f.tmppath == tmppath {
+			return nil, vfs.ErrFileInUse
+		}
+	}
+
+	infos, err := afs.fs.Stat(tmppath)
+	if err != nil {
+		return nil, err
+	}
+	newsize := newdoc.ByteSize
+	if newsize >= 0 && infos.Size() > newsize {
+		return nil, vfs.ErrContentLengthMismatch
+	}
+	maxsize, capsize, err := afs.sizeLimits(newsize, oldsize)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := afs.fs.OpenFile(tmppath, os.O_WRONLY|os.O_APPEND, newdoc.Mode())
+	if err != nil {
+		return nil, err
+	}
+	fc := afs.newFileCreation(f, newdoc, olddoc, tmppath, newsize, maxsize, capsize)
+	if err = fc.replay(); err != nil {
+		f.Close() // #nosec
+		if fc.meta != nil {
+			(*fc.meta).Abort(err)
+		}
+		if fc.inspector != nil {
+			fc.inspector.Close() // #nosec
+		}
+		return nil, err
+	}
+	uploads.add(afs.prefix, fc)
+	return fc, nil
+}
+
+// replay reads the content already written in the temporary file, to update
+// the state of the file creation with it.
+func (f *aferoFileCreation) replay() error {
+	tmp, err := f.afs.fs.Open(f.tmppath)
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := tmp.Read(buf)
+		if n > 0 {
+			if errc := f.consume(buf[:n]); errc != nil {
+				return errc
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package vfsafero
+
+import (
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/cozy/afero"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// notFoundIndexer is an index without any file.
+type notFoundIndexer struct {
+	vfs.Indexer
+}
+
+func (notFoundIndexer) FileByPath(name string) (*vfs.FileDoc, error) {
+	return nil, os.ErrNotExist
+}
+
+func (notFoundIndexer) HiddenFiles() ([]*vfs.FileDoc, error) {
+	return nil, nil
+}
+
+func TestTmpDirLeftovers(t *testing.T) {
+	afs := &aferoVFS{
+		Indexer: notFoundIndexer{},
+		fs:      afero.NewMemMapFs(),
+		prefix:  "tmpdir-test",
+		tmpDir:  "/.cozy_tmp",
+	}
+	doc := &vfs.FileDoc{DocID: "abc", DocRev: "2-def"}
+	assert.Equal(t, "/.cozy_tmp/.abc_2-def", afs.tmpPath(doc))
+
+	// No error when the directory has not been created yet
+	sessions, err := afs.ListUploadSessions()
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+
+	assert.NoError(t, afs.mkdirTmp())
+	assert.NoError(t, afs.mkdirTmp())
+	assert.NoError(t, afero.WriteFile(afs.fs, afs.tmpPath(doc), []byte("new"), 0644))
+	// A backup left at the root by a previous version of the stack
+	assert.NoError(t, afero.WriteFile(afs.fs, "/.ghi_1-a0b", []byte("old"), 0644))
+	assert.NoError(t, afero.WriteFile(afs.fs, "/notes.txt", []byte("user"), 0644))
+
+	sessions, err = afs.ListUploadSessions()
+	assert.NoError(t, err)
+	var paths []string
+	for _, s := range sessions {
+		paths = append(paths, s.TmpPath)
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{"/.cozy_tmp/.abc_2-def", "/.ghi_1-a0b"}, paths)
+}
@@ -3,7 +3,6 @@ package vfsswift
 import (
 	"bytes"
 	"encoding/hex"
-	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -157,6 +156,14 @@ func (sfs *swiftVFS) deleteContainer(container string) error {
 	return sfs.c.ContainerDelete(container)
 }
 
+// Capabilities implements the vfs.Fs interface.
+func (sfs *swiftVFS) Capabilities() vfs.Capabilities {
+	return vfs.Capabilities{
+		Backend:    config.SchemeSwift,
+		RangeReads: true,
+	}
+}
+
 func (sfs *swiftVFS) CreateDir(doc *vfs.DirDoc) error {
 	if lockerr := sfs.mu.Lock(); lockerr != nil {
 		return lockerr
@@ -169,6 +176,12 @@ func (sfs *swiftVFS) CreateDir(doc *vfs.DirDoc) error {
 	if exists {
 		return os.ErrExist
 	}
+	if err = vfs.CheckParentNotInTrash(sfs.Indexer, doc); err != nil {
+		return err
+	}
+	if err = vfs.InheritDirDefaults(sfs.Indexer, doc); err != nil {
+		return err
+	}
 	objName := doc.DirID + "/" + doc.DocName
 	f, err := sfs.c.ObjectCreate(sfs.container,
 		objName,
@@ -225,13 +238,16 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		newdoc.SetID(olddoc.ID())
 		newdoc.SetRev(olddoc.Rev())
 		newdoc.CreatedAt = olddoc.CreatedAt
+		if newdoc.ReferencedBy == nil {
+			newdoc.ReferencedBy = olddoc.ReferencedBy
+		}
 	}
 
 	newpath, err := sfs.Indexer.FilePath(newdoc)
 	if err != nil {
 		return nil, err
 	}
-	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+	if !newdoc.AllowInTrash && strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
 		return nil, vfs.ErrParentInTrash
 	}
 
@@ -250,6 +266,10 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 			return nil, os.ErrExist
 		}
 
+		if err = vfs.InheritFileDefaults(sfs.Indexer, newdoc); err != nil {
+			return nil, err
+		}
+
 		// When added to the index, the document is first considered hidden. This
 		// flag will only be removed at the end of the upload when all its metadata
 		// are known. See the Close() method.
@@ -284,7 +304,7 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		w:       0,
 		size:    newsize,
 		name:    objName,
-		meta:    vfs.NewMetaExtractor(newdoc),
+		sniffer: vfs.NewContentSniffer(newdoc, olddoc),
 		newdoc:  newdoc,
 		olddoc:  olddoc,
 		maxsize: maxsize,
@@ -402,6 +422,34 @@ func (sfs *swiftVFS) destroyFileVersions(objName string) error {
 	return nil
 }
 
+// Ping implements the vfs.Pinger interface, with a HEAD on the container.
+func (sfs *swiftVFS) Ping() error {
+	_, _, err := sfs.c.Container(sfs.container)
+	return err
+}
+
+// PingStorage checks that the swift cluster is reachable, with a HEAD on the
+// account, as there is no container shared by all the instances.
+func PingStorage(c *swift.Connection) error {
+	_, _, err := c.Account()
+	return err
+}
+
+func (sfs *swiftVFS) BackendStat(doc *vfs.FileDoc) (int64, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return 0, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	info, _, err := sfs.c.Object(sfs.container, doc.DirID+"/"+doc.DocName)
+	if err == swift.ObjectNotFound {
+		return 0, os.ErrNotExist
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Bytes, nil
+}
+
 func (sfs *swiftVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if lockerr := sfs.mu.RLock(); lockerr != nil {
 		return nil, lockerr
@@ -652,7 +700,7 @@ func (sfs *swiftVFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
 			return err
 		}
 		if exists {
-			return os.ErrExist
+			return vfs.ErrConflict
 		}
 		err = sfs.c.ObjectMove(
 			sfs.container, olddoc.DirID+"/"+olddoc.DocName,
@@ -676,13 +724,18 @@ func (sfs *swiftVFS) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
 		return lockerr
 	}
 	defer sfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID {
+		if err := vfs.CheckNoCycle(sfs.Indexer, olddoc, newdoc.DirID); err != nil {
+			return err
+		}
+	}
 	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
 		exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
 		if err != nil {
 			return err
 		}
 		if exists {
-			return os.ErrExist
+			return vfs.ErrConflict
 		}
 		err = sfs.c.ObjectMove(
 			sfs.container, olddoc.DirID+"/"+olddoc.DocName,
@@ -760,7 +813,7 @@ type swiftFileCreation struct {
 	fs      *swiftVFS
 	name    string
 	err     error
-	meta    *vfs.MetaExtractor
+	sniffer *vfs.ContentSniffer
 	newdoc  *vfs.FileDoc
 	olddoc  *vfs.FileDoc
 	maxsize int64
@@ -780,14 +833,8 @@ func (f *swiftFileCreation) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *swiftFileCreation) Write(p []byte) (int, error) {
-	if f.meta != nil {
-		if _, err := (*f.meta).Write(p); err != nil && err != io.ErrClosedPipe {
-			(*f.meta).Abort(err)
-			f.meta = nil
-		}
-	}
-
 	n, err := f.f.Write(p)
+	f.sniffer.Write(p[:n]) // #nosec
 	if err != nil {
 		f.err = err
 		return n, err
@@ -831,10 +878,7 @@ func (f *swiftFileCreation) Close() (err error) {
 		if err == swift.ObjectCorrupted {
 			err = vfs.ErrInvalidHash
 		}
-		if f.meta != nil {
-			(*f.meta).Abort(err)
-			f.meta = nil
-		}
+		f.sniffer.Abort(err)
 		if f.err == nil {
 			f.err = err
 		}
@@ -845,11 +889,7 @@ func (f *swiftFileCreation) Close() (err error) {
 		olddoc = newdoc.Clone().(*vfs.FileDoc)
 	}
 
-	if f.meta != nil {
-		if errc := (*f.meta).Close(); errc == nil {
-			newdoc.Metadata = (*f.meta).Result()
-		}
-	}
+	f.sniffer.Close() // #nosec
 
 	if f.err != nil {
 		return f.err
@@ -887,6 +927,13 @@ func (f *swiftFileCreation) Close() (err error) {
 		return vfs.ErrContentLengthMismatch
 	}
 
+	// The type of a new file without an explicit type is detected from its
+	// content. And when overwriting a file, the new content may have another
+	// type than the old one: the type and the metadata derived from the content
+	// are refreshed instead of keeping the stale ones (except if the metadata
+	// have been given and are trusted).
+	f.sniffer.Update(newdoc)
+
 	// The document is already added to the index when closing the file creation
 	// handler. When updating the content of the document with the final
 	// informations (size, md5, ...) we can reuse the same document as olddoc.
@@ -950,7 +997,9 @@ func (f *swiftFileOpen) Close() error {
 }
 
 var (
-	_ vfs.VFS  = &swiftVFS{}
-	_ vfs.File = &swiftFileCreation{}
-	_ vfs.File = &swiftFileOpen{}
+	_ vfs.VFS           = &swiftVFS{}
+	_ vfs.BackendStater = &swiftVFS{}
+	_ vfs.Pinger        = &swiftVFS{}
+	_ vfs.File          = &swiftFileCreation{}
+	_ vfs.File          = &swiftFileOpen{}
 )
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -42,6 +41,9 @@ type swiftVFSV2 struct {
 const (
 	swiftV2ContainerPrefixCozy = "cozy-v2-"
 	swiftV2ContainerPrefixData = "data-v2-"
+
+	swiftTierContainerPrefixCozy = "cozy-tier-"
+	swiftTierContainerPrefixData = "data-tier-"
 )
 
 // NewV2 returns a vfs.VFS instance associated with the specified indexer and
@@ -66,6 +68,26 @@ func NewV2(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu
 	}, nil
 }
 
+// NewV2Tier returns a vfs.VFS with the layout v2, for the storage tier with
+// the given name: it uses the connection of the tier, and the containers of the
+// instance are specific to this tier.
+func NewV2Tier(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, c *swift.Connection, tier string) (vfs.VFS, error) {
+	container := swiftTierContainerPrefixCozy + tier + "-" + db.DBPrefix()
+	return &swiftVFSV2{
+		Indexer:         index,
+		DiskThresholder: disk,
+
+		c:             c,
+		domain:        db.DomainName(),
+		prefix:        db.DBPrefix(),
+		container:     container,
+		version:       container + versionSuffix,
+		dataContainer: swiftTierContainerPrefixData + tier + "-" + db.DBPrefix(),
+		mu:            mu,
+		log:           logger.WithDomain(db.DomainName()).WithField("nspace", "vfsswift"),
+	}, nil
+}
+
 // MakeObjectName build the swift object name for a given file document. It
 // creates a virtual subfolder by splitting the document ID, which should be 32
 // bytes long, on the 27nth byte. This avoid having a flat hierarchy in swift with no bound
@@ -187,6 +209,14 @@ func (sfs *swiftVFSV2) deleteContainer(container string) error {
 	return sfs.c.ContainerDelete(container)
 }
 
+// Capabilities implements the vfs.Fs interface.
+func (sfs *swiftVFSV2) Capabilities() vfs.Capabilities {
+	return vfs.Capabilities{
+		Backend:    config.SchemeSwift,
+		RangeReads: true,
+	}
+}
+
 func (sfs *swiftVFSV2) CreateDir(doc *vfs.DirDoc) error {
 	if lockerr := sfs.mu.Lock(); lockerr != nil {
 		return lockerr
@@ -199,6 +229,12 @@ func (sfs *swiftVFSV2) CreateDir(doc *vfs.DirDoc) error {
 	if exists {
 		return os.ErrExist
 	}
+	if err = vfs.CheckParentNotInTrash(sfs.Indexer, doc); err != nil {
+		return err
+	}
+	if err = vfs.InheritDirDefaults(sfs.Indexer, doc); err != nil {
+		return err
+	}
 	if doc.ID() == "" {
 		return sfs.Indexer.CreateDirDoc(doc)
 	}
@@ -241,13 +277,16 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 		newdoc.SetID(olddoc.ID())
 		newdoc.SetRev(olddoc.Rev())
 		newdoc.CreatedAt = olddoc.CreatedAt
+		if newdoc.ReferencedBy == nil {
+			newdoc.ReferencedBy = olddoc.ReferencedBy
+		}
 	}
 
 	newpath, err := sfs.Indexer.FilePath(newdoc)
 	if err != nil {
 		return nil, err
 	}
-	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+	if !newdoc.AllowInTrash && strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
 		return nil, vfs.ErrParentInTrash
 	}
 
@@ -266,6 +305,10 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 			return nil, os.ErrExist
 		}
 
+		if err = vfs.InheritFileDefaults(sfs.Indexer, newdoc); err != nil {
+			return nil, err
+		}
+
 		// When added to the index, the document is first considered hidden. This
 		// flag will only be removed at the end of the upload when all its metadata
 		// are known. See the Close() method.
@@ -305,7 +348,7 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 		w:       0,
 		size:    newsize,
 		name:    objName,
-		meta:    vfs.NewMetaExtractor(newdoc),
+		sniffer: vfs.NewContentSniffer(newdoc, olddoc),
 		newdoc:  newdoc,
 		olddoc:  olddoc,
 		maxsize: maxsize,
@@ -332,7 +375,7 @@ func (sfs *swiftVFSV2) DestroyDirContent(doc *vfs.DirDoc) error {
 	if err == swift.Forbidden {
 		err = nil
 		for _, objName := range objNames {
-			if errd := sfs.c.ObjectDelete(sfs.container, objName); err == nil {
+			if errd := sfs.c.ObjectDelete(sfs.container, objName); err == nil && errd != swift.ObjectNotFound {
 				err = errd
 			}
 		}
@@ -359,7 +402,7 @@ func (sfs *swiftVFSV2) DestroyDirAndContent(doc *vfs.DirDoc) error {
 	if err == swift.Forbidden {
 		err = nil
 		for _, objName := range objNames {
-			if errd := sfs.c.ObjectDelete(sfs.container, objName); err == nil {
+			if errd := sfs.c.ObjectDelete(sfs.container, objName); err == nil && errd != swift.ObjectNotFound {
 				err = errd
 			}
 		}
@@ -376,6 +419,9 @@ func (sfs *swiftVFSV2) DestroyFile(doc *vfs.FileDoc) error {
 	err := sfs.Indexer.DeleteFileDoc(doc)
 	if err == nil {
 		err = sfs.c.ObjectDelete(sfs.container, MakeObjectName(doc.DocID))
+		if err == swift.ObjectNotFound {
+			err = nil
+		}
 	}
 	if err == nil {
 		vfs.DiskQuotaAfterDestroy(sfs, diskUsage, doc.ByteSize)
@@ -383,6 +429,27 @@ func (sfs *swiftVFSV2) DestroyFile(doc *vfs.FileDoc) error {
 	return err
 }
 
+// Ping implements the vfs.Pinger interface, with a HEAD on the container.
+func (sfs *swiftVFSV2) Ping() error {
+	_, _, err := sfs.c.Container(sfs.container)
+	return err
+}
+
+func (sfs *swiftVFSV2) BackendStat(doc *vfs.FileDoc) (int64, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return 0, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	info, _, err := sfs.c.Object(sfs.container, MakeObjectName(doc.DocID))
+	if err == swift.ObjectNotFound {
+		return 0, os.ErrNotExist
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Bytes, nil
+}
+
 func (sfs *swiftVFSV2) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if lockerr := sfs.mu.RLock(); lockerr != nil {
 		return nil, lockerr
@@ -553,7 +620,7 @@ func (sfs *swiftVFSV2) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
 			return err
 		}
 		if exists {
-			return os.ErrExist
+			return vfs.ErrConflict
 		}
 	}
 	return sfs.Indexer.UpdateFileDoc(olddoc, newdoc)
@@ -570,13 +637,18 @@ func (sfs *swiftVFSV2) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
 		return lockerr
 	}
 	defer sfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID {
+		if err := vfs.CheckNoCycle(sfs.Indexer, olddoc, newdoc.DirID); err != nil {
+			return err
+		}
+	}
 	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
 		exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
 		if err != nil {
 			return err
 		}
 		if exists {
-			return os.ErrExist
+			return vfs.ErrConflict
 		}
 	}
 	return sfs.Indexer.UpdateDirDoc(olddoc, newdoc)
@@ -645,7 +717,7 @@ type swiftFileCreationV2 struct {
 	fs      *swiftVFSV2
 	name    string
 	err     error
-	meta    *vfs.MetaExtractor
+	sniffer *vfs.ContentSniffer
 	newdoc  *vfs.FileDoc
 	olddoc  *vfs.FileDoc
 	maxsize int64
@@ -665,14 +737,8 @@ func (f *swiftFileCreationV2) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *swiftFileCreationV2) Write(p []byte) (int, error) {
-	if f.meta != nil {
-		if _, err := (*f.meta).Write(p); err != nil && err != io.ErrClosedPipe {
-			(*f.meta).Abort(err)
-			f.meta = nil
-		}
-	}
-
 	n, err := f.f.Write(p)
+	f.sniffer.Write(p[:n]) // #nosec
 	if err != nil {
 		f.err = err
 		return n, err
@@ -716,10 +782,7 @@ func (f *swiftFileCreationV2) Close() (err error) {
 		if err == swift.ObjectCorrupted {
 			err = vfs.ErrInvalidHash
 		}
-		if f.meta != nil {
-			(*f.meta).Abort(err)
-			f.meta = nil
-		}
+		f.sniffer.Abort(err)
 		if f.err == nil {
 			f.err = err
 		}
@@ -730,11 +793,7 @@ func (f *swiftFileCreationV2) Close() (err error) {
 		olddoc = newdoc.Clone().(*vfs.FileDoc)
 	}
 
-	if f.meta != nil {
-		if errc := (*f.meta).Close(); errc == nil {
-			newdoc.Metadata = (*f.meta).Result()
-		}
-	}
+	f.sniffer.Close() // #nosec
 
 	if f.err != nil {
 		return f.err
@@ -772,6 +831,13 @@ func (f *swiftFileCreationV2) Close() (err error) {
 		return vfs.ErrContentLengthMismatch
 	}
 
+	// The type of a new file without an explicit type is detected from its
+	// content. And when overwriting a file, the new content may have another
+	// type than the old one: the type and the metadata derived from the content
+	// are refreshed instead of keeping the stale ones (except if the metadata
+	// have been given and are trusted).
+	f.sniffer.Update(newdoc)
+
 	// The document is already added to the index when closing the file creation
 	// handler. When updating the content of the document with the final
 	// informations (size, md5, ...) we can reuse the same document as olddoc.
@@ -874,7 +940,9 @@ func objectToFileDocV2(c *swift.Connection, container string, object swift.Objec
 }
 
 var (
-	_ vfs.VFS  = &swiftVFSV2{}
-	_ vfs.File = &swiftFileCreationV2{}
-	_ vfs.File = &swiftFileOpenV2{}
+	_ vfs.VFS           = &swiftVFSV2{}
+	_ vfs.BackendStater = &swiftVFSV2{}
+	_ vfs.Pinger        = &swiftVFSV2{}
+	_ vfs.File          = &swiftFileCreationV2{}
+	_ vfs.File          = &swiftFileOpenV2{}
 )
@@ -0,0 +1,273 @@
+// Package vfstiered is for storing the files of an instance in several
+// storage backends, the tiers: for example, the hot files on a fast local disk
+// and the large or cold ones on Swift.
+//
+// The primary VFS holds the directories and the files matched by no rule. The
+// tiers must store the content of the files by their identifiers (like the
+// layout v2 of Swift), as they are not aware of the directories: moving or
+// renaming a directory is only done by the primary VFS. The tier of a file is
+// chosen when it is created, and recorded in the Backend field of its
+// document, so that the following operations go to the same tier.
+package vfstiered
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// ErrUnknownTier is used when a file document references a tier that is not
+// configured.
+var ErrUnknownTier = errors.New("vfstiered: unknown tier")
+
+// Rule chooses the tier of the new files: a file goes to the tier if its size
+// is at least MinSize (when greater than zero), or if it is in one of the
+// directories Dirs, or if it has one of the classes Classes.
+type Rule struct {
+	Tier    string
+	MinSize int64
+	Dirs    []string
+	Classes []string
+}
+
+// match returns true if the file, in the directory with the given path,
+// matches the rule.
+func (r *Rule) match(doc *vfs.FileDoc, dirPath string) bool {
+	if r.MinSize > 0 && doc.ByteSize >= r.MinSize {
+		return true
+	}
+	for _, dir := range r.Dirs {
+		dir = strings.TrimSuffix(dir, "/")
+		if dirPath == dir || strings.HasPrefix(dirPath, dir+"/") {
+			return true
+		}
+	}
+	for _, class := range r.Classes {
+		if doc.Class == class {
+			return true
+		}
+	}
+	return false
+}
+
+type tieredVFS struct {
+	vfs.VFS
+	tiers map[string]vfs.VFS
+	rules []Rule
+}
+
+// New returns a vfs.VFS that stores the files in the primary VFS, or in one of
+// the tiers, chosen with the first matching rule.
+func New(primary vfs.VFS, tiers map[string]vfs.VFS, rules []Rule) (vfs.VFS, error) {
+	for _, rule := range rules {
+		if _, ok := tiers[rule.Tier]; !ok || rule.Tier == "" {
+			return nil, fmt.Errorf("vfstiered: no tier %q for the rule", rule.Tier)
+		}
+	}
+	return &tieredVFS{
+		VFS:   primary,
+		tiers: tiers,
+		rules: rules,
+	}, nil
+}
+
+// backend returns the VFS where the content of the file is stored.
+func (tfs *tieredVFS) backend(doc *vfs.FileDoc) (vfs.VFS, error) {
+	if doc.Backend == "" {
+		return tfs.VFS, nil
+	}
+	if tier, ok := tfs.tiers[doc.Backend]; ok {
+		return tier, nil
+	}
+	return nil, ErrUnknownTier
+}
+
+// chooseTier returns the name of the tier for a new file, or "" for the
+// primary VFS.
+func (tfs *tieredVFS) chooseTier(doc *vfs.FileDoc) (string, error) {
+	if len(tfs.rules) == 0 {
+		return "", nil
+	}
+	parent, err := tfs.VFS.DirByID(doc.DirID)
+	if err != nil {
+		return "", err
+	}
+	for _, rule := range tfs.rules {
+		if rule.match(doc, parent.Fullpath) {
+			return rule.Tier, nil
+		}
+	}
+	return "", nil
+}
+
+func (tfs *tieredVFS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
+	tiers := make(map[string]vfs.VFS, len(tfs.tiers))
+	for name, tier := range tfs.tiers {
+		tiers[name] = tier.UseSharingIndexer(index)
+	}
+	return &tieredVFS{
+		VFS:   tfs.VFS.UseSharingIndexer(index),
+		tiers: tiers,
+		rules: tfs.rules,
+	}
+}
+
+func (tfs *tieredVFS) InitFs() error {
+	if err := tfs.VFS.InitFs(); err != nil {
+		return err
+	}
+	for _, tier := range tfs.tiers {
+		if err := tier.InitFs(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tfs *tieredVFS) Delete() error {
+	for _, tier := range tfs.tiers {
+		if err := tier.Delete(); err != nil {
+			return err
+		}
+	}
+	return tfs.VFS.Delete()
+}
+
+// CreateFile stores a new file in the tier chosen by the rules. The content of
+// an existing file stays in its tier when it is overwritten.
+func (tfs *tieredVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
+	if olddoc != nil {
+		newdoc.Backend = olddoc.Backend
+	} else {
+		tier, err := tfs.chooseTier(newdoc)
+		if err != nil {
+			return nil, err
+		}
+		newdoc.Backend = tier
+	}
+	backend, err := tfs.backend(newdoc)
+	if err != nil {
+		return nil, err
+	}
+	return backend.CreateFile(newdoc, olddoc)
+}
+
+func (tfs *tieredVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
+	backend, err := tfs.backend(doc)
+	if err != nil {
+		return nil, err
+	}
+	return backend.OpenFile(doc)
+}
+
+func (tfs *tieredVFS) DestroyFile(doc *vfs.FileDoc) error {
+	backend, err := tfs.backend(doc)
+	if err != nil {
+		return err
+	}
+	return backend.DestroyFile(doc)
+}
+
+func (tfs *tieredVFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
+	newdoc.Backend = olddoc.Backend
+	backend, err := tfs.backend(olddoc)
+	if err != nil {
+		return err
+	}
+	return backend.UpdateFileDoc(olddoc, newdoc)
+}
+
+// DestroyDirContent destroys the files of the directory stored in the tiers,
+// and then lets the primary VFS destroy the rest.
+func (tfs *tieredVFS) DestroyDirContent(doc *vfs.DirDoc) error {
+	if err := tfs.destroyTieredFiles(doc); err != nil {
+		return err
+	}
+	return tfs.VFS.DestroyDirContent(doc)
+}
+
+func (tfs *tieredVFS) DestroyDirAndContent(doc *vfs.DirDoc) error {
+	if err := tfs.destroyTieredFiles(doc); err != nil {
+		return err
+	}
+	return tfs.VFS.DestroyDirAndContent(doc)
+}
+
+func (tfs *tieredVFS) destroyTieredFiles(doc *vfs.DirDoc) error {
+	var files []*vfs.FileDoc
+	err := vfs.Walk(tfs.VFS, doc.Fullpath, func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file != nil && file.Backend != "" {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = tfs.DestroyFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fsck checks the primary VFS and the tiers: each of them only reports the
+// inconsistencies for the files that it stores. The inconsistencies are not
+// pruned, as a VFS would see the files of the other tiers as missing.
+func (tfs *tieredVFS) Fsck(opts vfs.FsckOptions) ([]*vfs.FsckLog, error) {
+	opts.Prune = false
+	logbook, err := tfs.fsckBackend(tfs.VFS, "", opts)
+	if err != nil {
+		return nil, err
+	}
+	for name, tier := range tfs.tiers {
+		logs, errf := tfs.fsckBackend(tier, name, opts)
+		if errf != nil {
+			return nil, errf
+		}
+		logbook = append(logbook, logs...)
+	}
+	return logbook, nil
+}
+
+func (tfs *tieredVFS) fsckBackend(backend vfs.VFS, name string, opts vfs.FsckOptions) ([]*vfs.FsckLog, error) {
+	logs, err := backend.Fsck(opts)
+	if err != nil {
+		return nil, err
+	}
+	var kept []*vfs.FsckLog
+	for _, log := range logs {
+		if log.FileDoc != nil && log.Type != vfs.IndexMissing && log.FileDoc.Backend != name {
+			continue
+		}
+		// The directories and the index are checked by the primary VFS.
+		if name != "" && log.Type != vfs.FileMissing && log.Type != vfs.IndexMissing &&
+			log.Type != vfs.ContentMismatch {
+			continue
+		}
+		kept = append(kept, log)
+	}
+	return kept, nil
+}
+
+// Capabilities returns the backend of the primary VFS, with only the features
+// supported by all the tiers, as a file can be stored on any of them.
+func (tfs *tieredVFS) Capabilities() vfs.Capabilities {
+	caps := tfs.VFS.Capabilities()
+	for _, tier := range tfs.tiers {
+		c := tier.Capabilities()
+		caps.StatFS = caps.StatFS && c.StatFS
+		caps.Symlinks = caps.Symlinks && c.Symlinks
+		caps.AtomicRename = caps.AtomicRename && c.AtomicRename
+		caps.RangeReads = caps.RangeReads && c.RangeReads
+	}
+	return caps
+}
+
+var _ vfs.VFS = &tieredVFS{}
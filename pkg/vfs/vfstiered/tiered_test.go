@@ -0,0 +1,44 @@
+package vfstiered
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleMatch(t *testing.T) {
+	rule := &Rule{
+		Tier:    "cold",
+		MinSize: 1000,
+		Dirs:    []string{"/Backups/"},
+		Classes: []string{"video"},
+	}
+	assert.True(t, rule.match(&vfs.FileDoc{ByteSize: 1000}, "/"))
+	assert.False(t, rule.match(&vfs.FileDoc{ByteSize: 999}, "/"))
+	assert.False(t, rule.match(&vfs.FileDoc{ByteSize: -1}, "/"))
+	assert.True(t, rule.match(&vfs.FileDoc{}, "/Backups"))
+	assert.True(t, rule.match(&vfs.FileDoc{}, "/Backups/2018/phone"))
+	assert.False(t, rule.match(&vfs.FileDoc{}, "/Backups-old"))
+	assert.True(t, rule.match(&vfs.FileDoc{Class: "video"}, "/Videos"))
+	assert.False(t, rule.match(&vfs.FileDoc{Class: "image"}, "/Photos"))
+
+	assert.False(t, (&Rule{Tier: "cold"}).match(&vfs.FileDoc{ByteSize: 1 << 30}, "/"))
+}
+
+func TestNewChecksTheTiersOfTheRules(t *testing.T) {
+	tiers := map[string]vfs.VFS{"cold": nil}
+	_, err := New(nil, tiers, []Rule{{Tier: "cold", MinSize: 1}})
+	assert.NoError(t, err)
+	_, err = New(nil, tiers, []Rule{{Tier: "hot", MinSize: 1}})
+	assert.Error(t, err)
+	_, err = New(nil, tiers, []Rule{{MinSize: 1}})
+	assert.Error(t, err)
+
+	tfs := &tieredVFS{tiers: tiers}
+	backend, err := tfs.backend(&vfs.FileDoc{Backend: "cold"})
+	assert.NoError(t, err)
+	assert.Nil(t, backend)
+	_, err = tfs.backend(&vfs.FileDoc{Backend: "unknown"})
+	assert.Equal(t, ErrUnknownTier, err)
+}
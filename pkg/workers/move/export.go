@@ -729,6 +729,7 @@ func writeInstanceDoc(in *instance.Instance, name string,
 	clone.OAuthSecret = nil
 	clone.CLISecret = nil
 	clone.SwiftCluster = 0
+	clone.AferoLayout = ""
 	return writeDoc("", name, clone, now, tw)
 }
 
@@ -0,0 +1,229 @@
+package push
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/go-redis/redis"
+)
+
+// aggregateTTL is added to the window for the expiration of an aggregate, so
+// that it does not stay forever if the job that must flush it is lost.
+const aggregateTTL = time.Minute
+
+// defaultAggregationSummary is the format of the summary of the aggregated
+// notifications, when it is not configured.
+const defaultAggregationSummary = "%d new notifications"
+
+// aggregateKey identifies the messages that can be aggregated: they are for
+// the same device and have the same collapse key.
+type aggregateKey struct {
+	domain      string
+	deviceID    string
+	collapseKey string
+}
+
+func (k aggregateKey) String() string {
+	return k.domain + "/push-aggregate/" + k.deviceID + "/" + k.collapseKey
+}
+
+// aggregateStore keeps the last message for an aggregate key, and the number
+// of messages that have been received for it during the window. It is shared
+// by all the processes of the stack through redis, when the locks are in
+// redis, and else it is local to the process.
+type aggregateStore interface {
+	// add records the message, and returns true if it is the first one for
+	// the key.
+	add(key string, msg []byte, ttl time.Duration) (bool, error)
+	// flush removes the aggregate, and returns its last message (nil if there
+	// is no aggregate) and its count.
+	flush(key string) ([]byte, int, error)
+}
+
+var (
+	aggregatesMu sync.Mutex
+	aggregates   aggregateStore
+)
+
+// getAggregateStore returns the store of the aggregates, in redis if the
+// locks are in redis.
+func getAggregateStore() aggregateStore {
+	aggregatesMu.Lock()
+	defer aggregatesMu.Unlock()
+	if aggregates != nil {
+		return aggregates
+	}
+	if cli := config.GetConfig().Lock.Client(); cli != nil {
+		aggregates = &redisAggregateStore{cli}
+	} else {
+		aggregates = &memAggregateStore{aggs: make(map[string]*memAggregate)}
+	}
+	return aggregates
+}
+
+type memAggregate struct {
+	msg     []byte
+	count   int
+	expires time.Time
+}
+
+type memAggregateStore struct {
+	mu   sync.Mutex
+	aggs map[string]*memAggregate
+}
+
+func (s *memAggregateStore) add(key string, msg []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, agg := range s.aggs {
+		if now.After(agg.expires) {
+			delete(s.aggs, k)
+		}
+	}
+	if agg, ok := s.aggs[key]; ok {
+		agg.msg = msg
+		agg.count++
+		return false, nil
+	}
+	s.aggs[key] = &memAggregate{msg: msg, count: 1, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *memAggregateStore) flush(key string) ([]byte, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	agg, ok := s.aggs[key]
+	if !ok {
+		return nil, 0, nil
+	}
+	delete(s.aggs, key)
+	return agg.msg, agg.count, nil
+}
+
+// redisAggregateStore keeps an aggregate in a hash, with the fields msg and
+// count, that expires after the ttl given for the first message.
+type redisAggregateStore struct {
+	c redis.UniversalClient
+}
+
+const luaAddToAggregate = `local n = redis.call("HINCRBY", KEYS[1], "count", 1)
+redis.call("HSET", KEYS[1], "msg", ARGV[1])
+if n == 1 then redis.call("PEXPIRE", KEYS[1], ARGV[2]) end
+return n`
+
+const luaFlushAggregate = `local v = redis.call("HMGET", KEYS[1], "msg", "count")
+redis.call("DEL", KEYS[1])
+return v`
+
+func (s *redisAggregateStore) add(key string, msg []byte, ttl time.Duration) (bool, error) {
+	ms := int64(ttl / time.Millisecond)
+	n, err := s.c.Eval(luaAddToAggregate, []string{key}, msg, ms).Int64()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *redisAggregateStore) flush(key string) ([]byte, int, error) {
+	res, err := s.c.Eval(luaFlushAggregate, []string{key}).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return nil, 0, nil
+	}
+	msg, ok := values[0].(string)
+	if !ok {
+		return nil, 0, nil
+	}
+	count, _ := values[1].(string)
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, 0, err
+	}
+	return []byte(msg), n, nil
+}
+
+// aggregationWindow returns the configured duration during which the
+// collapsible messages are aggregated, or 0 if the aggregation is disabled.
+func aggregationWindow() time.Duration {
+	return config.GetConfig().Notifications.AggregationWindow
+}
+
+// aggregationSummary returns the format used for the summary text of the
+// aggregated messages.
+func aggregationSummary() string {
+	if summary := config.GetConfig().Notifications.AggregationSummary; summary != "" {
+		return summary
+	}
+	return defaultAggregationSummary
+}
+
+// newAggregateKey returns the key for aggregating the message for a device,
+// and false if the message is not collapsible.
+func newAggregateKey(domain, deviceID string, msg *Message) (aggregateKey, bool) {
+	hashed, collapsible := collapseKey(msg)
+	return aggregateKey{
+		domain:      domain,
+		deviceID:    deviceID,
+		collapseKey: hex.EncodeToString(hashed),
+	}, collapsible
+}
+
+// addToAggregate records the message for the key. It returns true if there
+// was no aggregate for this key: the caller is then responsible for sending
+// the aggregated message at the end of the window, with scheduleFlush.
+func addToAggregate(key aggregateKey, msg *Message, window time.Duration) (bool, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	return getAggregateStore().add(key.String(), data, window+aggregateTTL)
+}
+
+// flushAggregate removes the aggregate for the key and returns the message to
+// send: the last one received, with the number of aggregated messages. It
+// returns nil if there is no aggregate for the key.
+func flushAggregate(key aggregateKey) (*Message, error) {
+	data, count, err := getAggregateStore().flush(key.String())
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var msg Message
+	if err = json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	if count > 1 {
+		msg.Count = count
+	}
+	return &msg, nil
+}
+
+// scheduleFlush adds a trigger for a push job at the end of the window, that
+// sends the aggregated message to the device. The message of this job has
+// only the fields needed for computing the aggregate key.
+func scheduleFlush(inst *instance.Instance, deviceID string, msg *Message, window time.Duration) error {
+	t, err := jobs.NewTrigger(inst, jobs.TriggerInfos{
+		Type:       "@in",
+		WorkerType: "push",
+		Arguments:  window.String(),
+	}, &Message{
+		NotificationID:  msg.NotificationID,
+		Source:          msg.Source,
+		Collapsible:     msg.Collapsible,
+		CollapseKey:     msg.CollapseKey,
+		AggregateDevice: deviceID,
+	})
+	if err != nil {
+		return err
+	}
+	return jobs.System().AddTrigger(t)
+}
@@ -0,0 +1,64 @@
+package push
+
+import (
+	"github.com/cozy/cozy-stack/pkg/instance"
+)
+
+// Branding is the default appearance of the notifications of an instance. It
+// is used for the messages that do not specify their own sound, icons or
+// category.
+type Branding struct {
+	Sound     string
+	SmallIcon string
+	LargeIcon string
+	Category  string
+}
+
+// Fields used by phonegap-plugin-push for the icons of the android
+// notifications.
+const (
+	smallIconDataKey = "icon"
+	largeIconDataKey = "image"
+)
+
+// instanceBranding returns the branding of the notifications, as defined by
+// the notifications_branding field of the settings of the instance.
+func instanceBranding(inst *instance.Instance) Branding {
+	var b Branding
+	settings, err := inst.SettingsDocument()
+	if err != nil {
+		return b
+	}
+	m, ok := settings.M["notifications_branding"].(map[string]interface{})
+	if !ok {
+		return b
+	}
+	b.Sound, _ = m["sound"].(string)
+	b.SmallIcon, _ = m["small_icon"].(string)
+	b.LargeIcon, _ = m["large_icon"].(string)
+	b.Category, _ = m["category"].(string)
+	return b
+}
+
+// apply merges the branding into the message. The values explicitly given in
+// the message are kept.
+func (b Branding) apply(msg *Message) {
+	if msg.Sound == "" {
+		msg.Sound = b.Sound
+	}
+	if msg.Category == "" {
+		msg.Category = b.Category
+	}
+	if b.SmallIcon == "" && b.LargeIcon == "" {
+		return
+	}
+	if msg.Data == nil {
+		msg.Data = make(map[string]interface{})
+	}
+	if _, ok := msg.Data[smallIconDataKey]; !ok && b.SmallIcon != "" {
+		msg.Data[smallIconDataKey] = b.SmallIcon
+	}
+	if _, ok := msg.Data[largeIconDataKey]; !ok && b.LargeIcon != "" {
+		msg.Data[largeIconDataKey] = b.LargeIcon
+	}
+}
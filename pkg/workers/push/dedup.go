@@ -0,0 +1,88 @@
+package push
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/go-redis/redis"
+)
+
+// dedupStore remembers the dedup keys of the messages sent to the devices
+// during the window. It is shared by all the processes of the stack through
+// redis, when the locks are in redis, and else it is local to the process.
+type dedupStore interface {
+	// mark records the key, and returns false if it has already been marked
+	// less than window ago.
+	mark(key string, now time.Time, window time.Duration) (bool, error)
+}
+
+var (
+	dedupsMu sync.Mutex
+	dedups   dedupStore
+)
+
+// getDedupStore returns the store of the dedup keys, in redis if the locks
+// are in redis.
+func getDedupStore() dedupStore {
+	dedupsMu.Lock()
+	defer dedupsMu.Unlock()
+	if dedups != nil {
+		return dedups
+	}
+	if cli := config.GetConfig().Lock.Client(); cli != nil {
+		dedups = &redisDedupStore{cli}
+	} else {
+		dedups = &memDedupStore{keys: make(map[string]time.Time)}
+	}
+	return dedups
+}
+
+type memDedupStore struct {
+	mu   sync.Mutex
+	keys map[string]time.Time
+}
+
+func (s *memDedupStore) mark(key string, now time.Time, window time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, at := range s.keys {
+		if now.Sub(at) >= window {
+			delete(s.keys, k)
+		}
+	}
+	if _, ok := s.keys[key]; ok {
+		return false, nil
+	}
+	s.keys[key] = now
+	return true, nil
+}
+
+// redisDedupStore sets a key that expires at the end of the window for each
+// message sent, only if it does not exist yet.
+type redisDedupStore struct {
+	c redis.UniversalClient
+}
+
+func (s *redisDedupStore) mark(key string, now time.Time, window time.Duration) (bool, error) {
+	return s.c.SetNX(key, "1", window).Result()
+}
+
+// dedupWindow returns the configured duration during which the messages with
+// the same dedup key are sent only once to a device, or 0 if the
+// deduplication is disabled.
+func dedupWindow() time.Duration {
+	return config.GetConfig().Notifications.DedupWindow
+}
+
+// markDedup records that the message is sent to the device, and returns false
+// if a message with the same dedup key has already been sent to it less than
+// window ago: the message must then be suppressed. The messages without a
+// dedup key and the cancel messages are never suppressed.
+func markDedup(domain, deviceID string, msg *Message, now time.Time, window time.Duration) (bool, error) {
+	if window <= 0 || msg.DedupKey == "" || msg.Cancel {
+		return true, nil
+	}
+	key := domain + "/push-dedup/" + deviceID + "/" + msg.DedupKey
+	return getDedupStore().mark(key, now, window)
+}
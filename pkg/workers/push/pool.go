@@ -0,0 +1,60 @@
+package push
+
+import (
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+)
+
+// defaultConcurrency is the number of notifications sent concurrently to a
+// provider, if not configured.
+const defaultConcurrency = 16
+
+// sendPool bounds the number of notifications sent concurrently to a
+// provider, for all the push jobs of the process. A job waits for a free slot
+// before starting a send, so that a burst of jobs does not open thousands of
+// concurrent requests. A nil pool does not bound the sends.
+type sendPool struct {
+	slots chan struct{}
+}
+
+func newSendPool(size int) *sendPool {
+	if size <= 0 {
+		size = defaultConcurrency
+	}
+	return &sendPool{slots: make(chan struct{}, size)}
+}
+
+// acquire waits for a free slot, and returns false if the job is done before.
+func (p *sendPool) acquire(ctx *jobs.WorkerContext) bool {
+	if p == nil {
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *sendPool) release() {
+	if p != nil {
+		<-p.slots
+	}
+}
+
+// newSendPools creates the pools of the providers, from the configuration.
+func (pc *pushClients) newSendPools() {
+	conf := config.GetConfig().Notifications
+	pc.apnsPool = newSendPool(conf.APNSConcurrency)
+	pc.fcmPool = newSendPool(conf.FCMConcurrency)
+}
+
+// pool returns the pool of the provider of the platform.
+func (pc *pushClients) pool(platform string) *sendPool {
+	if platform == oauth.PlatformAPNS {
+		return pc.apnsPool
+	}
+	return pc.fcmPool
+}
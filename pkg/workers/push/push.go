@@ -8,8 +8,15 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
+	"net/http"
+	"net/url"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -26,11 +33,44 @@ import (
 	apns_token "github.com/sideshow/apns2/token"
 )
 
+// pushClients are the clients of the providers, built by Init from the
+// configuration. They are replaced as a whole when Init is called again, and
+// the sends in progress keep the clients they have started with.
+type pushClients struct {
+	fcm *fcm.Client
+
+	// The iOS devices can declare the APNS environment of their application,
+	// else the environment of the configuration is used.
+	iosSandbox     *apns.Client
+	iosProduction  *apns.Client
+	iosDevelopment bool
+
+	// The pools bound the concurrent sends to each provider. They are
+	// replaced with the clients when the configuration is reloaded, and the
+	// sends in progress release their slot to the old pool.
+	apnsPool *sendPool
+	fcmPool  *sendPool
+}
+
 var (
-	fcmClient *fcm.Client
-	iosClient *apns.Client
+	clientsMu sync.RWMutex
+	clients   = &pushClients{}
 )
 
+// getClients returns the current clients of the providers. They must not be
+// modified.
+func getClients() *pushClients {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+	return clients
+}
+
+func setClients(c *pushClients) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	clients = c
+}
+
 func init() {
 	jobs.AddWorker(&jobs.WorkerConfig{
 		WorkerType:   "push",
@@ -42,25 +82,132 @@ func init() {
 	})
 }
 
+var (
+	// ErrInvalidSlug is used when the slug of the application targeted by a
+	// message is not valid.
+	ErrInvalidSlug = errors.New("notifications: invalid slug")
+	// ErrInvalidDeepLink is used when the deep link of a message is neither an
+	// absolute URL nor a path.
+	ErrInvalidDeepLink = errors.New("notifications: invalid deep link")
+	// ErrCancelWithoutCollapseKey is used when a cancel message has no collapse
+	// key to identify the notification it replaces.
+	ErrCancelWithoutCollapseKey = errors.New("notifications: a cancel message needs a collapse key")
+)
+
+// slugReg is the format of the slugs of the applications.
+var slugReg = regexp.MustCompile(`^[a-z0-9\-]+$`)
+
+// Keys used in the payloads of the mobile notifications for the application
+// targeted by a message: in the data for FCM, and as custom keys for APNS.
+const (
+	slugPayloadKey     = "slug"
+	deepLinkPayloadKey = "deep_link"
+	cancelPayloadKey   = "cancel"
+)
+
+// PrioritySilent is the priority of the messages that are delivered to the
+// applications without any visible alert, to trigger a background sync for
+// example.
+const PrioritySilent = "silent"
+
 // Message contains a push notification request.
 type Message struct {
 	NotificationID string `json:"notification_id"`
 	Source         string `json:"source"`
 	Title          string `json:"title,omitempty"`
+	Subtitle       string `json:"subtitle,omitempty"`
 	Message        string `json:"message,omitempty"`
 	Priority       string `json:"priority,omitempty"`
 	Sound          string `json:"sound,omitempty"`
+	Category       string `json:"category,omitempty"`
 	Collapsible    bool   `json:"collapsible,omitempty"`
+	CollapseKey    string `json:"collapse_key,omitempty"`
+
+	// SoundName, SoundCritical and SoundVolume describe a critical alert on
+	// iOS, played at the given volume (between 0 and 1) even in Do Not
+	// Disturb mode. It needs the entitlement for the application, and Sound
+	// is used as the name when SoundName is empty.
+	SoundName     string  `json:"sound_name,omitempty"`
+	SoundCritical bool    `json:"sound_critical,omitempty"`
+	SoundVolume   float64 `json:"sound_volume,omitempty"`
+
+	// DedupKey identifies the event of the message, across the sources: a
+	// message is not sent to a device that has already received one with the
+	// same dedup key during the dedup window.
+	DedupKey string `json:"dedup_key,omitempty"`
+
+	// Count is the number of notifications that have been aggregated in this
+	// message, when it is greater than one.
+	Count int `json:"count,omitempty"`
+
+	// AggregateDevice is set for the job that sends the aggregated messages
+	// to this device at the end of the aggregation window.
+	AggregateDevice string `json:"aggregate_device,omitempty"`
+
+	// Slug is the application that should handle the notification on the
+	// device, and DeepLink the screen of this application to open on a tap.
+	Slug     string `json:"slug,omitempty"`
+	DeepLink string `json:"deep_link,omitempty"`
+
+	// Cancel is true for a message that replaces the previous notification
+	// with the same collapse key: with a title or a message, it is shown as
+	// the final state of the notification, and without them, it is sent as a
+	// data-only message so that the application can dismiss the notification.
+	Cancel bool `json:"cancel,omitempty"`
 
 	Data map[string]interface{} `json:"data,omitempty"`
 }
 
-// Init initializes the necessary global clients
+// validate checks the format of the application slug and deep link, and that
+// a cancel message has a collapse key.
+func (m *Message) validate() error {
+	if m.Cancel && m.CollapseKey == "" && !m.Collapsible {
+		return ErrCancelWithoutCollapseKey
+	}
+	if m.Slug != "" && !slugReg.MatchString(m.Slug) {
+		return ErrInvalidSlug
+	}
+	if m.DeepLink != "" {
+		u, err := url.Parse(m.DeepLink)
+		if err != nil || (u.Scheme == "" && !strings.HasPrefix(m.DeepLink, "/")) {
+			return ErrInvalidDeepLink
+		}
+	}
+	return nil
+}
+
+// clears returns true if the message cancels a notification without showing a
+// final state: it is sent without any visible alert.
+func (m *Message) clears() bool {
+	return m.Cancel && m.Title == "" && m.Message == ""
+}
+
+// target returns the payload fields for the application targeted by the
+// message.
+func (m *Message) target() map[string]string {
+	fields := make(map[string]string)
+	if m.Slug != "" {
+		fields[slugPayloadKey] = m.Slug
+	}
+	if m.DeepLink != "" {
+		fields[deepLinkPayloadKey] = m.DeepLink
+	}
+	return fields
+}
+
+// Init initializes the necessary global clients. It can be called again to
+// reload the configuration, concurrently with the sends: the clients are
+// replaced only if they have all been built.
 func Init() (err error) {
 	conf := config.GetConfig().Notifications
+	pc := &pushClients{}
+	pc.newSendPools()
 
 	if conf.AndroidAPIKey != "" {
-		fcmClient, err = fcm.NewClient(conf.AndroidAPIKey)
+		// The FCM client has no context, and its requests are bounded with
+		// the timeout of its http client.
+		pc.fcm, err = fcm.NewClient(conf.AndroidAPIKey,
+			fcm.WithHTTPClient(&http.Client{Timeout: sendTimeout()}))
 		if err != nil {
 			return
 		}
@@ -86,56 +233,177 @@ func Init() (err error) {
 			return err
 		}
 
-		if authKey != nil {
-			t := &apns_token.Token{
-				AuthKey: authKey,
-				KeyID:   conf.IOSKeyID,
-				TeamID:  conf.IOSTeamID,
+		newClient := func() *apns.Client {
+			if authKey != nil {
+				return apns.NewTokenClient(&apns_token.Token{
+					AuthKey: authKey,
+					KeyID:   conf.IOSKeyID,
+					TeamID:  conf.IOSTeamID,
+				})
 			}
-			iosClient = apns.NewTokenClient(t)
-		} else {
-			iosClient = apns.NewClient(certificateKey)
-		}
-		if conf.Development {
-			iosClient = iosClient.Development()
-		} else {
-			iosClient = iosClient.Production()
+			return apns.NewClient(certificateKey)
 		}
+		pc.iosSandbox = newClient().Development()
+		pc.iosProduction = newClient().Production()
+		pc.iosDevelopment = conf.Development
 	}
+	setClients(pc)
 	return
 }
 
+// apnsClient returns the APNS client for the environment declared by the
+// device, or for the environment of the configuration. A push sent to the
+// wrong environment is silently dropped by APNS.
+func apnsClient(c *oauth.Client) *apns.Client {
+	return getClients().apns(c)
+}
+
+func (pc *pushClients) apns(c *oauth.Client) *apns.Client {
+	switch c.NotificationEnvironment {
+	case oauth.EnvironmentSandbox:
+		return pc.iosSandbox
+	case oauth.EnvironmentProduction:
+		return pc.iosProduction
+	}
+	if pc.iosDevelopment {
+		return pc.iosSandbox
+	}
+	return pc.iosProduction
+}
+
 // Worker is the worker that just logs its message (useful for debugging)
 func Worker(ctx *jobs.WorkerContext) error {
 	var msg Message
 	if err := ctx.UnmarshalMessage(&msg); err != nil {
 		return err
 	}
-	inst, err := instance.Get(ctx.Domain())
-	if err != nil {
+	if err := msg.validate(); err != nil {
 		return err
 	}
-	cs, err := oauth.GetNotifiables(inst)
+	inst, err := instance.Get(ctx.Domain())
 	if err != nil {
 		return err
 	}
+
+	// When the aggregation is enabled, the collapsible messages for a device
+	// are not sent immediately: the first job schedules another job at the end
+	// of the window, that sends only the last message, with the number of
+	// messages received in the window. The other jobs just update the
+	// aggregate.
+	window := aggregationWindow()
+	dedup := dedupWindow()
+	var cs []*oauth.Client
+	if msg.AggregateDevice != "" {
+		key, _ := newAggregateKey(ctx.Domain(), msg.AggregateDevice, &msg)
+		flushed, err := flushAggregate(key)
+		if err != nil || flushed == nil {
+			return err
+		}
+		c, err := oauth.FindClient(inst, msg.AggregateDevice)
+		if err != nil {
+			return err
+		}
+		msg, cs = *flushed, []*oauth.Client{c}
+		window, dedup = 0, 0
+	} else {
+		transform(&msg)
+		instanceBranding(inst).apply(&msg)
+		if dropped := fitData(&msg); len(dropped) > 0 {
+			ctx.Logger().WithField("source", msg.Source).
+				Warnf("Keys %v of the data dropped to fit in the notification payload", dropped)
+		}
+		if cs, err = oauth.GetNotifiables(inst); err != nil {
+			return err
+		}
+	}
+	result := newResult()
+	// The message is sent to the devices concurrently, but each send waits for
+	// a free slot in the pool of its provider, shared by all the jobs.
+	var sends sync.WaitGroup
+	send := func(c *oauth.Client, msg *Message) {
+		pool := getClients().pool(c.NotificationPlatform)
+		if !pool.acquire(ctx) {
+			result.add(c.NotificationPlatform, c.ID(), ctx.Err())
+			return
+		}
+		sends.Add(1)
+		go func() {
+			defer sends.Done()
+			defer pool.release()
+			sendToDevice(ctx, c, msg, result)
+		}()
+	}
 	for _, c := range cs {
-		if c.NotificationDeviceToken != "" {
-			err = push(ctx, c, &msg)
-			if err != nil {
-				ctx.Logger().
-					WithFields(logrus.Fields{
-						"device_id":       c.ID(),
-						"device_platform": c.NotificationPlatform,
-					}).
-					Warnf("could not send notification on device: %s", err)
+		if c.NotificationDeviceToken == "" {
+			continue
+		}
+		fresh, err := markDedup(ctx.Domain(), c.ID(), &msg, time.Now(), dedup)
+		if err != nil {
+			// The message is sent, as a duplicate is better than a loss
+			ctx.Logger().WithField("device_id", c.ID()).
+				Warnf("Could not check the dedup key: %s", err)
+		} else if !fresh {
+			result.count(c.NotificationPlatform, func(p *PlatformResult) { p.Deduplicated++ })
+			ctx.Logger().
+				WithFields(logrus.Fields{
+					"device_id": c.ID(),
+					"source":    msg.Source,
+					"dedup_key": msg.DedupKey,
+				}).
+				Infof("Notification suppressed as a duplicate")
+			continue
+		}
+		if window > 0 {
+			if key, ok := newAggregateKey(ctx.Domain(), c.ID(), &msg); ok {
+				first, err := addToAggregate(key, &msg, window)
+				if err == nil && first {
+					err = scheduleFlush(inst, c.ID(), &msg, window)
+				}
+				if err == nil {
+					result.count(c.NotificationPlatform, func(p *PlatformResult) { p.Aggregated++ })
+					continue
+				}
+				// The message is sent now, with the aggregate if it can't be
+				// sent at the end of the window
+				ctx.Logger().WithField("device_id", c.ID()).
+					Warnf("Could not aggregate the notification: %s", err)
+				if first {
+					if flushed, errf := flushAggregate(key); errf == nil && flushed != nil {
+						send(c, flushed)
+						continue
+					}
+				}
 			}
 		}
+		send(c, &msg)
+	}
+
+	sends.Wait()
+	errSend := result.finish()
+	if err = ctx.SetResult(result); err != nil {
+		return err
+	}
+	return errSend
+}
+
+func sendToDevice(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message, result *Result) {
+	err := push(ctx, c, msg)
+	result.add(c.NotificationPlatform, c.ID(), err)
+	if err != nil && err != errNotConfigured {
+		ctx.Logger().
+			WithFields(logrus.Fields{
+				"device_id":       c.ID(),
+				"device_platform": c.NotificationPlatform,
+			}).
+			Warnf("could not send notification on device: %s", err)
 	}
-	return nil
 }
 
 func push(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) error {
+	if err := checkTokenPlatform(c.NotificationPlatform, c.NotificationDeviceToken); err != nil {
+		reportInvalidToken(ctx.Domain(), c.NotificationPlatform, c.ID(), err.Error())
+		return err
+	}
 	switch c.NotificationPlatform {
 	case oauth.PlatformFirebase, "android", "ios":
 		return pushToFirebase(ctx, c, msg)
@@ -149,22 +417,38 @@ func push(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) error {
 // Firebase Cloud Messaging HTTP Protocol
 // https://firebase.google.com/docs/cloud-messaging/http-server-ref
 func pushToFirebase(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) error {
-	if fcmClient == nil {
+	client := getClients().fcm
+	if client == nil {
 		ctx.Logger().Warn("Could not send android notification: not configured")
-		return nil
+		return errNotConfigured
 	}
 
+	notification := newFirebaseMessage(c, msg)
+	var err error
+	for attempt := 0; attempt < fcmMaxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff(fcmRetryDelay, attempt)):
+			case <-ctx.Done():
+				return err
+			}
+		}
+		err = sendToFirebase(ctx, client, c, notification)
+		if !isTransientFCMError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// newFirebaseMessage returns the message to send to Firebase for the device.
+func newFirebaseMessage(c *oauth.Client, msg *Message) *fcm.Message {
 	var priority string
-	if msg.Priority == "high" {
+	if msg.Priority == "high" || msg.Priority == PrioritySilent || msg.clears() {
 		priority = "high"
 	}
 
-	var hashedSource []byte
-	if msg.Collapsible {
-		hashedSource = hashSource(msg.Source)
-	} else {
-		hashedSource = hashSource(msg.Source + msg.NotificationID)
-	}
+	hashedSource, collapsible := collapseKey(msg)
 
 	// notID should be an integer, we take the first 32bits of the hashed source
 	// value.
@@ -173,31 +457,65 @@ func pushToFirebase(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) erro
 		notID = -notID
 	}
 
+	// The title and body are sent twice: in the notification and in the data
+	title, body := fitPayload(msg.Title, msg.Message,
+		textBudget(msg, fcmMaxPayloadSize, 2))
+
 	notification := &fcm.Message{
 		To:               c.NotificationDeviceToken,
 		Priority:         priority,
 		ContentAvailable: true,
 		Notification: &fcm.Notification{
 			Sound: msg.Sound,
-			Title: msg.Title,
-			Body:  msg.Message,
+			Title: title,
+			Body:  body,
 		},
 		Data: map[string]interface{}{
 			// Fields required by phonegap-plugin-push
 			// see: https://github.com/phonegap/phonegap-plugin-push/blob/master/docs/PAYLOAD.md#android-behaviour
 			"notId": notID,
-			"title": msg.Title,
-			"body":  msg.Message,
+			"title": title,
+			"body":  body,
 		},
 	}
-	if msg.Collapsible {
+	if msg.Subtitle != "" {
+		notification.Data["subtitle"] = msg.Subtitle
+	}
+	if msg.Category != "" {
+		notification.Data["category"] = msg.Category
+	}
+	if collapsible {
 		notification.CollapseKey = hex.EncodeToString(hashedSource)
 	}
+	if msg.Count > 1 {
+		notification.Notification.Badge = strconv.Itoa(msg.Count)
+		notification.Data["badge"] = msg.Count
+		notification.Data["summaryText"] = fmt.Sprintf(aggregationSummary(), msg.Count)
+	}
+	if msg.Priority == PrioritySilent || msg.clears() {
+		// A data-only message is not displayed by the device, and
+		// phonegap-plugin-push needs the content-available flag to wake up
+		// the application.
+		notification.Notification = nil
+		delete(notification.Data, "title")
+		delete(notification.Data, "subtitle")
+		delete(notification.Data, "body")
+		notification.Data["content-available"] = "1"
+	}
 	for k, v := range msg.Data {
 		notification.Data[k] = v
 	}
+	for k, v := range msg.target() {
+		notification.Data[k] = v
+	}
+	if msg.Cancel {
+		notification.Data[cancelPayloadKey] = true
+	}
+	return notification
+}
 
-	res, err := fcmClient.Send(notification)
+func sendToFirebase(ctx *jobs.WorkerContext, client *fcm.Client, c *oauth.Client, notification *fcm.Message) error {
+	res, err := client.Send(notification)
 	if err != nil {
 		return err
 	}
@@ -207,6 +525,10 @@ func pushToFirebase(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) erro
 
 	for _, result := range res.Results {
 		if err = result.Error; err != nil {
+			if isInvalidFCMToken(err) {
+				reportInvalidToken(ctx.Domain(), c.NotificationPlatform, c.ID(), err.Error())
+				return &invalidTokenError{err}
+			}
 			return err
 		}
 	}
@@ -214,44 +536,156 @@ func pushToFirebase(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) erro
 }
 
 func pushToAPNS(ctx *jobs.WorkerContext, c *oauth.Client, msg *Message) error {
-	if iosClient == nil {
+	client := apnsClient(c)
+	if client == nil {
 		ctx.Logger().Warn("Could not send iOS notification: not configured")
-		return nil
+		return errNotConfigured
 	}
 
 	var priority int
-	if msg.Priority == "normal" {
+	if msg.Priority == "normal" || msg.Priority == PrioritySilent || msg.clears() {
 		priority = apns.PriorityLow
 	} else {
 		priority = apns.PriorityHigh
 	}
 
+	if msg.Priority == PrioritySilent || msg.clears() {
+		return sendToAPNS(ctx, client, c, msg, silentAPNSPayload(msg), priority)
+	}
+
+	return sendToAPNS(ctx, client, c, msg, alertAPNSPayload(msg), priority)
+}
+
+// alertAPNSPayload returns a payload with an alert shown to the user. The
+// subtitle is replaced by the summary for the aggregated notifications.
+func alertAPNSPayload(msg *Message) *apns_payload.Payload {
+	title, body := fitPayload(msg.Title, msg.Message,
+		textBudget(msg, apnsMaxPayloadSize, 1))
+
 	payload := apns_payload.NewPayload().
-		AlertTitle(msg.Title).
-		Alert(msg.Message).
-		Sound(msg.Sound)
+		AlertTitle(title).
+		Alert(body).
+		Sound(apnsSound(msg))
+
+	if msg.Subtitle != "" {
+		payload.AlertSubtitle(msg.Subtitle)
+	}
+
+	if msg.Category != "" {
+		payload.Category(msg.Category)
+	}
+
+	if msg.Count > 1 {
+		payload.Badge(msg.Count).
+			AlertSubtitle(fmt.Sprintf(aggregationSummary(), msg.Count))
+	}
 
 	for k, v := range msg.Data {
 		payload.Custom(k, v)
 	}
+	for k, v := range msg.target() {
+		payload.Custom(k, v)
+	}
+	if msg.Cancel {
+		payload.Custom(cancelPayloadKey, true)
+	}
+	return payload
+}
+
+// apnsSound returns the sound of the alert: the critical-sound dictionary for
+// a critical alert, or the plain name of the sound otherwise.
+func apnsSound(msg *Message) interface{} {
+	name := msg.SoundName
+	if name == "" {
+		name = msg.Sound
+	}
+	if !msg.SoundCritical {
+		return name
+	}
+	if name == "" {
+		name = "default"
+	}
+	volume := msg.SoundVolume
+	if volume < 0 || math.IsNaN(volume) {
+		volume = 0
+	} else if volume > 1 {
+		volume = 1
+	}
+	return map[string]interface{}{
+		"name":     name,
+		"critical": 1,
+		"volume":   volume,
+	}
+}
+
+// silentAPNSPayload returns a payload with only the content-available flag and
+// the data: iOS wakes up the application, but does not show an alert.
+func silentAPNSPayload(msg *Message) *apns_payload.Payload {
+	payload := apns_payload.NewPayload().ContentAvailable()
+	for k, v := range msg.Data {
+		payload.Custom(k, v)
+	}
+	for k, v := range msg.target() {
+		payload.Custom(k, v)
+	}
+	if msg.Cancel {
+		payload.Custom(cancelPayloadKey, true)
+	}
+	return payload
+}
+
+func sendToAPNS(ctx *jobs.WorkerContext, client *apns.Client, c *oauth.Client, msg *Message, payload *apns_payload.Payload, priority int) error {
+	collapseID := hashSource(msg.Source)
+	if msg.CollapseKey != "" {
+		collapseID, _ = collapseKey(msg)
+	}
 
 	notification := &apns.Notification{
 		DeviceToken: c.NotificationDeviceToken,
 		Payload:     payload,
 		Priority:    priority,
-		CollapseID:  hex.EncodeToString(hashSource(msg.Source)), // CollapseID should not exceed 64 bytes
+		CollapseID:  hex.EncodeToString(collapseID), // CollapseID should not exceed 64 bytes
 	}
 
-	res, err := iosClient.PushWithContext(ctx, notification)
+	sendCtx, cancel := ctx.WithTimeout(sendTimeout())
+	defer cancel()
+	res, err := client.PushWithContext(sendCtx, notification)
 	if err != nil {
 		return err
 	}
 	if res.StatusCode != 200 {
-		return fmt.Errorf("failed to push apns notification: %d %s", res.StatusCode, res.Reason)
+		err = fmt.Errorf("failed to push apns notification: %d %s", res.StatusCode, res.Reason)
+		if isInvalidAPNSToken(res) {
+			reportInvalidToken(ctx.Domain(), c.NotificationPlatform, c.ID(), res.Reason)
+			return &invalidTokenError{err}
+		}
+		return err
 	}
 	return nil
 }
 
+// collapseKey returns the hashed key used to identify the notification on the
+// device, and if the notification can collapse the previous ones with the same
+// key. When a collapse key is given, it is used with the source, so that the
+// notifications on the same subject collapse. Else, the notifications of a
+// collapsible source collapse.
+//
+// The priority is not part of the key: a high priority message supersedes a
+// pending normal priority one with the same key, as only the latest message
+// for a key is kept by FCM and APNS. The opposite is also true, and as the
+// messages are sent by concurrent workers, two messages pushed at nearly the
+// same time can be delivered in any order: the last sent is the one that is
+// shown, not the one with the highest priority.
+func collapseKey(msg *Message) ([]byte, bool) {
+	if msg.CollapseKey != "" {
+		return hashSource(msg.Source + "/" + msg.CollapseKey), true
+	}
+	if msg.Collapsible {
+		return hashSource(msg.Source), true
+	}
+	return hashSource(msg.Source + msg.NotificationID), false
+}
+
 func hashSource(source string) []byte {
 	h := md5.New()
 	h.Write([]byte(source))
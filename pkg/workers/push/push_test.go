@@ -0,0 +1,521 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fcm "github.com/appleboy/go-fcm"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	apns "github.com/sideshow/apns2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFitData(t *testing.T) {
+	config.UseTestFile()
+	conf := config.GetConfig()
+	prev := conf.Notifications
+	defer func() { conf.Notifications = prev }()
+
+	big := strings.Repeat("x", 2000)
+	newMsg := func() *Message {
+		return &Message{Title: "title", Message: "body", Data: map[string]interface{}{
+			"appName": big,
+			"preview": big,
+			"extra":   big,
+			"small":   "s",
+		}}
+	}
+
+	conf.Notifications.StripData = false
+	msg := newMsg()
+	assert.Nil(t, fitData(msg))
+	assert.Len(t, msg.Data, 4)
+
+	conf.Notifications.StripData = true
+	conf.Notifications.DataEssentialKeys = []string{"appName"}
+	conf.Notifications.DataStripOrder = []string{"preview", "appName"}
+	msg = newMsg()
+	assert.Equal(t, []string{"preview", "extra"}, fitData(msg))
+	assert.Len(t, msg.Data, 2)
+	assert.Contains(t, msg.Data, "appName")
+	assert.Contains(t, msg.Data, "small")
+
+	data, err := json.Marshal(msg.Data)
+	assert.NoError(t, err)
+	size, _ := dataSizes(msg.Data)
+	assert.Equal(t, len(data), size)
+	assert.True(t, size <= dataBudget(msg))
+
+	msg = &Message{Data: map[string]interface{}{"small": "s"}}
+	assert.Nil(t, fitData(msg))
+}
+
+func TestCollapseKey(t *testing.T) {
+	low := &Message{NotificationID: "1", Source: "cozy/app/bank/balance", Priority: "normal"}
+	high := &Message{NotificationID: "2", Source: "cozy/app/bank/balance", Priority: "high"}
+
+	key1, collapsible := collapseKey(low)
+	assert.False(t, collapsible)
+	key2, _ := collapseKey(high)
+	assert.NotEqual(t, key1, key2)
+
+	low.CollapseKey = "my-account"
+	high.CollapseKey = "my-account"
+	key1, collapsible = collapseKey(low)
+	assert.True(t, collapsible)
+	key2, _ = collapseKey(high)
+	assert.Equal(t, key1, key2)
+
+	high.CollapseKey = "other-account"
+	key2, _ = collapseKey(high)
+	assert.NotEqual(t, key1, key2)
+}
+
+func TestInvalidTokens(t *testing.T) {
+	reportInvalidToken("alice.cozy.tools", "ios", "device1", "Unregistered")
+	events, dropped := DrainInvalidTokens()
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "alice.cozy.tools", events[0].Domain)
+		assert.Equal(t, "device1", events[0].DeviceID)
+		assert.Equal(t, "Unregistered", events[0].Reason)
+	}
+	assert.EqualValues(t, 0, dropped)
+
+	for i := 0; i < invalidTokensSize+2; i++ {
+		reportInvalidToken("alice.cozy.tools", "ios", "device1", "Unregistered")
+	}
+	events, dropped = DrainInvalidTokens()
+	assert.Len(t, events, invalidTokensSize)
+	assert.EqualValues(t, 2, dropped)
+}
+
+func TestAggregate(t *testing.T) {
+	add := func(key aggregateKey, msg *Message) bool {
+		first, err := addToAggregate(key, msg, time.Minute)
+		assert.NoError(t, err)
+		return first
+	}
+	msg := &Message{NotificationID: "1", Source: "cozy/app/bank/balance", Collapsible: true, Message: "first"}
+	key, ok := newAggregateKey("alice.cozy.tools", "device1", msg)
+	assert.True(t, ok)
+	assert.True(t, add(key, msg))
+
+	last := &Message{NotificationID: "2", Source: "cozy/app/bank/balance", Collapsible: true, Message: "second"}
+	assert.False(t, add(key, last))
+
+	flushed, err := flushAggregate(key)
+	assert.NoError(t, err)
+	if assert.NotNil(t, flushed) {
+		assert.Equal(t, "second", flushed.Message)
+		assert.Equal(t, 2, flushed.Count)
+	}
+
+	assert.True(t, add(key, msg))
+	flushed, err = flushAggregate(key)
+	assert.NoError(t, err)
+	if assert.NotNil(t, flushed) {
+		assert.Equal(t, 0, flushed.Count)
+	}
+
+	// The job at the end of the window does nothing if the aggregate has
+	// already been flushed
+	flushed, err = flushAggregate(key)
+	assert.NoError(t, err)
+	assert.Nil(t, flushed)
+
+	_, ok = newAggregateKey("alice.cozy.tools", "device1", &Message{Source: "cozy/app/drive"})
+	assert.False(t, ok)
+}
+
+func TestDedup(t *testing.T) {
+	mark := func(domain, deviceID string, msg *Message, now time.Time, window time.Duration) bool {
+		fresh, err := markDedup(domain, deviceID, msg, now, window)
+		assert.NoError(t, err)
+		return fresh
+	}
+	now := time.Now()
+	window := time.Minute
+	mail := &Message{Source: "cozy/app/mail", DedupKey: "thread-42"}
+	chat := &Message{Source: "cozy/app/chat", DedupKey: "thread-42"}
+	assert.True(t, mark("alice.cozy.tools", "device1", mail, now, window))
+	assert.False(t, mark("alice.cozy.tools", "device1", chat, now.Add(time.Second), window))
+	assert.True(t, mark("alice.cozy.tools", "device2", chat, now.Add(time.Second), window))
+	assert.True(t, mark("bob.cozy.tools", "device1", chat, now.Add(time.Second), window))
+
+	// The cancel messages and the messages without dedup key are never
+	// suppressed, and neither are the messages when the window is disabled
+	assert.True(t, mark("alice.cozy.tools", "device1", &Message{DedupKey: "thread-42", Cancel: true}, now, window))
+	assert.True(t, mark("alice.cozy.tools", "device1", &Message{}, now, window))
+	assert.True(t, mark("alice.cozy.tools", "device1", chat, now, 0))
+
+	// After the window, the message is sent again
+	assert.True(t, mark("alice.cozy.tools", "device1", chat, now.Add(window), window))
+	assert.False(t, mark("alice.cozy.tools", "device1", mail, now.Add(window+time.Second), window))
+}
+
+func TestBranding(t *testing.T) {
+	b := Branding{
+		Sound:     "chime.wav",
+		SmallIcon: "ic_cozy",
+		LargeIcon: "https://cozy.example/logo.png",
+		Category:  "cozy",
+	}
+
+	msg := &Message{Source: "drive"}
+	b.apply(msg)
+	assert.Equal(t, "chime.wav", msg.Sound)
+	assert.Equal(t, "cozy", msg.Category)
+	assert.Equal(t, "ic_cozy", msg.Data["icon"])
+	assert.Equal(t, "https://cozy.example/logo.png", msg.Data["image"])
+
+	msg = &Message{
+		Source:   "drive",
+		Sound:    "ding.wav",
+		Category: "drive",
+		Data:     map[string]interface{}{"icon": "ic_drive"},
+	}
+	b.apply(msg)
+	assert.Equal(t, "ding.wav", msg.Sound)
+	assert.Equal(t, "drive", msg.Category)
+	assert.Equal(t, "ic_drive", msg.Data["icon"])
+	assert.Equal(t, "https://cozy.example/logo.png", msg.Data["image"])
+
+	msg = &Message{Source: "drive"}
+	Branding{}.apply(msg)
+	assert.Empty(t, msg.Sound)
+	assert.Nil(t, msg.Data)
+}
+
+func TestJitter(t *testing.T) {
+	config.UseTestFile()
+	conf := config.GetConfig()
+	prev := conf.Notifications.RetryJitter
+	defer func() { conf.Notifications.RetryJitter = prev }()
+
+	conf.Notifications.RetryJitter = 0
+	assert.Equal(t, time.Second, jitter(time.Second))
+	assert.Equal(t, 4*time.Second, backoff(time.Second, 3))
+
+	conf.Notifications.RetryJitter = 1
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		assert.True(t, d >= 0 && d <= time.Second)
+	}
+
+	conf.Notifications.RetryJitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := backoff(time.Second, 2)
+		assert.True(t, d >= time.Second && d <= 2*time.Second)
+	}
+}
+
+func TestSilentPriority(t *testing.T) {
+	c := &oauth.Client{NotificationDeviceToken: "token"}
+	msg := &Message{
+		Source:   "sync",
+		Title:    "ignored",
+		Message:  "ignored",
+		Priority: PrioritySilent,
+		Data:     map[string]interface{}{"doctype": "io.cozy.files"},
+	}
+
+	notification := newFirebaseMessage(c, msg)
+	assert.Equal(t, "high", notification.Priority)
+	assert.Nil(t, notification.Notification)
+	assert.NotContains(t, notification.Data, "title")
+	assert.NotContains(t, notification.Data, "body")
+	assert.Equal(t, "1", notification.Data["content-available"])
+	assert.Equal(t, "io.cozy.files", notification.Data["doctype"])
+
+	payload, err := json.Marshal(silentAPNSPayload(msg))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"aps":{"content-available":1},"doctype":"io.cozy.files"}`, string(payload))
+}
+
+func TestSubtitle(t *testing.T) {
+	c := &oauth.Client{NotificationDeviceToken: "token"}
+	msg := &Message{Source: "mail", Title: "New mail", Message: "Hello"}
+	notification := newFirebaseMessage(c, msg)
+	assert.NotContains(t, notification.Data, "subtitle")
+	alert := func(msg *Message) map[string]interface{} {
+		payload, err := json.Marshal(alertAPNSPayload(msg))
+		assert.NoError(t, err)
+		var parsed struct {
+			APS struct {
+				Alert map[string]interface{} `json:"alert"`
+			} `json:"aps"`
+		}
+		assert.NoError(t, json.Unmarshal(payload, &parsed))
+		return parsed.APS.Alert
+	}
+	assert.Equal(t, "New mail", alert(msg)["title"])
+	assert.NotContains(t, alert(msg), "subtitle")
+
+	msg.Subtitle = "alice@example.com"
+	notification = newFirebaseMessage(c, msg)
+	assert.Equal(t, "alice@example.com", notification.Data["subtitle"])
+	assert.Equal(t, "New mail", notification.Data["title"])
+	assert.Equal(t, "alice@example.com", alert(msg)["subtitle"])
+	assert.Equal(t, "Hello", alert(msg)["body"])
+
+	msg.Priority = PrioritySilent
+	notification = newFirebaseMessage(c, msg)
+	assert.NotContains(t, notification.Data, "subtitle")
+}
+
+func TestCriticalSound(t *testing.T) {
+	sound := func(msg *Message) interface{} {
+		payload, err := json.Marshal(alertAPNSPayload(msg))
+		assert.NoError(t, err)
+		var parsed struct {
+			APS struct {
+				Sound interface{} `json:"sound"`
+			} `json:"aps"`
+		}
+		assert.NoError(t, json.Unmarshal(payload, &parsed))
+		return parsed.APS.Sound
+	}
+	msg := &Message{Source: "security", Title: "Login", Sound: "chime.wav"}
+	assert.Equal(t, "chime.wav", sound(msg))
+
+	msg.SoundName = "alarm.wav"
+	msg.SoundCritical = true
+	msg.SoundVolume = 0.5
+	assert.Equal(t, map[string]interface{}{
+		"name":     "alarm.wav",
+		"critical": float64(1),
+		"volume":   0.5,
+	}, sound(msg))
+
+	msg.SoundVolume = 3
+	assert.Equal(t, float64(1), sound(msg).(map[string]interface{})["volume"])
+	msg.SoundVolume = -1
+	assert.Equal(t, float64(0), sound(msg).(map[string]interface{})["volume"])
+
+	msg.SoundCritical = false
+	assert.Equal(t, "alarm.wav", sound(msg))
+}
+
+func TestTargetApplication(t *testing.T) {
+	assert.NoError(t, (&Message{}).validate())
+	assert.NoError(t, (&Message{Slug: "banks", DeepLink: "/accounts/42"}).validate())
+	assert.NoError(t, (&Message{Slug: "drive", DeepLink: "cozydrive://folder/42"}).validate())
+	assert.Equal(t, ErrInvalidSlug, (&Message{Slug: "Bad Slug"}).validate())
+	assert.Equal(t, ErrInvalidDeepLink, (&Message{Slug: "banks", DeepLink: "accounts"}).validate())
+
+	c := &oauth.Client{NotificationDeviceToken: "token"}
+	msg := &Message{
+		Source:   "sync",
+		Priority: PrioritySilent,
+		Slug:     "banks",
+		DeepLink: "/accounts/42",
+		Data:     map[string]interface{}{"slug": "other", "key": "value"},
+	}
+	notification := newFirebaseMessage(c, msg)
+	assert.Equal(t, "banks", notification.Data["slug"])
+	assert.Equal(t, "/accounts/42", notification.Data["deep_link"])
+	assert.Equal(t, "value", notification.Data["key"])
+
+	payload, err := json.Marshal(silentAPNSPayload(msg))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"aps":{"content-available":1},"slug":"banks","deep_link":"/accounts/42","key":"value"}`, string(payload))
+}
+
+func TestAPNSEnvironment(t *testing.T) {
+	sandbox := &apns.Client{Host: apns.HostDevelopment}
+	production := &apns.Client{Host: apns.HostProduction}
+	setClients(&pushClients{iosSandbox: sandbox, iosProduction: production})
+	defer setClients(&pushClients{})
+
+	c := &oauth.Client{NotificationPlatform: oauth.PlatformAPNS}
+	assert.True(t, apnsClient(c) == production)
+	setClients(&pushClients{iosSandbox: sandbox, iosProduction: production, iosDevelopment: true})
+	assert.True(t, apnsClient(c) == sandbox)
+
+	c.NotificationEnvironment = oauth.EnvironmentProduction
+	assert.True(t, apnsClient(c) == production)
+	setClients(&pushClients{iosSandbox: sandbox, iosProduction: production})
+	c.NotificationEnvironment = oauth.EnvironmentSandbox
+	assert.True(t, apnsClient(c) == sandbox)
+}
+
+// TestConcurrentInit is meant to be run with the race detector.
+func TestConcurrentInit(t *testing.T) {
+	config.UseTestFile()
+	conf := config.GetConfig()
+	prev := conf.Notifications.AndroidAPIKey
+	defer func() {
+		conf.Notifications.AndroidAPIKey = prev
+		setClients(&pushClients{})
+	}()
+	conf.Notifications.AndroidAPIKey = "fake-api-key"
+
+	c := &oauth.Client{NotificationPlatform: oauth.PlatformAPNS}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, Init())
+		}()
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, apnsClient(c))
+			_ = getClients().fcm
+		}()
+	}
+	wg.Wait()
+	assert.NotNil(t, getClients().fcm)
+}
+
+func TestCancelMessage(t *testing.T) {
+	assert.Equal(t, ErrCancelWithoutCollapseKey, (&Message{Source: "calls", Cancel: true}).validate())
+	assert.NoError(t, (&Message{Source: "calls", CollapseKey: "call-42", Cancel: true}).validate())
+	assert.NoError(t, (&Message{Source: "calls", Collapsible: true, Cancel: true}).validate())
+
+	c := &oauth.Client{NotificationDeviceToken: "token"}
+	call := newFirebaseMessage(c, &Message{
+		Source:      "calls",
+		CollapseKey: "call-42",
+		Title:       "Incoming call",
+	})
+	assert.NotNil(t, call.Notification)
+	assert.Nil(t, call.Data["cancel"])
+
+	cancel := &Message{Source: "calls", CollapseKey: "call-42", Cancel: true}
+	dismiss := newFirebaseMessage(c, cancel)
+	assert.Equal(t, call.CollapseKey, dismiss.CollapseKey)
+	assert.Equal(t, call.Data["notId"], dismiss.Data["notId"])
+	assert.Nil(t, dismiss.Notification)
+	assert.Equal(t, "high", dismiss.Priority)
+	assert.Equal(t, true, dismiss.Data["cancel"])
+
+	ended := newFirebaseMessage(c, &Message{
+		Source:      "calls",
+		CollapseKey: "call-42",
+		Title:       "Call ended",
+		Cancel:      true,
+	})
+	assert.Equal(t, call.CollapseKey, ended.CollapseKey)
+	assert.Equal(t, call.Data["notId"], ended.Data["notId"])
+	if assert.NotNil(t, ended.Notification) {
+		assert.Equal(t, "Call ended", ended.Notification.Title)
+	}
+	assert.Equal(t, true, ended.Data["cancel"])
+
+	payload, err := json.Marshal(silentAPNSPayload(cancel))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"aps":{"content-available":1},"cancel":true}`, string(payload))
+}
+
+func TestCheckTokenPlatform(t *testing.T) {
+	apnsToken := strings.Repeat("0123456789abcdef", 4)
+	fcmToken := "dQw4w9WgXcQ:APA91bHun4MxP5egoKMwt2KZFBaFUH-1RYqx"
+
+	assert.NoError(t, checkTokenPlatform(oauth.PlatformAPNS, apnsToken))
+	assert.NoError(t, checkTokenPlatform(oauth.PlatformAPNS, strings.ToUpper(apnsToken)))
+	assert.NoError(t, checkTokenPlatform(oauth.PlatformFirebase, fcmToken))
+	assert.NoError(t, checkTokenPlatform("android", fcmToken))
+	assert.NoError(t, checkTokenPlatform("ios", fcmToken))
+
+	assert.Equal(t, ErrTokenPlatformMismatch, checkTokenPlatform(oauth.PlatformFirebase, apnsToken))
+	assert.Equal(t, ErrTokenPlatformMismatch, checkTokenPlatform("android", apnsToken))
+	assert.Equal(t, ErrTokenPlatformMismatch, checkTokenPlatform(oauth.PlatformAPNS, fcmToken))
+	assert.Equal(t, ErrTokenPlatformMismatch, checkTokenPlatform(oauth.PlatformAPNS, apnsToken[:40]))
+}
+
+func TestProbeToken(t *testing.T) {
+	apnsToken := strings.Repeat("0123456789abcdef", 4)
+	c := &oauth.Client{
+		NotificationPlatform:    oauth.PlatformFirebase,
+		NotificationDeviceToken: apnsToken,
+	}
+	res, reason, err := probeToken(c)
+	assert.NoError(t, err)
+	assert.Equal(t, probeInvalid, res)
+	assert.Equal(t, ErrTokenPlatformMismatch.Error(), reason)
+
+	// The providers are not configured in the tests
+	c.NotificationPlatform = oauth.PlatformAPNS
+	res, _, err = probeToken(c)
+	assert.NoError(t, err)
+	assert.Equal(t, probeSkipped, res)
+	c.NotificationPlatform = "windows"
+	c.NotificationDeviceToken = "token"
+	res, _, err = probeToken(c)
+	assert.NoError(t, err)
+	assert.Equal(t, probeSkipped, res)
+}
+
+func TestSendTimeout(t *testing.T) {
+	config.UseTestFile()
+	conf := config.GetConfig()
+	prev := conf.Notifications.SendTimeout
+	defer func() { conf.Notifications.SendTimeout = prev }()
+
+	conf.Notifications.SendTimeout = 0
+	assert.Equal(t, defaultSendTimeout, sendTimeout())
+	conf.Notifications.SendTimeout = 2 * time.Second
+	assert.Equal(t, 2*time.Second, sendTimeout())
+}
+
+func TestResult(t *testing.T) {
+	r := newResult()
+	assert.NoError(t, r.finish())
+	assert.Equal(t, StatusNoDevices, r.Status)
+
+	r = newResult()
+	r.add(oauth.PlatformFirebase, "device-1", nil)
+	r.add(oauth.PlatformFirebase, "device-2", &invalidTokenError{fcm.ErrNotRegistered})
+	r.add(oauth.PlatformAPNS, "device-3", ErrTokenPlatformMismatch)
+	r.add(oauth.PlatformAPNS, "device-4", errNotConfigured)
+	assert.NoError(t, r.finish())
+	assert.Equal(t, StatusPartial, r.Status)
+	assert.Equal(t, &PlatformResult{Attempted: 2, Succeeded: 1, Failed: 1}, r.Platforms[oauth.PlatformFirebase])
+	assert.Equal(t, &PlatformResult{Attempted: 1, Failed: 1, Skipped: 1}, r.Platforms[oauth.PlatformAPNS])
+	assert.Equal(t, []string{"device-2", "device-3"}, r.InvalidTokens)
+
+	r = newResult()
+	r.add(oauth.PlatformAPNS, "device-1", errors.New("timeout"))
+	assert.Equal(t, ErrNoDeviceReached, r.finish())
+	assert.Equal(t, StatusFailed, r.Status)
+	assert.Empty(t, r.InvalidTokens)
+}
+
+func TestSendPool(t *testing.T) {
+	db := prefixer.NewPrefixer("push.example.net", "push.example.net")
+	ctx := jobs.NewWorkerContext("id", jobs.NewJob(db, &jobs.JobRequest{WorkerType: "push"}))
+	var unbounded *sendPool
+	assert.True(t, unbounded.acquire(ctx))
+	unbounded.release()
+
+	p := newSendPool(2)
+	assert.True(t, p.acquire(ctx))
+	assert.True(t, p.acquire(ctx))
+	timeout, cancel := ctx.WithTimeout(20 * time.Millisecond)
+	defer cancel()
+	assert.False(t, p.acquire(timeout))
+	p.release()
+	assert.True(t, p.acquire(ctx))
+	assert.Equal(t, defaultConcurrency, cap(newSendPool(0).slots))
+
+	// The result can be updated by the concurrent sends
+	r := newResult()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.add(oauth.PlatformAPNS, "device", nil)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 10, r.Platforms[oauth.PlatformAPNS].Succeeded)
+}
@@ -0,0 +1,121 @@
+package push
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNoDeviceReached is used when the message has been sent to at least one
+// device, and it has failed for all of them.
+var ErrNoDeviceReached = errors.New("notifications: the message could not be sent to any device")
+
+// errNotConfigured is returned when the provider of the platform of a device
+// is not configured: the device is skipped.
+var errNotConfigured = errors.New("notifications: provider not configured")
+
+// invalidTokenError is returned when the provider reports that the token of
+// the device is no longer valid.
+type invalidTokenError struct {
+	err error
+}
+
+func (e *invalidTokenError) Error() string {
+	return e.err.Error()
+}
+
+// The status of a push job, in its result.
+const (
+	StatusSent      = "sent"
+	StatusPartial   = "partial"
+	StatusFailed    = "failed"
+	StatusNoDevices = "no_devices"
+)
+
+// Result is the outcome of a push job, saved in the result of the job.
+type Result struct {
+	Status    string                     `json:"status"`
+	Platforms map[string]*PlatformResult `json:"platforms,omitempty"`
+	// InvalidTokens is the list of the devices whose token has been reported
+	// as invalid by the provider, or does not match their platform.
+	InvalidTokens []string `json:"invalid_tokens,omitempty"`
+
+	// mu serializes the updates from the concurrent sends of a job.
+	mu sync.Mutex
+}
+
+// PlatformResult are the counters of a push job for a platform. Aggregated
+// is the number of devices where the message has been merged with a pending
+// one, to be sent by another job, and Deduplicated the number of devices
+// where it has been suppressed as a duplicate of a message already sent.
+type PlatformResult struct {
+	Attempted    int `json:"attempted"`
+	Succeeded    int `json:"succeeded"`
+	Failed       int `json:"failed"`
+	Skipped      int `json:"skipped,omitempty"`
+	Aggregated   int `json:"aggregated,omitempty"`
+	Deduplicated int `json:"deduplicated,omitempty"`
+}
+
+func newResult() *Result {
+	return &Result{Platforms: make(map[string]*PlatformResult)}
+}
+
+func (r *Result) platform(name string) *PlatformResult {
+	p, ok := r.Platforms[name]
+	if !ok {
+		p = &PlatformResult{}
+		r.Platforms[name] = p
+	}
+	return p
+}
+
+// count updates the counters of a platform.
+func (r *Result) count(platform string, fn func(p *PlatformResult)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(r.platform(platform))
+}
+
+// add counts the outcome of the sending of the message to a device. It can be
+// called concurrently.
+func (r *Result) add(platform, deviceID string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.platform(platform)
+	if err == errNotConfigured {
+		p.Skipped++
+		return
+	}
+	p.Attempted++
+	if err == nil {
+		p.Succeeded++
+		return
+	}
+	p.Failed++
+	if _, ok := err.(*invalidTokenError); ok || err == ErrTokenPlatformMismatch {
+		r.InvalidTokens = append(r.InvalidTokens, deviceID)
+	}
+}
+
+// finish computes the status of the job, and returns ErrNoDeviceReached if
+// the message has not been sent to any device.
+func (r *Result) finish() error {
+	var attempted, succeeded, aggregated int
+	for _, p := range r.Platforms {
+		attempted += p.Attempted
+		succeeded += p.Succeeded
+		aggregated += p.Aggregated
+	}
+	switch {
+	case attempted == 0 && aggregated == 0:
+		r.Status = StatusNoDevices
+	case succeeded == attempted:
+		r.Status = StatusSent
+	case succeeded > 0:
+		r.Status = StatusPartial
+	default:
+		r.Status = StatusFailed
+		return ErrNoDeviceReached
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package push
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+
+	fcm "github.com/appleboy/go-fcm"
+)
+
+// The maximal number of attempts to send a notification to Firebase when it
+// responds with a transient error, and the base delay between them.
+const (
+	fcmMaxAttempts = 3
+	fcmRetryDelay  = 500 * time.Millisecond
+)
+
+// defaultSendTimeout is the maximal duration of the sending of a notification
+// to a device, when it is not configured.
+const defaultSendTimeout = 5 * time.Second
+
+// sendTimeout returns the maximal duration of a request to FCM or APNS for
+// one device, so that a slow device does not use all the time of the job.
+func sendTimeout() time.Duration {
+	if timeout := config.GetConfig().Notifications.SendTimeout; timeout > 0 {
+		return timeout
+	}
+	return defaultSendTimeout
+}
+
+// retryJitter returns the configured part of the delays before a retry that
+// is randomized, between 0 and 1.
+func retryJitter() float64 {
+	j := config.GetConfig().Notifications.RetryJitter
+	if j < 0 {
+		return 0
+	}
+	if j > 1 {
+		return 1
+	}
+	return j
+}
+
+// jitter randomizes the given delay: with a jitter factor j, the result is
+// between delay * (1 - j) and delay. It spreads the retries after an outage
+// of a provider, instead of sending them all at the same time.
+func jitter(delay time.Duration) time.Duration {
+	random := time.Duration(retryJitter() * float64(delay))
+	if random <= 0 {
+		return delay
+	}
+	return delay - random + time.Duration(rand.Int63n(int64(random)+1))
+}
+
+// backoff returns the delay to wait before the given attempt (starting at 1
+// for the first retry), growing exponentially from base, with jitter.
+func backoff(base time.Duration, attempt int) time.Duration {
+	return jitter(base << uint(attempt-1))
+}
+
+// isTransientFCMError returns true if the error is a temporary failure of
+// Firebase, and the notification can be sent again later.
+func isTransientFCMError(err error) bool {
+	switch err {
+	case fcm.ErrUnavailable, fcm.ErrInternalServerError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package push
+
+import (
+	"errors"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/oauth"
+
+	fcm "github.com/appleboy/go-fcm"
+	apns "github.com/sideshow/apns2"
+)
+
+// invalidTokensSize is the maximal number of events kept until they are
+// drained. When the buffer is full, the new events are dropped.
+const invalidTokensSize = 1024
+
+// InvalidTokenEvent is emitted when FCM or APNS reports that the token of a
+// device is no longer valid.
+type InvalidTokenEvent struct {
+	Domain   string    `json:"domain"`
+	Platform string    `json:"platform"`
+	DeviceID string    `json:"device_id"`
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+}
+
+var (
+	invalidTokens = make(chan InvalidTokenEvent, invalidTokensSize)
+	droppedTokens uint64
+)
+
+// InvalidTokens returns the channel where the invalid token events are sent.
+// It is buffered and should be consumed by only one background job.
+func InvalidTokens() <-chan InvalidTokenEvent {
+	return invalidTokens
+}
+
+// DrainInvalidTokens returns the events that are waiting in the channel,
+// without blocking, and the number of events that have been dropped since the
+// last call because the channel was full.
+func DrainInvalidTokens() ([]InvalidTokenEvent, uint64) {
+	var events []InvalidTokenEvent
+	for {
+		select {
+		case ev := <-invalidTokens:
+			events = append(events, ev)
+		default:
+			return events, atomic.SwapUint64(&droppedTokens, 0)
+		}
+	}
+}
+
+// reportInvalidToken sends an event for the invalid token, or drops it if
+// nobody is consuming them.
+func reportInvalidToken(domain, platform, deviceID, reason string) {
+	ev := InvalidTokenEvent{
+		Domain:   domain,
+		Platform: platform,
+		DeviceID: deviceID,
+		Reason:   reason,
+		Time:     time.Now(),
+	}
+	select {
+	case invalidTokens <- ev:
+	default:
+		atomic.AddUint64(&droppedTokens, 1)
+	}
+}
+
+// ErrTokenPlatformMismatch is used when the token of a device does not have
+// the format of the tokens of its declared platform: nothing is sent, as the
+// provider would always reject it.
+var ErrTokenPlatformMismatch = errors.New("notifications: device token does not match the platform")
+
+// apnsTokenReg is the format of the APNS device tokens: 32 bytes, or more
+// in the future, encoded in hexadecimal. The FCM registration tokens are
+// longer and not in hexadecimal.
+var apnsTokenReg = regexp.MustCompile(`^[0-9a-fA-F]{64,}$`)
+
+// checkTokenPlatform returns ErrTokenPlatformMismatch if the shape of the
+// device token does not match the provider of the platform, like an APNS
+// token registered for Firebase.
+func checkTokenPlatform(platform, token string) error {
+	isAPNS := apnsTokenReg.MatchString(token)
+	if isAPNS != (platform == oauth.PlatformAPNS) {
+		return ErrTokenPlatformMismatch
+	}
+	return nil
+}
+
+// isInvalidFCMToken returns true if the error returned by FCM means that the
+// registration token of the device is no longer valid.
+func isInvalidFCMToken(err error) bool {
+	switch err {
+	case fcm.ErrInvalidRegistration, fcm.ErrNotRegistered, fcm.ErrMismatchSenderID:
+		return true
+	}
+	return false
+}
+
+// isInvalidAPNSToken returns true if the response of APNS means that the
+// device token is no longer valid.
+func isInvalidAPNSToken(res *apns.Response) bool {
+	switch res.Reason {
+	case apns.ReasonBadDeviceToken, apns.ReasonUnregistered,
+		apns.ReasonDeviceTokenNotForTopic:
+		return true
+	}
+	return false
+}
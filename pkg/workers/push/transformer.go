@@ -0,0 +1,202 @@
+package push
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// The maximal size in bytes of the payload of a notification, as accepted by
+// Firebase and APNS.
+const (
+	fcmMaxPayloadSize  = 4096
+	apnsMaxPayloadSize = 4096
+)
+
+// payloadOverhead is the number of bytes reserved in the payload for the
+// fields that are not the title, the body or the custom data.
+const payloadOverhead = 512
+
+// minTextBudget is the number of bytes kept for each occurrence of the title
+// and the body in the payload when the custom data are stripped.
+const minTextBudget = 256
+
+// ellipsis is appended to the texts that have been truncated.
+const ellipsis = "…"
+
+// Transformer is a function that can change the title and the body of a
+// notification before it is sent to the devices.
+type Transformer func(title, body string) (string, string)
+
+var (
+	transformersMu sync.RWMutex
+	transformers   = make(map[string]Transformer)
+)
+
+// RegisterTransformer registers the transformer to use for the notifications
+// with the given source (the slug of the application). A nil transformer
+// removes the one previously registered.
+func RegisterTransformer(source string, t Transformer) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+	if t == nil {
+		delete(transformers, source)
+	} else {
+		transformers[source] = t
+	}
+}
+
+// transform applies the transformer registered for the source of the message
+// to its title and body. Without transformer, the message is unchanged.
+func transform(msg *Message) {
+	transformersMu.RLock()
+	t, ok := transformers[msg.Source]
+	transformersMu.RUnlock()
+	if ok {
+		msg.Title, msg.Message = t(msg.Title, msg.Message)
+	}
+}
+
+// fitPayload truncates the body, and then the title if needed, so that their
+// cumulated size does not exceed the given number of bytes.
+func fitPayload(title, body string, size int) (string, string) {
+	if size < 0 {
+		size = 0
+	}
+	if len(title)+len(body) <= size {
+		return title, body
+	}
+	if len(title) < size {
+		return title, truncate(body, size-len(title))
+	}
+	return truncate(title, size), ""
+}
+
+// textBudget returns the number of bytes available for the title and the body
+// in a payload of the given maximal size, with the subtitle and the custom
+// data of the message. The texts are sent the given number of times in the
+// payload.
+func textBudget(msg *Message, maxSize, times int) int {
+	size := maxSize - payloadOverhead - len(msg.Subtitle)
+	if len(msg.Data) > 0 {
+		if data, err := json.Marshal(msg.Data); err == nil {
+			size -= len(data)
+		}
+	}
+	return size / times
+}
+
+// dataBudget returns the number of bytes available for the custom data of the
+// message, with enough room left for the title and the body on all the
+// platforms. The silent messages have no texts.
+func dataBudget(msg *Message) int {
+	size := fcmMaxPayloadSize
+	if apnsMaxPayloadSize < size {
+		size = apnsMaxPayloadSize
+	}
+	size -= payloadOverhead
+	if msg.Priority != PrioritySilent && !msg.clears() {
+		// The title and the body are sent twice to Firebase
+		size -= 2*minTextBudget + len(msg.Subtitle)
+	}
+	return size
+}
+
+// fitData removes keys from the custom data of the message, if it is enabled
+// in the configuration, until the data fit in the payload. The keys of the
+// configured strip order are removed first, in this order, and then the other
+// keys, from the biggest to the smallest. The essential keys are never
+// removed. It returns the removed keys.
+func fitData(msg *Message) []string {
+	conf := config.GetConfig().Notifications
+	if !conf.StripData || len(msg.Data) == 0 {
+		return nil
+	}
+	budget := dataBudget(msg)
+	size, sizes := dataSizes(msg.Data)
+	if size <= budget {
+		return nil
+	}
+
+	essential := make(map[string]bool, len(conf.DataEssentialKeys))
+	for _, k := range conf.DataEssentialKeys {
+		essential[k] = true
+	}
+	var order []string
+	ordered := make(map[string]bool, len(conf.DataStripOrder))
+	for _, k := range conf.DataStripOrder {
+		if _, ok := msg.Data[k]; ok && !essential[k] && !ordered[k] {
+			order = append(order, k)
+			ordered[k] = true
+		}
+	}
+	var others []string
+	for k := range msg.Data {
+		if !essential[k] && !ordered[k] {
+			others = append(others, k)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool {
+		if sizes[others[i]] != sizes[others[j]] {
+			return sizes[others[i]] > sizes[others[j]]
+		}
+		return others[i] < others[j]
+	})
+	order = append(order, others...)
+
+	data := make(map[string]interface{}, len(msg.Data))
+	for k, v := range msg.Data {
+		data[k] = v
+	}
+	var dropped []string
+	for _, k := range order {
+		if size <= budget {
+			break
+		}
+		delete(data, k)
+		size -= sizes[k]
+		dropped = append(dropped, k)
+	}
+	msg.Data = data
+	return dropped
+}
+
+// dataSizes returns the size of the custom data marshaled in JSON, and the
+// number of bytes taken by each key in it.
+func dataSizes(data map[string]interface{}) (int, map[string]int) {
+	sizes := make(map[string]int, len(data))
+	size := 2 // {}
+	for k, v := range data {
+		key, _ := json.Marshal(k)
+		val, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		// "key":value,
+		sizes[k] = len(key) + 1 + len(val) + 1
+		size += sizes[k]
+	}
+	if len(data) > 0 {
+		size-- // no comma after the last key
+	}
+	return size, sizes
+}
+
+// truncate cuts the string to at most max bytes, on a rune boundary, with an
+// ellipsis at the end to show that it has been truncated.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	if max < len(ellipsis) {
+		return ""
+	}
+	s = s[:max-len(ellipsis)]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + ellipsis
+}
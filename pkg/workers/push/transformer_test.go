@@ -0,0 +1,39 @@
+package push
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransform(t *testing.T) {
+	msg := &Message{Source: "drive", Title: "title", Message: "body"}
+	transform(msg)
+	assert.Equal(t, "title", msg.Title)
+	assert.Equal(t, "body", msg.Message)
+
+	RegisterTransformer("drive", func(title, body string) (string, string) {
+		return "Drive: " + title, strings.ToUpper(body)
+	})
+	defer RegisterTransformer("drive", nil)
+	transform(msg)
+	assert.Equal(t, "Drive: title", msg.Title)
+	assert.Equal(t, "BODY", msg.Message)
+}
+
+func TestFitPayload(t *testing.T) {
+	title, body := fitPayload("title", "body", 100)
+	assert.Equal(t, "title", title)
+	assert.Equal(t, "body", body)
+
+	title, body = fitPayload("title", "a long body", 12)
+	assert.Equal(t, "title", title)
+	assert.Equal(t, "a lo…", body)
+
+	title, body = fitPayload("a long title", "body", 8)
+	assert.Equal(t, "a lon…", title)
+	assert.Equal(t, "", body)
+
+	assert.Equal(t, "é…", truncate("ééé", 5))
+}
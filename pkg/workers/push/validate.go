@@ -0,0 +1,258 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+
+	fcm "github.com/appleboy/go-fcm"
+	apns "github.com/sideshow/apns2"
+)
+
+// defaultProbeInterval is the minimal delay between two probes of
+// ValidateTokens, to not be rate-limited by FCM and APNS.
+const defaultProbeInterval = 200 * time.Millisecond
+
+// validateBatchSize is the number of devices checked by a push-validate job.
+// The sweep of an instance with more devices is continued by another job,
+// scheduled after validateResumeDelay with the cursor of the report.
+const validateBatchSize = 100
+
+const validateResumeDelay = time.Minute
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "push-validate",
+		Concurrency:  1,
+		MaxExecCount: 1,
+		Timeout:      5 * time.Minute,
+		WorkerFunc:   ValidateWorker,
+	})
+}
+
+// ValidateMessage is the message of a push-validate job.
+type ValidateMessage struct {
+	// Cursor is the cursor of the report of the previous job of the sweep, or
+	// empty for a new sweep.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// ValidateWorker is the worker that checks a batch of the device tokens of an
+// instance with ValidateTokens. The cursor of the report is kept in the
+// message of the job that continues the sweep, so that it is resumed where it
+// has stopped, even if this job fails.
+func ValidateWorker(ctx *jobs.WorkerContext) error {
+	var msg ValidateMessage
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	inst, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	report, err := ValidateTokens(inst, &ValidateOptions{
+		Cursor: msg.Cursor,
+		Limit:  validateBatchSize,
+	})
+	if report == nil {
+		return err
+	}
+	ctx.Logger().Infof("Device tokens: %d valid, %d purged, %d skipped, %d failed",
+		report.Valid, report.Purged, report.Skipped, report.Failed)
+	if report.Done {
+		return err
+	}
+	if report.Cursor == msg.Cursor && err != nil {
+		// Nothing has been checked: the sweep is not continued, to not loop on
+		// the same error.
+		return err
+	}
+	if errs := scheduleValidate(inst, report.Cursor); errs != nil {
+		return errs
+	}
+	return err
+}
+
+// scheduleValidate adds a trigger for a push-validate job that continues the
+// sweep of the instance after the given cursor.
+func scheduleValidate(inst *instance.Instance, cursor string) error {
+	t, err := jobs.NewTrigger(inst, jobs.TriggerInfos{
+		Type:       "@in",
+		WorkerType: "push-validate",
+		Arguments:  validateResumeDelay.String(),
+	}, &ValidateMessage{Cursor: cursor})
+	if err != nil {
+		return err
+	}
+	return jobs.System().AddTrigger(t)
+}
+
+// ValidateOptions are the options of ValidateTokens.
+type ValidateOptions struct {
+	// Cursor is the identifier of the last device checked by a previous
+	// sweep: only the devices after it are checked.
+	Cursor string
+	// Limit is the maximal number of devices checked by this sweep, or zero
+	// for no limit.
+	Limit int
+	// Interval is the minimal delay between two probes. If zero, a default
+	// value is used.
+	Interval time.Duration
+}
+
+// ValidateReport is the result of ValidateTokens.
+type ValidateReport struct {
+	Valid   int `json:"valid"`
+	Purged  int `json:"purged"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+	// Cursor is the identifier of the last device checked, and Done is false
+	// if the sweep has stopped before the end: it can be resumed by calling
+	// ValidateTokens again with this cursor.
+	Cursor string `json:"cursor,omitempty"`
+	Done   bool   `json:"done"`
+}
+
+// probeResult is the outcome of the probe of a device token.
+type probeResult int
+
+const (
+	probeValid probeResult = iota
+	probeInvalid
+	probeSkipped
+)
+
+// ValidateTokens checks the device tokens of the notifiable clients of the
+// instance, with a dry-run message for FCM and a silent notification for APNS,
+// and purges the tokens that the providers report as invalid or unregistered.
+// The devices are checked in the order of their identifiers, so that a sweep
+// stopped by the limit or by an error can be resumed with the cursor of the
+// report.
+func ValidateTokens(inst *instance.Instance, opts *ValidateOptions) (*ValidateReport, error) {
+	if opts == nil {
+		opts = &ValidateOptions{}
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+
+	cs, err := oauth.GetNotifiables(inst)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].ID() < cs[j].ID() })
+
+	report := &ValidateReport{Cursor: opts.Cursor}
+	checked := 0
+	var last time.Time
+	for _, c := range cs {
+		if c.ID() <= opts.Cursor || c.NotificationDeviceToken == "" {
+			continue
+		}
+		if opts.Limit > 0 && checked >= opts.Limit {
+			return report, nil
+		}
+		if wait := interval - time.Since(last); wait > 0 {
+			time.Sleep(wait)
+		}
+		last = time.Now()
+		checked++
+
+		res, reason, errp := probeToken(c)
+		switch {
+		case errp != nil:
+			report.Failed++
+			inst.Logger().WithField("nspace", "push").
+				Infof("Cannot validate the token of the device %s: %s", c.ID(), errp)
+		case res == probeInvalid:
+			reportInvalidToken(inst.Domain, c.NotificationPlatform, c.ID(), reason)
+			c.NotificationDeviceToken = ""
+			if err = couchdb.UpdateDoc(inst, c); err != nil {
+				return report, err
+			}
+			report.Purged++
+		case res == probeSkipped:
+			report.Skipped++
+		default:
+			report.Valid++
+		}
+		report.Cursor = c.ID()
+	}
+	report.Done = true
+	return report, nil
+}
+
+// probeToken sends a message to the provider of the device that is not shown
+// to the user, and returns if the token has been accepted. The devices whose
+// provider is not configured are skipped.
+func probeToken(c *oauth.Client) (probeResult, string, error) {
+	if err := checkTokenPlatform(c.NotificationPlatform, c.NotificationDeviceToken); err != nil {
+		return probeInvalid, err.Error(), nil
+	}
+	switch c.NotificationPlatform {
+	case oauth.PlatformFirebase, "android", "ios":
+		return probeFirebase(c)
+	case oauth.PlatformAPNS:
+		return probeAPNS(c)
+	}
+	return probeSkipped, "", nil
+}
+
+// probeFirebase sends a dry-run message to FCM: the token is checked, but
+// nothing is delivered to the device.
+func probeFirebase(c *oauth.Client) (probeResult, string, error) {
+	client := getClients().fcm
+	if client == nil {
+		return probeSkipped, "", nil
+	}
+	res, err := client.Send(&fcm.Message{
+		To:     c.NotificationDeviceToken,
+		DryRun: true,
+	})
+	if err != nil {
+		return probeValid, "", err
+	}
+	for _, result := range res.Results {
+		if result.Error == nil {
+			continue
+		}
+		if isInvalidFCMToken(result.Error) {
+			return probeInvalid, result.Error.Error(), nil
+		}
+		return probeValid, "", result.Error
+	}
+	return probeValid, "", nil
+}
+
+// probeAPNS sends a silent notification without any data, as APNS has no
+// dry-run mode: the application may be woken up, but nothing is shown.
+func probeAPNS(c *oauth.Client) (probeResult, string, error) {
+	client := apnsClient(c)
+	if client == nil {
+		return probeSkipped, "", nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout())
+	defer cancel()
+	res, err := client.PushWithContext(ctx, &apns.Notification{
+		DeviceToken: c.NotificationDeviceToken,
+		Payload:     silentAPNSPayload(&Message{}),
+		Priority:    apns.PriorityLow,
+	})
+	if err != nil {
+		return probeValid, "", err
+	}
+	if res.StatusCode == 200 {
+		return probeValid, "", nil
+	}
+	if isInvalidAPNSToken(res) {
+		return probeInvalid, res.Reason, nil
+	}
+	return probeValid, "", fmt.Errorf("failed to push apns notification: %d %s", res.StatusCode, res.Reason)
+}
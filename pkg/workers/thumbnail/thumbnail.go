@@ -196,9 +196,13 @@ func generateThumbnails(ctx *jobs.WorkerContext, i *instance.Instance, img *vfs.
 		return nil
 	}
 
+	// The content is read with a budget, so that a file larger than its
+	// document or a slow storage does not block the worker. The reader is
+	// closed by recGenerateThub.
+	deadline, _ := ctx.Deadline()
 	fs := i.ThumbsFS()
 	var in io.Reader
-	in, err := i.VFS().OpenFile(img)
+	in, err := vfs.OpenFileLimited(i.VFS(), img, limit, deadline)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,46 @@
+package trash
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// Schedule is the cron specification of the trash-expiry job, run by the
+// stack when the old contents of the overwritten files are kept.
+const Schedule = "@every 1h"
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "trash-expiry",
+		Concurrency:  1,
+		MaxExecCount: 1,
+		Timeout:      1 * time.Hour,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is the worker that removes the expired elements of the trashes of
+// all the instances: for now, the old contents of the overwritten files that
+// are kept for longer than the retention.
+func Worker(ctx *jobs.WorkerContext) error {
+	var reclaimed int64
+	err := instance.ForeachInstances(func(inst *instance.Instance) error {
+		undoer, ok := inst.VFS().(vfs.OverwriteUndoer)
+		if !ok {
+			return nil
+		}
+		n, err := undoer.PurgeExpiredUndos()
+		if err != nil {
+			ctx.Logger().WithField("domain", inst.Domain).
+				Warnf("Could not purge the old contents: %s", err)
+			return nil
+		}
+		reclaimed += n
+		return nil
+	})
+	ctx.Logger().Infof("%d bytes reclaimed from the old contents", reclaimed)
+	return err
+}
@@ -64,6 +64,10 @@ func unzip(fs vfs.VFS, zipID, destination string) error {
 		return err
 	}
 
+	if err = vfs.CheckInodes(fs, int64(len(r.File))); err != nil {
+		return err
+	}
+
 	dirs := make(map[string]*vfs.DirDoc)
 	for _, f := range r.File {
 		f.Name = utils.CleanUTF8(f.Name)
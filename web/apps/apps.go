@@ -385,7 +385,7 @@ func wrapAppsError(err error) error {
 	switch err {
 	case apps.ErrInvalidSlugName:
 		return jsonapi.InvalidParameter("slug", err)
-	case apps.ErrAlreadyExists:
+	case apps.ErrAlreadyExists, apps.ErrVersionExists:
 		return jsonapi.Conflict(err)
 	case apps.ErrNotFound:
 		return jsonapi.NotFound(err)
@@ -399,6 +399,10 @@ func wrapAppsError(err error) error {
 		return jsonapi.BadRequest(err)
 	case apps.ErrMissingSource:
 		return jsonapi.BadRequest(err)
+	case apps.ErrInsufficientStorage:
+		return jsonapi.Errorf(http.StatusInsufficientStorage, "%s", err)
+	case apps.ErrAppTooBig:
+		return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", err)
 	}
 	if _, ok := err.(*url.Error); ok {
 		return jsonapi.InvalidParameter("Source", err)
@@ -172,6 +172,9 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs apps.FileServer, app
 		if os.IsNotExist(err) {
 			return echo.NewHTTPError(http.StatusNotFound, "Asset not found")
 		}
+		if apps.IsCorruptStoredObject(err) {
+			i.Logger().WithField("nspace", "apps").Error(err)
+		}
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err)
 		}
@@ -95,7 +95,11 @@ func createFileHandler(c echo.Context, fs vfs.VFS) (f *file, err error) {
 	}
 
 	instance := middlewares.GetInstance(c)
+	stop := abortOnDisconnect(c, file)
 	defer func() {
+		if aerr := stop(); aerr != nil && err == nil {
+			err = aerr
+		}
 		if cerr := file.Close(); cerr != nil && (err == nil || err == io.ErrUnexpectedEOF) {
 			instance.Logger().WithField("nspace", "files").
 				Warnf("Error on uploading file (close): %s", err)
@@ -205,7 +209,11 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 		return WrapVfsError(err)
 	}
 
+	stop := abortOnDisconnect(c, file)
 	defer func() {
+		if aerr := stop(); aerr != nil && err == nil {
+			err = aerr
+		}
 		if cerr := file.Close(); cerr != nil && err == nil {
 			err = cerr
 		}
@@ -220,6 +228,33 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 	return
 }
 
+// abortOnDisconnect aborts the creation of the file if the client disconnects
+// before the end of the upload, so that a partial content is never committed.
+// The returned function must be called before closing the file: it returns the
+// error of the request context if the creation has been aborted.
+func abortOnDisconnect(c echo.Context, file vfs.File) func() error {
+	aborter, ok := file.(vfs.Aborter)
+	if !ok {
+		return func() error { return nil }
+	}
+	ctx := c.Request().Context()
+	done := make(chan struct{})
+	aborted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			aborter.Abort() // #nosec
+			aborted <- ctx.Err()
+		case <-done:
+			aborted <- nil
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-aborted
+	}
+}
+
 // ModifyMetadataByIDHandler handles PATCH requests on /files/:file-id
 //
 // It can be used to modify the file or directory metadata, as well as
@@ -723,7 +758,31 @@ func ArchiveDownloadHandler(c echo.Context) error {
 	if archive == nil {
 		return jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
 	}
-	return archive.Serve(instance.VFS(), c.Response())
+	err = archive.ServeFrom(instance.VFS(), c.Response(), c.QueryParam("cursor"))
+	if err == vfs.ErrArchiveCursorNotFound {
+		return jsonapi.InvalidParameter("cursor", err)
+	}
+	return err
+}
+
+// ArchiveManifestHandler handles requests to /files/archive/:secret/manifest
+// and returns the names of the files of the archive, in the order in which
+// they are written, to resume an interrupted download with a cursor.
+func ArchiveManifestHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	secret := c.Param("secret")
+	archive, err := vfs.GetStore().GetArchive(instance, secret)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if archive == nil {
+		return jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
+	}
+	names, err := archive.Manifest(instance.VFS())
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{"entries": names})
 }
 
 // FileDownloadHandler send a file that have previously be defined
@@ -982,6 +1041,7 @@ func Routes(router *echo.Group) {
 	router.GET("/:file-id/thumbnails/:secret/:format", ThumbnailHandler)
 
 	router.POST("/archive", ArchiveDownloadCreateHandler)
+	router.GET("/archive/:secret/manifest", ArchiveManifestHandler)
 	router.GET("/archive/:secret/:fake-name", ArchiveDownloadHandler)
 
 	router.POST("/downloads", FileDownloadCreateHandler)
@@ -1001,6 +1061,9 @@ func Routes(router *echo.Group) {
 
 // WrapVfsError returns a formatted error from a golang error emitted by the vfs
 func WrapVfsError(err error) error {
+	if _, ok := err.(vfs.ErrRestoreFailed); ok {
+		return jsonapi.InternalServerError(err)
+	}
 	switch err {
 	case ErrDocTypeInvalid:
 		return jsonapi.InvalidAttribute("type", err)
@@ -1010,21 +1073,31 @@ func WrapVfsError(err error) error {
 		return jsonapi.NotFound(err)
 	case vfs.ErrParentInTrash:
 		return jsonapi.NotFound(err)
+	case vfs.ErrFileNotFound:
+		return jsonapi.NotFound(err)
 	case vfs.ErrForbiddenDocMove:
 		return jsonapi.PreconditionFailed("dir-id", err)
+	case vfs.ErrForbiddenSymlink:
+		return jsonapi.Forbidden(err)
 	case vfs.ErrIllegalFilename:
 		return jsonapi.InvalidParameter("name", err)
 	case vfs.ErrIllegalTime:
 		return jsonapi.InvalidParameter("UpdatedAt", err)
 	case vfs.ErrInvalidHash:
 		return jsonapi.PreconditionFailed("Content-MD5", err)
+	case vfs.ErrPostWriteVerificationFailed:
+		return jsonapi.InternalServerError(err)
 	case vfs.ErrContentLengthMismatch:
 		return jsonapi.PreconditionFailed("Content-Length", err)
 	case vfs.ErrConflict:
 		return jsonapi.Conflict(err)
 	case vfs.ErrFileInTrash, vfs.ErrNonAbsolutePath,
-		vfs.ErrDirNotEmpty:
+		vfs.ErrDirNotEmpty, vfs.ErrIsDirectory:
 		return jsonapi.BadRequest(err)
+	case vfs.ErrContentRejected:
+		return jsonapi.Errorf(http.StatusUnprocessableEntity, "%s", err)
+	case vfs.ErrTooManyOpenFiles, vfs.ErrMaintenance:
+		return jsonapi.Errorf(http.StatusServiceUnavailable, "%s", err)
 	case vfs.ErrFileTooBig:
 		return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", err)
 	}
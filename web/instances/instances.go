@@ -2,6 +2,7 @@ package instances
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -18,6 +19,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/workers/push"
 	"github.com/cozy/cozy-stack/pkg/workers/updates"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/echo"
@@ -192,10 +194,14 @@ func fsckHandler(c echo.Context) error {
 	}
 	prune, _ := strconv.ParseBool(c.QueryParam("Prune"))
 	dryRun, _ := strconv.ParseBool(c.QueryParam("DryRun"))
+	checkContent, _ := strconv.ParseBool(c.QueryParam("CheckContent"))
+	workers, _ := strconv.Atoi(c.QueryParam("Workers"))
 	fs := i.VFS()
 	logbook, err := fs.Fsck(vfs.FsckOptions{
-		Prune:  prune,
-		DryRun: dryRun,
+		Prune:        prune,
+		DryRun:       dryRun,
+		CheckContent: checkContent,
+		Workers:      workers,
 	})
 	if err != nil {
 		return wrapError(err)
@@ -203,6 +209,51 @@ func fsckHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, logbook)
 }
 
+// filesMaintenance enables or disables the maintenance mode of the VFS of the
+// instance: the files can still be read, but not modified.
+func filesMaintenance(c echo.Context) error {
+	domain := c.Param("domain")
+	i, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	enabled, err := strconv.ParseBool(c.QueryParam("Enabled"))
+	if err != nil {
+		return jsonapi.InvalidParameter("Enabled", err)
+	}
+	setter, ok := i.VFS().(vfs.MaintenanceSetter)
+	if !ok {
+		return jsonapi.BadRequest(errors.New("The maintenance mode is not supported by the VFS of this instance"))
+	}
+	if err = setter.SetMaintenance(enabled); err != nil {
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// validatePushTokens starts a sweep of the device tokens of the instance, that
+// purges the ones reported as invalid by the push providers. The sweep is done
+// by push-validate jobs, in batches.
+func validatePushTokens(c echo.Context) error {
+	domain := c.Param("domain")
+	i, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	msg, err := jobs.NewMessage(&push.ValidateMessage{})
+	if err != nil {
+		return err
+	}
+	job, err := jobs.System().PushJob(i, &jobs.JobRequest{
+		WorkerType: "push-validate",
+		Message:    msg,
+	})
+	if err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
 func rebuildRedis(c echo.Context) error {
 	instances, err := instance.List()
 	if err != nil {
@@ -404,11 +455,13 @@ func Routes(router *echo.Group) {
 	router.PATCH("/:domain", modifyHandler)
 	router.DELETE("/:domain", deleteHandler)
 	router.GET("/:domain/fsck", fsckHandler)
+	router.POST("/:domain/files_maintenance", filesMaintenance)
 	router.POST("/updates", updatesHandler)
 	router.POST("/token", createToken)
 	router.POST("/oauth_client", registerClient)
 	router.POST("/:domain/export", exporter)
 	router.POST("/:domain/import", importer)
 	router.POST("/:domain/orphan_accounts", cleanOrphanAccounts)
+	router.POST("/:domain/push_tokens", validatePushTokens)
 	router.POST("/redis", rebuildRedis)
 }
@@ -28,6 +28,7 @@ import (
 	_ "github.com/cozy/cozy-stack/pkg/workers/push"
 	_ "github.com/cozy/cozy-stack/pkg/workers/share"
 	_ "github.com/cozy/cozy-stack/pkg/workers/thumbnail"
+	_ "github.com/cozy/cozy-stack/pkg/workers/trash"
 	_ "github.com/cozy/cozy-stack/pkg/workers/unzip"
 	_ "github.com/cozy/cozy-stack/pkg/workers/updates"
 )
@@ -1,12 +1,17 @@
 // Package status is here just to say that the API is up and that it can
-// access the CouchDB databases, for debugging and monitoring purposes.
+// access the CouchDB databases and the storage of the files, for debugging and
+// monitoring purposes.
 package status
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/cozy/checkup"
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
 	"github.com/cozy/echo"
 )
 
@@ -20,18 +25,78 @@ func Status(c echo.Context) error {
 
 	var message string
 	couchdb, err := checker.Check()
-	if err != nil || couchdb.Status() != checkup.Healthy {
-		message = "KO"
-	} else {
+	fs := fsStatus()
+	tiers := tiersStatus()
+	healthy := err == nil && couchdb.Status() == checkup.Healthy && fs.Status == checkup.Healthy
+	for _, tier := range tiers {
+		healthy = healthy && tier.Status == checkup.Healthy
+	}
+	if healthy {
 		message = "OK"
+	} else {
+		message = "KO"
 	}
 
-	return c.JSON(http.StatusOK, echo.Map{
-		"message": message,
-		"couchdb": couchdb.Status(),
+	res := echo.Map{
+		"message":    message,
+		"couchdb":    couchdb.Status(),
+		"fs":         fs.Status,
+		"fs_latency": fs.Latency,
+	}
+	if len(tiers) > 0 {
+		res["fs_tiers"] = tiers
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// storageStatus is the result of the probe of a storage backend, with the
+// time it has taken.
+type storageStatus struct {
+	Status  checkup.StatusText `json:"status"`
+	Latency string             `json:"latency"`
+}
+
+// probeStorage calls the probe of a storage backend, with a short timeout.
+func probeStorage(key string, probe func() error) storageStatus {
+	start := time.Now()
+	err := vfs.WithPingTimeout(key, probe)
+	s := storageStatus{
+		Status:  checkup.Healthy,
+		Latency: time.Since(start).String(),
+	}
+	if err != nil {
+		s.Status = checkup.Down
+	}
+	return s
+}
+
+// fsStatus probes the storage backend of the files.
+func fsStatus() storageStatus {
+	fsURL := config.FsURL()
+	return probeStorage("fs", func() error {
+		if fsURL.Scheme == config.SchemeSwift {
+			return vfsswift.PingStorage(config.GetSwiftConnection())
+		}
+		return vfsafero.PingStorage(fsURL)
 	})
 }
 
+// tiersStatus probes the additional storage backends of the files, by name.
+func tiersStatus() map[string]storageStatus {
+	tiers := config.GetConfig().Fs.Tiers
+	if len(tiers) == 0 {
+		return nil
+	}
+	res := make(map[string]storageStatus, len(tiers))
+	for name := range tiers {
+		conn := config.GetSwiftTierConnection(name)
+		res[name] = probeStorage("fs-tier:"+name, func() error {
+			return vfsswift.PingStorage(conn)
+		})
+	}
+	return res
+}
+
 // Routes sets the routing for the status service
 func Routes(router *echo.Group) {
 	router.GET("", Status)
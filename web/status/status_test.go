@@ -1,6 +1,7 @@
 package status
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -21,7 +22,13 @@ func testRequest(t *testing.T, url string) {
 	body, ioerr := ioutil.ReadAll(res.Body)
 	assert.NoError(t, ioerr)
 	assert.Equal(t, "200 OK", res.Status, "should get a 200")
-	assert.Equal(t, "{\"couchdb\":\"healthy\",\"message\":\"OK\"}", string(body), "res body should match")
+	var status map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &status))
+	assert.Equal(t, "OK", status["message"])
+	assert.Equal(t, "healthy", status["couchdb"])
+	assert.Equal(t, "healthy", status["fs"])
+	assert.NotEmpty(t, status["fs_latency"])
+	assert.NotContains(t, status, "fs_tiers")
 }
 
 func TestRoutes(t *testing.T) {